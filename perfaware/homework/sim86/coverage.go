@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"sim86/instructions"
+	"sim86/sim"
+)
+
+// Coverage records which instructions of a program ran, and for each
+// conditional jump how often it was taken and how often it fell through.
+// A jump only has full coverage once it has gone both ways.
+type Coverage struct {
+	counts   map[uint32]uint64
+	branches map[uint32]*branchCount
+
+	image []byte
+	base  uint32 // where image was loaded
+}
+
+type branchCount struct {
+	Taken, NotTaken uint64
+}
+
+// NewCoverage collects coverage of image, loaded at the physical address
+// base.
+func NewCoverage(image []byte, base uint32) *Coverage {
+	return &Coverage{
+		counts:   map[uint32]uint64{},
+		branches: map[uint32]*branchCount{},
+		image:    image,
+		base:     base,
+	}
+}
+
+func (c *Coverage) Record(ex sim.Exec) {
+	c.counts[ex.Address]++
+	if !conditionalJump(ex.Op.OpType) {
+		return
+	}
+	b := c.branches[ex.Address]
+	if b == nil {
+		b = &branchCount{}
+		c.branches[ex.Address] = b
+	}
+	if ex.BranchTaken {
+		b.Taken++
+	} else {
+		b.NotTaken++
+	}
+}
+
+// coverageLine is a line of the annotated output. Count is -1 for lines
+// that aren't code.
+type coverageLine struct {
+	Text   string
+	Line   int // in the source, for lcov, or 0
+	Count  int64
+	Branch *branchCount
+	Jump   bool // a conditional jump, whether it ran or not
+}
+
+// lines annotates the listing when there is one, or else a disassembly of
+// the image. Lines from macros and included files are annotated but have
+// no line in the source for lcov.
+func (c *Coverage) lines(l *Listing, name string) []coverageLine {
+	if l != nil && l.Text != nil {
+		lines := make([]coverageLine, len(l.Text))
+		for i, text := range l.Text {
+			lines[i] = coverageLine{Text: text, Count: -1}
+		}
+		for _, ll := range l.Lines {
+			if !ll.Code() {
+				continue
+			}
+			cl := &lines[ll.Index]
+			addr := l.Base + ll.Offset
+			cl.Count = int64(c.counts[addr])
+			cl.Branch = c.branches[addr]
+			cl.Jump = c.jumpAt(addr)
+			if ll.Level == 0 {
+				cl.Line = ll.Line
+			}
+		}
+		return lines
+	}
+
+	lines := []coverageLine{
+		{Text: fmt.Sprintf("; %s disassembly:", name), Count: -1},
+		{Text: "bits 16", Count: -1},
+	}
+	r := bytes.NewReader(c.image)
+	for r.Len() > 0 {
+		off := uint32(len(c.image) - r.Len())
+		addr := c.base + off
+		if l != nil {
+			if label := l.Label(addr); label != "" {
+				lines = append(lines, coverageLine{Text: label + ":", Count: -1})
+			}
+		}
+		op, err := instructions.Parse(r)
+		if err != nil {
+			// What doesn't decode can't have run; show it as data.
+			r.Seek(int64(off+1), io.SeekStart)
+			lines = append(lines, coverageLine{Text: fmt.Sprintf("db 0x%02x", c.image[off]), Count: -1})
+			continue
+		}
+		cl := coverageLine{Text: withSource(op.String(), " ; ", l, addr), Count: int64(c.counts[addr])}
+		cl.Branch = c.branches[addr]
+		cl.Jump = conditionalJump(op.OpType)
+		cl.Line = len(lines) + 1
+		lines = append(lines, cl)
+	}
+	return lines
+}
+
+// jumpAt is whether the instruction at addr in the image is a conditional
+// jump.
+func (c *Coverage) jumpAt(addr uint32) bool {
+	if addr < c.base || addr >= c.base+uint32(len(c.image)) {
+		return false
+	}
+	op, err := instructions.Parse(bytes.NewReader(c.image[addr-c.base:]))
+	return err == nil && conditionalJump(op.OpType)
+}
+
+// coverageSummary counts what the annotated output shows.
+type coverageSummary struct {
+	Lines, LinesHit       int
+	Branches, BranchesHit int // directions of conditional jumps
+}
+
+func summarize(lines []coverageLine) coverageSummary {
+	var s coverageSummary
+	for _, cl := range lines {
+		if cl.Count < 0 {
+			continue
+		}
+		s.Lines++
+		if cl.Count > 0 {
+			s.LinesHit++
+		}
+		if cl.Jump {
+			s.Branches += 2
+			if cl.Branch != nil {
+				s.BranchesHit += boolCount(cl.Branch.Taken > 0) + boolCount(cl.Branch.NotTaken > 0)
+			}
+		}
+	}
+	return s
+}
+
+func boolCount(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s coverageSummary) String() string {
+	ratio := func(hit, total int) string {
+		if total == 0 {
+			return fmt.Sprintf("%d of %d", hit, total)
+		}
+		return fmt.Sprintf("%d of %d (%.1f%%)", hit, total, 100*float64(hit)/float64(total))
+	}
+	return fmt.Sprintf("lines executed: %s\nbranches taken: %s\n",
+		ratio(s.LinesHit, s.Lines), ratio(s.BranchesHit, s.Branches))
+}
+
+// WriteAnnotated writes the listing, or a disassembly without one, with
+// each instruction's execution count in front in the style of gcov: ####
+// marks instructions that never ran. Conditional jumps that didn't go
+// both ways say which way they never went.
+func (c *Coverage) WriteAnnotated(w io.Writer, l *Listing, name string) {
+	lines := c.lines(l, name)
+	for _, text := range strings.Split(strings.TrimSuffix(summarize(lines).String(), "\n"), "\n") {
+		fmt.Fprintf(w, "%10s: %s\n", "-", text)
+	}
+	for _, cl := range lines {
+		count := "-"
+		switch {
+		case cl.Count == 0:
+			count = "####"
+		case cl.Count > 0:
+			count = fmt.Sprint(cl.Count)
+		}
+		text := cl.Text
+		if cl.Jump && cl.Count > 0 {
+			switch b := cl.Branch; {
+			case b.Taken == 0:
+				text += "  <- never taken"
+			case b.NotTaken == 0:
+				text += "  <- always taken"
+			}
+		}
+		fmt.Fprintf(w, "%10s: %s\n", count, text)
+	}
+}
+
+// WriteDisassembly writes the disassembly lcov's lines are numbered in
+// when there is no listing to take them from.
+func (c *Coverage) WriteDisassembly(w io.Writer, l *Listing, name string) {
+	for _, cl := range c.lines(l, name) {
+		fmt.Fprintln(w, cl.Text)
+	}
+}
+
+// WriteLCOV writes an lcov tracefile. Lines are in the source the listing
+// came from, taken to be beside it with .asm in place of .lst, or without
+// a listing in dis, where WriteDisassembly's output was saved.
+func (c *Coverage) WriteLCOV(w io.Writer, l *Listing, name, dis string) {
+	source := dis
+	if l != nil && l.Text != nil {
+		source = strings.TrimSuffix(l.Path, filepath.Ext(l.Path)) + ".asm"
+	}
+	lines := c.lines(l, name)
+	fmt.Fprintf(w, "TN:\nSF:%s\n", source)
+	for _, cl := range lines {
+		if cl.Line == 0 || !cl.Jump {
+			continue
+		}
+		taken, notTaken := "-", "-"
+		if cl.Count > 0 {
+			taken, notTaken = fmt.Sprint(cl.Branch.Taken), fmt.Sprint(cl.Branch.NotTaken)
+		}
+		fmt.Fprintf(w, "BRDA:%d,0,0,%s\nBRDA:%d,0,1,%s\n", cl.Line, taken, cl.Line, notTaken)
+	}
+	var found []coverageLine
+	for _, cl := range lines {
+		if cl.Line != 0 && cl.Count >= 0 {
+			found = append(found, cl)
+		}
+	}
+	s := summarize(found)
+	fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", s.Branches, s.BranchesHit)
+	for _, cl := range found {
+		fmt.Fprintf(w, "DA:%d,%d\n", cl.Line, cl.Count)
+	}
+	fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", s.Lines, s.LinesHit)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sim86/sim"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or with -update rewrites it.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n%s", path, unifiedDiff(path, "got", strings.Split(string(want), "\n"), strings.Split(string(got), "\n")))
+	}
+}
+
+// coverageImage is what testdata/coverage.lst assembles to.
+var coverageImage = []byte{0xb9, 0x03, 0x00, 0x49, 0x78, 0x04, 0x75, 0xfb, 0xeb, 0x01, 0x90, 0x90}
+
+func runCoverage(t *testing.T) *Coverage {
+	t.Helper()
+	m := sim.NewMachine(sim.Options{})
+	if err := (sim.RawLoader{}).Load(m, coverageImage); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCoverage(coverageImage, 0)
+	m.Trace = c.Record
+	if res := m.Run(context.Background()); res.Reason != sim.StopEnd {
+		t.Fatalf("run stopped with %v: %v", res.Reason, res.Err)
+	}
+	return c
+}
+
+func TestCoverage(t *testing.T) {
+	l, err := ReadListing(filepath.Join("testdata", "coverage.lst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := runCoverage(t)
+
+	var b bytes.Buffer
+	c.WriteAnnotated(&b, l, "coverage.com")
+	checkGolden(t, "coverage.annotated", b.Bytes())
+	b.Reset()
+	c.WriteLCOV(&b, l, "coverage.com", "")
+	checkGolden(t, "coverage.info", b.Bytes())
+}
+
+func TestCoverageDisassembly(t *testing.T) {
+	c := runCoverage(t)
+
+	var b bytes.Buffer
+	c.WriteAnnotated(&b, nil, "coverage.com")
+	checkGolden(t, "coverage.dis.annotated", b.Bytes())
+	b.Reset()
+	c.WriteDisassembly(&b, nil, "coverage.com")
+	checkGolden(t, "coverage.dis", b.Bytes())
+	dis := strings.Split(b.String(), "\n")
+	b.Reset()
+	c.WriteLCOV(&b, nil, "coverage.com", "out/coverage.com.dis")
+	checkGolden(t, "coverage.dis.info", b.Bytes())
+
+	// Every line lcov counts is an instruction in the disassembly.
+	for _, line := range strings.Split(b.String(), "\n") {
+		da, ok := strings.CutPrefix(line, "DA:")
+		if !ok {
+			continue
+		}
+		var n, count int
+		if _, err := fmt.Sscanf(da, "%d,%d", &n, &count); err != nil {
+			t.Fatal(err)
+		}
+		if text := dis[n-1]; strings.HasPrefix(text, ";") || strings.HasSuffix(text, ":") || text == "bits 16" {
+			t.Errorf("DA line %d is %q", n, text)
+		}
+	}
+}
+
+func TestLCOVSource(t *testing.T) {
+	// Without a listing, the disassembly lcov refers to is written where
+	// it says.
+	dir := t.TempDir()
+	var lcov bytes.Buffer
+	opt := options{Program: "coverage.com", LCOV: &lcov, LCOVSource: filepath.Join(dir, "coverage.com.dis")}
+	if err := simulate(&bytes.Buffer{}, "coverage.com", coverageImage, opt); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(lcov.String(), "SF:"+opt.LCOVSource+"\n") {
+		t.Errorf("tracefile doesn't name %s:\n%s", opt.LCOVSource, &lcov)
+	}
+	dis, err := os.ReadFile(opt.LCOVSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "coverage.dis"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dis, want) {
+		t.Errorf("wrote disassembly\n%s\nwant\n%s", dis, want)
+	}
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sim86/instructions"
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// dapServer speaks the Debug Adapter Protocol over a pair of streams, the
+// way editors launch debug adapters. It debugs one program, with one
+// thread and one stack frame, and uses a nasm listing, when there is one,
+// to put source lines to addresses.
+type dapServer struct {
+	out io.Writer
+	seq int
+
+	requests chan dapMessage
+	readErr  error
+
+	s       *session
+	m       *sim.Machine
+	listing *Listing
+	source  string
+	disk    *sim.Disk
+
+	// Source breakpoints are replaced a file at a time, instruction
+	// breakpoints all at once, so they are kept apart.
+	lineBreaks map[uint32]bool
+	instBreaks map[uint32]bool
+
+	stopOnEntry bool
+	paused      bool
+	ended       bool
+	done        bool
+}
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+// dapThread is the one thread the 8086 has.
+const dapThread = 1
+
+// Variable references for the Registers scope and its groups.
+const (
+	dapRegisters = iota + 1
+	dapGeneral
+	dapSegment
+	dapFlags
+)
+
+// serveDAP runs the adapter until the client disconnects or hangs up.
+func serveDAP(in io.Reader, out io.Writer) error {
+	d := &dapServer{
+		out:        out,
+		requests:   make(chan dapMessage),
+		lineBreaks: map[uint32]bool{},
+		instBreaks: map[uint32]bool{},
+	}
+	go d.read(bufio.NewReader(in))
+	for !d.done {
+		req, ok := <-d.requests
+		if !ok {
+			break
+		}
+		d.handle(req)
+	}
+	if d.disk != nil {
+		defer d.disk.Close()
+	}
+	if d.s != nil {
+		return d.s.finish(nil)
+	}
+	if d.readErr != nil && !errors.Is(d.readErr, io.EOF) {
+		return d.readErr
+	}
+	return nil
+}
+
+// read turns the Content-Length framed stream into requests.
+func (d *dapServer) read(r *bufio.Reader) {
+	defer close(d.requests)
+	tp := textproto.NewReader(r)
+	for {
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			d.readErr = err
+			return
+		}
+		n, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			d.readErr = fmt.Errorf("message without a Content-Length")
+			return
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			d.readErr = err
+			return
+		}
+		var msg dapMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			d.readErr = err
+			return
+		}
+		if msg.Type == "request" {
+			d.requests <- msg
+		}
+	}
+}
+
+func (d *dapServer) send(msg any) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(d.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (d *dapServer) event(name string, body any) {
+	d.seq++
+	d.send(dapEvent{Seq: d.seq, Type: "event", Event: name, Body: body})
+}
+
+func (d *dapServer) stopped(reason, text string) {
+	d.event("stopped", map[string]any{
+		"reason":            reason,
+		"description":       text,
+		"threadId":          dapThread,
+		"allThreadsStopped": true,
+	})
+}
+
+// dapOutput sends what the program prints as output events.
+type dapOutput struct {
+	d *dapServer
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.d.event("output", map[string]any{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+// handle answers a request. Execution requests are answered first and
+// then run, since their results arrive as events.
+func (d *dapServer) handle(req dapMessage) {
+	body, after, err := d.dispatch(req)
+	resp := dapResponse{Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	d.seq++
+	resp.Seq = d.seq
+	d.send(resp)
+	if after != nil && err == nil {
+		after()
+	}
+}
+
+var errNotLaunched = errors.New("no program has been launched")
+
+func (d *dapServer) dispatch(req dapMessage) (any, func(), error) {
+	if d.s == nil {
+		switch req.Command {
+		case "initialize", "launch", "disconnect", "terminate", "setExceptionBreakpoints":
+		default:
+			return nil, nil, errNotLaunched
+		}
+	}
+	switch req.Command {
+	case "initialize":
+		return map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+			"supportsDisassembleRequest":       true,
+			"supportsSteppingGranularity":      true,
+			"supportsInstructionBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil, nil
+	case "launch":
+		if err := d.launch(req.Arguments); err != nil {
+			return nil, nil, err
+		}
+		return nil, func() { d.event("initialized", nil) }, nil
+	case "setExceptionBreakpoints":
+		return map[string]any{"breakpoints": []any{}}, nil, nil
+	case "setBreakpoints":
+		body, err := d.setBreakpoints(req.Arguments)
+		return body, nil, err
+	case "setInstructionBreakpoints":
+		body, err := d.setInstructionBreakpoints(req.Arguments)
+		return body, nil, err
+	case "configurationDone":
+		return nil, func() {
+			if d.stopOnEntry {
+				d.stopped("entry", "")
+				return
+			}
+			d.run("continue", false)
+		}, nil
+	case "threads":
+		return map[string]any{"threads": []any{map[string]any{"id": dapThread, "name": "8086"}}}, nil, nil
+	case "stackTrace":
+		return d.stackTrace(), nil, nil
+	case "scopes":
+		return map[string]any{"scopes": []any{map[string]any{
+			"name": "Registers", "presentationHint": "registers", "variablesReference": dapRegisters, "expensive": false,
+		}}}, nil, nil
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, nil, err
+		}
+		return map[string]any{"variables": d.variables(args.VariablesReference)}, nil, nil
+	case "continue":
+		return map[string]any{"allThreadsContinued": true}, func() { d.run("continue", false) }, nil
+	case "next", "stepIn", "stepOut":
+		var args struct {
+			Granularity string `json:"granularity"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		return nil, func() { d.run(req.Command, args.Granularity == "instruction") }, nil
+	case "pause":
+		// Only reached while stopped; pausing a run is handled by run.
+		return nil, nil, nil
+	case "readMemory":
+		body, err := d.readMemory(req.Arguments)
+		return body, nil, err
+	case "disassemble":
+		body, err := d.disassemble(req.Arguments)
+		return body, nil, err
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, nil, err
+		}
+		e, err := ParseExpr(args.Expression)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := e.Eval(d.m)
+		if err != nil {
+			return nil, nil, err
+		}
+		return map[string]any{"result": fmt.Sprintf("%d (0x%x)", v, v), "variablesReference": 0}, nil, nil
+	case "disconnect", "terminate":
+		d.done = true
+		if req.Command == "terminate" && !d.ended {
+			return nil, func() { d.finished() }, nil
+		}
+		return nil, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+type dapLaunchArgs struct {
+	Program string `json:"program"`
+	// Listing is the nasm -l listing; by default program.lst, or
+	// program's name with .lst, if either exists. Map is a nasm map file
+	// with more labels.
+	Listing string `json:"listing"`
+	Map     string `json:"map"`
+	// Source is the .asm file lines refer to; by default program.asm.
+	Source      string   `json:"source"`
+	Format      string   `json:"format"`
+	At          string   `json:"at"`
+	Args        []string `json:"args"`
+	DOSDir      string   `json:"dosDir"`
+	Timer       bool     `json:"timer"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+}
+
+func (d *dapServer) launch(raw json.RawMessage) error {
+	var args dapLaunchArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return fmt.Errorf("launch needs a program")
+	}
+	image, err := os.ReadFile(args.Program)
+	if err != nil {
+		return err
+	}
+	if args.Format == "" {
+		args.Format = formatFor(args.Program)
+	}
+	if args.At == "" {
+		args.At = "0:0"
+	}
+	loader, needsDOS, err := newLoader(args.Format, args.At, 0, strings.Join(args.Args, " "), dapOutput{d})
+	if err != nil {
+		return err
+	}
+
+	// The program gets no keyboard: stdin carries the protocol.
+	out := dapOutput{d}
+	noInput := bufio.NewReader(bytes.NewReader(nil))
+	listing, err := findListing(args.Program, args.Listing, args.Map)
+	if err != nil {
+		return err
+	}
+	opt := options{ShowIP: true, Loader: loader, Timer: args.Timer, Listing: listing}
+	if needsDOS {
+		if args.DOSDir == "" {
+			args.DOSDir = filepath.Dir(args.Program)
+		}
+		opt.DOS = sim.NewDOS(args.DOSDir, noInput, out)
+	}
+	if args.Format == "boot" {
+		opt.BIOS = &sim.BIOS{Stdin: noInput, Stdout: out, Disks: map[uint8]*sim.Disk{}}
+		if len(image) > sim.SectorSize {
+			if d.disk, err = sim.OpenDisk(args.Program, false); err != nil {
+				return err
+			}
+			opt.BIOS.Disks[0] = d.disk
+		}
+	}
+	if d.s, err = newSession(out, image, opt); err != nil {
+		return err
+	}
+	d.m = d.s.m
+	d.syncBreakpoints()
+	d.stopOnEntry = args.StopOnEntry
+
+	d.source = args.Source
+	if d.source == "" {
+		d.source = args.Program + ".asm"
+	}
+	if d.listing = d.s.opt.Listing; d.listing == nil {
+		d.event("output", map[string]any{"category": "console", "output": "no listing found, so no source lines\n"})
+	}
+	if abs, err := filepath.Abs(d.source); err == nil {
+		d.source = abs
+	}
+	return nil
+}
+
+func (d *dapServer) setBreakpoints(raw json.RawMessage) (any, error) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	d.lineBreaks = map[uint32]bool{}
+	result := []any{}
+	for _, b := range args.Breakpoints {
+		bp := map[string]any{"verified": false, "line": b.Line}
+		if d.listing == nil {
+			bp["message"] = "no listing to find lines in"
+		} else if !d.sameSource(args.Source.Path) {
+			bp["message"] = "not the launched program's source"
+		} else if addr, line, ok := d.listing.Address(b.Line); !ok {
+			bp["message"] = "no code at or after this line"
+		} else {
+			d.lineBreaks[addr] = true
+			bp["verified"], bp["line"] = true, line
+			bp["instructionReference"] = fmt.Sprintf("0x%05x", addr)
+		}
+		result = append(result, bp)
+	}
+	d.syncBreakpoints()
+	return map[string]any{"breakpoints": result}, nil
+}
+
+func (d *dapServer) sameSource(path string) bool {
+	abs, err := filepath.Abs(path)
+	return err == nil && abs == d.source
+}
+
+func (d *dapServer) setInstructionBreakpoints(raw json.RawMessage) (any, error) {
+	var args struct {
+		Breakpoints []struct {
+			InstructionReference string `json:"instructionReference"`
+			Offset               int    `json:"offset"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	d.instBreaks = map[uint32]bool{}
+	result := []any{}
+	for _, b := range args.Breakpoints {
+		addr, err := parseMemoryReference(b.InstructionReference, b.Offset)
+		if err != nil {
+			result = append(result, map[string]any{"verified": false, "message": err.Error()})
+			continue
+		}
+		d.instBreaks[addr] = true
+		result = append(result, map[string]any{"verified": true, "instructionReference": fmt.Sprintf("0x%05x", addr)})
+	}
+	d.syncBreakpoints()
+	return map[string]any{"breakpoints": result}, nil
+}
+
+// parseMemoryReference parses the physical addresses memory references
+// are, plus offset.
+func parseMemoryReference(ref string, offset int) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(ref, "0x"), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad memory reference %q", ref)
+	}
+	addr := int64(v) + int64(offset)
+	if addr < 0 || addr >= memory.Size {
+		return 0, fmt.Errorf("memory reference %q%+d is outside memory", ref, offset)
+	}
+	return uint32(addr), nil
+}
+
+// line is the source line pc is on, or 0.
+func (d *dapServer) line(pc uint32) int {
+	if d.listing == nil {
+		return 0
+	}
+	if l, ok := d.listing.At(pc); ok && l.Level == 0 {
+		return l.Line
+	}
+	return 0
+}
+
+func (d *dapServer) finished() {
+	d.ended = true
+	code := 0
+	if d.s.opt.DOS != nil {
+		code = int(d.s.opt.DOS.ExitCode)
+	}
+	d.event("exited", map[string]any{"exitCode": code})
+	d.event("terminated", nil)
+}
+
+// run executes for continue, next, stepIn or stepOut until it should
+// stop and reports why. Stepping goes by source line when there is a
+// listing and instruction is false, and by instruction otherwise. Calls
+// and interrupts are tracked by depth so next can run over them and
+// stepOut out of them.
+func (d *dapServer) run(kind string, instruction bool) {
+	if d.ended {
+		d.finished()
+		return
+	}
+	if d.listing == nil {
+		instruction = true
+	}
+	startLine := d.line(d.m.PC())
+	depth := 0
+	d.paused = false
+	var executed uint64
+	d.s.trace = func(ex sim.Exec) {
+		executed++
+		switch ex.Op.OpType {
+		case instructions.OpCall, instructions.OpInt, instructions.OpInt3:
+			// Interrupts handled by the host return before the next
+			// instruction, so they don't go any deeper.
+			if d.m.Reg(&registers.SP) != ex.Before.Get(&registers.SP) {
+				depth++
+			}
+		case instructions.OpInto:
+			if ex.BranchTaken {
+				depth++
+			}
+		case instructions.OpRet, instructions.OpRetf, instructions.OpIret:
+			depth--
+		}
+		if ex.Interrupted {
+			depth++
+		}
+		if executed%4096 == 0 {
+			d.poll()
+		}
+	}
+	// stepped is set when the step asked for is over, which like a pause
+	// stops Run as a breakpoint would.
+	stepped := false
+	d.m.BreakOn = func(instructions.Operation) bool {
+		line := d.line(d.m.PC())
+		newLine := instruction || (line != 0 && line != startLine)
+		switch kind {
+		case "stepIn":
+			stepped = newLine
+		case "next":
+			stepped = depth < 0 || (depth == 0 && newLine)
+		case "stepOut":
+			stepped = depth < 0
+		}
+		return stepped || d.paused || d.done
+	}
+	defer func() { d.s.trace, d.m.BreakOn = nil, nil }()
+	d.m.StepLimit, d.m.StopOnWatch = 0, false
+
+	res := d.m.Run(context.Background())
+	switch pc := d.m.PC(); {
+	case res.Reason == sim.StopHalt || res.Reason == sim.StopEnd:
+		d.finished()
+	case res.Reason == sim.StopError:
+		d.event("output", map[string]any{"category": "stderr", "output": fmt.Sprintf("%v at 0x%05x\n", res.Err, pc)})
+		d.stopped("exception", res.Err.Error())
+	case res.Err == sim.ErrBreak || d.lineBreaks[pc] || d.instBreaks[pc]:
+		d.stopped("breakpoint", "")
+	case stepped:
+		d.stopped("step", "")
+	default:
+		d.stopped("pause", "")
+	}
+}
+
+// syncBreakpoints gives the machine the line and instruction breakpoints.
+func (d *dapServer) syncBreakpoints() {
+	if d.m == nil {
+		return
+	}
+	for _, addr := range d.m.Breakpoints() {
+		d.m.RemoveBreakpoint(addr)
+	}
+	for _, breaks := range []map[uint32]bool{d.lineBreaks, d.instBreaks} {
+		for addr := range breaks {
+			d.m.AddBreakpoint(addr)
+		}
+	}
+}
+
+// poll answers requests that arrive while running and reports whether
+// one was pause.
+func (d *dapServer) poll() bool {
+	for {
+		select {
+		case req, ok := <-d.requests:
+			if !ok {
+				d.done = true
+				return true
+			}
+			if req.Command == "pause" {
+				d.paused = true
+			}
+			d.handle(req)
+			if d.paused || d.done {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func (d *dapServer) stackTrace() any {
+	if d.ended {
+		return map[string]any{"stackFrames": []any{}, "totalFrames": 0}
+	}
+	pc := d.m.PC()
+	ip := nearCS(d.m, pc)
+	frame := map[string]any{
+		"id":                          1,
+		"name":                        ip.String(),
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("0x%05x", pc),
+	}
+	if op, err := instructions.Parse(d.m.Memory.PeekReader(ip.seg, ip.off)); err == nil {
+		frame["name"] = fmt.Sprintf("%s  %s", ip, op)
+	}
+	if d.listing != nil {
+		if label, past, ok := d.listing.Nearest(pc); ok {
+			frame["name"] = fmt.Sprintf("%s+0x%x", label, past)
+		}
+		if l, ok := d.listing.At(pc); ok && l.Level == 0 {
+			frame["line"], frame["column"] = l.Line, 1
+			frame["source"] = map[string]any{"name": filepath.Base(d.source), "path": d.source}
+		}
+	}
+	return map[string]any{"stackFrames": []any{frame}, "totalFrames": 1}
+}
+
+func (d *dapServer) variables(ref int) []any {
+	word := func(r *registers.Register) any {
+		return map[string]any{"name": r.Name, "value": fmt.Sprintf("0x%04x", d.m.Reg(r)), "type": "word", "variablesReference": 0}
+	}
+	var vars []any
+	switch ref {
+	case dapRegisters:
+		vars = []any{
+			map[string]any{"name": "General", "value": "", "variablesReference": dapGeneral},
+			map[string]any{"name": "Segment", "value": "", "variablesReference": dapSegment},
+			map[string]any{"name": "Flags", "value": registers.FlagsString(d.m.Reg(&registers.FLAGS)), "variablesReference": dapFlags},
+		}
+	case dapGeneral:
+		for _, r := range []*registers.Register{&registers.AX, &registers.BX, &registers.CX, &registers.DX,
+			&registers.SP, &registers.BP, &registers.SI, &registers.DI, &registers.IP} {
+			vars = append(vars, word(r))
+		}
+	case dapSegment:
+		for _, r := range []*registers.Register{&registers.CS, &registers.DS, &registers.ES, &registers.SS} {
+			vars = append(vars, word(r))
+		}
+	case dapFlags:
+		vars = append(vars, word(&registers.FLAGS))
+		for _, letter := range []byte("CPAZSTIDO") {
+			bit, _ := registers.FlagByLetter(letter)
+			v := "0"
+			if d.m.Flag(bit) {
+				v = "1"
+			}
+			vars = append(vars, map[string]any{"name": string(letter) + "F", "value": v, "variablesReference": 0})
+		}
+	}
+	if vars == nil {
+		vars = []any{}
+	}
+	return vars
+}
+
+func (d *dapServer) readMemory(raw json.RawMessage) (any, error) {
+	var args struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	addr, err := parseMemoryReference(args.MemoryReference, args.Offset)
+	if err != nil {
+		return nil, err
+	}
+	n := min(args.Count, memory.Size-int(addr))
+	data := make([]byte, max(n, 0))
+	for i := range data {
+		data[i] = d.m.Memory.Peek(addr + uint32(i))
+	}
+	return map[string]any{
+		"address":         fmt.Sprintf("0x%05x", addr),
+		"data":            base64.StdEncoding.EncodeToString(data),
+		"unreadableBytes": args.Count - len(data),
+	}, nil
+}
+
+// backUp is where n instructions before a start. The listing knows where
+// instructions start, so it is followed back while its lines run on
+// without gaps; otherwise it is up to decoding.
+func (d *dapServer) backUp(a address, n int) address {
+	if d.listing != nil {
+		lines := d.listing.Lines
+		i := sort.Search(len(lines), func(i int) bool { return d.listing.Base+lines[i].Offset >= a.physical() })
+		if i < len(lines) && d.listing.Base+lines[i].Offset == a.physical() {
+			j := i
+			for ; j > 0 && i-j < n; j-- {
+				prev := lines[j-1]
+				if prev.Size == 0 || prev.Offset+prev.Size != lines[j].Offset {
+					break
+				}
+			}
+			if i-j == n {
+				return address{a.seg, a.off - uint16(lines[i].Offset-lines[j].Offset)}
+			}
+		}
+	}
+	loaded, _ := d.m.Loaded()
+	return backUp(d.m.Memory, loaded, a, n)
+}
+
+// disassemble answers with exactly instructionCount instructions around
+// the reference, padding with invalid ones where there is nothing to
+// decode before it.
+func (d *dapServer) disassemble(raw json.RawMessage) (any, error) {
+	var args struct {
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	addr, err := parseMemoryReference(args.MemoryReference, args.Offset)
+	if err != nil {
+		return nil, err
+	}
+	a := nearCS(d.m, addr)
+	var result []any
+	start := a
+	if args.InstructionOffset < 0 {
+		start = d.backUp(a, -args.InstructionOffset)
+		before := 0
+		for r := d.m.Memory.PeekReader(start.seg, start.off); r.Off < a.off; before++ {
+			if _, err := instructions.Parse(r); err != nil {
+				break
+			}
+		}
+		for i := -args.InstructionOffset - before; i > 0; i-- {
+			// Addresses wrap around the top of memory, as they do on the 8086.
+			pad := (start.physical() - uint32(i)) % memory.Size
+			result = append(result, map[string]any{"address": fmt.Sprintf("0x%05x", pad), "instruction": "??", "presentationHint": "invalid"})
+		}
+	}
+
+	r := d.m.Memory.PeekReader(start.seg, start.off)
+	for skip := args.InstructionOffset; len(result) < args.InstructionCount; skip-- {
+		off := r.Off
+		phys := memory.Address(start.seg, off)
+		op, err := instructions.Parse(r)
+		if err != nil {
+			r.Off = off + 1
+		}
+		if skip > 0 {
+			continue
+		}
+		inst := map[string]any{"address": fmt.Sprintf("0x%05x", phys)}
+		if err != nil {
+			inst["instruction"] = "(bad)"
+			inst["presentationHint"] = "invalid"
+		} else {
+			var raw []string
+			for i := uint16(0); i < uint16(op.Size); i++ {
+				raw = append(raw, fmt.Sprintf("%02x", d.m.Memory.Peek(memory.Address(start.seg, off+i))))
+			}
+			inst["instructionBytes"] = strings.Join(raw, " ")
+			inst["instruction"] = op.String()
+		}
+		if line := d.line(phys); line != 0 {
+			inst["line"] = line
+			inst["location"] = map[string]any{"name": filepath.Base(d.source), "path": d.source}
+		}
+		result = append(result, inst)
+	}
+	return map[string]any{"instructions": result}, nil
+}
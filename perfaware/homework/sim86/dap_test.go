@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// dapSession frames requests the way a client sends them.
+func dapSession(t *testing.T, requests []map[string]any) io.Reader {
+	t.Helper()
+	var b bytes.Buffer
+	for i, req := range requests {
+		req["seq"], req["type"] = i+1, "request"
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	return &b
+}
+
+// dapMessages splits what the server sent into messages.
+func dapMessages(t *testing.T, out []byte) []map[string]any {
+	t.Helper()
+	r := bufio.NewReader(bytes.NewReader(out))
+	tp := textproto.NewReader(r)
+	var msgs []map[string]any
+	for {
+		header, err := tp.ReadMIMEHeader()
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]any
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// dapField digs a value out of a decoded message by keys and indexes.
+func dapField(v any, path ...any) any {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, _ := v.(map[string]any)
+			v = m[k]
+		case int:
+			s, _ := v.([]any)
+			if k >= len(s) {
+				return nil
+			}
+			v = s[k]
+		}
+	}
+	return v
+}
+
+// dapRegister finds a register's value in a variables response.
+func dapRegister(msg map[string]any, name string) any {
+	vars, _ := dapField(msg, "body", "variables").([]any)
+	for _, v := range vars {
+		if dapField(v, "name") == name {
+			return dapField(v, "value")
+		}
+	}
+	return nil
+}
+
+func TestDAPSession(t *testing.T) {
+	dir := filepath.Join("..", "..", "part1")
+	program := filepath.Join(dir, "listing_0054_draw_rectangle")
+	source, err := filepath.Abs(program + ".asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	general := map[string]any{"variablesReference": dapGeneral}
+	in := dapSession(t, []map[string]any{
+		{"command": "initialize", "arguments": map[string]any{"adapterID": "sim86"}},
+		{"command": "launch", "arguments": map[string]any{
+			"program": program,
+			"listing": filepath.Join("testdata", "listing_0054_draw_rectangle.lst"),
+			"source":  source,
+		}},
+		{"command": "setBreakpoints", "arguments": map[string]any{
+			"source":      map[string]any{"path": source},
+			"breakpoints": []any{map[string]any{"line": 27}, map[string]any{"line": 44}},
+		}},
+		{"command": "configurationDone"},
+		{"command": "stackTrace", "arguments": map[string]any{"threadId": dapThread}},
+		{"command": "scopes", "arguments": map[string]any{"frameId": 1}},
+		{"command": "variables", "arguments": map[string]any{"variablesReference": dapRegisters}},
+		{"command": "variables", "arguments": general},
+		{"command": "next", "arguments": map[string]any{"threadId": dapThread}},
+		{"command": "stackTrace", "arguments": map[string]any{"threadId": dapThread}},
+		{"command": "continue", "arguments": map[string]any{"threadId": dapThread}},
+		{"command": "variables", "arguments": general},
+		{"command": "readMemory", "arguments": map[string]any{"memoryReference": "0x100", "count": 4}},
+		{"command": "disassemble", "arguments": map[string]any{"memoryReference": "0x9", "instructionCount": 2}},
+		{"command": "evaluate", "arguments": map[string]any{"expression": "cx + 1"}},
+		{"command": "disconnect"},
+	})
+	var out bytes.Buffer
+	if err := serveDAP(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	msgs := dapMessages(t, out.Bytes())
+
+	// What each message is, in order: a response's command, or an event
+	// and its reason.
+	var got []string
+	for _, msg := range msgs {
+		switch msg["type"] {
+		case "response":
+			if msg["success"] != true {
+				t.Errorf("%s failed: %v", msg["command"], msg["message"])
+			}
+			got = append(got, fmt.Sprint(msg["command"]))
+		case "event":
+			e := fmt.Sprint(msg["event"])
+			if reason, ok := dapField(msg, "body", "reason").(string); ok {
+				e += " " + reason
+			}
+			got = append(got, e)
+		}
+	}
+	want := []string{
+		"initialize", "launch", "initialized",
+		"setBreakpoints", "configurationDone", "stopped breakpoint",
+		"stackTrace", "scopes", "variables", "variables",
+		"next", "stopped step", "stackTrace",
+		"continue", "stopped breakpoint", "variables",
+		"readMemory", "disassemble", "evaluate", "disconnect",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got messages\n\t%v\nwant\n\t%v", got, want)
+	}
+
+	checks := []struct {
+		msg  int
+		path []any
+		want any
+	}{
+		// Line 27 is a comment, so the breakpoint moves to the first
+		// instruction after it. Line 44 is past the last one.
+		{3, []any{"body", "breakpoints", 0, "verified"}, true},
+		{3, []any{"body", "breakpoints", 0, "line"}, 28.0},
+		{3, []any{"body", "breakpoints", 0, "instructionReference"}, "0x00009"},
+		{3, []any{"body", "breakpoints", 1, "verified"}, false},
+		{6, []any{"body", "stackFrames", 0, "line"}, 28.0},
+		{6, []any{"body", "stackFrames", 0, "instructionPointerReference"}, "0x00009"},
+		{6, []any{"body", "stackFrames", 0, "source", "path"}, source},
+		{7, []any{"body", "scopes", 0, "name"}, "Registers"},
+		{7, []any{"body", "scopes", 0, "variablesReference"}, float64(dapRegisters)},
+		{8, []any{"body", "variables", 0, "name"}, "General"},
+		{8, []any{"body", "variables", 2, "name"}, "Flags"},
+		{12, []any{"body", "stackFrames", 0, "line"}, 29.0},
+		{16, []any{"body", "address"}, "0x00100"},
+		{16, []any{"body", "data"}, "AAAA/w=="},
+		{17, []any{"body", "instructions", 0, "address"}, "0x00009"},
+		{17, []any{"body", "instructions", 0, "instruction"}, "mov word [bp], cx"},
+		{17, []any{"body", "instructions", 0, "line"}, 28.0},
+		{17, []any{"body", "instructions", 1, "instruction"}, "mov word [bp+2], dx"},
+		{18, []any{"body", "result"}, "2 (0x2)"},
+	}
+	for _, c := range checks {
+		if got := dapField(msgs[c.msg], c.path...); got != c.want {
+			t.Errorf("%s %v: got %v, want %v", msgs[c.msg]["command"], c.path, got, c.want)
+		}
+	}
+
+	// The first stop is before the first pixel, the second one pixel on.
+	for _, c := range []struct {
+		msg    int
+		cx, bp string
+	}{
+		{9, "0x0000", "0x0100"},
+		{15, "0x0001", "0x0104"},
+	} {
+		if cx, bp := dapRegister(msgs[c.msg], "cx"), dapRegister(msgs[c.msg], "bp"); cx != c.cx || bp != c.bp {
+			t.Errorf("message %d: cx %v bp %v, want %s %s", c.msg, cx, bp, c.cx, c.bp)
+		}
+	}
+}
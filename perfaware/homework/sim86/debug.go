@@ -0,0 +1,952 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"sim86/instructions"
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// debugger is the `sim86 debug` command loop. Commands come from the same
+// reader the program's keyboard input does, a line at a time.
+type debugger struct {
+	s   *session
+	m   *sim.Machine
+	w   io.Writer
+	in  *bufio.Reader
+	opt options
+
+	breaks   map[uint32]*breakpoint
+	displays []*Expr
+	// Symbols are the labels commands can use in place of addresses.
+	Symbols map[string]uint32
+
+	last      string  // repeated by an empty line
+	next      address // where x carries on from
+	interrupt chan os.Signal
+}
+
+// breakpoint stops execution at an address once its condition, if it has
+// one, has held more than after times.
+type breakpoint struct {
+	cond  *Expr
+	after int
+	hits  int
+}
+
+func (b *breakpoint) String() string {
+	s := fmt.Sprintf("hits %d", b.hits)
+	if b.after > 0 {
+		s += fmt.Sprintf(", after %d", b.after)
+	}
+	if b.cond != nil {
+		s += ", if " + b.cond.Text
+	}
+	return s
+}
+
+// address is a segment:offset a command names.
+type address struct {
+	seg, off uint16
+}
+
+func (a address) physical() uint32 {
+	return memory.Address(a.seg, a.off)
+}
+
+func (a address) String() string {
+	return fmt.Sprintf("%04x:%04x", a.seg, a.off)
+}
+
+const debugHelp = `Commands, with numbers in hex except counts:
+  s, step [n]          execute n instructions, tracing each (default 1)
+  n, next              step, running called procedures and interrupts to completion
+  c, continue          run until a breakpoint, hlt, the end or ^C
+  b, break [addr]      set a breakpoint, or list them with their hit counts
+    [after n] [if cond]  stopping only once cond has held more than n times
+  p, print expr        evaluate an expression, e.g. p word[ds:bp+2] > 100
+  display [expr]       print expr whenever execution stops, or list them
+  undisplay [n]        stop displaying one or all expressions
+  d, clear [addr]      clear a breakpoint, or all of them
+  watch[/Nf] addr      stop when N bytes or words at addr are written
+  rwatch, awatch       the same, for reads or for reads and writes
+  watch                list watchpoints; unwatch [n] clears one or all
+  r, regs              print the registers and flags
+  x[/Nf] [addr]        dump N units of memory, f is b (bytes) or w (words)
+  set reg value        set a register, e.g. set ax 1f or set flags.Z 1
+  set byte addr v...   write bytes, set word addr v... writes words
+  u, dis [addr] [n]    disassemble n instructions from addr, or around ip
+  rs, reverse-step [n] undo n instructions
+  rc, reverse-continue run backwards to a breakpoint or watchpoint
+  goto index           go back or forward to the instruction with that index
+  save file            write a snapshot of the machine to file
+  restore file         go back to a snapshot, clearing the history
+  q, quit              stop debugging
+An addr is seg:off, off or a label; seg and off may be registers, e.g. ds:si.
+A bare off is in cs for b, d and u, and in ds for x and set.
+Expressions use C operators on registers, flags.X, byte[addr] and
+word[addr], with decimal or 0x numbers, e.g. cx == 0x40 && flags.Z.
+`
+
+func newDebugger(w io.Writer, in *bufio.Reader, s *session) *debugger {
+	d := &debugger{
+		s:       s,
+		m:       s.m,
+		w:       w,
+		in:      in,
+		opt:     s.opt,
+		breaks:  map[uint32]*breakpoint{},
+		Symbols: map[string]uint32{},
+		next:    address{s.m.Reg(&registers.DS), 0},
+	}
+	// Commands say how far to run; watchpoints stop them all but goto.
+	s.m.StepLimit, s.m.StopOnWatch = 0, true
+	if l := s.opt.Listing; l != nil {
+		for name, off := range l.Labels {
+			d.Symbols[name] = l.Base + off
+		}
+	}
+	return d
+}
+
+// debug runs image under the debugger until the user quits or input ends.
+func debug(w io.Writer, in *bufio.Reader, image []byte, opt options) error {
+	s, err := newSession(w, image, opt)
+	if err != nil {
+		return err
+	}
+	if opt.Journal > 0 {
+		s.m.EnableJournal(opt.Journal)
+	}
+	d := newDebugger(w, in, s)
+	d.interrupt = make(chan os.Signal, 1)
+	signal.Notify(d.interrupt, os.Interrupt)
+	defer signal.Stop(d.interrupt)
+
+	fmt.Fprintln(w, "Type help for a list of commands.")
+	d.where()
+	return s.finish(d.loop())
+}
+
+func (d *debugger) loop() error {
+	for {
+		fmt.Fprint(d.w, "(sim86) ")
+		line, err := d.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(d.w)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = d.last
+		}
+		d.last = line
+		if quit, err := d.command(line); quit {
+			return nil
+		} else if err != nil {
+			fmt.Fprintf(d.w, "error: %v\n", err)
+		}
+	}
+}
+
+// command runs one line and reports whether it was quit.
+func (d *debugger) command(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	name, args := fields[0], fields[1:]
+	if strings.HasPrefix(name, "x/") || name == "x" {
+		return false, d.examine(strings.TrimPrefix(name, "x"), args)
+	}
+	if kind, _, _ := strings.Cut(name, "/"); kind == "watch" || kind == "rwatch" || kind == "awatch" {
+		return false, d.addWatch(name, args)
+	}
+
+	switch name {
+	case "s", "step":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				return false, fmt.Errorf("bad count %q", args[0])
+			}
+		}
+		d.step(n)
+	case "n", "next":
+		d.stepOver()
+	case "c", "continue", "cont":
+		d.run()
+	case "b", "break":
+		if len(args) == 0 {
+			d.listBreaks()
+			return false, nil
+		}
+		return false, d.addBreak(line, args)
+	case "d", "clear", "delete":
+		if len(args) == 0 {
+			for a := range d.breaks {
+				d.m.RemoveBreakpoint(a)
+			}
+			d.breaks = map[uint32]*breakpoint{}
+			return false, nil
+		}
+		a, err := d.address(args[0], &registers.CS)
+		if err != nil {
+			return false, err
+		}
+		if d.breaks[a.physical()] == nil {
+			return false, fmt.Errorf("no breakpoint at %s", d.describe(a))
+		}
+		delete(d.breaks, a.physical())
+		d.m.RemoveBreakpoint(a.physical())
+	case "unwatch":
+		if len(args) == 0 {
+			for len(d.m.Watches()) > 0 {
+				d.m.RemoveWatch(0)
+			}
+			return false, nil
+		}
+		i, err := strconv.Atoi(args[0])
+		if err != nil || i < 0 || i >= len(d.m.Watches()) {
+			return false, fmt.Errorf("no watchpoint %q", args[0])
+		}
+		d.m.RemoveWatch(i)
+	case "r", "regs", "registers":
+		d.registers()
+	case "set":
+		if err := d.set(strings.Fields(strings.ReplaceAll(strings.Join(args, " "), "=", " "))); err != nil {
+			return false, err
+		}
+		if j := d.m.Journal(); j != nil && d.m.Executed > d.m.Oldest() {
+			// The journal can't undo past a change it didn't see.
+			j.Reset()
+			fmt.Fprintln(d.w, "history cleared")
+		}
+	case "rs", "reverse-step":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				return false, fmt.Errorf("bad count %q", args[0])
+			}
+		}
+		return false, d.reverseStep(n)
+	case "rc", "reverse-continue":
+		return false, d.reverseContinue()
+	case "goto":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: goto index")
+		}
+		n, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("bad instruction index %q", args[0])
+		}
+		return false, d.goTo(n)
+	case "p", "print":
+		_, text, _ := strings.Cut(line, " ")
+		e, err := ParseExpr(text)
+		if err != nil {
+			return false, err
+		}
+		d.print(e)
+	case "display":
+		_, text, _ := strings.Cut(line, " ")
+		if strings.TrimSpace(text) == "" {
+			d.showDisplays()
+			return false, nil
+		}
+		e, err := ParseExpr(text)
+		if err != nil {
+			return false, err
+		}
+		d.displays = append(d.displays, e)
+		d.print(e)
+	case "undisplay":
+		if len(args) == 0 {
+			d.displays = nil
+			return false, nil
+		}
+		i, err := strconv.Atoi(args[0])
+		if err != nil || i < 0 || i >= len(d.displays) {
+			return false, fmt.Errorf("no display %q", args[0])
+		}
+		d.displays = append(d.displays[:i], d.displays[i+1:]...)
+	case "u", "dis", "disassemble":
+		return false, d.disassemble(args)
+	case "save", "restore":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: %s file", name)
+		}
+		if name == "save" {
+			return false, writeSnapshot(d.m, args[0])
+		}
+		if err := readSnapshot(d.m, args[0]); err != nil {
+			return false, err
+		}
+		d.where()
+	case "h", "help", "?":
+		fmt.Fprint(d.w, debugHelp)
+	case "q", "quit", "exit":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command %q, try help", name)
+	}
+	return false, nil
+}
+
+// stopped reports why the machine can't go on, or "" if it can.
+func (d *debugger) stopped() string {
+	switch {
+	case d.m.Halted:
+		return "halted"
+	case d.m.Exited:
+		return "exited"
+	case !d.m.Running():
+		return "ended"
+	}
+	return ""
+}
+
+// exec runs up to limit instructions, with no limit for 0, stopping early
+// at breakpoints whose conditions hold, watchpoints, errors, the end of
+// the program or an interrupt. At any other breakpoint it stops only if
+// done, when set, returns true there. With trace set each instruction is
+// printed.
+func (d *debugger) exec(limit uint64, trace bool, done func() bool) {
+	for len(d.interrupt) > 0 {
+		<-d.interrupt
+	}
+	ctx, cancel := interruptible(d.interrupt)
+	defer cancel()
+	// last is the instruction that set off the watchpoints, if any did.
+	var last sim.Exec
+	d.s.trace = func(ex sim.Exec) {
+		last = ex
+		if trace {
+			traceLine(d.w, d.m, ex, d.opt)
+		}
+	}
+	defer func() { d.s.trace = nil }()
+	for {
+		d.m.StepLimit = limit
+		res := d.m.Run(ctx)
+		if res.Reason == sim.StopBreakpoint && res.Watched == nil && res.Err == nil {
+			limit -= min(limit, res.Executed)
+			if (done != nil && done()) || d.hitBreak() {
+				return
+			}
+			continue
+		}
+		d.report(res, last.Op)
+		return
+	}
+}
+
+// report says why a run stopped, when it wasn't where it was asked to;
+// op is the instruction last executed.
+func (d *debugger) report(res sim.RunResult, op instructions.Operation) {
+	switch res.Reason {
+	case sim.StopHalt, sim.StopEnd:
+		fmt.Fprintf(d.w, "program %s\n", d.stopped())
+	case sim.StopBreakpoint:
+		if res.Err != nil {
+			fmt.Fprintf(d.w, "%v at %s\n", res.Err, d.describe(d.ip()))
+		}
+		for _, h := range res.Watched {
+			fmt.Fprintf(d.w, "watchpoint %d: %s (%s)\n", h.Watch, h, op)
+		}
+	case sim.StopError:
+		var unimplemented sim.UnimplementedError
+		switch {
+		case errors.Is(res.Err, context.Canceled):
+			fmt.Fprintln(d.w, "interrupted")
+		case errors.As(res.Err, &unimplemented):
+			fmt.Fprintf(d.w, "unimplemented instruction (%s) at %s\n", unimplemented.Op, d.describe(d.ip()))
+		default:
+			fmt.Fprintf(d.w, "%v at %s\n", res.Err, d.describe(d.ip()))
+		}
+	}
+}
+
+func (d *debugger) step(n int) {
+	d.exec(uint64(n), true, nil)
+	d.where()
+}
+
+// stepOver steps, except that calls and software interrupts run until
+// they return to the instruction after them.
+func (d *debugger) stepOver() {
+	op, err := d.m.Fetch()
+	if err != nil || !d.m.Running() {
+		d.step(1)
+		return
+	}
+	switch op.OpType {
+	case instructions.OpCall, instructions.OpInt, instructions.OpInt3, instructions.OpInto:
+	default:
+		d.step(1)
+		return
+	}
+	ip := d.ip()
+	ret := address{ip.seg, ip.off + uint16(op.Size)}
+	sp := d.m.Reg(&registers.SP)
+	// A breakpoint where the call returns to, unless there is one there
+	// already, stops the run to look at the stack.
+	if d.breaks[ret.physical()] == nil {
+		d.m.AddBreakpoint(ret.physical())
+		defer d.m.RemoveBreakpoint(ret.physical())
+	}
+	d.exec(0, false, func() bool {
+		return d.ip() == ret && d.m.Reg(&registers.SP) >= sp
+	})
+	d.where()
+}
+
+// run executes until a breakpoint, or until the machine stops or the user
+// interrupts it.
+func (d *debugger) run() {
+	d.exec(0, false, nil)
+	d.where()
+}
+
+func (d *debugger) ip() address {
+	return address{d.m.Reg(&registers.CS), d.m.Reg(&registers.IP)}
+}
+
+var errNoJournal = errors.New("there is no history, start with -journal above 0")
+
+func (d *debugger) reverseStep(n int) error {
+	if d.m.Journal() == nil {
+		return errNoJournal
+	}
+	for i := 0; i < n; i++ {
+		if ok, _ := d.m.Undo(); !ok {
+			fmt.Fprintln(d.w, "at the start of the history")
+			break
+		}
+	}
+	d.where()
+	return nil
+}
+
+// reverseContinue undoes instructions until it is back at a breakpoint
+// whose condition holds, or has undone one that set off a watchpoint.
+// Hit counts aren't taken back or added to.
+func (d *debugger) reverseContinue() error {
+	if d.m.Journal() == nil {
+		return errNoJournal
+	}
+	for {
+		ok, watched := d.m.Undo()
+		if !ok {
+			fmt.Fprintln(d.w, "at the start of the history")
+			break
+		}
+		if watched {
+			fmt.Fprintf(d.w, "watchpoint set off at %s\n", d.describe(d.ip()))
+			break
+		}
+		if b := d.breaks[d.m.PC()]; b != nil {
+			if b.cond == nil {
+				fmt.Fprintf(d.w, "breakpoint at %s\n", d.describe(d.ip()))
+				break
+			}
+			if ok, err := b.cond.True(d.m); ok || err != nil {
+				fmt.Fprintf(d.w, "breakpoint at %s\n", d.describe(d.ip()))
+				break
+			}
+		}
+	}
+	d.where()
+	return nil
+}
+
+// goTo moves to instruction index n: back through the journal, or forward
+// by executing without stopping at breakpoints.
+func (d *debugger) goTo(n uint64) error {
+	if n < d.m.Executed {
+		if d.m.Journal() == nil {
+			return errNoJournal
+		}
+		if n < d.m.Oldest() {
+			return fmt.Errorf("the history only goes back to %d", d.m.Oldest())
+		}
+		for d.m.Executed > n {
+			d.m.Undo()
+		}
+	}
+	if d.m.Executed < n {
+		// The machine only stops at the breakpoints it is given, so taking
+		// them away leaves hit counts and conditions alone too.
+		for addr := range d.breaks {
+			d.m.RemoveBreakpoint(addr)
+		}
+		d.m.StopOnWatch = false
+		d.exec(n-d.m.Executed, false, nil)
+		d.m.StopOnWatch = true
+		for addr := range d.breaks {
+			d.m.AddBreakpoint(addr)
+		}
+	}
+	d.where()
+	return nil
+}
+
+// hitBreak reports whether a breakpoint at cs:ip stops execution.
+func (d *debugger) hitBreak() bool {
+	b := d.breaks[d.m.PC()]
+	if b == nil {
+		return false
+	}
+	if b.cond != nil {
+		ok, err := b.cond.True(d.m)
+		if err != nil {
+			fmt.Fprintf(d.w, "breakpoint at %s: %v\n", d.describe(d.ip()), err)
+			return true
+		}
+		if !ok {
+			return false
+		}
+	}
+	b.hits++
+	if b.hits <= b.after {
+		return false
+	}
+	fmt.Fprintf(d.w, "breakpoint at %s, hit %d\n", d.describe(d.ip()), b.hits)
+	return true
+}
+
+// addBreak is break addr [after n] [if cond].
+func (d *debugger) addBreak(line string, args []string) error {
+	a, err := d.address(args[0], &registers.CS)
+	if err != nil {
+		return err
+	}
+	b := &breakpoint{}
+	_, cond, hasCond := strings.Cut(line, " if ")
+	if hasCond {
+		if b.cond, err = ParseExpr(cond); err != nil {
+			return err
+		}
+	}
+	if len(args) > 2 && args[1] == "after" {
+		if b.after, err = strconv.Atoi(args[2]); err != nil || b.after < 0 {
+			return fmt.Errorf("bad count %q", args[2])
+		}
+	} else if len(args) > 1 && !hasCond {
+		return fmt.Errorf("usage: break addr [after n] [if condition]")
+	}
+	d.breaks[a.physical()] = b
+	d.m.AddBreakpoint(a.physical())
+	fmt.Fprintf(d.w, "breakpoint at %s\n", d.describe(a))
+	return nil
+}
+
+// where shows the instruction at cs:ip and the display expressions.
+func (d *debugger) where() {
+	if d.stopped() != "" {
+		return
+	}
+	d.showDisplays()
+	d.listing(d.ip(), 1, d.m.PC())
+}
+
+func (d *debugger) showDisplays() {
+	for i, e := range d.displays {
+		fmt.Fprintf(d.w, "%d: %s = ", i, e)
+		d.print(e)
+	}
+}
+
+func (d *debugger) print(e *Expr) {
+	v, err := e.Eval(d.m)
+	if err != nil {
+		fmt.Fprintf(d.w, "error: %v\n", err)
+		return
+	}
+	if v < 0 {
+		fmt.Fprintf(d.w, "%d\n", v)
+		return
+	}
+	fmt.Fprintf(d.w, "%d (0x%x)\n", v, v)
+}
+
+func (d *debugger) listBreaks() {
+	if len(d.breaks) == 0 {
+		fmt.Fprintln(d.w, "no breakpoints")
+		return
+	}
+	for _, a := range d.m.Breakpoints() {
+		fmt.Fprintf(d.w, "  %s  %s\n", d.describe(nearCS(d.m, a)), d.breaks[a])
+	}
+}
+
+func (d *debugger) registers() {
+	for i, r := range registers.Words {
+		if r == &registers.FLAGS {
+			v := d.m.Reg(r)
+			fmt.Fprintf(d.w, "flags %04x %-9s", v, registers.FlagsString(v))
+			continue
+		}
+		fmt.Fprintf(d.w, "%-2s %04x  ", r.Name, d.m.Reg(r))
+		if i == 7 {
+			fmt.Fprintln(d.w)
+		}
+	}
+	fmt.Fprintf(d.w, " clocks %s  executed %d\n", d.m.Clocks, d.m.Executed)
+}
+
+// examine is x: /Nf says how many bytes or words to dump.
+func (d *debugger) examine(format string, args []string) error {
+	count, unit, err := parseFormat(format, 16)
+	if err != nil {
+		return err
+	}
+	a := d.next
+	if len(args) > 0 {
+		var err error
+		if a, err = d.address(args[0], &registers.DS); err != nil {
+			return err
+		}
+	}
+
+	perLine := 16 / unit
+	for i := 0; i < count; i += perLine {
+		n := min(perLine, count-i)
+		row := address{a.seg, a.off + uint16(i*unit)}
+		fmt.Fprintf(d.w, "%s ", row)
+		var text strings.Builder
+		for j := 0; j < n; j++ {
+			off := row.off + uint16(j*unit)
+			if unit == 2 {
+				fmt.Fprintf(d.w, " %04x", d.m.Peek(a.seg, off, true))
+				continue
+			}
+			b := d.m.Memory.Peek(memory.Address(a.seg, off))
+			fmt.Fprintf(d.w, " %02x", b)
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			text.WriteByte(b)
+		}
+		if unit == 1 {
+			fmt.Fprintf(d.w, "%*s  %s", (perLine-n)*3, "", text.String())
+		}
+		fmt.Fprintln(d.w)
+	}
+	d.next = address{a.seg, a.off + uint16(count*unit)}
+	return nil
+}
+
+// parseFormat parses the /Nf after x or watch into a count of units and
+// the unit's size in bytes.
+func parseFormat(format string, count int) (int, int, error) {
+	unit := 1
+	if format == "" {
+		return count, unit, nil
+	}
+	f := strings.TrimPrefix(format, "/")
+	if n := strings.TrimRight(f, "bw"); n != "" {
+		c, err := strconv.Atoi(n)
+		if err != nil || c < 1 {
+			return 0, 0, fmt.Errorf("bad format %q", format)
+		}
+		count = c
+		f = f[len(n):]
+	}
+	switch f {
+	case "", "b":
+	case "w":
+		unit = 2
+	default:
+		return 0, 0, fmt.Errorf("bad format %q, want b or w", format)
+	}
+	return count, unit, nil
+}
+
+// addWatch is watch, rwatch and awatch. With no address it lists the
+// watchpoints.
+func (d *debugger) addWatch(name string, args []string) error {
+	kind, format, _ := strings.Cut(name, "/")
+	if len(args) == 0 {
+		if format != "" {
+			return fmt.Errorf("usage: %s addr", name)
+		}
+		if len(d.m.Watches()) == 0 {
+			fmt.Fprintln(d.w, "no watchpoints")
+		}
+		for i, w := range d.m.Watches() {
+			fmt.Fprintf(d.w, "  %d: %s\n", i, w)
+		}
+		return nil
+	}
+	count, unit, err := parseFormat(format, 1)
+	if err != nil {
+		return err
+	}
+	a, err := d.address(args[0], &registers.DS)
+	if err != nil {
+		return err
+	}
+	first := a.physical()
+	last := first + uint32(count*unit) - 1
+	if last >= memory.Size {
+		return fmt.Errorf("watch runs past the end of memory")
+	}
+	w := sim.Watch{First: first, Last: last, Read: kind != "watch", Write: kind != "rwatch"}
+	i := d.m.AddWatch(w)
+	fmt.Fprintf(d.w, "watchpoint %d: %s\n", i, w)
+	return nil
+}
+
+// set changes a register, a flag or memory.
+func (d *debugger) set(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: set reg value, set flags.X 0|1 or set byte|word addr value...")
+	}
+	target := strings.ToLower(args[0])
+	if target == "byte" || target == "word" {
+		if len(args) < 3 {
+			return fmt.Errorf("usage: set %s addr value...", target)
+		}
+		a, err := d.address(args[1], &registers.DS)
+		if err != nil {
+			return err
+		}
+		for i, s := range args[2:] {
+			v, err := parseHex(s)
+			if err != nil {
+				return err
+			}
+			if target == "byte" {
+				d.m.Memory.Poke(memory.Address(a.seg, a.off+uint16(i)), uint8(v))
+				continue
+			}
+			off := a.off + uint16(2*i)
+			d.m.Memory.Poke(memory.Address(a.seg, off), uint8(v))
+			d.m.Memory.Poke(memory.Address(a.seg, off+1), uint8(v>>8))
+		}
+		return nil
+	}
+
+	v, err := parseHex(args[1])
+	if err != nil {
+		return err
+	}
+	if letter, ok := strings.CutPrefix(args[0], "flags."); ok && len(letter) == 1 {
+		bit, ok := registers.FlagByLetter(strings.ToUpper(letter)[0])
+		if !ok {
+			return fmt.Errorf("no flag %q", letter)
+		}
+		d.m.SetFlag(bit, v != 0)
+		return nil
+	}
+	r := registers.ByName(target)
+	if r == nil {
+		return fmt.Errorf("no register %q", args[0])
+	}
+	d.m.SetReg(r, v)
+	return nil
+}
+
+// disassemble is u: with no address it shows a few instructions either
+// side of ip.
+func (d *debugger) disassemble(args []string) error {
+	count := 10
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad count %q", args[1])
+		}
+		count = n
+	}
+	if len(args) > 0 {
+		a, err := d.address(args[0], &registers.CS)
+		if err != nil {
+			return err
+		}
+		d.listing(a, count, d.m.PC())
+		return nil
+	}
+	ip := d.ip()
+	loaded, _ := d.m.Loaded()
+	start := backUp(d.m.Memory, loaded, ip, 4)
+	d.listing(start, count, d.m.PC())
+	return nil
+}
+
+// backUp finds where to start decoding so as to show up to n instructions
+// before a. Decoding forward from loaded, where the program starts, gives
+// the real instructions when it reaches a. Otherwise backUp guesses:
+// instructions vary in length, so starts further back can decode into a
+// out of step with the real instructions, through the middle of them.
+// Each start that decodes into a votes for the offsets it decodes at, and
+// the n instructions before a with the most votes win. Out of step
+// decodes mostly fall back into step, so they win few votes.
+func backUp(mem *memory.Memory, loaded uint32, a address, n int) address {
+	if phys := a.physical(); loaded <= phys && phys-loaded <= uint32(a.off) {
+		if offs, ok := decodeTo(mem, address{a.seg, a.off - uint16(phys-loaded)}, a.off); ok {
+			if len(offs) == 0 {
+				return a
+			}
+			return address{a.seg, offs[max(0, len(offs)-n)]}
+		}
+	}
+
+	var tails [][]uint16
+	votes := map[uint16]int{}
+	for dist := 1; dist <= (n+4)*6 && int(a.off) >= dist; dist++ {
+		offs, ok := decodeTo(mem, address{a.seg, a.off - uint16(dist)}, a.off)
+		if !ok {
+			continue
+		}
+		for _, off := range offs {
+			votes[off]++
+		}
+		tails = append(tails, offs[max(0, len(offs)-n):])
+	}
+	// On a tie the furthest start wins, which is the start of the segment
+	// when that is all there is before a.
+	best, bestLen, bestVotes := a, 0, 0
+	for _, tail := range tails {
+		v := 0
+		for _, off := range tail {
+			v += votes[off]
+		}
+		if len(tail) > bestLen || (len(tail) == bestLen && v >= bestVotes) {
+			best, bestLen, bestVotes = address{a.seg, tail[0]}, len(tail), v
+		}
+	}
+	return best
+}
+
+// decodeTo decodes from start and returns the offsets of the instructions
+// up to end, and whether they end exactly there.
+func decodeTo(mem *memory.Memory, start address, end uint16) ([]uint16, bool) {
+	r := mem.PeekReader(start.seg, start.off)
+	var offs []uint16
+	for r.Off < end {
+		offs = append(offs, r.Off)
+		if _, err := instructions.Parse(r); err != nil {
+			return offs, false
+		}
+	}
+	return offs, r.Off == end
+}
+
+// listing disassembles count instructions from a, marking the one at pc
+// and any with breakpoints.
+func (d *debugger) listing(a address, count int, pc uint32) {
+	for i := 0; i < count; i++ {
+		r := d.m.Memory.PeekReader(a.seg, a.off)
+		op, err := instructions.Parse(r)
+		phys := a.physical()
+		mark := "  "
+		if phys == pc {
+			mark = "=>"
+		}
+		if d.breaks[phys] != nil {
+			mark = mark[:1] + "*"
+		}
+		if label := d.label(phys); label != "" {
+			fmt.Fprintf(d.w, "%s:\n", label)
+		}
+		if err != nil {
+			fmt.Fprintf(d.w, "%s %s  %02x  (bad)\n", mark, a, d.m.Memory.Peek(phys))
+			a.off++
+			continue
+		}
+		var raw strings.Builder
+		for j := 0; j < int(op.Size); j++ {
+			fmt.Fprintf(&raw, "%02x", d.m.Memory.Peek(memory.Address(a.seg, a.off+uint16(j))))
+		}
+		text := op.String()
+		if d.opt.Listing != nil {
+			if src := d.opt.Listing.Describe(phys); src != "" {
+				text = fmt.Sprintf("%-24s ; %s", text, src)
+			}
+		}
+		fmt.Fprintf(d.w, "%s %s  %-12s  %s\n", mark, a, raw.String(), text)
+		a.off += uint16(op.Size)
+	}
+}
+
+// address parses an addr argument. def is the segment a bare offset is in.
+func (d *debugger) address(s string, def *registers.Register) (address, error) {
+	if phys, ok := d.Symbols[s]; ok {
+		return nearCS(d.m, phys), nil
+	}
+	segText, offText, hasSeg := strings.Cut(s, ":")
+	if !hasSeg {
+		offText = segText
+	}
+	off, err := d.value(offText)
+	if err != nil {
+		return address{}, err
+	}
+	seg := d.m.Reg(def)
+	if hasSeg {
+		if seg, err = d.value(segText); err != nil {
+			return address{}, err
+		}
+	}
+	return address{seg, off}, nil
+}
+
+// value is a register's value or a hex number.
+func (d *debugger) value(s string) (uint16, error) {
+	if r := registers.ByName(strings.ToLower(s)); r != nil {
+		return d.m.Reg(r), nil
+	}
+	return parseHex(s)
+}
+
+func parseHex(s string) (uint16, error) {
+	t := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(s), "0x"), "h")
+	v, err := strconv.ParseUint(t, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return uint16(v), nil
+}
+
+// nearCS is the seg:off for a physical address, in cs when it can be.
+func nearCS(m *sim.Machine, phys uint32) address {
+	base := uint32(m.Reg(&registers.CS)) << 4
+	if phys >= base && phys-base <= 0xffff {
+		return address{m.Reg(&registers.CS), uint16(phys - base)}
+	}
+	return address{uint16(phys >> 4), uint16(phys & 0xf)}
+}
+
+// describe is a with the label there, if there is one.
+func (d *debugger) describe(a address) string {
+	if label := d.label(a.physical()); label != "" {
+		return fmt.Sprintf("%s (%s)", a, label)
+	}
+	return a.String()
+}
+
+func (d *debugger) label(phys uint32) string {
+	var found string
+	for name, a := range d.Symbols {
+		if a == phys && (found == "" || name < found) {
+			found = name
+		}
+	}
+	return found
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sim86/instructions"
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// TestBackUp backs up from every instruction of listing 54 by every
+// count, both decoding from where the program was loaded and guessing
+// without it. It must land on an instruction, not in the middle of one
+// where a longer, wrong decode also reaches the address, as
+// add word [bp+si], di at 0000:0002 does.
+func TestBackUp(t *testing.T) {
+	image, err := os.ReadFile(filepath.Join("..", "..", "part1", "listing_0054_draw_rectangle"))
+	if err != nil {
+		t.Skip(err)
+	}
+	m := sim.NewMachine(sim.Options{})
+	if err := (sim.RawLoader{}).Load(m, image); err != nil {
+		t.Fatal(err)
+	}
+	var starts []uint16
+	r := m.Memory.PeekReader(0, 0)
+	for int(r.Off) < len(image) {
+		starts = append(starts, r.Off)
+		if _, err := instructions.Parse(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		loaded uint32
+	}{
+		{"loaded", 0},
+		{"guessed", memory.Size},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for i, off := range starts {
+				for n := 1; n <= 6; n++ {
+					want := address{0, starts[max(0, i-n)]}
+					if got := backUp(m.Memory, c.loaded, address{0, off}, n); got != want {
+						t.Errorf("backUp(0000:%04x, %d) = %s, want %s", off, n, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGoTo(t *testing.T) {
+	// fillLoop stores words forever:
+	//
+	//	0000  mov bx, 0x1000
+	//	0003  mov [bx], ax
+	//	0005  inc bx
+	//	0006  inc bx
+	//	0007  jmp 0003
+	fillLoop := []byte{0xbb, 0x00, 0x10, 0x89, 0x07, 0x43, 0x43, 0xeb, 0xfa}
+	var out strings.Builder
+	s, err := newSession(&out, fillLoop, options{Journal: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.m.EnableJournal(1 << 20)
+	d := newDebugger(&out, nil, s)
+	run := func(line string) {
+		t.Helper()
+		if _, err := d.command(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	run("b 3")
+	run("b 5 if 1")
+	run("watch/w 1000")
+	out.Reset()
+
+	// Forward, goto runs past breakpoints and watchpoints without
+	// counting them.
+	run("goto 10")
+	if d.m.Executed != 10 {
+		t.Errorf("goto 10 stopped at index %d", d.m.Executed)
+	}
+	if strings.Contains(out.String(), "hit") || strings.Contains(out.String(), "watchpoint 0:") {
+		t.Errorf("goto stopped along the way:\n%s", out.String())
+	}
+	for addr, b := range d.breaks {
+		if b.hits != 0 {
+			t.Errorf("goto counted %d hits of the breakpoint at %05x", b.hits, addr)
+		}
+	}
+
+	// Back, and forward again from there, the breakpoints still work.
+	run("goto 2")
+	if d.m.Executed != 2 || d.m.Reg(&registers.IP) != 5 {
+		t.Errorf("goto 2 went to index %d, ip %#04x", d.m.Executed, d.m.Reg(&registers.IP))
+	}
+	out.Reset()
+	run("c")
+	if d.m.Executed != 5 || !strings.Contains(out.String(), "hit 1") {
+		t.Errorf("continue after goto stopped at index %d:\n%s", d.m.Executed, out.String())
+	}
+}
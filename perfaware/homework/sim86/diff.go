@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	diffContext = 3
+	// maxDiffEdits bounds the Myers search so a trace that went wrong
+	// early doesn't take forever to diff against its 30k line golden.
+	maxDiffEdits = 1000
+)
+
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff returns a unified diff turning want into got, or "" when
+// they are the same.
+func unifiedDiff(wantName, gotName string, want, got []string) string {
+	edits := diffLines(want, got)
+	changed := false
+	for _, e := range edits {
+		if e.op != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", wantName, gotName)
+
+	// wantLine and gotLine are the 1-based line numbers of edits[i].
+	wantLine, gotLine := make([]int, len(edits)+1), make([]int, len(edits)+1)
+	wantLine[0], gotLine[0] = 1, 1
+	for i, e := range edits {
+		wantLine[i+1], gotLine[i+1] = wantLine[i], gotLine[i]
+		if e.op != '+' {
+			wantLine[i+1]++
+		}
+		if e.op != '-' {
+			gotLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		start := max(i-diffContext, 0)
+		// Changes closer together than twice the context share a hunk.
+		end := i
+		for {
+			for end < len(edits) && edits[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next < len(edits) && next-end <= 2*diffContext {
+				end = next
+				continue
+			}
+			end = min(end+diffContext, len(edits))
+			break
+		}
+
+		wantCount, gotCount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				wantCount++
+			}
+			if e.op != '-' {
+				gotCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", wantLine[start], wantCount, gotLine[start], gotCount)
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&sb, "%c%s\n", e.op, e.line)
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// diffLines is Myers' O(ND) diff. The common prefix and suffix are
+// stripped first, which is most of a trace that's only slightly off.
+func diffLines(a, b []string) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []edit
+	for _, l := range a[:prefix] {
+		edits = append(edits, edit{' ', l})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, l := range a[len(a)-suffix:] {
+		edits = append(edits, edit{' ', l})
+	}
+	return edits
+}
+
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, offset, d)
+			}
+		}
+	}
+
+	// Too different to be worth aligning; replace everything.
+	var edits []edit
+	for _, l := range a {
+		edits = append(edits, edit{'-', l})
+	}
+	for _, l := range b {
+		edits = append(edits, edit{'+', l})
+	}
+	return edits
+}
+
+func backtrack(a, b []string, trace [][]int, offset, d int) []edit {
+	var edits []edit
+	x, y := len(a), len(b)
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			edits = append(edits, edit{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, edit{'+', b[y]})
+		} else {
+			x--
+			edits = append(edits, edit{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		edits = append(edits, edit{' ', a[x]})
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// Expr is a compiled debugger expression, such as
+//
+//	cx == 0x40 && flags.Z
+//	word[ds:bp+2] > 100
+//
+// Operands are numbers (decimal, or hex with 0x), register names,
+// flags.X for a flag letter as FlagsString prints it, and byte[addr] or
+// word[addr] for memory, where addr is seg:off or an offset in ds. The
+// operators are C's, with C's precedence, and comparisons give 1 or 0.
+// Everything is computed as signed 64-bit values, so nothing wraps, and
+// registers and memory read as unsigned.
+type Expr struct {
+	Text string
+	eval func(m *sim.Machine) (int64, error)
+}
+
+func (e *Expr) Eval(m *sim.Machine) (int64, error) {
+	return e.eval(m)
+}
+
+// True evaluates e as a condition.
+func (e *Expr) True(m *sim.Machine) (bool, error) {
+	v, err := e.eval(m)
+	return v != 0, err
+}
+
+func (e *Expr) String() string {
+	return e.Text
+}
+
+// ParseExpr compiles text.
+func ParseExpr(text string) (*Expr, error) {
+	toks, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	eval, err := p.binary(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != "" {
+		return nil, fmt.Errorf("unexpected %q in %q", t, text)
+	}
+	return &Expr{Text: text, eval: eval}, nil
+}
+
+type evalFunc = func(m *sim.Machine) (int64, error)
+
+// exprOperators are the multi-character operators, longest first so they
+// win over their prefixes.
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<<", ">>"}
+
+func tokenize(text string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_' || unicode.IsDigit(c):
+			j := i
+			for j < len(text) && (unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j])) || text[j] == '_' || text[j] == '.') {
+				j++
+			}
+			toks = append(toks, text[i:j])
+			i = j
+		default:
+			tok := ""
+			for _, op := range exprOperators {
+				if strings.HasPrefix(text[i:], op) {
+					tok = op
+					break
+				}
+			}
+			if tok == "" {
+				if !strings.ContainsRune("+-*/%&|^~!()[]:<>", c) {
+					return nil, fmt.Errorf("unexpected %q in %q", c, text)
+				}
+				tok = string(c)
+			}
+			toks = append(toks, tok)
+			i += len(tok)
+		}
+	}
+	return toks, nil
+}
+
+type exprParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(tok string) error {
+	if t := p.next(); t != tok {
+		if t == "" {
+			return fmt.Errorf("expected %q at the end", tok)
+		}
+		return fmt.Errorf("expected %q, got %q", tok, t)
+	}
+	return nil
+}
+
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+// binary parses operators of at least precedence min by precedence
+// climbing.
+func (p *exprParser) binary(min int) (evalFunc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		prec, ok := binaryPrecedence[op]
+		if !ok || prec < min {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func binaryOp(op string, left, right evalFunc) evalFunc {
+	return func(m *sim.Machine) (int64, error) {
+		a, err := left(m)
+		if err != nil {
+			return 0, err
+		}
+		// && and || don't evaluate their right side when they needn't.
+		switch {
+		case op == "&&" && a == 0:
+			return 0, nil
+		case op == "||" && a != 0:
+			return 1, nil
+		}
+		b, err := right(m)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "||", "&&":
+			return boolValue(b != 0), nil
+		case "|":
+			return a | b, nil
+		case "^":
+			return a ^ b, nil
+		case "&":
+			return a & b, nil
+		case "==":
+			return boolValue(a == b), nil
+		case "!=":
+			return boolValue(a != b), nil
+		case "<":
+			return boolValue(a < b), nil
+		case "<=":
+			return boolValue(a <= b), nil
+		case ">":
+			return boolValue(a > b), nil
+		case ">=":
+			return boolValue(a >= b), nil
+		case "<<":
+			return a << uint64(b&63), nil
+		case ">>":
+			return a >> uint64(b&63), nil
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		case "/", "%":
+			if b == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return a / b, nil
+			}
+			return a % b, nil
+		}
+		panic("unknown operator " + op)
+	}
+}
+
+func (p *exprParser) unary() (evalFunc, error) {
+	switch op := p.peek(); op {
+	case "-", "!", "~", "+":
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *sim.Machine) (int64, error) {
+			v, err := operand(m)
+			switch op {
+			case "-":
+				v = -v
+			case "!":
+				v = boolValue(v == 0)
+			case "~":
+				v = ^v
+			}
+			return v, err
+		}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (evalFunc, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("expression ends early")
+	case tok == "(":
+		e, err := p.binary(1)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case tok == "byte" || tok == "word":
+		if p.peek() == "[" {
+			return p.memory(tok == "word")
+		}
+	case unicode.IsDigit(rune(tok[0])):
+		// Numbers are decimal unless they start 0x, leading zeros and all.
+		digits, base := tok, 10
+		if hex, ok := strings.CutPrefix(strings.ToLower(tok), "0x"); ok {
+			digits, base = hex, 16
+		}
+		v, err := strconv.ParseInt(digits, base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok)
+		}
+		return func(*sim.Machine) (int64, error) { return v, nil }, nil
+	}
+
+	name := strings.ToLower(tok)
+	if letter, ok := strings.CutPrefix(name, "flags."); ok && len(letter) == 1 {
+		bit, ok := registers.FlagByLetter(strings.ToUpper(letter)[0])
+		if !ok {
+			return nil, fmt.Errorf("no flag %q", letter)
+		}
+		return func(m *sim.Machine) (int64, error) { return boolValue(m.Flag(bit)), nil }, nil
+	}
+	if r := registers.ByName(name); r != nil {
+		return func(m *sim.Machine) (int64, error) { return int64(m.Reg(r)), nil }, nil
+	}
+	return nil, fmt.Errorf("unknown name %q", tok)
+}
+
+// memory parses [seg:off] or [off] after byte or word.
+func (p *exprParser) memory(wide bool) (evalFunc, error) {
+	p.next()
+	off, err := p.binary(1)
+	if err != nil {
+		return nil, err
+	}
+	seg := func(m *sim.Machine) (int64, error) { return int64(m.Reg(&registers.DS)), nil }
+	if p.peek() == ":" {
+		p.next()
+		seg = off
+		if off, err = p.binary(1); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	return func(m *sim.Machine) (int64, error) {
+		s, err := seg(m)
+		if err != nil {
+			return 0, err
+		}
+		o, err := off(m)
+		if err != nil {
+			return 0, err
+		}
+		return int64(m.Peek(uint16(s), uint16(o), wide)), nil
+	}, nil
+}
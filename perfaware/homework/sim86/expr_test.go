@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"sim86/registers"
+	"sim86/sim"
+)
+
+func TestExpr(t *testing.T) {
+	m := sim.NewMachine(sim.Options{})
+	m.SetReg(&registers.AX, 0x1234)
+	m.SetReg(&registers.CX, 0x40)
+	m.SetReg(&registers.BP, 0x10)
+	m.SetReg(&registers.DS, 0x100)
+	m.SetReg(&registers.FLAGS, registers.FlagZF)
+	m.Memory.PutWord(0x100, 0x12, 0xbeef)
+	m.Memory.PutWord(0x200, 0x12, 0x0102)
+
+	for _, c := range []struct {
+		text string
+		want int64
+	}{
+		{"42", 42},
+		{"0x2a", 42},
+		{"0X2A", 42},
+		{"010", 10},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"20 / 3 % 4", 2},
+		{"1 << 4 + 1", 32},
+		{"1 | 2 ^ 3 & 6", 1},
+		{"1 < 2 == 1", 1},
+		{"-1 < 0", 1},
+		{"~0", -1},
+		{"!5 + !0", 1},
+		{"0xffff + 1", 0x10000},
+		{"0 && 1 / 0", 0},
+		{"1 || 1 / 0", 1},
+		{"2 && 3", 1},
+		{"ax", 0x1234},
+		{"AH", 0x12},
+		{"al + 1", 0x35},
+		{"cx == 0x40 && flags.Z", 1},
+		{"flags.c", 0},
+		{"word[bp+2]", 0xbeef},
+		{"byte[bp+2]", 0xef},
+		{"byte[0x12 + 1]", 0xbe},
+		{"word[0x200:bp+2]", 0x0102},
+		{"word[ds:bp+2] > 100", 1},
+	} {
+		e, err := ParseExpr(c.text)
+		if err != nil {
+			t.Errorf("%s: %v", c.text, err)
+			continue
+		}
+		got, err := e.Eval(m)
+		if err != nil {
+			t.Errorf("%s: %v", c.text, err)
+		} else if got != c.want {
+			t.Errorf("%s is %d, want %d", c.text, got, c.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want string
+	}{
+		{"", "ends early"},
+		{"1 +", "ends early"},
+		{"(1", `expected ")" at the end`},
+		{"(1]", `expected ")", got "]"`},
+		{"1 2", `unexpected "2"`},
+		{"0x", `bad number "0x"`},
+		{"0b11", "bad number"},
+		{"1_000", "bad number"},
+		{"flags.Q", "no flag"},
+		{"foo", `unknown name "foo"`},
+		{"word[1", `expected "]"`},
+		{"ax $ 1", `unexpected '$'`},
+	} {
+		_, err := ParseExpr(c.text)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want an error saying %s", c.text, err, c.want)
+		}
+	}
+
+	m := sim.NewMachine(sim.Options{})
+	for _, text := range []string{"1 / cx", "ax % 0", "word[1 / 0]"} {
+		e, err := ParseExpr(text)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		if _, err := e.Eval(m); err == nil || err.Error() != "division by zero" {
+			t.Errorf("%s: got %v, want division by zero", text, err)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// gdbStub serves one GDB connection over the remote serial protocol. GDB
+// sees the machine as an i8086 whose memory is the 1MB physical address
+// space, and its registers as i386's, each 32 bits wide with the top half
+// zero.
+type gdbStub struct {
+	s    *session
+	m    *sim.Machine
+	conn io.ReadWriter
+	log  io.Writer
+
+	// noAck is set by the packet handler and read by the reader, which
+	// sends the acks.
+	noAck atomic.Bool
+
+	packets   chan string
+	interrupt chan struct{}
+	readErr   error
+}
+
+// gdbRegisters are the registers in the order GDB's i386 numbering has
+// them. fs and gs don't exist on the 8086 and read as 0.
+var gdbRegisters = []*registers.Register{
+	&registers.AX, &registers.CX, &registers.DX, &registers.BX,
+	&registers.SP, &registers.BP, &registers.SI, &registers.DI,
+	&registers.IP, &registers.FLAGS,
+	&registers.CS, &registers.SS, &registers.DS, &registers.ES,
+	nil, nil,
+}
+
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <architecture>i8086</architecture>
+  <feature name="org.gnu.gdb.i386.core">
+    <reg name="eax" bitsize="32" type="int32" regnum="0"/>
+    <reg name="ecx" bitsize="32" type="int32"/>
+    <reg name="edx" bitsize="32" type="int32"/>
+    <reg name="ebx" bitsize="32" type="int32"/>
+    <reg name="esp" bitsize="32" type="data_ptr"/>
+    <reg name="ebp" bitsize="32" type="data_ptr"/>
+    <reg name="esi" bitsize="32" type="int32"/>
+    <reg name="edi" bitsize="32" type="int32"/>
+    <reg name="eip" bitsize="32" type="code_ptr"/>
+    <reg name="eflags" bitsize="32" type="int32"/>
+    <reg name="cs" bitsize="32" type="int32"/>
+    <reg name="ss" bitsize="32" type="int32"/>
+    <reg name="ds" bitsize="32" type="int32"/>
+    <reg name="es" bitsize="32" type="int32"/>
+    <reg name="fs" bitsize="32" type="int32"/>
+    <reg name="gs" bitsize="32" type="int32"/>
+  </feature>
+</target>
+`
+
+// gdbListen opens addr, which is host:port for TCP or unix:path for a
+// Unix socket.
+func gdbListen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serveGDB runs image under the first GDB to connect to addr, until it
+// detaches, kills the program or hangs up.
+func serveGDB(w io.Writer, addr string, image []byte, opt options) error {
+	s, err := newSession(w, image, opt)
+	if err != nil {
+		return err
+	}
+	l, err := gdbListen(addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Fprintf(w, "waiting for gdb on %s\n", l.Addr())
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	g := newGDBStub(s, conn)
+	g.log = w
+	return s.finish(g.serve())
+}
+
+func newGDBStub(s *session, conn io.ReadWriter) *gdbStub {
+	return &gdbStub{
+		s:         s,
+		m:         s.m,
+		conn:      conn,
+		log:       io.Discard,
+		packets:   make(chan string),
+		interrupt: make(chan struct{}, 1),
+	}
+}
+
+func (g *gdbStub) serve() error {
+	go g.read()
+	for p := range g.packets {
+		reply, done := g.handle(p)
+		if err := g.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	if errors.Is(g.readErr, io.EOF) {
+		return nil
+	}
+	return g.readErr
+}
+
+// read splits the connection into packets and interrupts until it ends.
+func (g *gdbStub) read() {
+	defer close(g.packets)
+	r := bufio.NewReader(g.conn)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			g.readErr = err
+			return
+		}
+		switch c {
+		case '+', '-':
+			// Acks. Everything is resent by gdb's own timeout anyway.
+		case 0x03:
+			select {
+			case g.interrupt <- struct{}{}:
+			default:
+			}
+		case '$':
+			body, err := r.ReadString('#')
+			if err != nil {
+				g.readErr = err
+				return
+			}
+			sum := make([]byte, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				g.readErr = err
+				return
+			}
+			body = body[:len(body)-1]
+			if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || uint8(want) != gdbChecksum(body) {
+				if !g.noAck.Load() {
+					g.conn.Write([]byte{'-'})
+				}
+				continue
+			}
+			if !g.noAck.Load() {
+				g.conn.Write([]byte{'+'})
+			}
+			g.packets <- body
+		}
+	}
+}
+
+func gdbChecksum(s string) uint8 {
+	var sum uint8
+	for i := 0; i < len(s); i++ {
+		sum += s[i]
+	}
+	return sum
+}
+
+func (g *gdbStub) send(reply string) error {
+	_, err := fmt.Fprintf(g.conn, "$%s#%02x", reply, gdbChecksum(reply))
+	return err
+}
+
+// handle answers one packet and reports whether the session is over.
+// Unsupported packets get the empty reply the protocol asks for.
+func (g *gdbStub) handle(p string) (string, bool) {
+	if p == "" {
+		return "", false
+	}
+	switch {
+	case p == "?":
+		return "S05", false
+	case strings.HasPrefix(p, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+", false
+	case p == "QStartNoAckMode":
+		g.noAck.Store(true)
+		return "OK", false
+	case strings.HasPrefix(p, "qXfer:features:read:target.xml:"):
+		return g.xfer(strings.TrimPrefix(p, "qXfer:features:read:target.xml:")), false
+	case p == "qAttached":
+		return "1", false
+	case p == "qC":
+		return "QC1", false
+	case p == "qfThreadInfo":
+		return "m1", false
+	case p == "qsThreadInfo":
+		return "l", false
+	case strings.HasPrefix(p, "H"), strings.HasPrefix(p, "T"):
+		return "OK", false
+	case p == "g":
+		var b strings.Builder
+		for _, r := range gdbRegisters {
+			b.WriteString(gdbRegister(g.m, r))
+		}
+		return b.String(), false
+	case strings.HasPrefix(p, "G"):
+		data := p[1:]
+		for i, r := range gdbRegisters {
+			if len(data) < (i+1)*8 {
+				break
+			}
+			g.setRegister(r, data[i*8:(i+1)*8])
+		}
+		return "OK", false
+	case strings.HasPrefix(p, "p"):
+		n, err := strconv.ParseUint(p[1:], 16, 8)
+		if err != nil || int(n) >= len(gdbRegisters) {
+			return "E01", false
+		}
+		return gdbRegister(g.m, gdbRegisters[n]), false
+	case strings.HasPrefix(p, "P"):
+		num, val, ok := strings.Cut(p[1:], "=")
+		n, err := strconv.ParseUint(num, 16, 8)
+		if !ok || err != nil || int(n) >= len(gdbRegisters) {
+			return "E01", false
+		}
+		g.setRegister(gdbRegisters[n], val)
+		return "OK", false
+	case strings.HasPrefix(p, "m"):
+		return g.readMemory(p[1:]), false
+	case strings.HasPrefix(p, "M"):
+		return g.writeMemory(p[1:]), false
+	case strings.HasPrefix(p, "Z"), strings.HasPrefix(p, "z"):
+		return g.breakpoint(p[0] == 'Z', p[1:]), false
+	case strings.HasPrefix(p, "s"):
+		if reply, ok := g.resumeAt(p[1:]); !ok {
+			return reply, false
+		}
+		return g.step(), false
+	case strings.HasPrefix(p, "c"):
+		if reply, ok := g.resumeAt(p[1:]); !ok {
+			return reply, false
+		}
+		return g.cont(), false
+	case p == "D" || strings.HasPrefix(p, "D;"):
+		return "OK", true
+	case p == "k":
+		return "", true
+	}
+	return "", false
+}
+
+// xfer serves offset,length of the target description.
+func (g *gdbStub) xfer(args string) string {
+	offText, lenText, _ := strings.Cut(args, ",")
+	off, err1 := strconv.ParseUint(offText, 16, 32)
+	n, err2 := strconv.ParseUint(lenText, 16, 32)
+	if err1 != nil || err2 != nil {
+		return "E01"
+	}
+	if off >= uint64(len(gdbTargetXML)) {
+		return "l"
+	}
+	chunk := gdbTargetXML[off:]
+	if uint64(len(chunk)) > n {
+		return "m" + gdbEscape(chunk[:n])
+	}
+	return "l" + gdbEscape(chunk)
+}
+
+// gdbEscape escapes the characters binary replies can't carry as is.
+func gdbEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '#', '$', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(c ^ 0x20)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// gdbRegister is r as 32 bits of little endian hex.
+func gdbRegister(m *sim.Machine, r *registers.Register) string {
+	var v uint16
+	if r != nil {
+		v = m.Reg(r)
+	}
+	return fmt.Sprintf("%02x%02x0000", uint8(v), uint8(v>>8))
+}
+
+func (g *gdbStub) setRegister(r *registers.Register, hexVal string) {
+	b, err := hex.DecodeString(hexVal)
+	if err != nil || len(b) < 2 || r == nil {
+		return
+	}
+	g.m.SetReg(r, uint16(b[0])|uint16(b[1])<<8)
+}
+
+// memoryRange parses addr,length.
+func memoryRange(args string) (uint32, int, bool) {
+	addrText, lenText, ok := strings.Cut(args, ",")
+	addr, err1 := strconv.ParseUint(addrText, 16, 32)
+	n, err2 := strconv.ParseUint(lenText, 16, 32)
+	if !ok || err1 != nil || err2 != nil || addr+n > memory.Size {
+		return 0, 0, false
+	}
+	return uint32(addr), int(n), true
+}
+
+func (g *gdbStub) readMemory(args string) string {
+	addr, n, ok := memoryRange(args)
+	if !ok {
+		return "E01"
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = g.m.Memory.Peek(addr + uint32(i))
+	}
+	return hex.EncodeToString(b)
+}
+
+func (g *gdbStub) writeMemory(args string) string {
+	rng, data, _ := strings.Cut(args, ":")
+	addr, n, ok := memoryRange(rng)
+	b, err := hex.DecodeString(data)
+	if !ok || err != nil || len(b) != n {
+		return "E01"
+	}
+	for i, v := range b {
+		g.m.Memory.Poke(addr+uint32(i), v)
+	}
+	return "OK"
+}
+
+// breakpoint sets or clears type,addr,kind. Types 0 and 1 are software
+// and hardware breakpoints, which are the same thing here; 2, 3 and 4 are
+// write, read and access watchpoints of kind bytes.
+func (g *gdbStub) breakpoint(set bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 3 {
+		return "E01"
+	}
+	addr, n, ok := memoryRange(parts[1] + "," + parts[2])
+	if !ok {
+		return "E01"
+	}
+	switch parts[0] {
+	case "0", "1":
+		if set {
+			g.m.AddBreakpoint(addr)
+		} else {
+			g.m.RemoveBreakpoint(addr)
+		}
+		return "OK"
+	case "2", "3", "4":
+		if n == 0 {
+			n = 1
+		}
+		w := sim.Watch{First: addr, Last: addr + uint32(n) - 1, Read: parts[0] != "2", Write: parts[0] != "3"}
+		if set {
+			g.m.AddWatch(w)
+			return "OK"
+		}
+		for i, o := range g.m.Watches() {
+			if o == w {
+				g.m.RemoveWatch(i)
+				return "OK"
+			}
+		}
+		return "E01"
+	}
+	return ""
+}
+
+// resumeAt handles the optional address s and c take. GDB gives it as
+// a physical address; it is taken as an offset in cs when it can be.
+func (g *gdbStub) resumeAt(args string) (string, bool) {
+	if args == "" {
+		return "", true
+	}
+	addr, err := strconv.ParseUint(args, 16, 32)
+	if err != nil {
+		return "E01", false
+	}
+	base := uint64(g.m.Reg(&registers.CS)) << 4
+	if addr < base || addr-base > 0xffff {
+		return "E01", false
+	}
+	g.m.SetReg(&registers.IP, uint16(addr-base))
+	return "", true
+}
+
+func (g *gdbStub) exited() string {
+	if d := g.s.opt.DOS; d != nil && d.Exited {
+		return fmt.Sprintf("W%02x", d.ExitCode)
+	}
+	return "W00"
+}
+
+// run executes up to limit instructions, with no limit for 0, and
+// returns the stop reply: at a breakpoint, a watchpoint, the end of the
+// program or an interrupt from gdb.
+func (g *gdbStub) run(limit uint64) string {
+	if !g.m.Running() {
+		return g.exited()
+	}
+	select {
+	case <-g.interrupt:
+	default:
+	}
+	ctx, cancel := interruptible(g.interrupt)
+	defer cancel()
+	g.m.StepLimit, g.m.StopOnWatch = limit, true
+	res := g.m.Run(ctx)
+	switch res.Reason {
+	case sim.StopHalt, sim.StopEnd:
+		if res.Executed == 0 || limit == 0 {
+			return g.exited()
+		}
+	case sim.StopBreakpoint:
+		if len(res.Watched) == 0 {
+			return "T05swbreak:;"
+		}
+		h := res.Watched[0]
+		w := g.m.Watches()[h.Watch]
+		kind := "awatch"
+		switch {
+		case !w.Read:
+			kind = "watch"
+		case !w.Write:
+			kind = "rwatch"
+		}
+		return fmt.Sprintf("T05%s:%x;", kind, h.Address())
+	case sim.StopError:
+		if res.Err == ctx.Err() {
+			return "S02"
+		}
+		fmt.Fprintf(g.log, "%v at 0x%05x\n", res.Err, g.m.PC())
+		var unimplemented sim.UnimplementedError
+		if errors.As(res.Err, &unimplemented) {
+			return "S04"
+		}
+		return "S0b"
+	}
+	return "S05"
+}
+
+func (g *gdbStub) step() string {
+	return g.run(1)
+}
+
+// cont runs until something stops the program.
+func (g *gdbStub) cont() string {
+	return g.run(0)
+}
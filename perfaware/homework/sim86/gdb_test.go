@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"sim86/registers"
+)
+
+// gdbTestProgram is, at 0000:0000,
+//
+//	0000  mov ax, 0x1234
+//	0003  mov bx, 0x200
+//	0006  mov [bx], ax
+//	0008  mov cx, [bx]
+//	000a  inc ax
+//	000b  nop
+var gdbTestProgram = []byte{
+	0xb8, 0x34, 0x12,
+	0xbb, 0x00, 0x02,
+	0x89, 0x07,
+	0x8b, 0x0f,
+	0x40,
+	0x90,
+}
+
+// gdbClient is the gdb end of a pipe to a stub.
+type gdbClient struct {
+	t     *testing.T
+	conn  net.Conn
+	r     *bufio.Reader
+	noAck bool
+	done  chan error
+}
+
+func newGDBClient(t *testing.T, image []byte) (*gdbClient, *gdbStub) {
+	t.Helper()
+	s, err := newSession(io.Discard, image, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	g := newGDBStub(s, server)
+	c := &gdbClient{t: t, conn: client, r: bufio.NewReader(client), done: make(chan error, 1)}
+	go func() {
+		c.done <- g.serve()
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	return c, g
+}
+
+func (c *gdbClient) write(s string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, s); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads the stub's next packet, after its ack unless acks are off.
+func (c *gdbClient) reply() string {
+	c.t.Helper()
+	b, err := c.r.ReadByte()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !c.noAck {
+		if b != '+' {
+			c.t.Fatalf("got %q, want an ack", b)
+		}
+		if b, err = c.r.ReadByte(); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	if b != '$' {
+		c.t.Fatalf("got %q, want the start of a packet", b)
+	}
+	body, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body = body[:len(body)-1]
+	sum := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, sum); err != nil {
+		c.t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%02x", gdbChecksum(body)); string(sum) != want {
+		c.t.Fatalf("reply %q has checksum %s, want %s", body, sum, want)
+	}
+	return body
+}
+
+func (c *gdbClient) send(p string) string {
+	c.t.Helper()
+	c.write(fmt.Sprintf("$%s#%02x", p, gdbChecksum(p)))
+	return c.reply()
+}
+
+func (c *gdbClient) expect(p, want string) {
+	c.t.Helper()
+	if got := c.send(p); got != want {
+		c.t.Errorf("%s: got %q, want %q", p, got, want)
+	}
+}
+
+func TestGDBStub(t *testing.T) {
+	c, g := newGDBClient(t, gdbTestProgram)
+
+	if got := c.send("qSupported:swbreak+"); !strings.Contains(got, "QStartNoAckMode+") || !strings.Contains(got, "qXfer:features:read+") {
+		t.Errorf("qSupported: got %q", got)
+	}
+
+	// A packet with a bad checksum is nacked and not answered.
+	c.write("$g#00")
+	if b, _ := c.r.ReadByte(); b != '-' {
+		t.Errorf("bad checksum: got %q, want a nack", b)
+	}
+
+	c.expect("QStartNoAckMode", "OK")
+	c.noAck = true
+
+	c.expect("qXfer:features:read:target.xml:0,ffff", "l"+gdbTargetXML)
+	c.expect("qXfer:features:read:target.xml:0,10", "m"+gdbTargetXML[:0x10])
+	c.expect(fmt.Sprintf("qXfer:features:read:target.xml:%x,ffff", len(gdbTargetXML)), "l")
+
+	regs := c.send("g")
+	if len(regs) != len(gdbRegisters)*8 {
+		t.Fatalf("g: got %d hex digits, want %d", len(regs), len(gdbRegisters)*8)
+	}
+	c.expect("P0=78560000", "OK")
+	c.expect("p0", "78560000")
+	if ax := g.m.Reg(&registers.AX); ax != 0x5678 {
+		t.Errorf("P0 set ax to %#x, want 0x5678", ax)
+	}
+	c.expect("p1a", "E01")
+	c.expect("G"+regs, "OK")
+	c.expect("g", regs)
+
+	c.expect("M200,2:aabb", "OK")
+	c.expect("m200,2", "aabb")
+	c.expect("mfffff,2", "E01")
+
+	c.expect("s", "S05")
+	if ip := g.m.Reg(&registers.IP); ip != 3 {
+		t.Errorf("s stopped at ip %#x, want 0x3", ip)
+	}
+
+	c.expect("Z0,6,1", "OK")
+	c.expect("c", "T05swbreak:;")
+	if ip := g.m.Reg(&registers.IP); ip != 6 {
+		t.Errorf("breakpoint stopped at ip %#x, want 0x6", ip)
+	}
+	c.expect("z0,6,1", "OK")
+
+	c.expect("Z2,200,2", "OK")
+	c.expect("c", "T05watch:200;")
+	if ip := g.m.Reg(&registers.IP); ip != 8 {
+		t.Errorf("write watchpoint stopped at ip %#x, want 0x8", ip)
+	}
+	c.expect("z2,200,2", "OK")
+	c.expect("z2,200,2", "E01")
+
+	c.expect("Z3,200,2", "OK")
+	c.expect("c", "T05rwatch:200;")
+	c.expect("z3,200,2", "OK")
+
+	c.expect("Z4,300,1", "OK")
+	c.expect("c", "W00")
+	c.expect("s", "W00")
+
+	c.expect("D", "OK")
+	if err := <-c.done; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
+
+func TestGDBInterrupt(t *testing.T) {
+	// jmp $
+	c, _ := newGDBClient(t, []byte{0xeb, 0xfe})
+	// With acks on the stub would be writing one when the interrupt comes,
+	// and the pipe holds nothing.
+	c.expect("QStartNoAckMode", "OK")
+	c.noAck = true
+	c.write(fmt.Sprintf("$c#%02x", gdbChecksum("c")))
+	c.write("\x03")
+	if got := c.reply(); got != "S02" {
+		t.Errorf("interrupted c: got %q, want S02", got)
+	}
+	c.expect("k", "")
+	if err := <-c.done; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package instructions
+
+import (
+	"fmt"
+	"strings"
+
+	"sim86/registers"
+)
+
+// Base and index registers picked by the RM field of a memory operand.
+var eaTerms = [8][]*registers.Register{
+	0b000: {&registers.BX, &registers.SI},
+	0b001: {&registers.BX, &registers.DI},
+	0b010: {&registers.BP, &registers.SI},
+	0b011: {&registers.BP, &registers.DI},
+	0b100: {&registers.SI},
+	0b101: {&registers.DI},
+	0b110: {&registers.BP},
+	0b111: {&registers.BX},
+}
+
+// Register returns the register a ValRegister operand names.
+func (o Operand) Register() *registers.Register {
+	if o.Seg {
+		return registers.GetSeg(o.Reg)
+	}
+	var w uint8
+	if o.Wide {
+		w = 1
+	}
+	return registers.Get(w, o.Reg)
+}
+
+// Terms returns the registers summed into a ValMemory operand's offset.
+func (o Operand) Terms() []*registers.Register {
+	if o.Direct || o.Explicit {
+		return nil
+	}
+	return eaTerms[o.RM]
+}
+
+// IsString reports whether the operation is one of the string
+// instructions that rep applies to.
+func (op Operation) IsString() bool {
+	switch op.OpType {
+	case OpMovs, OpCmps, OpScas, OpLods, OpStos:
+		return true
+	}
+	return false
+}
+
+// String formats the operation as nasm compatible assembly.
+func (op Operation) String() string {
+	var sb strings.Builder
+	if op.Lock {
+		sb.WriteString("lock ")
+	}
+	if op.Rep {
+		if op.RepZ {
+			sb.WriteString("rep ")
+		} else {
+			sb.WriteString("repne ")
+		}
+	}
+	sb.WriteString(op.OpType.String())
+	if op.IsString() {
+		if op.Wide() {
+			sb.WriteString("w")
+		} else {
+			sb.WriteString("b")
+		}
+	}
+
+	separator := " "
+	for _, o := range op.Operands {
+		if o.Type == ValNone {
+			continue
+		}
+		sb.WriteString(separator)
+		separator = ", "
+		sb.WriteString(op.operandString(o))
+	}
+	return sb.String()
+}
+
+func (op Operation) operandString(o Operand) string {
+	switch o.Type {
+	case ValRegister:
+		return o.Register().Name
+	case ValMemory:
+		if o.Explicit {
+			return fmt.Sprintf("%d:%d", o.Segment, uint16(o.Disp))
+		}
+		var sb strings.Builder
+		if op.Far {
+			sb.WriteString("far ")
+		} else if op.Operands[0].Type != ValRegister {
+			if op.Wide() {
+				sb.WriteString("word ")
+			} else {
+				sb.WriteString("byte ")
+			}
+		}
+		if op.SegOverride != nil {
+			sb.WriteString(registers.GetSeg(op.SegOverride.Value).Name + ":")
+		}
+		sb.WriteString(bracket(effectiveAddress(o)))
+		return sb.String()
+	case ValImmediate:
+		if o.Relative {
+			return fmt.Sprintf("$%+d", o.Imm+int32(op.Size))
+		}
+		return fmt.Sprint(o.Imm)
+	}
+	return ""
+}
+
+func effectiveAddress(o Operand) string {
+	var names []string
+	for _, r := range o.Terms() {
+		names = append(names, r.Name)
+	}
+	s := strings.Join(names, "+")
+	if len(names) == 0 || o.Disp != 0 {
+		s += fmt.Sprintf("%+d", o.Disp)
+	}
+	return s
+}
+
+func bracket(s string) string {
+	return fmt.Sprintf("[%s]", s)
+}
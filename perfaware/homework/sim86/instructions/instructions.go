@@ -1,8 +1,9 @@
 package instructions
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 )
 
 type BitType int
@@ -12,6 +13,8 @@ const (
 	BitsD
 	BitsS
 	BitsW
+	BitsV
+	BitsZ
 	BitsRM
 	BitsMOD
 	BitsREG
@@ -20,6 +23,13 @@ const (
 	BitsDataHi
 	BitsAddr
 	BitsSegReg
+	BitsEscHi
+	BitsEscLo
+	BitsFar
+	BitsRelJmp
+	BitsRMRegAlwaysW
+
+	bitsCount
 )
 
 type Bit struct {
@@ -39,24 +49,38 @@ func B(b string) Bit {
 	return Bit{Type: BitsLiteral, Size: uint8(len(b)), Value: value}
 }
 
+// Fields with a Size are read out of the opcode bytes. The zero sized ones
+// (DISP, ADDR, DATA, ...) only mark that trailing bytes follow, or set a
+// property of the encoding.
 var (
 	D         = Bit{Type: BitsD, Size: 1}
 	S         = Bit{Type: BitsS, Size: 1}
 	W         = Bit{Type: BitsW, Size: 1}
+	V         = Bit{Type: BitsV, Size: 1}
+	Z         = Bit{Type: BitsZ, Size: 1}
 	RM        = Bit{Type: BitsRM, Size: 3}
 	MOD       = Bit{Type: BitsMOD, Size: 2}
 	REG       = Bit{Type: BitsREG, Size: 3}
-	DISP      = Bit{Type: BitsDisp, Size: 8}
-	ADDR      = Bit{Type: BitsAddr, Size: 16}
-	DATA      = Bit{Type: BitsDataLo, Size: 8}
-	DATA_IF_W = Bit{Type: BitsDataHi, Size: 8}
 	SR        = Bit{Type: BitsSegReg, Size: 2}
+	ESC_HI    = Bit{Type: BitsEscHi, Size: 3}
+	ESC_LO    = Bit{Type: BitsEscLo, Size: 3}
+	DISP      = Bit{Type: BitsDisp}
+	ADDR      = Bit{Type: BitsAddr}
+	DATA      = Bit{Type: BitsDataLo}
+	DATA_IF_W = Bit{Type: BitsDataHi, Value: 1}
+	FAR       = Bit{Type: BitsFar, Value: 1}
+	REL       = Bit{Type: BitsRelJmp, Value: 1}
+	RM_W      = Bit{Type: BitsRMRegAlwaysW, Value: 1}
 )
 
 func ImplD(value byte) Bit {
 	return Bit{Type: BitsD, Size: 0, Value: value}
 }
 
+func ImplS(value byte) Bit {
+	return Bit{Type: BitsS, Size: 0, Value: value}
+}
+
 func ImplW(value byte) Bit {
 	return Bit{Type: BitsW, Size: 0, Value: value}
 }
@@ -77,10 +101,97 @@ type OpType uint8
 const (
 	OpNone OpType = iota
 	OpMov
+	OpPush
+	OpPop
+	OpXchg
+	OpIn
+	OpOut
+	OpXlat
+	OpLea
+	OpLds
+	OpLes
+	OpLahf
+	OpSahf
+	OpPushf
+	OpPopf
 	OpAdd
+	OpAdc
+	OpInc
+	OpAaa
+	OpDaa
 	OpSub
+	OpSbb
+	OpDec
+	OpNeg
 	OpCmp
+	OpAas
+	OpDas
+	OpMul
+	OpImul
+	OpAam
+	OpDiv
+	OpIdiv
+	OpAad
+	OpCbw
+	OpCwd
+	OpNot
+	OpShl
+	OpShr
+	OpSar
+	OpRol
+	OpRor
+	OpRcl
+	OpRcr
+	OpAnd
+	OpTest
+	OpOr
+	OpXor
+	OpRep
+	OpMovs
+	OpCmps
+	OpScas
+	OpLods
+	OpStos
+	OpCall
 	OpJmp
+	OpRet
+	OpRetf
+	OpJe
+	OpJl
+	OpJle
+	OpJb
+	OpJbe
+	OpJp
+	OpJo
+	OpJs
+	OpJne
+	OpJnl
+	OpJg
+	OpJnb
+	OpJa
+	OpJnp
+	OpJno
+	OpJns
+	OpLoop
+	OpLoopz
+	OpLoopnz
+	OpJcxz
+	OpInt
+	OpInt3
+	OpInto
+	OpIret
+	OpClc
+	OpCmc
+	OpStc
+	OpCld
+	OpStd
+	OpCli
+	OpSti
+	OpHlt
+	OpWait
+	OpEsc
+	OpLock
+	OpSegment
 )
 
 type ValueType uint8
@@ -93,26 +204,144 @@ const (
 )
 
 var opToString = map[OpType]string{
-	OpNone: "",
-	OpMov:  "mov",
-	OpAdd:  "add",
-	OpSub:  "sub",
-	OpCmp:  "cmp",
-	OpJmp:  "jmp",
+	OpNone:    "",
+	OpMov:     "mov",
+	OpPush:    "push",
+	OpPop:     "pop",
+	OpXchg:    "xchg",
+	OpIn:      "in",
+	OpOut:     "out",
+	OpXlat:    "xlat",
+	OpLea:     "lea",
+	OpLds:     "lds",
+	OpLes:     "les",
+	OpLahf:    "lahf",
+	OpSahf:    "sahf",
+	OpPushf:   "pushf",
+	OpPopf:    "popf",
+	OpAdd:     "add",
+	OpAdc:     "adc",
+	OpInc:     "inc",
+	OpAaa:     "aaa",
+	OpDaa:     "daa",
+	OpSub:     "sub",
+	OpSbb:     "sbb",
+	OpDec:     "dec",
+	OpNeg:     "neg",
+	OpCmp:     "cmp",
+	OpAas:     "aas",
+	OpDas:     "das",
+	OpMul:     "mul",
+	OpImul:    "imul",
+	OpAam:     "aam",
+	OpDiv:     "div",
+	OpIdiv:    "idiv",
+	OpAad:     "aad",
+	OpCbw:     "cbw",
+	OpCwd:     "cwd",
+	OpNot:     "not",
+	OpShl:     "shl",
+	OpShr:     "shr",
+	OpSar:     "sar",
+	OpRol:     "rol",
+	OpRor:     "ror",
+	OpRcl:     "rcl",
+	OpRcr:     "rcr",
+	OpAnd:     "and",
+	OpTest:    "test",
+	OpOr:      "or",
+	OpXor:     "xor",
+	OpRep:     "rep",
+	OpMovs:    "movs",
+	OpCmps:    "cmps",
+	OpScas:    "scas",
+	OpLods:    "lods",
+	OpStos:    "stos",
+	OpCall:    "call",
+	OpJmp:     "jmp",
+	OpRet:     "ret",
+	OpRetf:    "retf",
+	OpJe:      "je",
+	OpJl:      "jl",
+	OpJle:     "jle",
+	OpJb:      "jb",
+	OpJbe:     "jbe",
+	OpJp:      "jp",
+	OpJo:      "jo",
+	OpJs:      "js",
+	OpJne:     "jne",
+	OpJnl:     "jnl",
+	OpJg:      "jg",
+	OpJnb:     "jnb",
+	OpJa:      "ja",
+	OpJnp:     "jnp",
+	OpJno:     "jno",
+	OpJns:     "jns",
+	OpLoop:    "loop",
+	OpLoopz:   "loopz",
+	OpLoopnz:  "loopnz",
+	OpJcxz:    "jcxz",
+	OpInt:     "int",
+	OpInt3:    "int3",
+	OpInto:    "into",
+	OpIret:    "iret",
+	OpClc:     "clc",
+	OpCmc:     "cmc",
+	OpStc:     "stc",
+	OpCld:     "cld",
+	OpStd:     "std",
+	OpCli:     "cli",
+	OpSti:     "sti",
+	OpHlt:     "hlt",
+	OpWait:    "wait",
+	OpEsc:     "esc",
+	OpLock:    "lock",
+	OpSegment: "segment",
+}
+
+func (t OpType) String() string {
+	return opToString[t]
 }
 
 type DecodeScheme struct {
 	Mnemonic OpType
 	Bits     []Bit
 }
+
+// Operand is one decoded source or destination.
+type Operand struct {
+	Type ValueType
+
+	// ValRegister: Reg is the REG/RM encoding, Wide picks ax over al and
+	// Seg picks the segment registers.
+	Reg  uint8
+	Wide bool
+	Seg  bool
+
+	// ValMemory: RM picks the base/index registers unless Direct is set,
+	// in which case Disp is the whole address. Explicit is a far pointer
+	// literal (jmp 1234:5678) with the segment in Segment.
+	RM       uint8
+	Direct   bool
+	Disp     int16
+	Explicit bool
+	Segment  uint16
+
+	// ValImmediate: Relative marks a jump displacement from the next
+	// instruction.
+	Imm      int32
+	Relative bool
+}
+
 type Operation struct {
-	OpType     OpType
-	Literal    []Bit
-	ValueTypes []ValueType
+	OpType  OpType
+	Literal []Bit
 
 	D,
 	S,
 	W,
+	V,
+	Z,
 	MOD,
 	SR,
 	REG,
@@ -123,209 +352,470 @@ type Operation struct {
 	ADDR_HI,
 	DATA_LO,
 	DATA_HI *Bit
+
+	// Size is the encoded length in bytes, prefixes included.
+	Size uint8
+
+	Lock bool
+	Rep  bool
+	// RepZ is set for rep/repe (F3) and clear for repne (F2).
+	RepZ bool
+	// SegOverride holds the segment prefix, if any.
+	SegOverride *Bit
+	Far         bool
+
+	Operands [2]Operand
+}
+
+func (op Operation) Wide() bool {
+	return op.W != nil && op.W.Value == 1
 }
 
 var OpNotFound = Operation{
 	OpType: OpNone,
 }
 
-var noOperation = DecodeScheme{OpNone, nil}
-
-var movRegMemReg = DecodeScheme{OpMov, []Bit{B("100010"), D, W, MOD, REG, RM}}
-var movImmedRegMem = DecodeScheme{OpMov, []Bit{B("1100011"), W, MOD, B("000"), RM, DATA, ImplD(0)}}
-var movImmedReg = DecodeScheme{OpMov, []Bit{B("1011"), W, REG, DATA, ImplD(1)}}
-var movMem2Acc = DecodeScheme{OpMov, []Bit{B("1010000"), W, ADDR, ImplD(1), ImplMOD(0), ImplREG(0)}}
-var movAcc2Mem = DecodeScheme{OpMov, []Bit{B("1010001"), W, ADDR, ImplD(0), ImplMOD(0), ImplREG(0)}}
-var movRegMemSeg = DecodeScheme{OpMov, []Bit{B("100011"), D, B("0"), MOD, B("0"), SR, RM, ImplW(1)}}
-
-var Table = map[uint8]DecodeScheme{
-	// Mov
-	0b10001000: movRegMemReg,
-	0b10001001: movRegMemReg,
-	0b10001010: movRegMemReg,
-	0b10001011: movRegMemReg,
-	0b10110000: movImmedReg,
-	0b10110001: movImmedReg,
-	0b10110010: movImmedReg,
-	0b10110011: movImmedReg,
-	0b10110100: movImmedReg,
-	0b10110101: movImmedReg,
-	0b10110110: movImmedReg,
-	0b10110111: movImmedReg,
-	0b10111000: movImmedReg,
-	0b10111001: movImmedReg,
-	0b10111010: movImmedReg,
-	0b10111011: movImmedReg,
-	0b10111100: movImmedReg,
-	0b10111101: movImmedReg,
-	0b10111110: movImmedReg,
-	0b10111111: movImmedReg,
-	0b11000110: movImmedRegMem,
-	0b11000111: movImmedRegMem,
-	0b10100000: movMem2Acc,
-	0b10100001: movMem2Acc,
-	0b10100010: movAcc2Mem,
-	0b10100011: movAcc2Mem,
-	0b10001110: movRegMemSeg,
-	0b10001100: movRegMemSeg,
-	// Add/Sub/Cmp
-	0b10000000: noOperation, // immedtoRegMem(""), // add,sub,cmp
-	0b10000001: noOperation, // immedtoRegMem(""), // add,sub,cmp
-	0b10000010: noOperation, // immedtoRegMem(""), // add,sub,cmp
-	0b10000011: noOperation, // immedtoRegMem(""), // add,sub,cmp
-	// Add
-	0b00000000: noOperation, // regMemReg("add"),
-	0b00000001: noOperation, // regMemReg("add"),
-	0b00000010: noOperation, // regMemReg("add"),
-	0b00000011: noOperation, // regMemReg("add"),
-	0b00000100: noOperation, // immedToReg("add"),
-	0b00000101: noOperation, // immedToReg("add"),
-	// Sub
-	0b00101000: noOperation, // regMemReg("sub"),
-	0b00101001: noOperation, // regMemReg("sub"),
-	0b00101010: noOperation, // regMemReg("sub"),
-	0b00101011: noOperation, // regMemReg("sub"),
-	0b00101100: noOperation, // immedToReg("sub"),
-	0b00101101: noOperation, // immedToReg("sub"),
-	// Cmp
-	0b00111000: noOperation, // regMemReg("cmp"),
-	0b00111001: noOperation, // regMemReg("cmp"),
-	0b00111010: noOperation, // regMemReg("cmp"),
-	0b00111011: noOperation, // regMemReg("cmp"),
-	0b00111100: noOperation, // immedToReg("cmp"),
-	0b00111101: noOperation, // immedToReg("cmp"),
-	// Jump
-	0b01110100: noOperation, // jump("je"),
-	0b01111100: noOperation, // jump("jl"),
-	0b01111110: noOperation, // jump("jle"),
-	0b01110010: noOperation, // jump("jb"),
-	0b01110110: noOperation, // jump("jbe"),
-	0b01111010: noOperation, // jump("jp"),
-	0b01110000: noOperation, // jump("jo"),
-	0b01111000: noOperation, // jump("js"),
-	0b01110101: noOperation, // jump("jne"),
-	0b01111101: noOperation, // jump("jnl"),
-	0b01111111: noOperation, // jump("jnle"),
-	0b01110011: noOperation, // jump("jnb"),
-	0b01110111: noOperation, // jump("jnbe"),
-	0b01111011: noOperation, // jump("jnp"),
-	0b01110001: noOperation, // jump("jno"),
-	0b01111001: noOperation, // jump("jns"),
-	0b11100010: noOperation, // jump("loop"),
-	0b11100001: noOperation, // jump("loopz"),
-	0b11100000: noOperation, // jump("loopnz"),
-	0b11100011: noOperation, // jump("jcxz"),
+var ErrUnknownOpcode = errors.New("unknown opcode")
+
+// The 8086 has no instruction longer than this, prefixes included.
+const maxInstructionSize = 15
+
+var (
+	movRegMemReg   = DecodeScheme{OpMov, []Bit{B("100010"), D, W, MOD, REG, RM}}
+	movImmedRegMem = DecodeScheme{OpMov, []Bit{B("1100011"), W, MOD, B("000"), RM, DATA, DATA_IF_W, ImplD(0)}}
+	movImmedReg    = DecodeScheme{OpMov, []Bit{B("1011"), W, REG, DATA, DATA_IF_W, ImplD(1)}}
+	movMem2Acc     = DecodeScheme{OpMov, []Bit{B("1010000"), W, ADDR, ImplREG(0), ImplMOD(0), ImplRM(0b110), ImplD(1)}}
+	movAcc2Mem     = DecodeScheme{OpMov, []Bit{B("1010001"), W, ADDR, ImplREG(0), ImplMOD(0), ImplRM(0b110), ImplD(0)}}
+	movRegMemSeg   = DecodeScheme{OpMov, []Bit{B("100011"), D, B("0"), MOD, B("0"), SR, RM, ImplW(1)}}
+)
+
+// Schemes is table 4-12 of the 8086 manual, in the manual's order.
+var Schemes = []DecodeScheme{
+	movRegMemReg,
+	movImmedRegMem,
+	movImmedReg,
+	movMem2Acc,
+	movAcc2Mem,
+	movRegMemSeg,
+
+	{OpPush, []Bit{B("11111111"), MOD, B("110"), RM, ImplW(1), ImplD(1)}},
+	{OpPush, []Bit{B("01010"), REG, ImplW(1), ImplD(1)}},
+	{OpPush, []Bit{B("000"), SR, B("110"), ImplW(1), ImplD(1)}},
+
+	{OpPop, []Bit{B("10001111"), MOD, B("000"), RM, ImplW(1), ImplD(1)}},
+	{OpPop, []Bit{B("01011"), REG, ImplW(1), ImplD(1)}},
+	{OpPop, []Bit{B("000"), SR, B("111"), ImplW(1), ImplD(1)}},
+
+	{OpXchg, []Bit{B("1000011"), W, MOD, REG, RM, ImplD(1)}},
+	{OpXchg, []Bit{B("10010"), REG, ImplMOD(0b11), ImplW(1), ImplRM(0)}},
+
+	{OpIn, []Bit{B("1110010"), W, DATA, ImplREG(0), ImplD(1)}},
+	{OpIn, []Bit{B("1110110"), W, ImplREG(0), ImplD(1), ImplMOD(0b11), ImplRM(2), RM_W}},
+	{OpOut, []Bit{B("1110011"), W, DATA, ImplREG(0), ImplD(0)}},
+	{OpOut, []Bit{B("1110111"), W, ImplREG(0), ImplD(0), ImplMOD(0b11), ImplRM(2), RM_W}},
+
+	{OpXlat, []Bit{B("11010111")}},
+	{OpLea, []Bit{B("10001101"), MOD, REG, RM, ImplD(1), ImplW(1)}},
+	{OpLds, []Bit{B("11000101"), MOD, REG, RM, ImplD(1), ImplW(1)}},
+	{OpLes, []Bit{B("11000100"), MOD, REG, RM, ImplD(1), ImplW(1)}},
+	{OpLahf, []Bit{B("10011111")}},
+	{OpSahf, []Bit{B("10011110")}},
+	{OpPushf, []Bit{B("10011100")}},
+	{OpPopf, []Bit{B("10011101")}},
+
+	{OpAdd, []Bit{B("000000"), D, W, MOD, REG, RM}},
+	{OpAdd, []Bit{B("100000"), S, W, MOD, B("000"), RM, DATA, DATA_IF_W}},
+	{OpAdd, []Bit{B("0000010"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpAdc, []Bit{B("000100"), D, W, MOD, REG, RM}},
+	{OpAdc, []Bit{B("100000"), S, W, MOD, B("010"), RM, DATA, DATA_IF_W}},
+	{OpAdc, []Bit{B("0001010"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpInc, []Bit{B("1111111"), W, MOD, B("000"), RM, ImplD(1)}},
+	{OpInc, []Bit{B("01000"), REG, ImplW(1), ImplD(1)}},
+
+	{OpAaa, []Bit{B("00110111")}},
+	{OpDaa, []Bit{B("00100111")}},
+
+	{OpSub, []Bit{B("001010"), D, W, MOD, REG, RM}},
+	{OpSub, []Bit{B("100000"), S, W, MOD, B("101"), RM, DATA, DATA_IF_W}},
+	{OpSub, []Bit{B("0010110"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpSbb, []Bit{B("000110"), D, W, MOD, REG, RM}},
+	{OpSbb, []Bit{B("100000"), S, W, MOD, B("011"), RM, DATA, DATA_IF_W}},
+	{OpSbb, []Bit{B("0001110"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpDec, []Bit{B("1111111"), W, MOD, B("001"), RM, ImplD(1)}},
+	{OpDec, []Bit{B("01001"), REG, ImplW(1), ImplD(1)}},
+
+	{OpNeg, []Bit{B("1111011"), W, MOD, B("011"), RM}},
+
+	{OpCmp, []Bit{B("001110"), D, W, MOD, REG, RM}},
+	{OpCmp, []Bit{B("100000"), S, W, MOD, B("111"), RM, DATA, DATA_IF_W}},
+	{OpCmp, []Bit{B("0011110"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpAas, []Bit{B("00111111")}},
+	{OpDas, []Bit{B("00101111")}},
+	{OpMul, []Bit{B("1111011"), W, MOD, B("100"), RM, ImplS(0)}},
+	{OpImul, []Bit{B("1111011"), W, MOD, B("101"), RM, ImplS(1)}},
+	{OpAam, []Bit{B("11010100"), B("00001010")}},
+	{OpDiv, []Bit{B("1111011"), W, MOD, B("110"), RM, ImplS(0)}},
+	{OpIdiv, []Bit{B("1111011"), W, MOD, B("111"), RM, ImplS(1)}},
+	{OpAad, []Bit{B("11010101"), B("00001010")}},
+	{OpCbw, []Bit{B("10011000")}},
+	{OpCwd, []Bit{B("10011001")}},
+
+	{OpNot, []Bit{B("1111011"), W, MOD, B("010"), RM}},
+	{OpShl, []Bit{B("110100"), V, W, MOD, B("100"), RM}},
+	{OpShr, []Bit{B("110100"), V, W, MOD, B("101"), RM}},
+	{OpSar, []Bit{B("110100"), V, W, MOD, B("111"), RM}},
+	{OpRol, []Bit{B("110100"), V, W, MOD, B("000"), RM}},
+	{OpRor, []Bit{B("110100"), V, W, MOD, B("001"), RM}},
+	{OpRcl, []Bit{B("110100"), V, W, MOD, B("010"), RM}},
+	{OpRcr, []Bit{B("110100"), V, W, MOD, B("011"), RM}},
+
+	{OpAnd, []Bit{B("001000"), D, W, MOD, REG, RM}},
+	{OpAnd, []Bit{B("1000000"), W, MOD, B("100"), RM, DATA, DATA_IF_W}},
+	{OpAnd, []Bit{B("0010010"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	// The manual shows a D bit on the first test encoding, but it would
+	// collide with xchg.
+	{OpTest, []Bit{B("1000010"), W, MOD, REG, RM}},
+	{OpTest, []Bit{B("1111011"), W, MOD, B("000"), RM, DATA, DATA_IF_W}},
+	{OpTest, []Bit{B("1010100"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpOr, []Bit{B("000010"), D, W, MOD, REG, RM}},
+	{OpOr, []Bit{B("1000000"), W, MOD, B("001"), RM, DATA, DATA_IF_W}},
+	{OpOr, []Bit{B("0000110"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpXor, []Bit{B("001100"), D, W, MOD, REG, RM}},
+	{OpXor, []Bit{B("1000000"), W, MOD, B("110"), RM, DATA, DATA_IF_W}},
+	{OpXor, []Bit{B("0011010"), W, DATA, DATA_IF_W, ImplREG(0), ImplD(1)}},
+
+	{OpRep, []Bit{B("1111001"), Z}},
+	{OpMovs, []Bit{B("1010010"), W}},
+	{OpCmps, []Bit{B("1010011"), W}},
+	{OpScas, []Bit{B("1010111"), W}},
+	{OpLods, []Bit{B("1010110"), W}},
+	{OpStos, []Bit{B("1010101"), W}},
+
+	{OpCall, []Bit{B("11101000"), ADDR, REL}},
+	{OpCall, []Bit{B("11111111"), MOD, B("010"), RM, ImplW(1)}},
+	{OpCall, []Bit{B("10011010"), ADDR, DATA, DATA_IF_W, ImplW(1), FAR}},
+	{OpCall, []Bit{B("11111111"), MOD, B("011"), RM, ImplW(1), FAR}},
+
+	{OpJmp, []Bit{B("11101001"), ADDR, REL}},
+	{OpJmp, []Bit{B("11101011"), DISP, REL}},
+	{OpJmp, []Bit{B("11111111"), MOD, B("100"), RM, ImplW(1)}},
+	{OpJmp, []Bit{B("11101010"), ADDR, DATA, DATA_IF_W, ImplW(1), FAR}},
+	{OpJmp, []Bit{B("11111111"), MOD, B("101"), RM, ImplW(1), FAR}},
+
+	// The manual doesn't tell ret and retf apart, but nasm needs it to
+	// reassemble the output.
+	{OpRet, []Bit{B("11000011")}},
+	{OpRet, []Bit{B("11000010"), DATA, DATA_IF_W, ImplW(1)}},
+	{OpRetf, []Bit{B("11001011"), FAR}},
+	{OpRetf, []Bit{B("11001010"), DATA, DATA_IF_W, ImplW(1), FAR}},
+
+	{OpJe, []Bit{B("01110100"), DISP, REL}},
+	{OpJl, []Bit{B("01111100"), DISP, REL}},
+	{OpJle, []Bit{B("01111110"), DISP, REL}},
+	{OpJb, []Bit{B("01110010"), DISP, REL}},
+	{OpJbe, []Bit{B("01110110"), DISP, REL}},
+	{OpJp, []Bit{B("01111010"), DISP, REL}},
+	{OpJo, []Bit{B("01110000"), DISP, REL}},
+	{OpJs, []Bit{B("01111000"), DISP, REL}},
+	{OpJne, []Bit{B("01110101"), DISP, REL}},
+	{OpJnl, []Bit{B("01111101"), DISP, REL}},
+	{OpJg, []Bit{B("01111111"), DISP, REL}},
+	{OpJnb, []Bit{B("01110011"), DISP, REL}},
+	{OpJa, []Bit{B("01110111"), DISP, REL}},
+	{OpJnp, []Bit{B("01111011"), DISP, REL}},
+	{OpJno, []Bit{B("01110001"), DISP, REL}},
+	{OpJns, []Bit{B("01111001"), DISP, REL}},
+	{OpLoop, []Bit{B("11100010"), DISP, REL}},
+	{OpLoopz, []Bit{B("11100001"), DISP, REL}},
+	{OpLoopnz, []Bit{B("11100000"), DISP, REL}},
+	{OpJcxz, []Bit{B("11100011"), DISP, REL}},
+
+	{OpInt, []Bit{B("11001101"), DATA}},
+	{OpInt3, []Bit{B("11001100")}},
+	{OpInto, []Bit{B("11001110")}},
+	{OpIret, []Bit{B("11001111")}},
+
+	{OpClc, []Bit{B("11111000")}},
+	{OpCmc, []Bit{B("11110101")}},
+	{OpStc, []Bit{B("11111001")}},
+	{OpCld, []Bit{B("11111100")}},
+	{OpStd, []Bit{B("11111101")}},
+	{OpCli, []Bit{B("11111010")}},
+	{OpSti, []Bit{B("11111011")}},
+	{OpHlt, []Bit{B("11110100")}},
+	{OpWait, []Bit{B("10011011")}},
+	{OpEsc, []Bit{B("11011"), ESC_HI, MOD, ESC_LO, RM, ImplD(1)}},
+	{OpLock, []Bit{B("11110000")}},
+	{OpSegment, []Bit{B("001"), SR, B("110")}},
 }
 
-func Parse(b1 byte, br *bufio.Reader) (op Operation) {
-	decodeScheme, ok := Table[b1]
-	if !ok {
-		fmt.Printf("%b\n", b1)
-		panic("op code not found can't continue decoding")
+// Table maps a first opcode byte to every scheme that could match it. Some
+// bytes (0x80, 0xFF, ...) need the REG field of the second byte to pick one.
+var Table = map[uint8][]DecodeScheme{}
+
+func init() {
+	for _, scheme := range Schemes {
+		for b := 0; b < 256; b++ {
+			if scheme.matchesFirstByte(uint8(b)) {
+				Table[uint8(b)] = append(Table[uint8(b)], scheme)
+			}
+		}
+	}
+}
+
+func (s DecodeScheme) matchesFirstByte(b byte) bool {
+	var used uint8
+	for _, bits := range s.Bits {
+		if bits.Size == 0 {
+			continue
+		}
+		if used+bits.Size > 8 {
+			break
+		}
+		used += bits.Size
+		if bits.Type == BitsLiteral && readBits(b, 8-used, 8-used+bits.Size-1) != bits.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// opcodeBytes buffers the bytes every candidate scheme looks at, so a
+// scheme that doesn't match can be retried with the next one.
+type opcodeBytes struct {
+	br  io.ByteReader
+	buf []byte
+	pos int
+}
+
+func (o *opcodeBytes) next() (byte, error) {
+	if o.pos == len(o.buf) {
+		b, err := o.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		o.buf = append(o.buf, b)
 	}
+	b := o.buf[o.pos]
+	o.pos++
+	return b, nil
+}
 
-	op.OpType = decodeScheme.Mnemonic
+// trailing reads a displacement or data byte that follows the opcode.
+func (o *opcodeBytes) trailing() (byte, error) {
+	o.pos = len(o.buf)
+	return o.next()
+}
 
-	var currentByte = b1
-	var currentBit uint8 = 0
-	var bitsRead uint8 = 0
-	for _, bits := range decodeScheme.Bits {
+// Parse decodes one instruction, prefixes included, from br.
+func Parse(br io.ByteReader) (op Operation, err error) {
+	var size int
+	for {
+		ob := &opcodeBytes{br: br}
+		b1, err := ob.next()
+		if err != nil {
+			return op, err
+		}
 
-		if currentBit == 8 && bits.Size != 0 {
-			b, err := br.ReadByte()
+		var part Operation
+		matched := false
+		for _, scheme := range Table[b1] {
+			ob.pos = 0
+			part, matched, err = decode(scheme, ob, op)
 			if err != nil {
-				panic("Error reading byte")
+				return op, err
+			}
+			if matched {
+				break
 			}
-			currentByte = b
-			currentBit = 0
+		}
+		if !matched {
+			return OpNotFound, fmt.Errorf("%w %08b", ErrUnknownOpcode, b1)
 		}
 
-		if bits.Size != 0 {
-			bits.Value = readBits(currentByte, 8-currentBit-bits.Size, 7-currentBit)
+		size += len(ob.buf)
+		if size > maxInstructionSize {
+			return OpNotFound, fmt.Errorf("instruction longer than %d bytes", maxInstructionSize)
 		}
-		switch bits.Type {
-		case BitsLiteral:
-			op.Literal = append(op.Literal, bits)
-		case BitsD:
-			op.D = &bits
-		case BitsS:
-			op.S = &bits
-		case BitsW:
-			op.W = &bits
-		case BitsMOD:
-			op.MOD = &bits
-		case BitsREG:
-			op.REG = &bits
-			op.ValueTypes = append(op.ValueTypes, ValRegister)
-		case BitsSegReg:
-			op.SR = &bits
-			op.ValueTypes = append(op.ValueTypes, ValRegister)
-		case BitsRM:
-			op.RM = &bits
-			switch op.MOD.Value {
-			case 0b00:
-				if bits.Value == 0b110 {
-					bLo, errLo := br.ReadByte()
-					bHi, errHi := br.ReadByte()
-					if errLo != nil || errHi != nil {
-						panic(fmt.Sprintf("%v, %v", errLo, errHi))
-					}
-					op.ADDR_LO.Value = bLo
-					op.ADDR_HI.Value = bHi
-
-					op.ValueTypes = append(op.ValueTypes, ValMemory)
-				} else {
-					op.ValueTypes = append(op.ValueTypes, ValRegister)
 
-				}
-			case 0b01:
-				b, err := br.ReadByte()
+		switch part.OpType {
+		case OpLock:
+			op.Lock = true
+		case OpRep:
+			op.Rep = true
+			op.RepZ = part.Z.Value == 1
+		case OpSegment:
+			op.SegOverride = part.SR
+		default:
+			part.Size = uint8(size)
+			return part, nil
+		}
+	}
+}
+
+// decode tries a single scheme. prefix carries the lock/rep/segment state
+// collected so far.
+func decode(scheme DecodeScheme, ob *opcodeBytes, prefix Operation) (op Operation, matched bool, err error) {
+	var has [bitsCount]bool
+	var vals [bitsCount]byte
+
+	var pending byte
+	var pendingCount uint8
+	for _, bits := range scheme.Bits {
+		value := bits.Value
+		if bits.Size != 0 {
+			if pendingCount == 0 {
+				pending, err = ob.next()
 				if err != nil {
-					panic(fmt.Sprintf("%v", err))
-				}
-				op.DISP_LO = &Bit{Type: BitsDisp, Value: b}
-				op.ValueTypes = append(op.ValueTypes, ValRegister)
-			case 0b10:
-				bLo, errLo := br.ReadByte()
-				bHi, errHi := br.ReadByte()
-				if errLo != nil || errHi != nil {
-					panic(fmt.Sprintf("%v, %v", errLo, errHi))
+					return op, false, err
 				}
-				op.DISP_LO = &Bit{Type: BitsDisp, Value: bLo}
-				op.DISP_HI = &Bit{Type: BitsDisp, Value: bHi}
-				op.ValueTypes = append(op.ValueTypes, ValRegister)
-			case 0b11:
-				op.ValueTypes = append(op.ValueTypes, ValRegister)
+				pendingCount = 8
 			}
-		case BitsDataLo:
-			op.DATA_LO = &Bit{Type: BitsDataLo, Value: currentByte}
+			pendingCount -= bits.Size
+			value = readBits(pending, pendingCount, pendingCount+bits.Size-1)
+		}
 
-			op.ValueTypes = append(op.ValueTypes, ValImmediate)
-			if op.W.Value == 0b1 {
-				bHi, errHi := br.ReadByte()
-				if errHi != nil {
-					panic(fmt.Sprintf("%v", errHi))
+		if bits.Type == BitsLiteral {
+			if value != bits.Value {
+				return op, false, nil
+			}
+			op.Literal = append(op.Literal, Bit{Type: BitsLiteral, Size: bits.Size, Value: value})
+			continue
+		}
+		has[bits.Type] = true
+		vals[bits.Type] |= value
+	}
 
-				}
-				op.DATA_HI = &Bit{Type: BitsDataHi, Value: bHi}
+	op.OpType = scheme.Mnemonic
+	op.Lock = prefix.Lock
+	op.Rep = prefix.Rep
+	op.RepZ = prefix.RepZ
+	op.SegOverride = prefix.SegOverride
+	op.Far = vals[BitsFar] == 1
+
+	field := func(t BitType) *Bit {
+		if !has[t] {
+			return nil
+		}
+		return &Bit{Type: t, Value: vals[t]}
+	}
+	op.D = field(BitsD)
+	op.S = field(BitsS)
+	op.W = field(BitsW)
+	op.V = field(BitsV)
+	op.Z = field(BitsZ)
+	op.MOD = field(BitsMOD)
+	op.SR = field(BitsSegReg)
+	op.REG = field(BitsREG)
+	op.RM = field(BitsRM)
+
+	mod := vals[BitsMOD]
+	rm := vals[BitsRM]
+	w := vals[BitsW]
+	direct := has[BitsMOD] && mod == 0b00 && rm == 0b110
+	hasDisp := has[BitsDisp] || has[BitsAddr] || direct ||
+		(has[BitsMOD] && (mod == 0b01 || mod == 0b10))
+	dispIsWide := has[BitsAddr] || direct || (has[BitsMOD] && mod == 0b10)
+
+	var disp int16
+	if hasDisp {
+		lo, err := ob.trailing()
+		if err != nil {
+			return op, false, err
+		}
+		disp = int16(int8(lo))
+		if dispIsWide {
+			hi, err := ob.trailing()
+			if err != nil {
+				return op, false, err
 			}
-		case BitsAddr:
-			bLo, errLo := br.ReadByte()
-			bHi, errHi := br.ReadByte()
-			if errLo != nil || errHi != nil {
-				panic(fmt.Sprintf("%v, %v", errLo, errHi))
+			disp = int16(uint16(hi)<<8 | uint16(lo))
+			if has[BitsAddr] {
+				op.ADDR_LO = &Bit{Type: BitsAddr, Value: lo}
+				op.ADDR_HI = &Bit{Type: BitsAddr, Value: hi}
+			} else {
+				op.DISP_LO = &Bit{Type: BitsDisp, Value: lo}
+				op.DISP_HI = &Bit{Type: BitsDisp, Value: hi}
 			}
-			op.ADDR_LO = &Bit{Type: BitsAddr, Value: bLo}
-			op.ADDR_HI = &Bit{Type: BitsAddr, Value: bHi}
+		} else {
+			op.DISP_LO = &Bit{Type: BitsDisp, Value: lo}
+		}
+	}
+
+	var data int32
+	if has[BitsDataLo] {
+		lo, err := ob.trailing()
+		if err != nil {
+			return op, false, err
+		}
+		op.DATA_LO = &Bit{Type: BitsDataLo, Value: lo}
+		data = int32(lo)
+		if vals[BitsS] == 1 {
+			data = int32(int8(lo))
+		}
+		if has[BitsDataHi] && vals[BitsS] == 0 && w == 1 {
+			hi, err := ob.trailing()
+			if err != nil {
+				return op, false, err
+			}
+			op.DATA_HI = &Bit{Type: BitsDataHi, Value: hi}
+			data = int32(uint16(hi)<<8 | uint16(lo))
+		}
+	}
+
+	regOperand, modOperand := &op.Operands[1], &op.Operands[0]
+	if vals[BitsD] == 1 {
+		regOperand, modOperand = &op.Operands[0], &op.Operands[1]
+	}
 
-			op.ValueTypes = append(op.ValueTypes, ValMemory)
+	if has[BitsSegReg] {
+		*regOperand = Operand{Type: ValRegister, Reg: vals[BitsSegReg], Wide: true, Seg: true}
+	}
+	if has[BitsREG] {
+		*regOperand = Operand{Type: ValRegister, Reg: vals[BitsREG], Wide: w == 1}
+	}
+	if has[BitsMOD] {
+		if mod == 0b11 {
+			*modOperand = Operand{Type: ValRegister, Reg: rm, Wide: w == 1 || has[BitsRMRegAlwaysW]}
+		} else {
+			*modOperand = Operand{Type: ValMemory, RM: rm, Direct: direct, Disp: disp}
 		}
+	}
 
-		currentBit += bits.Size
-		bitsRead += bits.Size
+	if has[BitsDataLo] && hasDisp && !has[BitsMOD] {
+		op.Operands[0] = Operand{Type: ValMemory, Explicit: true, Segment: uint16(data), Disp: disp}
+	} else {
+		// Immediates go in whichever slot REG and MOD left free, since
+		// some of them (out 12, al) are destinations.
+		last := &op.Operands[0]
+		if last.Type != ValNone {
+			last = &op.Operands[1]
+		}
+		switch {
+		case has[BitsRelJmp]:
+			*last = Operand{Type: ValImmediate, Imm: int32(disp), Relative: true}
+		case has[BitsDataLo]:
+			*last = Operand{Type: ValImmediate, Imm: data}
+		case has[BitsV]:
+			if vals[BitsV] == 1 {
+				*last = Operand{Type: ValRegister, Reg: 0b001}
+			} else {
+				*last = Operand{Type: ValImmediate, Imm: 1}
+			}
+		case has[BitsEscHi]:
+			*last = Operand{Type: ValImmediate, Imm: int32(vals[BitsEscHi]<<3 | vals[BitsEscLo])}
+		}
 	}
 
-	return op
+	return op, true, nil
 }
 
 func readBits(b byte, start, end uint8) uint8 {
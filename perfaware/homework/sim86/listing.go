@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Listing maps addresses to source lines and labels using the listing
+// nasm writes with -l, and the map file a [map] directive writes, if
+// there is one. Addresses in both are offsets into the assembled image,
+// so Base is where the image was loaded.
+type Listing struct {
+	// Lines are the source lines that assembled to bytes, in address
+	// order.
+	Lines []ListingLine
+	// Labels are the offsets of the labels the source defines. Local
+	// labels are qualified by the label before them, as nasm does.
+	Labels map[string]uint32
+	Base   uint32
+
+	// Path is the listing file and Text its lines as they were, for
+	// annotating.
+	Path string
+	Text []string
+}
+
+// ListingLine is a source line and the bytes it assembled to.
+type ListingLine struct {
+	Line   int
+	Offset uint32
+	Size   uint32
+	// Level is how deep in macro expansions and included files the line
+	// is, where 0 is the assembled file itself. Line numbers at other
+	// levels are in some other file.
+	Level  int
+	Source string
+	// Index is where the line is in the listing's Text.
+	Index int
+}
+
+// nasm's listing columns: a 6 digit line number, an 8 digit offset, 19
+// columns of hex data and the source text from column 40.
+const (
+	listOffsetColumn = 7
+	listDataColumn   = 16
+	listSourceColumn = 40
+)
+
+// ReadListing parses a nasm -l listing.
+func ReadListing(path string) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := parseListing(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	l.Path = path
+	return l, nil
+}
+
+// findListing reads the listing for program: the one named, or else
+// program.lst or program's name with .lst in place of its extension, if
+// either exists. mapFile, if named, adds its labels. With neither a
+// listing nor a map file it returns nil.
+func findListing(program, listing, mapFile string) (*Listing, error) {
+	if listing == "" {
+		for _, p := range []string{program + ".lst", strings.TrimSuffix(program, filepath.Ext(program)) + ".lst"} {
+			if _, err := os.Stat(p); err == nil {
+				listing = p
+				break
+			}
+		}
+	}
+	l := &Listing{Labels: map[string]uint32{}}
+	if listing != "" {
+		var err error
+		if l, err = ReadListing(listing); err != nil {
+			return nil, err
+		}
+	} else if mapFile == "" {
+		return nil, nil
+	}
+	if mapFile != "" {
+		if err := l.ReadMap(mapFile); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func parseListing(r io.Reader) (*Listing, error) {
+	l := &Listing{Labels: map[string]uint32{}}
+	var scope string     // the label local labels belong to
+	var pending []string // labels waiting for the next line with an offset
+	var end uint32       // past the last byte so far
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimRight(sc.Text(), "\r")
+		l.Text = append(l.Text, text)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if len(text) < listOffsetColumn {
+			return nil, fmt.Errorf("line %d is too short for a listing line", n)
+		}
+		lineNo, err := strconv.Atoi(strings.TrimSpace(text[:listOffsetColumn-1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d doesn't start with a line number", n)
+		}
+		var source string
+		if len(text) > listSourceColumn {
+			source = text[listSourceColumn:]
+		}
+		level := 0
+		if m := listLevel.FindStringSubmatch(source); m != nil {
+			level, _ = strconv.Atoi(m[1])
+			source = source[len(m[0]):]
+		}
+		if label := sourceLabel(source); label != "" {
+			if !strings.HasPrefix(label, ".") || strings.HasPrefix(label, "..") {
+				scope = label
+			} else {
+				label = scope + label
+			}
+			pending = append(pending, label)
+		}
+
+		offText := column(text, listOffsetColumn, listDataColumn-1)
+		if offText == "" {
+			continue
+		}
+		off, err := strconv.ParseUint(offText, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d has a bad offset %q", n, offText)
+		}
+		for _, label := range pending {
+			l.Labels[label] = uint32(off)
+		}
+		pending = pending[:0]
+		size := dataSize(column(text, listDataColumn, listSourceColumn-5))
+		end = max(end, uint32(off)+size)
+
+		// Data too long for one line carries on in lines of its own.
+		if last := len(l.Lines) - 1; last >= 0 && l.Lines[last].Line == lineNo && source == "" &&
+			l.Lines[last].Offset+l.Lines[last].Size == uint32(off) {
+			l.Lines[last].Size += size
+			continue
+		}
+		l.Lines = append(l.Lines, ListingLine{Line: lineNo, Offset: uint32(off), Size: size, Level: level, Source: strings.TrimSpace(source), Index: n - 1})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	// Labels after the last bytes, like an end: marking the end of the
+	// program, have no line with an offset to take.
+	for _, label := range pending {
+		l.Labels[label] = end
+	}
+	sort.SliceStable(l.Lines, func(i, j int) bool { return l.Lines[i].Offset < l.Lines[j].Offset })
+	return l, nil
+}
+
+// listLevel is the <n> nasm puts before lines from macros and includes.
+var listLevel = regexp.MustCompile(`^<(\d+)> ?`)
+
+// listLabel matches a label definition at the start of a source line.
+var listLabel = regexp.MustCompile(`^\s*([A-Za-z._?$][\w.$#@~?]*):`)
+
+// sourceLabel is the label source defines, if it defines one. Labels given
+// a value with equ aren't addresses, so they don't count.
+func sourceLabel(source string) string {
+	m := listLabel.FindStringSubmatch(source)
+	if m == nil {
+		return ""
+	}
+	rest := strings.Fields(source[len(m[0]):])
+	if len(rest) > 0 && strings.EqualFold(rest[0], "equ") {
+		return ""
+	}
+	return m[1]
+}
+
+// listData are the directives that put data rather than code in the
+// output.
+var listData = map[string]bool{
+	"db": true, "dw": true, "dd": true, "dq": true, "dt": true, "do": true, "dy": true, "dz": true,
+	"resb": true, "resw": true, "resd": true, "resq": true, "rest": true, "reso": true, "resy": true, "resz": true,
+	"incbin": true, "align": true, "alignb": true,
+}
+
+// Code is whether the line assembled to instructions rather than data.
+func (ll ListingLine) Code() bool {
+	source := ll.Source
+	if m := listLabel.FindStringIndex(source); m != nil {
+		source = source[m[1]:]
+	}
+	source, _, _ = strings.Cut(source, ";")
+	fields := strings.Fields(strings.ToLower(source))
+	if len(fields) > 2 && fields[0] == "times" {
+		fields = fields[2:]
+	}
+	return ll.Size > 0 && len(fields) > 0 && !listData[fields[0]]
+}
+
+// column is text[from:to] trimmed, or what there is of it.
+func column(text string, from, to int) string {
+	if len(text) <= from {
+		return ""
+	}
+	return strings.TrimSpace(text[from:min(to, len(text))])
+}
+
+// dataSize counts the bytes in a data column. Hex digits are bytes, two
+// at a time; brackets and parentheses mark relocations and the trailing
+// dash a continuation. <res N> is space reserved without data, and
+// <rep N> after data the number of times a times directive repeated it.
+func dataSize(data string) uint32 {
+	if rest, ok := strings.CutPrefix(data, "<res "); ok {
+		return listCount(rest)
+	}
+	if data, rest, ok := strings.Cut(data, "<rep "); ok {
+		return dataSize(data) * listCount(rest)
+	}
+	digits := 0
+	for _, c := range data {
+		if strings.ContainsRune("0123456789ABCDEFabcdef", c) {
+			digits++
+		}
+	}
+	return uint32(digits / 2)
+}
+
+// listCount reads the hex count ending a <res N> or <rep N>, which nasm
+// writes with or without an h.
+func listCount(text string) uint32 {
+	text = strings.TrimSuffix(strings.TrimSuffix(text, ">"), "h")
+	n, err := strconv.ParseUint(text, 16, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(n)
+}
+
+// At finds the line whose bytes include the physical address addr.
+func (l *Listing) At(addr uint32) (ListingLine, bool) {
+	if addr < l.Base {
+		return ListingLine{}, false
+	}
+	off := addr - l.Base
+	i := sort.Search(len(l.Lines), func(i int) bool { return l.Lines[i].Offset+l.Lines[i].Size > off })
+	if i < len(l.Lines) && l.Lines[i].Offset <= off && l.Lines[i].Size > 0 {
+		return l.Lines[i], true
+	}
+	return ListingLine{}, false
+}
+
+// Address is where the first code at or after line n of the assembled
+// file starts, and the line that code is on.
+func (l *Listing) Address(n int) (uint32, int, bool) {
+	best := -1
+	for i, ll := range l.Lines {
+		if ll.Level == 0 && ll.Line >= n && ll.Size > 0 && (best < 0 || ll.Line < l.Lines[best].Line) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, 0, false
+	}
+	return l.Base + l.Lines[best].Offset, l.Lines[best].Line, true
+}
+
+// Label is the label at the physical address addr, or "". Where several
+// name the same place, the first in alphabetical order wins.
+func (l *Listing) Label(addr uint32) string {
+	var found string
+	for name, off := range l.Labels {
+		if l.Base+off == addr && (found == "" || name < found) {
+			found = name
+		}
+	}
+	return found
+}
+
+// Nearest is the closest label at or before the physical address addr
+// and how far past it addr is.
+func (l *Listing) Nearest(addr uint32) (string, uint32, bool) {
+	var found string
+	var at uint32
+	for name, off := range l.Labels {
+		a := l.Base + off
+		if a <= addr && (found == "" || a > at || (a == at && name < found)) {
+			found, at = name, a
+		}
+	}
+	return found, addr - at, found != ""
+}
+
+// Describe is the source for the instruction at the physical address addr,
+// as line: source, or "" if the listing has none. Lines from macros and
+// includes have no line number that means anything here.
+func (l *Listing) Describe(addr uint32) string {
+	ll, ok := l.At(addr)
+	if !ok || ll.Offset != addr-l.Base {
+		return ""
+	}
+	if ll.Level > 0 {
+		return ll.Source
+	}
+	return fmt.Sprintf("%d: %s", ll.Line, ll.Source)
+}
+
+// ReadMap adds the symbols in a nasm map file to the labels. Map files
+// give addresses with the program's origin added, so it is taken off.
+func (l *Listing) ReadMap(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := l.parseMap(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (l *Listing) parseMap(r io.Reader) error {
+	if l.Labels == nil {
+		l.Labels = map[string]uint32{}
+	}
+	var origin uint64
+	var section string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(text, "-- "):
+			section = strings.Trim(text, "- ")
+			continue
+		case strings.HasPrefix(text, "---- "):
+			// The symbols of one section of the output.
+			continue
+		case text == "":
+			continue
+		}
+		fields := strings.Fields(text)
+		switch section {
+		case "Program origin":
+			v, err := strconv.ParseUint(fields[0], 16, 32)
+			if err != nil {
+				return fmt.Errorf("line %d has a bad origin %q", n, fields[0])
+			}
+			origin = v
+		case "Symbols":
+			if fields[0] == "Real" || len(fields) < 2 {
+				continue
+			}
+			real, err := strconv.ParseUint(fields[0], 16, 32)
+			if err != nil || real < origin {
+				return fmt.Errorf("line %d has a bad address %q", n, fields[0])
+			}
+			l.Labels[fields[len(fields)-1]] = uint32(real - origin)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// listLine formats a line of a nasm listing: its number, then the offset
+// and data columns when data isn't "", then the source.
+func listLine(n int, off uint32, data, source string) string {
+	if data == "" {
+		return fmt.Sprintf("%6d %-32s %s", n, "", source)
+	}
+	return fmt.Sprintf("%6d %08X %-23s %s", n, off, data, source)
+}
+
+// testListing has code, a macro, local labels, a times, data long enough
+// to carry on over two lines, reserved space, an equ and a label at the
+// end.
+var testListing = strings.Join([]string{
+	listLine(1, 0, "", "bits 16"),
+	listLine(2, 0, "", "count equ 3"),
+	listLine(3, 0, "", "%macro print 0"),
+	listLine(4, 0, "", "  mov ah, 9"),
+	listLine(5, 0, "", "%endmacro"),
+	listLine(6, 0, "", ""),
+	listLine(7, 0, "", "start:"),
+	listLine(8, 0, "B90300", "mov cx, count"),
+	listLine(9, 0, "", ".loop:"),
+	listLine(10, 3, "E2FE", "loop .loop ; spin"),
+	listLine(11, 5, "", "print"),
+	listLine(4, 5, "B409", "<1>  mov ah, 9"),
+	listLine(12, 7, "CD21", "int 21h"),
+	listLine(13, 9, "90<rep 3h>", "times 3 nop"),
+	listLine(14, 0xc, "48656C6C6F2C20776F-", "msg: db \"Hello, world\", 0"),
+	listLine(14, 0x15, "726C6400", ""),
+	listLine(15, 0x19, "<res 00000010>", "buf: resb 16"),
+	listLine(16, 0, "", ".end:"),
+}, "\n") + "\n"
+
+func TestParseListing(t *testing.T) {
+	l, err := parseListing(strings.NewReader(testListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Text) != 18 {
+		t.Errorf("kept %d lines of text, want 18", len(l.Text))
+	}
+	type line struct {
+		Line, Level  int
+		Offset, Size uint32
+		Code         bool
+		Source       string
+	}
+	var got []line
+	for _, ll := range l.Lines {
+		got = append(got, line{ll.Line, ll.Level, ll.Offset, ll.Size, ll.Code(), ll.Source})
+		if !strings.Contains(l.Text[ll.Index], ll.Source) {
+			t.Errorf("line %d has index %d, which is %q", ll.Line, ll.Index, l.Text[ll.Index])
+		}
+	}
+	want := []line{
+		{8, 0, 0x0, 3, true, "mov cx, count"},
+		{10, 0, 0x3, 2, true, "loop .loop ; spin"},
+		{4, 1, 0x5, 2, true, "mov ah, 9"},
+		{12, 0, 0x7, 2, true, "int 21h"},
+		{13, 0, 0x9, 3, true, "times 3 nop"},
+		{14, 0, 0xc, 13, false, `msg: db "Hello, world", 0`},
+		{15, 0, 0x19, 16, false, "buf: resb 16"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines are\n%v\nwant\n%v", got, want)
+	}
+
+	wantLabels := map[string]uint32{"start": 0, "start.loop": 3, "msg": 0xc, "buf": 0x19, "buf.end": 0x29}
+	if !reflect.DeepEqual(l.Labels, wantLabels) {
+		t.Errorf("labels are %v, want %v", l.Labels, wantLabels)
+	}
+}
+
+func TestListingLookups(t *testing.T) {
+	l, err := parseListing(strings.NewReader(testListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Base = 0x10100
+	l.Labels["begin"] = 0
+
+	for addr, want := range map[uint32]string{
+		0x10100: "8: mov cx, count",
+		0x10101: "", // inside the mov
+		0x10105: "mov ah, 9",
+		0x10107: "12: int 21h",
+		0x100ff: "",
+	} {
+		if got := l.Describe(addr); got != want {
+			t.Errorf("describe %#05x: %q, want %q", addr, got, want)
+		}
+	}
+	if ll, ok := l.At(0x10110); !ok || ll.Line != 14 {
+		t.Errorf("at 0x10110: line %d %t, want the data on line 14", ll.Line, ok)
+	}
+	for n, want := range map[int][2]uint32{1: {0x10100, 8}, 9: {0x10103, 10}, 11: {0x10107, 12}} {
+		if addr, line, ok := l.Address(n); !ok || addr != want[0] || uint32(line) != want[1] {
+			t.Errorf("line %d: %#05x line %d %t, want %#05x line %d", n, addr, line, ok, want[0], want[1])
+		}
+	}
+	if _, _, ok := l.Address(16); ok {
+		t.Error("found code after the last line")
+	}
+
+	// Of two labels at one place, the first alphabetically names it.
+	if got := l.Label(0x10100); got != "begin" {
+		t.Errorf("label at 0x10100 is %q", got)
+	}
+	if got := l.Label(0x10101); got != "" {
+		t.Errorf("label at 0x10101 is %q", got)
+	}
+	if name, off, ok := l.Nearest(0x10105); !ok || name != "start.loop" || off != 2 {
+		t.Errorf("nearest to 0x10105 is %s+%d %t", name, off, ok)
+	}
+	if _, _, ok := l.Nearest(0x100ff); ok {
+		t.Error("found a label before the program")
+	}
+}
+
+func TestParseListingErrors(t *testing.T) {
+	for _, c := range []struct {
+		text, want string
+	}{
+		{"  1", "too short"},
+		{strings.Repeat("x", 40), "doesn't start with a line number"},
+		{listLine(1, 0, "90", "nop")[:7] + "0000000G 90" + strings.Repeat(" ", 30) + "nop", "bad offset"},
+	} {
+		if _, err := parseListing(strings.NewReader(c.text)); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want an error saying %s", c.text, err, c.want)
+		}
+	}
+}
+
+const testMap = `
+- NASM Map file ---------------------------------------------------------------
+
+Source file:  prog.asm
+Output file:  prog.com
+
+-- Program origin -------------------------------------------------------------
+
+00000100
+
+-- Sections (summary) ---------------------------------------------------------
+
+Vstart            Start             Stop              Length    Class     Name
+             100               100               12A  0000002A  progbits  .text
+
+-- Symbols --------------------------------------------------------------------
+
+---- Section .text ------------------------------------------------------------
+
+Real              Virtual           Name
+             100               100  start
+             103               103  start.loop
+             10C               10C  msg
+`
+
+func TestParseMap(t *testing.T) {
+	l := &Listing{}
+	if err := l.parseMap(strings.NewReader(testMap)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint32{"start": 0, "start.loop": 3, "msg": 0xc}
+	if !reflect.DeepEqual(l.Labels, want) {
+		t.Errorf("labels are %v, want %v", l.Labels, want)
+	}
+
+	for _, c := range []struct {
+		text, want string
+	}{
+		{strings.Replace(testMap, "00000100", "zz", 1), `bad origin "zz"`},
+		{strings.Replace(testMap, "             10C               10C  msg", "              C                 C  msg", 1), `bad address "C"`},
+	} {
+		if err := (&Listing{}).parseMap(strings.NewReader(c.text)); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("got %v, want an error saying %s", err, c.want)
+		}
+	}
+}
+
+func TestFindListing(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	com := write("prog.com", "")
+	bin := write("other.bin", "")
+	write("prog.lst", testListing)
+	mapFile := write("prog.map", testMap)
+
+	l, err := findListing(com, "", "")
+	if err != nil || l == nil || l.Path != filepath.Join(dir, "prog.lst") {
+		t.Fatalf("found %+v, %v; want prog.lst", l, err)
+	}
+	if l, err := findListing(bin, "", ""); l != nil || err != nil {
+		t.Errorf("found %+v, %v for a program without a listing", l, err)
+	}
+	// A map file alone gives labels and no lines.
+	l, err = findListing(bin, "", mapFile)
+	if err != nil || l == nil || l.Text != nil || l.Labels["msg"] != 0xc {
+		t.Errorf("map alone gave %+v, %v", l, err)
+	}
+	if _, err := findListing(bin, filepath.Join(dir, "missing.lst"), ""); err == nil {
+		t.Error("read a missing listing")
+	}
+}
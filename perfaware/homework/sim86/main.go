@@ -2,464 +2,300 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sim86/instructions"
-	"sim86/registers"
-)
-
-type Instruction func(bytes []byte, byteReader *bufio.Reader) string
+	"strings"
 
-var instructionLookup = map[uint8]Instruction{
-	// Mov
-	0b10001000: regMemReg("mov"),
-	0b10001001: regMemReg("mov"),
-	0b10001010: regMemReg("mov"),
-	0b10001011: regMemReg("mov"),
-	0b10110000: immedToReg("mov"),
-	0b10110001: immedToReg("mov"),
-	0b10110010: immedToReg("mov"),
-	0b10110011: immedToReg("mov"),
-	0b10110100: immedToReg("mov"),
-	0b10110101: immedToReg("mov"),
-	0b10110110: immedToReg("mov"),
-	0b10110111: immedToReg("mov"),
-	0b10111000: immedToReg("mov"),
-	0b10111001: immedToReg("mov"),
-	0b10111010: immedToReg("mov"),
-	0b10111011: immedToReg("mov"),
-	0b10111100: immedToReg("mov"),
-	0b10111101: immedToReg("mov"),
-	0b10111110: immedToReg("mov"),
-	0b10111111: immedToReg("mov"),
-	0b11000110: immedtoRegMem("mov"),
-	0b11000111: immedtoRegMem("mov"),
-	0b10100000: memToAccAccToMem,
-	0b10100001: memToAccAccToMem,
-	0b10100010: memToAccAccToMem,
-	0b10100011: memToAccAccToMem,
-	// Add/Sub/Cmp
-	0b10000000: immedtoRegMem(""), // add,sub,cmp
-	0b10000001: immedtoRegMem(""), // add,sub,cmp
-	0b10000010: immedtoRegMem(""), // add,sub,cmp
-	0b10000011: immedtoRegMem(""), // add,sub,cmp
-	// Add
-	0b00000000: regMemReg("add"),
-	0b00000001: regMemReg("add"),
-	0b00000010: regMemReg("add"),
-	0b00000011: regMemReg("add"),
-	0b00000100: immedToReg("add"),
-	0b00000101: immedToReg("add"),
-	// Sub
-	0b00101000: regMemReg("sub"),
-	0b00101001: regMemReg("sub"),
-	0b00101010: regMemReg("sub"),
-	0b00101011: regMemReg("sub"),
-	0b00101100: immedToReg("sub"),
-	0b00101101: immedToReg("sub"),
-	// Cmp
-	0b00111000: regMemReg("cmp"),
-	0b00111001: regMemReg("cmp"),
-	0b00111010: regMemReg("cmp"),
-	0b00111011: regMemReg("cmp"),
-	0b00111100: immedToReg("cmp"),
-	0b00111101: immedToReg("cmp"),
-	// Jump
-	0b01110100: jump("je"),
-	0b01111100: jump("jl"),
-	0b01111110: jump("jle"),
-	0b01110010: jump("jb"),
-	0b01110110: jump("jbe"),
-	0b01111010: jump("jp"),
-	0b01110000: jump("jo"),
-	0b01111000: jump("js"),
-	0b01110101: jump("jne"),
-	0b01111101: jump("jnl"),
-	0b01111111: jump("jnle"),
-	0b01110011: jump("jnb"),
-	0b01110111: jump("jnbe"),
-	0b01111011: jump("jnp"),
-	0b01110001: jump("jno"),
-	0b01111001: jump("jns"),
-	0b11100010: jump("loop"),
-	0b11100001: jump("loopz"),
-	0b11100000: jump("loopnz"),
-	0b11100011: jump("jcxz"),
-}
+	"sim86/memory"
+	"sim86/sim"
+)
 
-func notImplemented(_ byte, _ *bufio.Reader) string {
-	return "\nnot implemented"
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: sim86 [flags] file [args]\n       sim86 debug [flags] file [args]\n       sim86 verify [flags]\n       sim86 diff [flags] a b\n       sim86 dap\n\n")
+	flag.PrintDefaults()
 }
 
-func regMemReg(mnemonic string) Instruction {
-	return func(bytes []byte, br *bufio.Reader) string {
-		var left string
-		var right string
-		b1 := bytes[0]
-		b2 := bytes[1]
-
-		byteOrWord := getBits(b1, 0, 0)
-		destination := getBits(b1, 1, 1)
-
-		reg := registers.Get(byteOrWord, getBits(b2, 3, 5))
-		left = reg.Name
-		right = handleModRegRm(byteOrWord, b2, br)
-
-		if destination == 0b0 {
-			temp := left
-			left = right
-			right = temp
-		}
-		return formatInst(mnemonic, left, right)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Stdout, os.Args[2:]))
 	}
-}
-
-func immedToReg(mnemonic string) Instruction {
-	return func(bytes []byte, br *bufio.Reader) string {
-		b1 := bytes[0]
-		b2 := bytes[1]
-		byteOrWord := getBits(b1, 3, 3)
-		regIdx := getBits(b1, 0, 2)
-		if mnemonic != "mov" {
-			byteOrWord = getBits(b1, 0, 0)
-			regIdx = 0b0
-		}
-		reg := registers.Get(byteOrWord, regIdx)
-
-		num := int16(int8(b2))
-		if byteOrWord == 0b1 {
-			b3, err := br.ReadByte()
-			if err != nil {
-				return fmt.Sprint(err)
-			}
-			num = int16(uint16(b3)<<8 | uint16(b2))
-		}
-		if mnemonic == "mov" {
-			reg.Put(uint16(num))
-		} else if mnemonic == "add" {
-			reg.Put(reg.Get() + uint16(num))
-		} else {
-			reg.Put(reg.Get() - uint16(num))
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(snapdiff(os.Stdout, os.Args[2:]))
+	}
+	// dap talks the Debug Adapter Protocol on stdin and stdout; the
+	// program and its settings come in the launch request.
+	if len(os.Args) > 1 && os.Args[1] == "dap" {
+		if err := serveDAP(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-
-		return formatInst(mnemonic, reg.Name, fmt.Sprint(num))
+		return
 	}
-}
-
-func jump(mnemonic string) Instruction {
-	return func(bytes []byte, br *bufio.Reader) string {
-		b2 := bytes[1]
-		num := int8(b2)
-		return fmt.Sprintf("\n%s %s", mnemonic, fmt.Sprint(num))
+	// debug takes the same flags as running a file does.
+	debugging := len(os.Args) > 1 && os.Args[1] == "debug"
+	if debugging {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
 	}
-}
-
-func immedtoRegMem(mnemonic string) Instruction {
-	return func(bytes []byte, br *bufio.Reader) string {
-		var left string
-		var right string
-		b1 := bytes[0]
-		b2 := bytes[1]
-
-		byteOrWord := getBits(b1, 0, 0)
-		signedExt := getBits(b1, 1, 1)
-		_, reg, _ := parseModRegRM(b2)
 
-		left = handleModRegRm(byteOrWord, b2, br)
-
-		var num int16
-		length := "byte"
-		bfirst, err := br.ReadByte()
-		if err != nil {
-			return fmt.Sprint(err)
-		}
-
-		num = int16(bfirst)
-		if byteOrWord == 0b1 && signedExt == 0b0 {
-			bsecond, err := br.ReadByte()
-			if err != nil {
-				return fmt.Sprint(err)
-			}
-
-			num = int16(bsecond)<<8 | num
-			length = "word"
-		}
-		_ = signedExt
-		right = fmt.Sprintf("%s %d", length, num)
+	exec := flag.Bool("exec", false, "execute the file instead of disassembling it")
+	showClocks := flag.Bool("showclocks", false, "print clock estimates while executing")
+	explainClocks := flag.Bool("explainclocks", false, "break clock estimates down into base, ea and penalty clocks")
+	is8088 := flag.Bool("8088", false, "estimate clocks for an 8088 instead of an 8086")
+	stopOnRet := flag.Bool("stoponret", false, "stop executing at the first ret")
+	noIP := flag.Bool("noip", false, "leave ip out of the trace")
+	showMemory := flag.Bool("showmem", false, "trace every memory read and write")
+	quiet := flag.Bool("quiet", false, "don't print the trace or final registers")
+	dos := flag.Bool("dos", false, "serve DOS int 20h and int 21h calls")
+	dosDir := flag.String("dosdir", ".", "directory DOS file calls are confined to")
+	format := flag.String("load", "", "how to load the file: raw, com, exe or boot (default: picked from the file's extension)")
+	drive := flag.Uint("drive", 0, "BIOS drive number boot code is started with")
+	debugPort := flag.Uint("debugport", 0, "port whose writes are printed, e.g. 0xe9 (default none)")
+	timer := flag.Bool("timer", false, "add an 8253 timer and 8259 interrupt controller at the PC's ports")
+	screen := flag.Bool("screen", false, "draw the CGA text screen at B800:0000 on the terminal as it changes")
+	screenFrames := flag.Uint("screenframes", 0, "frames to skip between screen redraws")
+	screenText := flag.String("screentext", "", "file to write the final CGA text screen to as plain text, - for stdout")
+	vga := flag.String("vga", "", "add VGA mode 13h and save the screen to `prefix`-0001.png and so on, at the end of the run unless -vgaevery or -vgaonhlt say when")
+	vgaEvery := flag.Uint("vgaevery", 0, "save a mode 13h snapshot every this many frames")
+	vgaOnHalt := flag.Bool("vgaonhlt", false, "save a mode 13h snapshot at every hlt")
+	var watches []sim.Watch
+	flag.Var(watchFlag{&watches, false, true}, "watch", "log writes to `addr[+len]`, a physical address or seg:off in hex and a length in bytes; repeatable")
+	flag.Var(watchFlag{&watches, true, false}, "rwatch", "log reads of `addr[+len]`")
+	flag.Var(watchFlag{&watches, true, true}, "awatch", "log reads and writes of `addr[+len]`")
+	var regions []memory.Region
+	flag.Var(regionFlag{&regions, memory.ROM}, "rom", "make `first-last`, physical addresses in hex, ROM that ignores writes; repeatable")
+	flag.Var(regionFlag{&regions, memory.ReadOnly}, "readonly", "make writes to `first-last` errors")
+	flag.Var(regionFlag{&regions, memory.Unmapped}, "unmapped", "leave nothing at `first-last`: reads give 0xff and writes are dropped")
+	memFault := flag.Bool("memfault", false, "make accesses to -unmapped memory errors instead")
+	journal := flag.Int("journal", 64, "MB of undo history the debugger keeps for reverse execution, 0 for none")
+	gdbAddr := flag.String("gdb", "", "serve gdb's remote protocol on `address`, host:port or unix:path, instead of running")
+	writeDisk := flag.Bool("writedisk", false, "let boot code write to the disk image instead of a copy of it")
+	listing := flag.String("listing", "", "nasm -l `listing` of the file, for source lines and labels (default: file.lst, if there is one)")
+	mapFile := flag.String("map", "", "nasm map `file` with more labels")
+	profile := flag.String("profile", "", "write a report of the clocks spent per instruction, basic block and loop to `file`, - for stdout")
+	pprof := flag.String("pprof", "", "write the profile to `file` for go tool pprof")
+	coverage := flag.String("coverage", "", "write the listing, or a disassembly, marked with what ran to `file`, - for stdout")
+	lcov := flag.String("lcov", "", "write coverage as an lcov tracefile to `file`, with the disassembly its lines are in beside it when there is no listing")
+	restore := flag.String("restore", "", "start from the machine snapshot in `file`, set up with the same device flags it was saved with; the program file may then be left out")
+	save := flag.String("save", "", "write a machine snapshot to `file` when the run stops")
+	stopAfter := flag.Uint64("stopafter", 0, "stop the run after `n` instructions")
+	at := flag.String("at", "0:0", "segment:offset raw files are loaded at and started from")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 && *restore == "" {
+		usage()
+		os.Exit(2)
+	}
 
-		if reg == 0b0 {
-			if mnemonic != "mov" {
-				mnemonic = "add"
-			}
-		} else if reg == 0b101 {
-			mnemonic = "sub"
-		} else if reg == 0b111 {
-			mnemonic = "cmp"
+	// A snapshot has the program in it already.
+	fileName, image := *restore, []byte(nil)
+	if flag.NArg() > 0 {
+		fileName = flag.Arg(0)
+		var err error
+		if image, err = os.ReadFile(fileName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-
-		return formatInst(mnemonic, left, right)
 	}
-}
 
-func memToAccAccToMem(bytes []byte, br *bufio.Reader) string {
-	b1 := bytes[0]
-	b2 := bytes[1]
-	memToAcc := getBits(b1, 1, 1) == 0b0
-	byteOrWord := getBits(b1, 0, 0)
-	regs := registers.Get(byteOrWord, 0b000).Name
-
-	b3, err := br.ReadByte()
+	if *format == "" {
+		*format = formatFor(fileName)
+	}
+	lst, err := findListing(fileName, *listing, *mapFile)
 	if err != nil {
-		return fmt.Sprint(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	dirAdd := uint16(b3)<<8 | uint16(b2)
-	left := regs
-	right := bracket(fmt.Sprint(dirAdd))
-	if !memToAcc {
-		return formatInst("mov", right, left)
+	stdin := bufio.NewReader(os.Stdin)
+	var args string
+	if flag.NArg() > 1 {
+		args = strings.Join(flag.Args()[1:], " ")
 	}
-	return formatInst("mov", left, right)
-
-}
-
-func main() {
-	fileName := os.Args[1]
-	file, err := os.Open(fileName)
+	loader, needsDOS, err := newLoader(*format, *at, uint8(*drive), args, os.Stderr)
 	if err != nil {
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	defer file.Close()
-
-	br := bufio.NewReader(file)
-	newfile := "bits 16\n"
-loop:
-	for {
-		b1, err := br.ReadByte()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			newfile += fmt.Sprintf("error parsing bytes 1: %v", err)
-			break
-		}
-		op := instructions.Parse(b1, br)
-		switch op.OpType {
-		case instructions.OpNone:
-			fmt.Printf("%b\n", b1)
-			fmt.Println("hit here")
-			break loop
-		case instructions.OpMov:
-			first := op.ValueTypes[0]
-			second := op.ValueTypes[1]
-			var loc1 *registers.Register
-			var loc2 *registers.Register
-			var value uint16
-			switch first {
-			case instructions.ValMemory:
-			case instructions.ValRegister:
-				if op.SR != nil {
-					loc1 = registers.GetSeg(op.SR.Value)
-				} else {
-
-					loc1 = registers.Get(op.W.Value, op.REG.Value)
-				}
-				switch second {
-				case instructions.ValImmediate:
-					if op.W.Value == 0 {
-						value = uint16(op.DATA_LO.Value)
-					} else {
-						value = uint16(op.DATA_HI.Value)<<8 | uint16(op.DATA_LO.Value)
-
-					}
-				case instructions.ValRegister:
-					switch op.MOD.Value {
-					case 0b11:
-						loc2 = registers.Get(op.W.Value, op.RM.Value)
-						if op.D.Value == 0 {
-							tmp := loc1
-							loc1 = loc2
-							loc2 = tmp
-						}
-						value = loc2.Get()
-					case 0b00:
-						// if regm == 0b110 {
-						// 	b3, err3 := br.ReadByte()
-						// 	b4, err4 := br.ReadByte()
-						// 	if err3 != nil || err4 != nil {
-						// 		return fmt.Sprintf("%v, %v", err3, err4)
-						// 	}
-						// 	dirAdd := fmt.Sprintf("%d", uint16(b4)<<8|uint16(b3))
-						//
-						// 	right = bracket(dirAdd)
-						// 	break
-						// }
-
-						// right =
-					case 0b01:
-						// b3, err := br.ReadByte()
-						// if err != nil {
-						// 	return fmt.Sprint(err)
-						// }
-						// displ := fmt.Sprint(int8(b3))
-						//
-						// right = bracket(regms + " + " + displ)
-					case 0b10:
-						// b3, err3 := br.ReadByte()
-						// b4, err4 := br.ReadByte()
-						// if err3 != nil || err4 != nil {
-						// 	return fmt.Sprintf("%v, %v", err3, err4)
-						// }
-						// displ := fmt.Sprintf("%d", int16(uint16(b4)<<8|uint16(b3)))
-						//
-						// right = bracket(regms + " + " + displ)
-					}
-				}
-			case instructions.ValNone:
-			case instructions.ValImmediate:
-
-			}
-			// fmt.Println(loc1.Name)
-			// fmt.Println(value)
-			loc1.Put(value)
+	*dos = *dos || needsDOS
+	var bios *sim.BIOS
+	if *format == "boot" {
+		bios = &sim.BIOS{Stdin: stdin, Stdout: os.Stdout, Disks: map[uint8]*sim.Disk{}}
+		// A bare boot sector has no disk behind it, only floppy images do.
+		if disk, err := sim.OpenDisk(fileName, *writeDisk); err == nil {
+			bios.Disks[uint8(*drive)] = disk
+			defer disk.Close()
+		} else if len(image) > sim.SectorSize {
+			fmt.Fprintf(os.Stderr, "warning: no disk for int 13h: %v\n", err)
 		}
-
 	}
-	registers.Print()
-	dir := filepath.Dir(fileName)
-	newFileName := filepath.Join(dir, "new"+filepath.Base(fileName)+".asm")
-	err = os.WriteFile(newFileName, ([]byte)(newfile), 0644)
-	if err != nil {
-		fmt.Println(err)
-	}
-}
 
-func parseModRegRM(b2 byte) (uint8, uint8, uint8) {
-	mod := getBits(b2, 6, 7)
-	reg := getBits(b2, 3, 5)
-	regm := getBits(b2, 0, 2)
-	return mod, reg, regm
-}
-func handleModRegRm(byteOrWord, b2 byte, br *bufio.Reader) string {
-	var right string
-	mod, _, regm := parseModRegRM(b2)
-	regms, okregm := regmField[regm]
-	if !okregm {
-		regms = "not found"
+	var d *sim.DOS
+	if *dos {
+		d = sim.NewDOS(*dosDir, stdin, os.Stdout)
+		defer d.Close()
 	}
-	switch mod {
-	case 0b11:
-		right = registers.Get(byteOrWord, regm).Name
-	case 0b00:
-		if regm == 0b110 {
-			b3, err3 := br.ReadByte()
-			b4, err4 := br.ReadByte()
-			if err3 != nil || err4 != nil {
-				return fmt.Sprintf("%v, %v", err3, err4)
-			}
-			dirAdd := fmt.Sprintf("%d", uint16(b4)<<8|uint16(b3))
 
-			right = bracket(dirAdd)
-			break
+	var liveScreen io.Writer
+	if *screen {
+		liveScreen = os.Stdout
+	}
+	// Reports go to files named by flags, or stdout for -.
+	var outputs []*os.File
+	defer func() {
+		for _, f := range outputs {
+			f.Close()
 		}
-
-		right = bracket(regms)
-	case 0b01:
-		b3, err := br.ReadByte()
+	}()
+	output := func(name string) io.Writer {
+		switch name {
+		case "":
+			return nil
+		case "-":
+			return os.Stdout
+		}
+		f, err := os.Create(name)
 		if err != nil {
-			return fmt.Sprint(err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		displ := fmt.Sprint(int8(b3))
+		outputs = append(outputs, f)
+		return f
+	}
 
-		right = bracket(regms + " + " + displ)
-	case 0b10:
-		b3, err3 := br.ReadByte()
-		b4, err4 := br.ReadByte()
-		if err3 != nil || err4 != nil {
-			return fmt.Sprintf("%v, %v", err3, err4)
-		}
-		displ := fmt.Sprintf("%d", int16(uint16(b4)<<8|uint16(b3)))
+	// Without a listing, lcov's lines are in a disassembly written beside
+	// the tracefile.
+	var lcovSource string
+	if *lcov != "" {
+		lcovSource = filepath.Join(filepath.Dir(*lcov), filepath.Base(fileName)+".dis")
+	}
 
-		right = bracket(regms + " + " + displ)
+	opt := options{
+		Is8088:        *is8088,
+		ShowBanner:    *showClocks,
+		ShowClocks:    *showClocks || *explainClocks,
+		ExplainClocks: *explainClocks,
+		ShowIP:        !*noIP,
+		ShowMemory:    *showMemory,
+		StopOnRet:     *stopOnRet,
+		Quiet:         *quiet,
+		Loader:        loader,
+		DOS:           d,
+		BIOS:          bios,
+		DebugPort:     uint16(*debugPort),
+		Timer:         *timer,
+		Screen:        liveScreen,
+		ScreenFrames:  uint32(*screenFrames),
+		ScreenText:    output(*screenText),
+		VGA:           *vga,
+		VGAEvery:      uint32(*vgaEvery),
+		VGAOnHalt:     *vgaOnHalt,
+		Watches:       watches,
+		Regions:       regions,
+		MemFault:      *memFault,
+		Journal:       *journal << 20,
+		Listing:       lst,
+		Program:       fileName,
+		Profile:       output(*profile),
+		PProf:         output(*pprof),
+		Coverage:      output(*coverage),
+		LCOV:          output(*lcov),
+		LCOVSource:    lcovSource,
+		Restore:       *restore,
+		Save:          *save,
+		StopAfter:     *stopAfter,
+	}
+	switch {
+	case debugging:
+		err = debug(os.Stdout, stdin, image, opt)
+	case *gdbAddr != "":
+		err = serveGDB(os.Stdout, *gdbAddr, image, opt)
+	case *exec:
+		err = simulate(os.Stdout, fileName, image, opt)
+	default:
+		err = disassemble(os.Stdout, fileName, image, options{Loader: loader, Listing: lst})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if d != nil && d.ExitCode != 0 {
+		d.Close()
+		os.Exit(int(d.ExitCode))
 	}
-	return right
 }
 
-var regmField = map[uint8]string{
-	0b000: "bx + si",
-	0b001: "bx + di",
-	0b010: "bp + si",
-	0b011: "bp + di",
-	0b100: "si",
-	0b101: "di",
-	0b110: "bp",
-	0b111: "bx",
+// formatFor picks how to load a file from its extension: raw, com, exe
+// or boot.
+func formatFor(fileName string) string {
+	switch ext := strings.ToLower(filepath.Ext(fileName)); ext {
+	case ".com", ".exe":
+		return ext[1:]
+	case ".img":
+		return "boot"
+	}
+	return "raw"
 }
 
-func getBits(b byte, start, end uint8) uint8 {
-	if start > end || end >= 8 {
-		panic("Invalid start or end position")
+// newLoader makes the loader for format. at is the hex seg:off raw images
+// go to, drive the boot drive and args the command tail. It also reports
+// whether the program needs DOS, since DOS programs can't do anything
+// useful without it.
+func newLoader(format, at string, drive uint8, args string, warn io.Writer) (sim.Loader, bool, error) {
+	switch format {
+	case "raw":
+		var seg, off uint16
+		if _, err := fmt.Sscanf(at, "%x:%x", &seg, &off); err != nil {
+			return nil, false, fmt.Errorf("bad load address %q, want hex segment:offset", at)
+		}
+		return sim.RawLoader{Seg: seg, Off: off}, false, nil
+	case "com":
+		return sim.COMLoader{Seg: sim.COMDefaultSegment, Args: args}, true, nil
+	case "exe":
+		return sim.EXELoader{Seg: sim.COMDefaultSegment, Args: args}, true, nil
+	case "boot":
+		return sim.BootLoader{Drive: drive, Warn: warn}, false, nil
 	}
-	width := end - start + 1
-
-	mask := uint8((1 << width) - 1)
-
-	return (b >> start) & mask
+	return nil, false, fmt.Errorf("unknown load format %q", format)
 }
 
-func bracket(s string) string {
-	return fmt.Sprintf("[%s]", s)
+// watchFlag collects watchpoints from repeated -watch, -rwatch or -awatch
+// flags.
+type watchFlag struct {
+	watches     *[]sim.Watch
+	read, write bool
 }
 
-func printB(b byte) {
-	fmt.Printf("%b\n", b)
+func (f watchFlag) String() string {
+	return ""
 }
 
-func formatInst(inst, left, right string) string {
-	return fmt.Sprintf(
-		"\n%s %s, %s",
-		inst,
-		left,
-		right,
-	)
-}
-func oldMain() {
-	fileName := os.Args[1]
-	file, err := os.Open(fileName)
+func (f watchFlag) Set(spec string) error {
+	w, err := sim.ParseWatch(spec, f.read, f.write)
 	if err != nil {
-		return
+		return err
 	}
-	defer file.Close()
+	*f.watches = append(*f.watches, w)
+	return nil
+}
 
-	br := bufio.NewReader(file)
-	newfile := "bits 16\n"
+// regionFlag collects memory regions of one mode from repeated -rom,
+// -readonly or -unmapped flags.
+type regionFlag struct {
+	regions *[]memory.Region
+	mode    memory.Mode
+}
 
-	for {
-		b1, err1 := br.ReadByte()
-		b2, err2 := br.ReadByte()
-		if err1 != nil || err2 != nil {
-			if err1 == io.EOF {
-				break
-			}
-			newfile += fmt.Sprintf("error parsing bytes 1&2: %v, %v", err1, err2)
-			break
-		}
+func (f regionFlag) String() string {
+	return ""
+}
 
-		opInst, ok := instructionLookup[b1]
-		if ok {
-			inst := opInst([]byte{b1, b2}, br)
-			fmt.Print(inst)
-			newfile += inst
-		}
-	}
-	fmt.Println()
-	registers.Print()
-	dir := filepath.Dir(fileName)
-	newFileName := filepath.Join(dir, "new"+filepath.Base(fileName)+".asm")
-	err = os.WriteFile(newFileName, ([]byte)(newfile), 0644)
-	if err != nil {
-		fmt.Println(err)
+func (f regionFlag) Set(spec string) error {
+	var first, last uint32
+	if _, err := fmt.Sscanf(spec, "%x-%x", &first, &last); err != nil {
+		return fmt.Errorf("bad region %q, want first-last in hex", spec)
 	}
+	*f.regions = append(*f.regions, memory.Region{First: first, Last: last, Mode: f.mode})
+	return nil
 }
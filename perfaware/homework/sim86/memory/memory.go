@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"io"
+)
+
+// Size is the 8086's 20-bit physical address space.
+const Size = 1 << 20
+
+const addressMask = Size - 1
+
+// Memory is one machine's main memory. Every simulated machine owns its
+// own instance; nothing in here is global.
+//
+// It is all RAM until regions are mapped over parts of it.
+type Memory struct {
+	bytes []byte
+
+	// Policy is what accessing Unmapped regions does.
+	Policy UnmappedPolicy
+
+	regions []Region
+	paged   [Size >> pageShift]bool // pages with a region in them
+	err     error
+}
+
+func New() *Memory {
+	return &Memory{bytes: make([]byte, Size)}
+}
+
+// Address converts a segment:offset pair to a physical address, wrapping
+// at 1MB like the 8086 does.
+func Address(seg, off uint16) uint32 {
+	return (uint32(seg)<<4 + uint32(off)) & addressMask
+}
+
+func (m *Memory) Get(addr uint32) uint8 {
+	addr &= addressMask
+	if m.paged[addr>>pageShift] {
+		return m.getMapped(addr)
+	}
+	return m.bytes[addr]
+}
+
+func (m *Memory) Put(addr uint32, val uint8) {
+	addr &= addressMask
+	if m.paged[addr>>pageShift] {
+		m.putMapped(addr, val)
+		return
+	}
+	m.bytes[addr] = val
+}
+
+// Peek reads the RAM at addr, going around any region there and without
+// setting off its callbacks. It is for looking at memory, not executing.
+func (m *Memory) Peek(addr uint32) uint8 {
+	return m.bytes[addr&addressMask]
+}
+
+// GetWord reads a little-endian word at seg:off. The high byte wraps
+// around within the segment when off is 0xFFFF.
+func (m *Memory) GetWord(seg, off uint16) uint16 {
+	lo := m.Get(Address(seg, off))
+	hi := m.Get(Address(seg, off+1))
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+func (m *Memory) PutWord(seg, off, val uint16) {
+	m.Put(Address(seg, off), uint8(val))
+	m.Put(Address(seg, off+1), uint8(val>>8))
+}
+
+// Poke is Peek's counterpart: it writes the RAM at addr no matter what is
+// mapped there.
+func (m *Memory) Poke(addr uint32, val uint8) {
+	m.bytes[addr&addressMask] = val
+}
+
+// Load copies r into memory starting at addr and returns how many bytes
+// were read. Anything past the end of the address space is discarded.
+// It fills the RAM under any regions, which is how ROMs get their
+// contents.
+func (m *Memory) Load(r io.Reader, addr uint32) (int, error) {
+	n, err := io.ReadFull(r, m.bytes[addr&addressMask:])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// WriteTo writes all of RAM to w, as it is under any regions. Load at 0
+// puts it back.
+func (m *Memory) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m.bytes)
+	return int64(n), err
+}
+
+// Reader returns an io.ByteReader that walks memory from seg:off,
+// wrapping within the segment. It is what the decoder fetches from.
+func (m *Memory) Reader(seg, off uint16) *Reader {
+	return &Reader{mem: m, Seg: seg, Off: off}
+}
+
+// PeekReader is a Reader that reads with Peek, for disassembling without
+// touching devices.
+func (m *Memory) PeekReader(seg, off uint16) *Reader {
+	return &Reader{mem: m, Seg: seg, Off: off, peek: true}
+}
+
+type Reader struct {
+	mem  *Memory
+	Seg  uint16
+	Off  uint16
+	peek bool
+}
+
+func (r *Reader) ReadByte() (byte, error) {
+	addr := Address(r.Seg, r.Off)
+	r.Off++
+	if r.peek {
+		return r.mem.Peek(addr), nil
+	}
+	b := r.mem.Get(addr)
+	return b, r.mem.err
+}
@@ -0,0 +1,211 @@
+package memory
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Mode says what a region does with reads and writes.
+type Mode int
+
+const (
+	// ROM reads like RAM and silently ignores writes.
+	ROM Mode = iota
+	// ReadOnly reads like RAM, and writing it is an error.
+	ReadOnly
+	// WriteOnly takes writes, and reading it is an error.
+	WriteOnly
+	// Callback hands every read and write to the region's functions.
+	Callback
+	// Unmapped has nothing behind it. Accesses follow the memory's
+	// UnmappedPolicy.
+	Unmapped
+)
+
+var modeNames = [...]string{"rom", "read-only", "write-only", "callback", "unmapped"}
+
+func (m Mode) String() string {
+	if int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Region covers First through Last, inclusive, with something other than
+// plain RAM. Read and Write receive physical addresses. They are required
+// for Callback regions; elsewhere a nil Read or Write falls back to the
+// RAM underneath.
+type Region struct {
+	First, Last uint32
+	Mode        Mode
+	Read        func(addr uint32) uint8
+	Write       func(addr uint32, val uint8)
+}
+
+// UnmappedPolicy is what accessing an Unmapped region does.
+type UnmappedPolicy int
+
+const (
+	// OpenBus reads 0xFF, what a PC's floating data bus returns, and drops
+	// writes.
+	OpenBus UnmappedPolicy = iota
+	// Fault makes the access an error.
+	Fault
+)
+
+// AccessError is an access a region refused.
+type AccessError struct {
+	Addr  uint32
+	Write bool
+	Mode  Mode
+}
+
+func (e AccessError) Error() string {
+	if e.Write {
+		return fmt.Sprintf("write to %s memory at 0x%05x", e.Mode, e.Addr)
+	}
+	return fmt.Sprintf("read from %s memory at 0x%05x", e.Mode, e.Addr)
+}
+
+// Regions are looked up through 4K pages so that memory without any stays
+// a plain slice index.
+const pageShift = 12
+
+// Map puts r over the address space. Regions can't overlap.
+func (m *Memory) Map(r Region) error {
+	if r.Last < r.First || r.Last >= Size {
+		return fmt.Errorf("memory region 0x%05x-0x%05x is out of range", r.First, r.Last)
+	}
+	if r.Mode == Callback && (r.Read == nil || r.Write == nil) {
+		return fmt.Errorf("callback region 0x%05x-0x%05x needs both Read and Write", r.First, r.Last)
+	}
+	for _, o := range m.regions {
+		if r.First <= o.Last && o.First <= r.Last {
+			return fmt.Errorf("memory 0x%05x-0x%05x overlaps %s region 0x%05x-0x%05x", r.First, r.Last, o.Mode, o.First, o.Last)
+		}
+	}
+	m.regions = append(m.regions, r)
+	sort.Slice(m.regions, func(i, j int) bool { return m.regions[i].First < m.regions[j].First })
+	for p := r.First >> pageShift; p <= r.Last>>pageShift; p++ {
+		m.paged[p] = true
+	}
+	return nil
+}
+
+// MapROM, MapReadOnly and MapUnmapped are shorthands for Map.
+func (m *Memory) MapROM(first, last uint32) error {
+	return m.Map(Region{First: first, Last: last, Mode: ROM})
+}
+
+func (m *Memory) MapReadOnly(first, last uint32) error {
+	return m.Map(Region{First: first, Last: last, Mode: ReadOnly})
+}
+
+func (m *Memory) MapUnmapped(first, last uint32) error {
+	return m.Map(Region{First: first, Last: last, Mode: Unmapped})
+}
+
+// Unmap removes the region covering addr, leaving the RAM underneath as
+// the region last saw it. It reports whether there was one.
+func (m *Memory) Unmap(addr uint32) bool {
+	i := m.regionIndex(addr)
+	if i < 0 {
+		return false
+	}
+	first, last := m.regions[i].First>>pageShift, m.regions[i].Last>>pageShift
+	m.regions = slices.Delete(m.regions, i, i+1)
+	for p := first; p <= last; p++ {
+		m.paged[p] = false
+	}
+	// Pages the removed region shared with its neighbors still have them.
+	for _, o := range m.regions {
+		for p := max(first, o.First>>pageShift); p <= min(last, o.Last>>pageShift); p++ {
+			m.paged[p] = true
+		}
+	}
+	return true
+}
+
+// Regions lists what has been mapped, in address order.
+func (m *Memory) Regions() []Region {
+	return slices.Clone(m.regions)
+}
+
+// Err is the first access a region refused since the last ClearErr. Get
+// and Put can't fail, so the machine checks this after each instruction.
+func (m *Memory) Err() error {
+	return m.err
+}
+
+func (m *Memory) ClearErr() {
+	m.err = nil
+}
+
+func (m *Memory) fault(addr uint32, write bool, mode Mode) {
+	if m.err == nil {
+		m.err = AccessError{Addr: addr, Write: write, Mode: mode}
+	}
+}
+
+// regionIndex is the index of the region covering addr, or -1.
+func (m *Memory) regionIndex(addr uint32) int {
+	i := sort.Search(len(m.regions), func(i int) bool { return m.regions[i].Last >= addr })
+	if i < len(m.regions) && m.regions[i].First <= addr {
+		return i
+	}
+	return -1
+}
+
+func (m *Memory) region(addr uint32) *Region {
+	if i := m.regionIndex(addr); i >= 0 {
+		return &m.regions[i]
+	}
+	return nil
+}
+
+func (m *Memory) getMapped(addr uint32) uint8 {
+	r := m.region(addr)
+	if r == nil {
+		return m.bytes[addr]
+	}
+	switch r.Mode {
+	case WriteOnly:
+		m.fault(addr, false, r.Mode)
+		return 0xff
+	case Unmapped:
+		if m.Policy == Fault {
+			m.fault(addr, false, r.Mode)
+		}
+		return 0xff
+	}
+	if r.Read != nil {
+		return r.Read(addr)
+	}
+	return m.bytes[addr]
+}
+
+func (m *Memory) putMapped(addr uint32, val uint8) {
+	r := m.region(addr)
+	if r == nil {
+		m.bytes[addr] = val
+		return
+	}
+	switch r.Mode {
+	case ROM:
+		return
+	case ReadOnly:
+		m.fault(addr, true, r.Mode)
+		return
+	case Unmapped:
+		if m.Policy == Fault {
+			m.fault(addr, true, r.Mode)
+		}
+		return
+	}
+	if r.Write != nil {
+		r.Write(addr, val)
+		return
+	}
+	m.bytes[addr] = val
+}
@@ -0,0 +1,141 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegions(t *testing.T) {
+	const addr = 0x10010
+	for _, c := range []struct {
+		name   string
+		region Region
+		policy UnmappedPolicy
+		// read is what Get returns after Put(addr, 0x42) over RAM holding
+		// 0x11, and ram what is then in the RAM.
+		read, ram      uint8
+		putErr, getErr bool
+	}{
+		{name: "rom", region: Region{Mode: ROM}, read: 0x11, ram: 0x11},
+		{name: "read-only", region: Region{Mode: ReadOnly}, read: 0x11, ram: 0x11, putErr: true},
+		{name: "write-only", region: Region{Mode: WriteOnly}, read: 0xff, ram: 0x42, getErr: true},
+		{name: "unmapped open bus", region: Region{Mode: Unmapped}, read: 0xff, ram: 0x11},
+		{name: "unmapped fault", region: Region{Mode: Unmapped}, policy: Fault, read: 0xff, ram: 0x11, putErr: true, getErr: true},
+		{name: "callback", read: 0x43, ram: 0x42, region: Region{Mode: Callback}},
+		{name: "rom with read hook", read: 0x99, ram: 0x11, region: Region{Mode: ROM, Read: func(uint32) uint8 { return 0x99 }}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := New()
+			m.Policy = c.policy
+			m.Poke(addr, 0x11)
+			r := c.region
+			r.First, r.Last = 0x10000, 0x1ffff
+			if r.Mode == Callback {
+				r.Read = func(a uint32) uint8 { return m.Peek(a) + 1 }
+				r.Write = func(a uint32, v uint8) { m.Poke(a, v) }
+			}
+			if err := m.Map(r); err != nil {
+				t.Fatal(err)
+			}
+
+			m.Put(addr, 0x42)
+			if err := m.Err(); (err != nil) != c.putErr {
+				t.Errorf("put: got error %v, want one %t", err, c.putErr)
+			} else if err != nil {
+				var ae AccessError
+				if !errors.As(err, &ae) || ae.Addr != addr || !ae.Write || ae.Mode != r.Mode {
+					t.Errorf("put: got %#v", err)
+				}
+			}
+			m.ClearErr()
+			if got := m.Get(addr); got != c.read {
+				t.Errorf("read %#02x, want %#02x", got, c.read)
+			}
+			if err := m.Err(); (err != nil) != c.getErr {
+				t.Errorf("get: got error %v, want one %t", err, c.getErr)
+			}
+			if got := m.Peek(addr); got != c.ram {
+				t.Errorf("RAM holds %#02x, want %#02x", got, c.ram)
+			}
+
+			// Memory next to the region is plain RAM.
+			m.ClearErr()
+			m.Put(0x20000, 0x77)
+			if got := m.Get(0x20000); got != 0x77 || m.Err() != nil {
+				t.Errorf("RAM after the region read %#02x, error %v", got, m.Err())
+			}
+		})
+	}
+}
+
+func TestFaultKeepsFirst(t *testing.T) {
+	m := New()
+	m.MapReadOnly(0x100, 0x1ff)
+	m.Put(0x100, 1)
+	m.Put(0x180, 1)
+	var ae AccessError
+	if !errors.As(m.Err(), &ae) || ae.Addr != 0x100 {
+		t.Errorf("got %v, want the write to 0x00100", m.Err())
+	}
+	if want := "write to read-only memory at 0x00100"; m.Err().Error() != want {
+		t.Errorf("got %q, want %q", m.Err(), want)
+	}
+}
+
+func TestMapErrors(t *testing.T) {
+	m := New()
+	if err := m.MapROM(0x1000, 0x1fff); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		r    Region
+	}{
+		{"backwards", Region{First: 0x3000, Last: 0x2fff}},
+		{"past the end", Region{First: 0xff000, Last: Size}},
+		{"overlap", Region{First: 0x1fff, Last: 0x2fff}},
+		{"callback without functions", Region{First: 0x3000, Last: 0x3fff, Mode: Callback}},
+	} {
+		if err := m.Map(c.r); err == nil {
+			t.Errorf("%s: mapped %+v", c.name, c.r)
+		}
+	}
+}
+
+func TestUnmap(t *testing.T) {
+	m := New()
+	// Two regions sharing the page at 0x1000.
+	if err := m.MapROM(0x0800, 0x17ff); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MapUnmapped(0x1800, 0x2fff); err != nil {
+		t.Fatal(err)
+	}
+
+	regions := m.Regions()
+	if len(regions) != 2 || regions[0].Mode != ROM || regions[1].Mode != Unmapped {
+		t.Fatalf("regions are %+v", regions)
+	}
+	regions[0].Mode = Callback
+	if m.Regions()[0].Mode != ROM {
+		t.Error("changing what Regions returned changed the memory's regions")
+	}
+
+	if !m.Unmap(0x1000) {
+		t.Fatal("nothing unmapped at 0x01000")
+	}
+	if m.Unmap(0x1000) {
+		t.Error("unmapped 0x01000 twice")
+	}
+	m.Put(0x1000, 0x42)
+	if got := m.Get(0x1000); got != 0x42 {
+		t.Errorf("unmapped ROM reads %#02x after a write, want 0x42", got)
+	}
+	// The region sharing the page is still there.
+	if got := m.Get(0x1800); got != 0xff {
+		t.Errorf("unmapped region reads %#02x, want 0xff", got)
+	}
+	if rs := m.Regions(); len(rs) != 1 || rs[0].First != 0x1800 {
+		t.Errorf("regions left are %+v", rs)
+	}
+}
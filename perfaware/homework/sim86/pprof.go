@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// WritePProf writes the profile as a gzipped profile.proto, the format
+// go tool pprof reads. Each instruction is a location with two values,
+// times executed and clocks, the worst case where estimates are ranges.
+// Functions are the listing's labels, each instruction counting toward
+// the one before it, or the instructions themselves where there is no
+// label before them.
+func (p *Profile) WritePProf(w io.Writer, program string, l *Listing) error {
+	pb := &protoBuffer{strings: map[string]int64{"": 0}, table: []string{""}}
+
+	valueType := func(field int, typ, unit string) {
+		pb.message(field, func() {
+			pb.int(1, pb.string(typ))
+			pb.int(2, pb.string(unit))
+		})
+	}
+	valueType(1, "instructions", "count")
+	valueType(1, "clocks", "count")
+
+	instrs := p.sorted()
+	for i, in := range instrs {
+		pb.message(2, func() {
+			pb.packed(1, []uint64{uint64(i + 1)})
+			pb.packed(2, []uint64{in.Count, in.Clocks.Max})
+		})
+	}
+
+	pb.message(3, func() {
+		pb.uint(1, 1)
+		pb.uint(3, 0x100000)
+		pb.int(5, pb.string(program))
+		pb.uint(7, 1) // has_functions
+		pb.uint(9, 1) // has_line_numbers
+	})
+
+	functions := map[string]uint64{}
+	var names []string
+	for i, in := range instrs {
+		name := fmt.Sprintf("%s %s", in.At, in.Op)
+		if l != nil {
+			if label, _, ok := l.Nearest(in.Address); ok {
+				name = label
+			}
+		}
+		id, ok := functions[name]
+		if !ok {
+			id = uint64(len(names) + 1)
+			functions[name] = id
+			names = append(names, name)
+		}
+		line := int64(0)
+		if l != nil {
+			if ll, ok := l.At(in.Address); ok && ll.Level == 0 {
+				line = int64(ll.Line)
+			}
+		}
+		pb.message(4, func() {
+			pb.uint(1, uint64(i+1))
+			pb.uint(2, 1)
+			pb.uint(3, uint64(in.Address))
+			pb.message(4, func() {
+				pb.uint(1, id)
+				pb.int(2, line)
+			})
+		})
+	}
+	for i, name := range names {
+		pb.message(5, func() {
+			pb.uint(1, uint64(i+1))
+			pb.int(2, pb.string(name))
+			pb.int(3, pb.string(name))
+			pb.int(4, pb.string(program))
+		})
+	}
+
+	// The string table goes last, once everything has added its strings.
+	defaultType := pb.string("clocks")
+	for _, s := range pb.table {
+		pb.bytes(6, []byte(s))
+	}
+	pb.int(14, defaultType)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(pb.buf); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protoBuffer encodes the protocol buffer wire format, only as much of it
+// as a profile needs.
+type protoBuffer struct {
+	buf     []byte
+	strings map[string]int64
+	table   []string
+}
+
+func (pb *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		pb.buf = append(pb.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	pb.buf = append(pb.buf, byte(x))
+}
+
+func (pb *protoBuffer) key(field, wireType int) {
+	pb.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// uint and int leave out zeros, which are the default.
+func (pb *protoBuffer) uint(field int, x uint64) {
+	if x != 0 {
+		pb.key(field, 0)
+		pb.varint(x)
+	}
+}
+
+func (pb *protoBuffer) int(field int, x int64) {
+	pb.uint(field, uint64(x))
+}
+
+func (pb *protoBuffer) bytes(field int, b []byte) {
+	pb.key(field, 2)
+	pb.varint(uint64(len(b)))
+	pb.buf = append(pb.buf, b...)
+}
+
+func (pb *protoBuffer) packed(field int, xs []uint64) {
+	var inner protoBuffer
+	for _, x := range xs {
+		inner.varint(x)
+	}
+	pb.bytes(field, inner.buf)
+}
+
+// message encodes what body adds as an embedded message.
+func (pb *protoBuffer) message(field int, body func()) {
+	outer := pb.buf
+	pb.buf = nil
+	body()
+	inner := pb.buf
+	pb.buf = outer
+	pb.bytes(field, inner)
+}
+
+// string is s's index in the string table.
+func (pb *protoBuffer) string(s string) int64 {
+	i, ok := pb.strings[s]
+	if !ok {
+		i = int64(len(pb.table))
+		pb.strings[s] = i
+		pb.table = append(pb.table, s)
+	}
+	return i
+}
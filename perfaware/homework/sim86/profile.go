@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"sim86/instructions"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// Profile counts how often each instruction ran and the clocks estimated
+// for it, and puts the instructions together into basic blocks and loops
+// for the report.
+//
+// Blocks and loops come from the flow seen while running, not from the
+// code: a block starts wherever control arrived other than by falling
+// through, and after any instruction that can send it elsewhere. A
+// backward jump that was taken closes a loop from its target to itself.
+type Profile struct {
+	Instructions uint64
+	Clocks       profileClocks
+
+	instrs  map[uint32]*profiledInstruction
+	leaders map[uint32]bool
+	// backEdges count taken backward jumps by where they jumped from and
+	// to.
+	backEdges map[[2]uint32]uint64
+}
+
+// profileClocks is a total of clock estimates, which are ranges for some
+// instructions.
+type profileClocks struct {
+	Min, Max uint64
+}
+
+func (c *profileClocks) add(o profileClocks) {
+	c.Min += o.Min
+	c.Max += o.Max
+}
+
+// more orders totals by their worst case, then their best.
+func (c profileClocks) more(o profileClocks) bool {
+	return c.Max > o.Max || (c.Max == o.Max && c.Min > o.Min)
+}
+
+func (c profileClocks) String() string {
+	if c.Min != c.Max {
+		return fmt.Sprintf("[%d,%d]", c.Min, c.Max)
+	}
+	return fmt.Sprint(c.Min)
+}
+
+type profiledInstruction struct {
+	Address uint32
+	At      address
+	Op      instructions.Operation
+	Count   uint64
+	Clocks  profileClocks
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		instrs:    map[uint32]*profiledInstruction{},
+		leaders:   map[uint32]bool{},
+		backEdges: map[[2]uint32]uint64{},
+	}
+}
+
+// Record adds an executed instruction. next is where execution went on
+// from it.
+func (p *Profile) Record(ex sim.Exec, next uint32) {
+	in := p.instrs[ex.Address]
+	if in == nil {
+		in = &profiledInstruction{
+			Address: ex.Address,
+			At:      address{ex.Before.Get(&registers.CS), ex.Before.Get(&registers.IP)},
+			Op:      ex.Op,
+		}
+		p.instrs[ex.Address] = in
+		if len(p.instrs) == 1 {
+			p.leaders[ex.Address] = true
+		}
+	}
+	c := profileClocks{uint64(ex.Clocks.Min), uint64(ex.Clocks.Max)}
+	in.Count++
+	in.Clocks.add(c)
+	p.Instructions++
+	p.Clocks.add(c)
+
+	if next != ex.Address+uint32(ex.Op.Size) {
+		p.leaders[next] = true
+		if jumps(ex.Op.OpType) && next <= ex.Address {
+			p.backEdges[[2]uint32{ex.Address, next}]++
+		}
+	}
+}
+
+// jumps is whether t is a jump, conditional or not, as opposed to a call,
+// return or interrupt.
+func jumps(t instructions.OpType) bool {
+	return t == instructions.OpJmp || conditionalJump(t)
+}
+
+// conditionalJump is whether t may or may not jump depending on the flags
+// or cx.
+func conditionalJump(t instructions.OpType) bool {
+	switch t {
+	case instructions.OpJe, instructions.OpJl, instructions.OpJle, instructions.OpJb,
+		instructions.OpJbe, instructions.OpJp, instructions.OpJo, instructions.OpJs,
+		instructions.OpJne, instructions.OpJnl, instructions.OpJg, instructions.OpJnb,
+		instructions.OpJa, instructions.OpJnp, instructions.OpJno, instructions.OpJns,
+		instructions.OpLoop, instructions.OpLoopz, instructions.OpLoopnz, instructions.OpJcxz:
+		return true
+	}
+	return false
+}
+
+// transfers is whether t can send control somewhere other than the next
+// instruction.
+func transfers(t instructions.OpType) bool {
+	switch t {
+	case instructions.OpCall, instructions.OpRet, instructions.OpRetf, instructions.OpInt,
+		instructions.OpInt3, instructions.OpInto, instructions.OpIret, instructions.OpHlt:
+		return true
+	}
+	return jumps(t)
+}
+
+// sorted is the executed instructions in address order.
+func (p *Profile) sorted() []*profiledInstruction {
+	instrs := make([]*profiledInstruction, 0, len(p.instrs))
+	for _, in := range p.instrs {
+		instrs = append(instrs, in)
+	}
+	sort.Slice(instrs, func(i, j int) bool { return instrs[i].Address < instrs[j].Address })
+	return instrs
+}
+
+// profileBlock is a basic block: instructions that always run one after
+// the other.
+type profileBlock struct {
+	Instrs []*profiledInstruction
+	Count  uint64
+	Clocks profileClocks
+}
+
+func (p *Profile) blocks() []*profileBlock {
+	var blocks []*profileBlock
+	var prev *profiledInstruction
+	for _, in := range p.sorted() {
+		if prev == nil || p.leaders[in.Address] || transfers(prev.Op.OpType) ||
+			prev.Address+uint32(prev.Op.Size) != in.Address {
+			blocks = append(blocks, &profileBlock{Count: in.Count})
+		}
+		b := blocks[len(blocks)-1]
+		b.Instrs = append(b.Instrs, in)
+		b.Clocks.add(in.Clocks)
+		prev = in
+	}
+	return blocks
+}
+
+// profileLoop is the code from a loop's header, where its backward jumps
+// go, to the last of them, its latch.
+type profileLoop struct {
+	Header, Latch *profiledInstruction
+	// Iterations is how often a backward jump went round again.
+	Iterations uint64
+	Clocks     profileClocks
+}
+
+func (p *Profile) loops() []*profileLoop {
+	byHeader := map[uint32]*profileLoop{}
+	for edge, taken := range p.backEdges {
+		from, to := p.instrs[edge[0]], edge[1]
+		l := byHeader[to]
+		if l == nil {
+			if p.instrs[to] == nil {
+				// The run ended before getting there.
+				continue
+			}
+			l = &profileLoop{Header: p.instrs[to], Latch: from}
+			byHeader[to] = l
+		}
+		if from.Address > l.Latch.Address {
+			l.Latch = from
+		}
+		l.Iterations += taken
+	}
+	loops := make([]*profileLoop, 0, len(byHeader))
+	instrs := p.sorted()
+	for _, l := range byHeader {
+		for _, in := range instrs {
+			if in.Address >= l.Header.Address && in.Address <= l.Latch.Address {
+				l.Clocks.add(in.Clocks)
+			}
+		}
+		loops = append(loops, l)
+	}
+	sort.Slice(loops, func(i, j int) bool { return loops[i].Header.Address < loops[j].Header.Address })
+	return loops
+}
+
+// WriteReport prints the instructions, basic blocks and loops, each
+// sorted by the clocks spent in them, worst case first. l, if not nil,
+// adds labels and source lines.
+func (p *Profile) WriteReport(w io.Writer, l *Listing) {
+	fmt.Fprintf(w, "Profile: %d instructions executed, %s clocks\n", p.Instructions, p.Clocks)
+	percent := func(c profileClocks) string {
+		if p.Clocks.Max == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(c.Max)/float64(p.Clocks.Max))
+	}
+	name := func(addr uint32) string {
+		if l == nil {
+			return ""
+		}
+		if label, past, ok := l.Nearest(addr); ok {
+			if past == 0 {
+				return label
+			}
+			return fmt.Sprintf("%s+0x%x", label, past)
+		}
+		return ""
+	}
+
+	instrs := p.sorted()
+	sort.SliceStable(instrs, func(i, j int) bool { return instrs[i].Clocks.more(instrs[j].Clocks) })
+	fmt.Fprintf(w, "\nInstructions:\n%12s %6s %10s  %-9s  %s\n", "clocks", "", "count", "address", "instruction")
+	for _, in := range instrs {
+		text := in.Op.String()
+		if l != nil {
+			if src := l.Describe(in.Address); src != "" {
+				text = fmt.Sprintf("%-24s ; %s", text, src)
+			}
+		}
+		fmt.Fprintf(w, "%12s %6s %10d  %s  %s\n", in.Clocks, percent(in.Clocks), in.Count, in.At, text)
+	}
+
+	blocks := p.blocks()
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].Clocks.more(blocks[j].Clocks) })
+	fmt.Fprintf(w, "\nBasic blocks:\n%12s %6s %10s  %-9s  %-9s  %s\n", "clocks", "", "count", "first", "last", "instructions")
+	for _, b := range blocks {
+		first, last := b.Instrs[0], b.Instrs[len(b.Instrs)-1]
+		line := fmt.Sprintf("%12s %6s %10d  %s  %s  %d %s", b.Clocks, percent(b.Clocks), b.Count, first.At, last.At,
+			len(b.Instrs), name(first.Address))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+		for _, in := range b.Instrs {
+			fmt.Fprintf(w, "%42s  %s\n", "", in.Op)
+		}
+	}
+
+	loops := p.loops()
+	if len(loops) == 0 {
+		return
+	}
+	sort.SliceStable(loops, func(i, j int) bool { return loops[i].Clocks.more(loops[j].Clocks) })
+	fmt.Fprintf(w, "\nLoops:\n%12s %6s %10s  %-9s  %-9s  %s\n", "clocks", "", "iterations", "header", "latch", "entries")
+	for _, lp := range loops {
+		// The header runs once more than the loop goes round for each
+		// time the loop is entered.
+		entries := lp.Header.Count - min(lp.Iterations, lp.Header.Count)
+		line := fmt.Sprintf("%12s %6s %10d  %s  %s  %d %s", lp.Clocks, percent(lp.Clocks), lp.Iterations,
+			lp.Header.At, lp.Latch.At, entries, name(lp.Header.Address))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"sim86/sim"
+)
+
+// runProfile profiles coverageImage, which loops three times.
+func runProfile(t *testing.T) *Profile {
+	t.Helper()
+	m := sim.NewMachine(sim.Options{})
+	if err := (sim.RawLoader{}).Load(m, coverageImage); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProfile()
+	m.Trace = func(ex sim.Exec) { p.Record(ex, m.PC()) }
+	if res := m.Run(context.Background()); res.Reason != sim.StopEnd {
+		t.Fatalf("run stopped with %v: %v", res.Reason, res.Err)
+	}
+	return p
+}
+
+func TestProfileReport(t *testing.T) {
+	l, err := ReadListing(filepath.Join("testdata", "coverage.lst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := runProfile(t)
+	if p.Instructions != 12 || p.Clocks != (profileClocks{77, 77}) {
+		t.Errorf("profiled %d instructions, %v clocks; want 12, 77", p.Instructions, p.Clocks)
+	}
+
+	var b bytes.Buffer
+	p.WriteReport(&b, l)
+	checkGolden(t, "coverage.profile", b.Bytes())
+
+	// Each section lists the hottest first.
+	for _, section := range strings.Split(b.String(), "\n\n")[1:] {
+		lines := strings.Split(section, "\n")
+		last := -1
+		for _, line := range lines[2:] {
+			clocks, err := strconv.Atoi(strings.Fields(line + " x")[0])
+			if err != nil {
+				continue // an instruction of a block
+			}
+			if last >= 0 && clocks > last {
+				t.Errorf("%s: %d clocks after %d", lines[0], clocks, last)
+			}
+			last = clocks
+		}
+	}
+}
+
+// protoField is a field of an encoded protocol buffer message: a varint
+// in x or the bytes of anything else in b.
+type protoField struct {
+	n int
+	x uint64
+	b []byte
+}
+
+// protoVarint takes a varint off the front of b.
+func protoVarint(t *testing.T, b *[]byte) uint64 {
+	t.Helper()
+	var x uint64
+	for shift := 0; ; shift += 7 {
+		if len(*b) == 0 {
+			t.Fatal("message ends in a varint")
+		}
+		c := (*b)[0]
+		*b = (*b)[1:]
+		x |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return x
+		}
+	}
+}
+
+func decodeProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key := protoVarint(t, &b)
+		f := protoField{n: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.x = protoVarint(t, &b)
+		case 2:
+			n := protoVarint(t, &b)
+			if n > uint64(len(b)) {
+				t.Fatalf("field %d is %d bytes, only %d left", f.n, n, len(b))
+			}
+			f.b, b = b[:n], b[n:]
+		default:
+			t.Fatalf("field %d has wire type %d", f.n, key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func decodePacked(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var xs []uint64
+	for len(b) > 0 {
+		xs = append(xs, protoVarint(t, &b))
+	}
+	return xs
+}
+
+func TestPProf(t *testing.T) {
+	l, err := ReadListing(filepath.Join("testdata", "coverage.lst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := runProfile(t).WritePProf(&b, "coverage.com", l); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strs []string
+	var sampleTypes, samples [][]protoField
+	locations := map[uint64][]protoField{}
+	functions := map[uint64][]protoField{}
+	var defaultType uint64
+	byID := func(fields []protoField) uint64 {
+		for _, f := range fields {
+			if f.n == 1 {
+				return f.x
+			}
+		}
+		return 0
+	}
+	for _, f := range decodeProto(t, data) {
+		switch f.n {
+		case 1:
+			sampleTypes = append(sampleTypes, decodeProto(t, f.b))
+		case 2:
+			samples = append(samples, decodeProto(t, f.b))
+		case 4:
+			loc := decodeProto(t, f.b)
+			locations[byID(loc)] = loc
+		case 5:
+			fn := decodeProto(t, f.b)
+			functions[byID(fn)] = fn
+		case 6:
+			strs = append(strs, string(f.b))
+		case 14:
+			defaultType = f.x
+		}
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			t.Fatalf("string %d of %d", i, len(strs))
+		}
+		return strs[i]
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table starts %q", strs)
+	}
+
+	var types []string
+	for _, st := range sampleTypes {
+		types = append(types, str(st[0].x)+"/"+str(st[1].x))
+	}
+	if got := strings.Join(types, " "); got != "instructions/count clocks/count" {
+		t.Errorf("sample types are %s", got)
+	}
+	if got := str(defaultType); got != "clocks" {
+		t.Errorf("default sample type is %q", got)
+	}
+
+	// Each instruction is a sample at its address, in a function named
+	// after the label before it and on its line of the listing.
+	type sample struct {
+		count, clocks uint64
+		function      string
+		line          uint64
+	}
+	got := map[uint64]sample{}
+	for _, s := range samples {
+		ids, values := decodePacked(t, s[0].b), decodePacked(t, s[1].b)
+		loc := locations[ids[0]]
+		var addr uint64
+		var line []protoField
+		for _, f := range loc {
+			switch f.n {
+			case 3:
+				addr = f.x
+			case 4:
+				line = decodeProto(t, f.b)
+			}
+		}
+		fn := functions[line[0].x]
+		got[addr] = sample{values[0], values[1], str(fn[1].x), line[1].x}
+	}
+	want := map[uint64]sample{
+		0x0: {1, 4, "0000:0000 mov cx, 3", 5},
+		0x3: {3, 6, "again", 7},
+		0x4: {3, 12, "again", 8},
+		0x6: {3, 36, "again", 9},
+		0x8: {1, 15, "again", 10},
+		0xb: {1, 4, "done", 14},
+	}
+	for addr, w := range want {
+		if got[addr] != w {
+			t.Errorf("%#x: %+v, want %+v", addr, got[addr], w)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d samples, want %d", len(got), len(want))
+	}
+
+	// go tool pprof reads it too.
+	if testing.Short() {
+		return
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		return
+	}
+	path := filepath.Join(t.TempDir(), "coverage.pprof")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(goTool, "tool", "pprof", "-top", "-nodecount=1", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool pprof: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "again") {
+		t.Errorf("go tool pprof -top printed\n%s", out)
+	}
+}
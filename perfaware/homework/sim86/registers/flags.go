@@ -0,0 +1,73 @@
+package registers
+
+import "strings"
+
+// Bits of the FLAGS register.
+const (
+	FlagCF uint16 = 1 << 0  // Carry
+	FlagPF uint16 = 1 << 2  // Parity
+	FlagAF uint16 = 1 << 4  // Aux carry
+	FlagZF uint16 = 1 << 6  // Zero
+	FlagSF uint16 = 1 << 7  // Sign
+	FlagTF uint16 = 1 << 8  // Trap
+	FlagIF uint16 = 1 << 9  // Interrupt
+	FlagDF uint16 = 1 << 10 // Direction
+	FlagOF uint16 = 1 << 11 // Overflow
+
+	FlagMask = FlagCF | FlagPF | FlagAF | FlagZF | FlagSF | FlagTF | FlagIF | FlagDF | FlagOF
+
+	// FlagReserved are the bits the 8086 always reads back as set, e.g.
+	// in the word pushf pushes.
+	FlagReserved uint16 = 0xf002
+)
+
+var flagLetters = []struct {
+	bit    uint16
+	letter byte
+}{
+	{FlagCF, 'C'},
+	{FlagPF, 'P'},
+	{FlagAF, 'A'},
+	{FlagZF, 'Z'},
+	{FlagSF, 'S'},
+	{FlagTF, 'T'},
+	{FlagIF, 'I'},
+	{FlagDF, 'D'},
+	{FlagOF, 'O'},
+}
+
+// Flag reports whether bit is set in the flags s holds.
+func (s State) Flag(bit uint16) bool {
+	return s[FLAGS.index]&bit != 0
+}
+
+// SetFlag sets or clears bit in the flags s holds.
+func (s *State) SetFlag(bit uint16, on bool) {
+	v := s[FLAGS.index] &^ bit
+	if on {
+		v |= bit
+	}
+	s[FLAGS.index] = v
+}
+
+// FlagsString formats flag bits the way the reference simulator does,
+// e.g. "CPAZ".
+func FlagsString(v uint16) string {
+	var sb strings.Builder
+	for _, f := range flagLetters {
+		if v&f.bit != 0 {
+			sb.WriteByte(f.letter)
+		}
+	}
+	return sb.String()
+}
+
+// FlagByLetter finds a flag bit by the letter FlagsString uses for it.
+func FlagByLetter(letter byte) (uint16, bool) {
+	for _, f := range flagLetters {
+		if f.letter == letter {
+			return f.bit, true
+		}
+	}
+	return 0, false
+}
@@ -1,75 +1,59 @@
 package registers
 
-import "fmt"
-
 const (
 	Full = iota
 	Low
 	High
 )
 
+// Register names one of the 8086's registers, or a byte half of one. It
+// holds no value: values live in a State, the register file of one
+// machine.
 type Register struct {
-	value *[2]uint8
+	// index is where the 16-bit register, or the one this is half of, is
+	// in Words and State.
+	index int
 	rtype uint8
 	Name  string
 }
 
-func (r *Register) Get() uint16 {
-	if r.rtype == Low {
-		return uint16(r.value[0])
-	} else if r.rtype == High {
-		return uint16(r.value[1])
-	} else {
-		return uint16(r.value[1])<<8 | uint16(r.value[0])
-	}
-
-}
-func (r *Register) Put(val uint16) {
-	if r.rtype == Low {
-		r.value[0] = uint8(val)
-	} else if r.rtype == High {
-		r.value[1] = uint8(val)
-	} else {
-		r.value[0] = uint8(val)
-		r.value[1] = uint8(val >> 8)
-	}
+// Wide reports whether the register is a full 16-bit register.
+func (r *Register) Wide() bool {
+	return r.rtype == Full
 }
+
 func (r *Register) String() string {
-	val := r.Get()
-	if r.rtype == Low {
-		return fmt.Sprintf("%s 0x%X (lo)", r.Name, val)
-	} else if r.rtype == High {
-		return fmt.Sprintf("%s 0x%X (hi)", r.Name, val)
-	} else {
-		return fmt.Sprintf("%s 0x%X", r.Name, val)
-	}
+	return r.Name
 }
 
 var (
-	AX = Register{value: &[2]uint8{}, Name: "ax"}
-	AL = Register{value: AX.value, rtype: Low, Name: "al"}
-	AH = Register{value: AX.value, rtype: High, Name: "ah"}
-
-	BX = Register{value: &[2]uint8{}, Name: "bx"}
-	BL = Register{value: BX.value, rtype: Low, Name: "bl"}
-	BH = Register{value: BX.value, rtype: High, Name: "bh"}
-
-	CX = Register{value: &[2]uint8{}, Name: "cx"}
-	CL = Register{value: CX.value, rtype: Low, Name: "cl"}
-	CH = Register{value: CX.value, rtype: High, Name: "ch"}
-
-	DX = Register{value: &[2]uint8{}, Name: "dx"}
-	DL = Register{value: DX.value, rtype: Low, Name: "dl"}
-	DH = Register{value: DX.value, rtype: High, Name: "dh"}
-
-	SP = Register{value: &[2]uint8{}, Name: "sp"}
-	BP = Register{value: &[2]uint8{}, Name: "bp"}
-	SI = Register{value: &[2]uint8{}, Name: "si"}
-	DI = Register{value: &[2]uint8{}, Name: "di"}
-	ES = Register{value: &[2]uint8{}, Name: "es"}
-	CS = Register{value: &[2]uint8{}, Name: "cs"}
-	SS = Register{value: &[2]uint8{}, Name: "ss"}
-	DS = Register{value: &[2]uint8{}, Name: "ds"}
+	AX = Register{index: 0, Name: "ax"}
+	AL = Register{index: AX.index, rtype: Low, Name: "al"}
+	AH = Register{index: AX.index, rtype: High, Name: "ah"}
+
+	BX = Register{index: 1, Name: "bx"}
+	BL = Register{index: BX.index, rtype: Low, Name: "bl"}
+	BH = Register{index: BX.index, rtype: High, Name: "bh"}
+
+	CX = Register{index: 2, Name: "cx"}
+	CL = Register{index: CX.index, rtype: Low, Name: "cl"}
+	CH = Register{index: CX.index, rtype: High, Name: "ch"}
+
+	DX = Register{index: 3, Name: "dx"}
+	DL = Register{index: DX.index, rtype: Low, Name: "dl"}
+	DH = Register{index: DX.index, rtype: High, Name: "dh"}
+
+	SP = Register{index: 4, Name: "sp"}
+	BP = Register{index: 5, Name: "bp"}
+	SI = Register{index: 6, Name: "si"}
+	DI = Register{index: 7, Name: "di"}
+	ES = Register{index: 8, Name: "es"}
+	CS = Register{index: 9, Name: "cs"}
+	SS = Register{index: 10, Name: "ss"}
+	DS = Register{index: 11, Name: "ds"}
+
+	IP    = Register{index: 12, Name: "ip"}
+	FLAGS = Register{index: 13, Name: "flags"}
 
 	// Array of all registers
 	RegistersArray = []*Register{
@@ -94,8 +78,74 @@ var (
 		&SS,
 		&DS,
 	}
+
+	// Every 16-bit register in the order the reference simulator prints them.
+	Words = [WordCount]*Register{
+		&AX,
+		&BX,
+		&CX,
+		&DX,
+		&SP,
+		&BP,
+		&SI,
+		&DI,
+		&ES,
+		&CS,
+		&SS,
+		&DS,
+		&IP,
+		&FLAGS,
+	}
 )
 
+// WordCount is the number of 16-bit registers in the machine state.
+const WordCount = 14
+
+// State is a register file: the value of every 16-bit register, indexed
+// like Words. Each machine has its own.
+type State [WordCount]uint16
+
+// Get is the value s holds for r.
+func (s State) Get(r *Register) uint16 {
+	v := s[r.index]
+	switch r.rtype {
+	case Low:
+		return v & 0xff
+	case High:
+		return v >> 8
+	}
+	return v
+}
+
+// Put sets r to val. Only the low byte of val goes into a byte register.
+func (s *State) Put(r *Register, val uint16) {
+	v := &s[r.index]
+	switch r.rtype {
+	case Low:
+		*v = *v&0xff00 | val&0xff
+	case High:
+		*v = *v&0x00ff | val<<8
+	default:
+		*v = val
+	}
+}
+
+// ByName finds a register by its lower case name, e.g. "al" or "flags".
+func ByName(name string) *Register {
+	if name == IP.Name {
+		return &IP
+	}
+	if name == FLAGS.Name {
+		return &FLAGS
+	}
+	for _, r := range RegistersArray {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
 func Get(bw, idx uint8) *Register {
 	if idx > 15 {
 		panic("idx is bigger than then number of registers")
@@ -112,9 +162,3 @@ func GetSeg(idx uint8) *Register {
 	}
 	return RegistersArray[idx+16]
 }
-
-func Print() {
-	for i := 0; i < len(RegistersArray); i++ {
-		fmt.Printf("%s\n", RegistersArray[i])
-	}
-}
@@ -0,0 +1,99 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// BootLoader loads the first sector of an image at 0000:7C00 and jumps to
+// it with the boot drive in dl, like a PC BIOS does.
+type BootLoader struct {
+	Drive uint8
+	// Warn, when set, is told about images that lack the boot signature.
+	Warn io.Writer
+}
+
+const (
+	bootAddress = 0x7c00
+	SectorSize  = 512
+)
+
+// The last two bytes of a bootable sector.
+var bootSignature = [2]byte{0x55, 0xaa}
+
+func (l BootLoader) Load(m *Machine, image []byte) error {
+	if len(image) == 0 {
+		return fmt.Errorf("boot image is empty")
+	}
+	sector := make([]byte, SectorSize)
+	copy(sector, image)
+	if sig := [2]byte(sector[SectorSize-2:]); sig != bootSignature && l.Warn != nil {
+		fmt.Fprintf(l.Warn, "warning: boot sector ends in % x, not the % x signature\n", sig, bootSignature)
+	}
+
+	m.Load(sector, bootAddress)
+	// Boot code loads more of the disk and jumps to it, so anything in
+	// memory may run. Only hlt stops it.
+	m.End = memory.Size
+
+	m.SetReg(&registers.IP, bootAddress)
+	m.SetReg(&registers.DL, uint16(l.Drive))
+	m.SetReg(&registers.SP, bootAddress)
+	return nil
+}
+
+// BIOS serves the video, disk and keyboard interrupts boot code uses,
+// with the console standing in for the screen and keyboard.
+type BIOS struct {
+	Stdin  *bufio.Reader
+	Stdout io.Writer
+	// Disks are the drives int 13h knows, by BIOS drive number.
+	Disks map[uint8]*Disk
+}
+
+// Install hooks int 10h, int 13h and int 16h on m.
+func (b *BIOS) Install(m *Machine) {
+	m.HandleInterrupt(0x10, b.int10)
+	m.HandleInterrupt(0x13, b.int13)
+	m.HandleInterrupt(0x16, b.int16)
+}
+
+func (b *BIOS) int10(m *Machine, _ uint8) error {
+	switch ah := m.Reg(&registers.AH); ah {
+	case 0x0e:
+		// Teletype output.
+		b.Stdout.Write([]byte{uint8(m.Reg(&registers.AL))})
+	default:
+		return fmt.Errorf("unsupported int 10h function %02xh", ah)
+	}
+	return nil
+}
+
+func (b *BIOS) int16(m *Machine, _ uint8) error {
+	switch ah := m.Reg(&registers.AH); ah {
+	case 0x00:
+		// Wait for a key. There are no scan codes, only what stdin holds.
+		c, err := b.Stdin.ReadByte()
+		if err != nil {
+			c = dosEndOfInput
+		}
+		m.SetReg(&registers.AX, uint16(c))
+	case 0x01:
+		// Is a key waiting? This blocks until stdin has a byte or ends,
+		// which keeps runs with piped input deterministic.
+		next, err := b.Stdin.Peek(1)
+		if err != nil {
+			m.SetFlag(registers.FlagZF, true)
+			break
+		}
+		m.SetReg(&registers.AX, uint16(next[0]))
+		m.SetFlag(registers.FlagZF, false)
+	default:
+		return fmt.Errorf("unsupported int 16h function %02xh", ah)
+	}
+	return nil
+}
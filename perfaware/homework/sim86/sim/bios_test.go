@@ -0,0 +1,130 @@
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// bootSector pads code to a sector with the boot signature at the end.
+func bootSector(code []byte) []byte {
+	sector := make([]byte, SectorSize)
+	copy(sector, code)
+	copy(sector[SectorSize-2:], bootSignature[:])
+	return sector
+}
+
+func TestBootLoader(t *testing.T) {
+	// Only the first sector is loaded; the rest is for int 13h to read.
+	image := append(bootSector([]byte{0xf4}), 0x42)
+	m := NewMachine(Options{})
+	var warn bytes.Buffer
+	if err := (BootLoader{Drive: 0x80, Warn: &warn}).Load(m, image); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []regValue{
+		{&registers.CS, 0}, {&registers.IP, 0x7c00}, {&registers.DL, 0x80}, {&registers.SS, 0}, {&registers.SP, 0x7c00},
+	} {
+		if got := m.Reg(r.r); got != r.val {
+			t.Errorf("%s is %#04x, want %#04x", r.r, got, r.val)
+		}
+	}
+	if got := m.Memory.Peek(0x7c00); got != 0xf4 {
+		t.Errorf("0000:7C00 holds %#02x, want the boot sector's 0xf4", got)
+	}
+	if got := m.Memory.Peek(0x7c00 + SectorSize); got != 0 {
+		t.Errorf("the byte past the boot sector is %#02x, want it not loaded", got)
+	}
+	if m.End != memory.Size {
+		t.Errorf("program ends at %#05x, want all of memory", m.End)
+	}
+	if warn.Len() != 0 {
+		t.Errorf("warned %q", &warn)
+	}
+
+	// A short image without the signature is padded, with a warning.
+	m = NewMachine(Options{})
+	if err := (BootLoader{Warn: &warn}).Load(m, []byte{0xf4}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(warn.String(), "not the 55 aa signature") {
+		t.Errorf("warned %q, want the missing signature", &warn)
+	}
+
+	if err := (BootLoader{}).Load(NewMachine(Options{}), nil); err == nil {
+		t.Error("loaded an empty boot image")
+	}
+}
+
+func TestBootTeletype(t *testing.T) {
+	code := []byte{
+		0xb4, 0x0e, // mov ah, 0x0e
+		0xb0, 'H', // mov al, 'H'
+		0xcd, 0x10, // int 0x10
+		0xb0, 'i', // mov al, 'i'
+		0xcd, 0x10, // int 0x10
+		0xf4, // hlt
+	}
+	m := NewMachine(Options{})
+	if err := (BootLoader{}).Load(m, bootSector(code)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	(&BIOS{Stdout: &out}).Install(m)
+	res := m.Run(context.Background())
+	if res.Reason != StopHalt || res.Executed != 6 {
+		t.Errorf("stopped with %v after %d instructions: %v", res.Reason, res.Executed, res.Err)
+	}
+	if out.String() != "Hi" {
+		t.Errorf("printed %q, want Hi", &out)
+	}
+	if ip := m.Reg(&registers.IP); ip != 0x7c00+uint16(len(code)) {
+		t.Errorf("halted at ip %#04x", ip)
+	}
+}
+
+func TestBIOSKeyboard(t *testing.T) {
+	m := newTestMachine(t, []byte{0xcd, 0x16}) // int 0x16
+	(&BIOS{Stdin: bufio.NewReader(strings.NewReader("ab"))}).Install(m)
+	for _, c := range []struct {
+		ah uint16
+		al uint16
+		zf bool
+	}{
+		{0x01, 'a', false},
+		{0x00, 'a', false},
+		{0x00, 'b', false},
+		{0x01, 0, true},
+		{0x00, dosEndOfInput, false},
+	} {
+		m.SetReg(&registers.AX, 0)
+		callInt(t, m, regValue{&registers.AH, c.ah})
+		if al, zf := m.Reg(&registers.AL), m.Flag(registers.FlagZF); al != c.al || (c.ah == 0x01 && zf != c.zf) {
+			t.Errorf("int 16h/%02xh gave al %#02x zf %t, want %#02x %t", c.ah, al, zf, c.al, c.zf)
+		}
+	}
+}
+
+func TestBIOSUnsupported(t *testing.T) {
+	for _, c := range []struct {
+		vector uint8
+		want   string
+	}{
+		{0x10, "int 10h function 99h"},
+		{0x13, "int 13h function 99h"},
+		{0x16, "int 16h function 99h"},
+	} {
+		m := newTestMachine(t, []byte{0xcd, c.vector})
+		disk, _ := NewDisk(make([]byte, 368640))
+		(&BIOS{Disks: map[uint8]*Disk{0: disk}}).Install(m)
+		m.SetReg(&registers.AH, 0x99)
+		if _, err := m.Step(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("got %v, want an error saying %s", err, c.want)
+		}
+	}
+}
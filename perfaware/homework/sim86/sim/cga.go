@@ -0,0 +1,198 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"sim86/memory"
+)
+
+// CGA is the color adapter's 80x25 text mode. The screen is plain memory
+// at B800:0000, a character byte then an attribute byte per cell, which
+// the adapter scans out every frame. Programs write it directly, so all
+// this does is look at it once a frame and draw what changed.
+type CGA struct {
+	Mem *memory.Memory
+	// Live, when set, is a terminal the screen is drawn to with ANSI
+	// escapes.
+	Live io.Writer
+	// Frames is how many frames pass between redraws; 0 means every one.
+	Frames uint32
+
+	clocks uint32 // into the current frame
+	frames uint32 // since the last redraw
+	drawn  bool
+	shown  [cgaCells * 2]byte
+}
+
+const (
+	cgaBase    = 0xb8000
+	cgaColumns = 80
+	cgaRows    = 25
+	cgaCells   = cgaColumns * cgaRows
+	cgaStatus  = 0x3da
+
+	// A frame is 912x262 pixel clocks of 14.31818 MHz, which is exactly
+	// 79648 clocks of the 4.77 MHz CPU. That is 59.92 frames a second.
+	cgaFrameClocks = 912 * 262 / 3
+	cgaLineClocks  = cgaFrameClocks / 262
+	cgaVisibleRows = 200
+)
+
+// InstallCGA puts c's status port on m and has it follow m's clock.
+func InstallCGA(m *Machine, c *CGA) error {
+	if err := m.Ports.Register(cgaStatus, cgaStatus, c); err != nil {
+		return err
+	}
+	m.AddClocked(c)
+	return nil
+}
+
+func (c *CGA) Advance(clocks uint32) {
+	c.clocks += clocks
+	for c.clocks >= cgaFrameClocks {
+		c.clocks -= cgaFrameClocks
+		c.frames++
+		if c.frames > c.Frames {
+			c.frames = 0
+			c.Refresh()
+		}
+	}
+}
+
+// SaveState keeps the CGA's place in the frame. What has been drawn stays
+// drawn.
+func (c *CGA) SaveState() (any, int) {
+	return [2]uint32{c.clocks, c.frames}, 8
+}
+
+func (c *CGA) RestoreState(state any) {
+	s := state.([2]uint32)
+	c.clocks, c.frames = s[0], s[1]
+}
+
+func (c *CGA) SnapshotName() string {
+	return "cga"
+}
+
+// MarshalBinary keeps the CGA's place in the frame, like SaveState; the
+// screen itself is in memory.
+func (c *CGA) MarshalBinary() ([]byte, error) {
+	return marshalState([2]uint32{c.clocks, c.frames})
+}
+
+func (c *CGA) UnmarshalBinary(data []byte) error {
+	var s [2]uint32
+	if err := unmarshalState(data, &s); err != nil {
+		return err
+	}
+	c.clocks, c.frames = s[0], s[1]
+	// Whatever was drawn before isn't what the restored screen shows.
+	c.drawn = false
+	return nil
+}
+
+// Refresh redraws the live screen if memory has changed since it was
+// last drawn.
+func (c *CGA) Refresh() {
+	if c.Live == nil {
+		return
+	}
+	var cells [cgaCells * 2]byte
+	for i := range cells {
+		cells[i] = c.Mem.Peek(cgaBase + uint32(i))
+	}
+	if c.drawn && cells == c.shown {
+		return
+	}
+	c.shown = cells
+
+	var b bytes.Buffer
+	if !c.drawn {
+		// Clear the terminal and hide its cursor.
+		b.WriteString("\x1b[2J\x1b[?25l")
+		c.drawn = true
+	}
+	b.WriteString("\x1b[H")
+	for row := 0; row < cgaRows; row++ {
+		attr := -1
+		for col := 0; col < cgaColumns; col++ {
+			i := (row*cgaColumns + col) * 2
+			if a := int(cells[i+1]); a != attr {
+				attr = a
+				b.WriteString(ansiAttribute(uint8(a)))
+			}
+			b.WriteRune(cp437[cells[i]])
+		}
+		b.WriteString("\x1b[0m\r\n")
+	}
+	c.Live.Write(b.Bytes())
+}
+
+// Close draws the final screen and gives the terminal its cursor back.
+func (c *CGA) Close() {
+	if c.Live == nil {
+		return
+	}
+	c.Refresh()
+	if c.drawn {
+		io.WriteString(c.Live, "\x1b[0m\x1b[?25h")
+	}
+}
+
+// Text is the screen as plain text, one line per row with trailing
+// blanks trimmed and colors dropped.
+func (c *CGA) Text() string {
+	var b strings.Builder
+	for row := 0; row < cgaRows; row++ {
+		var line strings.Builder
+		for col := 0; col < cgaColumns; col++ {
+			line.WriteRune(cp437[c.Mem.Peek(cgaBase+uint32(row*cgaColumns+col)*2)])
+		}
+		b.WriteString(strings.TrimRight(line.String(), " "))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// In reads the status register. Bit 3 is set during vertical retrace and
+// bit 0 whenever the beam isn't drawing, which is what programs poll to
+// time their updates.
+func (c *CGA) In(port uint16, wide bool) uint16 {
+	line := c.clocks / cgaLineClocks
+	var status uint16
+	if line >= cgaVisibleRows {
+		status |= 0x09
+	} else if c.clocks%cgaLineClocks >= cgaLineClocks*640/912 {
+		status |= 0x01
+	}
+	return status
+}
+
+func (c *CGA) Out(port uint16, val uint16, wide bool) {}
+
+// ansiColors maps the CGA's color numbers, which go blue, green, red, to
+// ANSI's, which go red, green, blue.
+var ansiColors = [8]int{0, 4, 2, 6, 1, 5, 3, 7}
+
+func ansiAttribute(a uint8) string {
+	fg := 30 + ansiColors[a&0x07]
+	if a&0x08 != 0 {
+		fg += 60
+	}
+	// Bit 7 is blink. Terminals don't blink reliably, so it's ignored.
+	bg := 40 + ansiColors[(a>>4)&0x07]
+	return fmt.Sprintf("\x1b[%d;%dm", fg, bg)
+}
+
+// cp437 is the PC's character set as Unicode. NUL and 0xFF are blanks.
+var cp437 = []rune(" ☺☻♥♦♣♠•◘○◙♂♀♪♫☼►◄↕‼¶§▬↨↑↓→←∟↔▲▼" +
+	" !\"#$%&'()*+,-./0123456789:;<=>?" +
+	"@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_" +
+	"`abcdefghijklmnopqrstuvwxyz{|}~⌂" +
+	"ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ ")
@@ -0,0 +1,127 @@
+package sim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"sim86/memory"
+)
+
+func TestANSIAttribute(t *testing.T) {
+	for _, c := range []struct {
+		attr uint8
+		want string
+	}{
+		{0x07, "\x1b[37;40m"}, // light gray on black
+		{0x70, "\x1b[30;47m"}, // black on light gray
+		{0x1f, "\x1b[97;44m"}, // white on blue
+		{0x4e, "\x1b[93;41m"}, // yellow on red
+		{0x23, "\x1b[36;42m"}, // cyan on green
+		{0x8c, "\x1b[91;40m"}, // blinking light red, drawn without the blink
+	} {
+		if got := ansiAttribute(c.attr); got != c.want {
+			t.Errorf("attribute %#02x is %q, want %q", c.attr, got, c.want)
+		}
+	}
+}
+
+// putCells writes text to the screen at row, col with attribute attr.
+func putCells(mem *memory.Memory, row, col int, text string, attr uint8) {
+	for i := 0; i < len(text); i++ {
+		addr := cgaBase + uint32(row*cgaColumns+col+i)*2
+		mem.Poke(addr, text[i])
+		mem.Poke(addr+1, attr)
+	}
+}
+
+func TestCGARefresh(t *testing.T) {
+	mem := memory.New()
+	var out bytes.Buffer
+	c := &CGA{Mem: mem, Live: &out}
+	putCells(mem, 0, 0, "AB", 0x1e)
+	putCells(mem, 0, 2, "C", 0x07)
+	putCells(mem, 1, 0, "\x01\xdb", 0x07)
+
+	c.Refresh()
+	first := out.String()
+	// Colors are only sent when the attribute changes.
+	for _, want := range []string{
+		"\x1b[2J\x1b[?25l\x1b[H\x1b[93;44mAB\x1b[37;40mC\x1b[30;40m ",
+		"\x1b[0m\r\n\x1b[37;40m☺█\x1b[30;40m ",
+	} {
+		if !strings.Contains(first, want) {
+			t.Errorf("screen %q doesn't have %q", first, want)
+		}
+	}
+	if n := strings.Count(first, "\r\n"); n != cgaRows {
+		t.Errorf("drew %d rows", n)
+	}
+
+	out.Reset()
+	c.Refresh()
+	if out.Len() != 0 {
+		t.Errorf("redrew an unchanged screen: %q", &out)
+	}
+
+	putCells(mem, 24, 79, "Z", 0x07)
+	c.Refresh()
+	if s := out.String(); !strings.HasPrefix(s, "\x1b[H") || !strings.Contains(s, "Z") {
+		t.Errorf("changed screen drew %q", s)
+	}
+
+	out.Reset()
+	c.Close()
+	if !strings.HasSuffix(out.String(), "\x1b[0m\x1b[?25h") {
+		t.Errorf("closing wrote %q, want the cursor back", &out)
+	}
+}
+
+func TestCGAText(t *testing.T) {
+	mem := memory.New()
+	c := &CGA{Mem: mem}
+	putCells(mem, 0, 0, "hi", 0x4f)
+	putCells(mem, 2, 78, "\x03\xff", 0x07)
+	lines := strings.Split(c.Text(), "\n")
+	if len(lines) != cgaRows+1 || lines[0] != "hi" || lines[1] != "" || lines[2] != strings.Repeat(" ", 78)+"♥" {
+		t.Errorf("text is %q", lines[:3])
+	}
+}
+
+func TestCGAFrames(t *testing.T) {
+	mem := memory.New()
+	var out bytes.Buffer
+	c := &CGA{Mem: mem, Live: &out, Frames: 1}
+	putCells(mem, 0, 0, "x", 0x07)
+
+	// With Frames 1 every second frame is drawn.
+	c.Advance(cgaFrameClocks)
+	if out.Len() != 0 {
+		t.Error("drew after one frame")
+	}
+	c.Advance(cgaFrameClocks)
+	if out.Len() == 0 {
+		t.Error("didn't draw after two frames")
+	}
+}
+
+func TestCGAStatus(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		clocks uint32
+		want   uint16
+	}{
+		{"drawing", 0, 0},
+		{"horizontal retrace", cgaLineClocks - 1, 0x01},
+		{"next line", cgaLineClocks, 0},
+		{"vertical retrace", cgaVisibleRows * cgaLineClocks, 0x09},
+		{"end of the frame", cgaFrameClocks - 1, 0x09},
+		{"next frame", cgaFrameClocks, 0},
+	} {
+		cga := &CGA{Mem: memory.New()}
+		cga.Advance(c.clocks)
+		if got := cga.In(cgaStatus, false); got != c.want {
+			t.Errorf("%s: status %#02x, want %#02x", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package sim
+
+import (
+	"fmt"
+	"sim86/instructions"
+)
+
+// Clock estimates come straight from the cycle table in the 8086 manual.
+// Some of its entries are very likely typos, so treat these as estimates.
+
+// ClockInterval is a clock estimate, or a total of them. Min and Max
+// differ where the manual gives a range, as it does for multiplies and
+// divides.
+type ClockInterval struct {
+	Min, Max uint32
+}
+
+func (c ClockInterval) String() string {
+	if c.Min != c.Max {
+		return fmt.Sprintf("[%d,%d]", c.Min, c.Max)
+	}
+	return fmt.Sprint(c.Min)
+}
+
+type instructionTiming struct {
+	Base ClockInterval
+	// Transfers is the number of word sized memory transfers, each of
+	// which costs 4 more clocks on an 8088 or at an odd address.
+	Transfers uint32
+	EA        uint32
+}
+
+func clocks(n, transfers uint32, ea ...uint32) instructionTiming {
+	return clockRange(n, n, transfers, ea...)
+}
+
+func clockRange(min, max, transfers uint32, ea ...uint32) instructionTiming {
+	t := instructionTiming{Base: ClockInterval{min, max}, Transfers: transfers}
+	if len(ea) > 0 {
+		t.EA = ea[0]
+	}
+	return t
+}
+
+// eaClocks is the cost of computing a memory operand's effective address.
+func eaClocks(op instructions.Operation, o instructions.Operand) uint32 {
+	var n uint32
+	terms := o.Terms()
+	switch len(terms) {
+	case 0:
+		n = 2
+	case 1:
+		n = 5
+	case 2:
+		if o.RM == 0b000 || o.RM == 0b011 {
+			// bx+si and bp+di
+			n = 7
+		} else {
+			n = 8
+		}
+	}
+	if o.Disp != 0 {
+		n += 4
+	}
+	if op.SegOverride != nil {
+		n += 2
+	}
+	return n
+}
+
+// estimateClocks returns the manual's timing for an executed instruction
+// and the clocks it works out to once EA and bus penalties are added.
+func estimateClocks(ex Exec, is8088 bool) (instructionTiming, ClockInterval) {
+	t := baseTiming(ex)
+	extra := t.EA
+	if ex.Op.Wide() && (is8088 || ex.Unaligned) {
+		extra += 4 * t.Transfers
+	}
+	c := t.Base
+	c.Min += extra
+	c.Max += extra
+	return t, c
+}
+
+func baseTiming(ex Exec) instructionTiming {
+	op := ex.Op
+	is := func(i int, v instructions.ValueType) bool {
+		return op.Operands[i].Type == v
+	}
+	reg0, reg1 := is(0, instructions.ValRegister), is(1, instructions.ValRegister)
+	mem0, mem1 := is(0, instructions.ValMemory), is(1, instructions.ValMemory)
+	imm0, imm1 := is(0, instructions.ValImmediate), is(1, instructions.ValImmediate)
+	wide := op.Wide()
+
+	var ea uint32
+	if mem0 && !op.Operands[0].Explicit {
+		ea = eaClocks(op, op.Operands[0])
+	}
+	if mem1 {
+		ea = eaClocks(op, op.Operands[1])
+	}
+
+	taken := ex.BranchTaken
+	rep := uint32(ex.RepCount)
+	cl := uint32(ex.ShiftCount)
+
+	var t instructionTiming
+	switch op.OpType {
+	case instructions.OpCbw, instructions.OpClc, instructions.OpCld, instructions.OpCli,
+		instructions.OpCmc, instructions.OpHlt, instructions.OpStc, instructions.OpStd,
+		instructions.OpSti:
+		t = clocks(2, 0)
+
+	case instructions.OpAaa, instructions.OpAas, instructions.OpDaa, instructions.OpDas,
+		instructions.OpLahf, instructions.OpSahf:
+		t = clocks(4, 0)
+
+	case instructions.OpCwd:
+		t = clocks(5, 0)
+	case instructions.OpAad:
+		t = clocks(60, 0)
+	case instructions.OpAam:
+		t = clocks(83, 0)
+
+	case instructions.OpAdc, instructions.OpAdd, instructions.OpAnd, instructions.OpXor,
+		instructions.OpOr, instructions.OpSub, instructions.OpSbb:
+		switch {
+		case reg0 && reg1:
+			t = clocks(3, 0)
+		case reg0 && mem1:
+			t = clocks(9, 1, ea)
+		case mem0 && reg1:
+			t = clocks(16, 2, ea)
+		case reg0 && imm1:
+			t = clocks(4, 0)
+		case mem0 && imm1:
+			t = clocks(17, 2, ea)
+		}
+
+	case instructions.OpCall:
+		switch {
+		case mem0 && op.Operands[0].Explicit:
+			t = clocks(28, 2)
+		case mem0 && op.Far:
+			t = clocks(37, 4, ea)
+		case mem0:
+			t = clocks(21, 2, ea)
+		case reg0:
+			t = clocks(16, 1)
+		default:
+			t = clocks(19, 1)
+		}
+
+	case instructions.OpCmp:
+		switch {
+		case reg0 && reg1:
+			t = clocks(3, 0)
+		case reg0 && mem1, mem0 && reg1:
+			t = clocks(9, 1, ea)
+		case reg0 && imm1:
+			t = clocks(4, 0)
+		case mem0 && imm1:
+			t = clocks(10, 1, ea)
+		}
+
+	case instructions.OpCmps:
+		if rep != 0 {
+			t = clocks(9+22*rep, 2*rep)
+		} else {
+			t = clocks(22, 2)
+		}
+
+	case instructions.OpDec, instructions.OpInc:
+		switch {
+		case reg0 && !wide:
+			t = clocks(3, 0)
+		case reg0 && wide:
+			t = clocks(2, 0)
+		case mem0:
+			t = clocks(15, 2, ea)
+		}
+
+	case instructions.OpDiv:
+		switch {
+		case reg0 && !wide:
+			t = clockRange(80, 90, 0)
+		case reg0 && wide:
+			t = clockRange(144, 162, 0)
+		case mem0 && !wide:
+			t = clockRange(86, 96, 1, ea)
+		case mem0 && wide:
+			t = clockRange(150, 168, 1, ea)
+		}
+
+	case instructions.OpEsc:
+		switch {
+		case imm0 && mem1:
+			t = clocks(8, 1, ea)
+		case imm0 && reg1:
+			t = clocks(2, 0)
+		}
+
+	case instructions.OpIdiv:
+		switch {
+		case reg0 && !wide:
+			t = clockRange(101, 112, 0)
+		case reg0 && wide:
+			t = clockRange(165, 184, 0)
+		case mem0 && !wide:
+			t = clockRange(107, 118, 1, ea)
+		case mem0 && wide:
+			t = clockRange(171, 190, 1, ea)
+		}
+
+	case instructions.OpImul:
+		switch {
+		case reg0 && !wide:
+			t = clockRange(80, 98, 0)
+		case reg0 && wide:
+			t = clockRange(128, 154, 0)
+		case mem0 && !wide:
+			t = clockRange(86, 104, 1, ea)
+		case mem0 && wide:
+			t = clockRange(134, 160, 1, ea)
+		}
+
+	case instructions.OpIn:
+		switch {
+		case reg0 && imm1:
+			t = clocks(10, 1)
+		case reg0 && reg1:
+			t = clocks(8, 1)
+		}
+
+	case instructions.OpInt:
+		if op.Operands[0].Imm == 3 {
+			t = clocks(52, 5)
+		} else {
+			t = clocks(51, 5)
+		}
+	case instructions.OpInt3:
+		t = clocks(52, 5)
+	case instructions.OpInto:
+		if taken {
+			t = clocks(53, 5)
+		} else {
+			t = clocks(4, 0)
+		}
+	case instructions.OpIret:
+		t = clocks(24, 3)
+
+	case instructions.OpJe, instructions.OpJl, instructions.OpJle, instructions.OpJb,
+		instructions.OpJbe, instructions.OpJp, instructions.OpJo, instructions.OpJs,
+		instructions.OpJne, instructions.OpJnl, instructions.OpJg, instructions.OpJnb,
+		instructions.OpJa, instructions.OpJnp, instructions.OpJno, instructions.OpJns:
+		if taken {
+			t = clocks(16, 0)
+		} else {
+			t = clocks(4, 0)
+		}
+	case instructions.OpJcxz:
+		if taken {
+			t = clocks(18, 0)
+		} else {
+			t = clocks(6, 0)
+		}
+
+	case instructions.OpJmp:
+		switch {
+		case mem0 && op.Operands[0].Explicit, imm0:
+			t = clocks(15, 0)
+		case mem0 && op.Far:
+			t = clocks(24, 2, ea)
+		case mem0:
+			t = clocks(18, 1, ea)
+		case reg0:
+			t = clocks(11, 0)
+		}
+
+	case instructions.OpLds, instructions.OpLes:
+		t = clocks(16, 2, ea)
+	case instructions.OpLea:
+		t = clocks(2, 0, ea)
+
+	case instructions.OpLods:
+		if rep != 0 {
+			t = clocks(9+13*rep, rep)
+		} else {
+			t = clocks(12, 1)
+		}
+
+	case instructions.OpLoop:
+		if taken {
+			t = clocks(17, 0)
+		} else {
+			t = clocks(5, 0)
+		}
+	case instructions.OpLoopz:
+		if taken {
+			t = clocks(18, 0)
+		} else {
+			t = clocks(6, 0)
+		}
+	case instructions.OpLoopnz:
+		if taken {
+			t = clocks(19, 0)
+		} else {
+			t = clocks(5, 0)
+		}
+
+	case instructions.OpMov:
+		switch {
+		case mem0 && reg1:
+			t = clocks(9, 1, ea)
+		case reg0 && mem1:
+			t = clocks(8, 1, ea)
+		case reg0 && reg1:
+			t = clocks(2, 0)
+		case reg0 && imm1:
+			t = clocks(4, 0)
+		case mem0 && imm1:
+			t = clocks(10, 1, ea)
+		}
+
+	case instructions.OpMovs:
+		if rep != 0 {
+			t = clocks(9+17*rep, 2*rep)
+		} else {
+			t = clocks(18, 2)
+		}
+
+	case instructions.OpMul:
+		switch {
+		case reg0 && !wide:
+			t = clockRange(70, 77, 0)
+		case reg0 && wide:
+			t = clockRange(118, 133, 0)
+		case mem0 && !wide:
+			t = clockRange(76, 83, 1, ea)
+		case mem0 && wide:
+			t = clockRange(124, 139, 1, ea)
+		}
+
+	case instructions.OpNeg, instructions.OpNot:
+		switch {
+		case reg0:
+			t = clocks(3, 0)
+		case mem0:
+			t = clocks(16, 2, ea)
+		}
+
+	case instructions.OpOut:
+		switch {
+		case imm0 && reg1:
+			t = clocks(10, 1)
+		case reg0 && reg1:
+			t = clocks(8, 1)
+		}
+
+	case instructions.OpPop:
+		switch {
+		case reg0:
+			t = clocks(8, 1)
+		case mem0:
+			t = clocks(17, 2, ea)
+		}
+	case instructions.OpPopf:
+		t = clocks(8, 1)
+
+	case instructions.OpPush:
+		switch {
+		case reg0 && op.Operands[0].Seg:
+			t = clocks(10, 1)
+		case reg0:
+			t = clocks(11, 1)
+		case mem0:
+			t = clocks(16, 2, ea)
+		}
+	case instructions.OpPushf:
+		t = clocks(10, 1)
+
+	case instructions.OpRet:
+		if imm0 {
+			t = clocks(12, 1)
+		} else {
+			t = clocks(8, 1)
+		}
+	case instructions.OpRetf:
+		if imm0 {
+			t = clocks(17, 2)
+		} else {
+			t = clocks(18, 2)
+		}
+
+	case instructions.OpRcl, instructions.OpRcr, instructions.OpRol, instructions.OpRor,
+		instructions.OpShl, instructions.OpSar, instructions.OpShr:
+		switch {
+		case reg0 && imm1:
+			t = clocks(2, 0)
+		case reg0 && reg1:
+			t = clocks(8+4*cl, 0)
+		case mem0 && imm1:
+			t = clocks(15, 2, ea)
+		case mem0 && reg1:
+			t = clocks(20+4*cl, 2, ea)
+		}
+
+	case instructions.OpScas:
+		if rep != 0 {
+			t = clocks(9+15*rep, rep)
+		} else {
+			t = clocks(15, 1)
+		}
+
+	case instructions.OpStos:
+		if rep != 0 {
+			t = clocks(9+10*rep, rep)
+		} else {
+			t = clocks(11, 1)
+		}
+
+	case instructions.OpTest:
+		switch {
+		case reg0 && reg1:
+			t = clocks(3, 0)
+		case reg0 && mem1:
+			t = clocks(9, 1, ea)
+		case reg0 && imm1:
+			t = clocks(5, 0)
+		case mem0 && imm1:
+			t = clocks(11, 0, ea)
+		}
+
+	case instructions.OpWait:
+		t = clocks(3, 0)
+
+	case instructions.OpXchg:
+		switch {
+		case mem0 && reg1, reg0 && mem1:
+			t = clocks(17, 2, ea)
+		case reg0 && reg1:
+			t = clocks(4, 0)
+		}
+
+	case instructions.OpXlat:
+		t = clocks(11, 1)
+	}
+
+	// Prefixes are clocked as instructions of their own.
+	var prefixes uint32
+	if op.Lock {
+		prefixes++
+	}
+	if op.Rep {
+		prefixes++
+	}
+	if op.SegOverride != nil {
+		prefixes++
+	}
+	t.Base.Min += 2 * prefixes
+	t.Base.Max += 2 * prefixes
+	return t
+}
+
+// ExplainClocks breaks the instruction's clocks down the way the reference
+// simulator's -explainclocks does: "(8 + 7ea + 4p)".
+func (ex Exec) ExplainClocks() string {
+	t, c := ex.Timing, ex.Clocks
+	if t.Base.Min == c.Min {
+		return ""
+	}
+	s := " (" + t.Base.String()
+	if t.EA != 0 {
+		s += fmt.Sprintf(" + %dea", t.EA)
+	}
+	if penalty := c.Min - (t.Base.Min + t.EA); penalty != 0 {
+		s += fmt.Sprintf(" + %dp", penalty)
+	}
+	return s + ")"
+}
@@ -0,0 +1,149 @@
+package sim
+
+import (
+	"fmt"
+	"os"
+
+	"sim86/registers"
+)
+
+// Disk is a floppy image served through int 13h. Writes land in an
+// in-memory copy of the image, and only reach the file when it was
+// opened writable.
+type Disk struct {
+	Cylinders, Heads, Sectors int
+	// Type is what int 13h/08h reports in bl.
+	Type uint8
+
+	data []byte
+	file *os.File
+}
+
+var floppyGeometries = []struct {
+	size                      int
+	cylinders, heads, sectors int
+	typ                       uint8
+}{
+	{368640, 40, 2, 9, 1},   // 360K
+	{1228800, 80, 2, 15, 2}, // 1.2M
+	{737280, 80, 2, 9, 3},   // 720K
+	{1474560, 80, 2, 18, 4}, // 1.44M
+}
+
+// OpenDisk loads a floppy image, working out its geometry from its size.
+// With writable set, sector writes are written through to the file.
+func OpenDisk(path string, writable bool) (*Disk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDisk(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if writable {
+		if d.file, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// NewDisk serves data as a floppy. It is used, not copied.
+func NewDisk(data []byte) (*Disk, error) {
+	for _, g := range floppyGeometries {
+		if g.size == len(data) {
+			return &Disk{Cylinders: g.cylinders, Heads: g.heads, Sectors: g.sectors, Type: g.typ, data: data}, nil
+		}
+	}
+	return nil, fmt.Errorf("can't tell the floppy geometry of a %d byte image", len(data))
+}
+
+func (d *Disk) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
+
+// lba turns a cylinder/head/sector address into a sector index. Sectors
+// count from 1.
+func (d *Disk) lba(c, h, s int) (int, bool) {
+	if c >= d.Cylinders || h >= d.Heads || s < 1 || s > d.Sectors {
+		return 0, false
+	}
+	return (c*d.Heads+h)*d.Sectors + s - 1, true
+}
+
+// int 13h status codes, returned in ah.
+const (
+	diskOK             = 0x00
+	diskBadCommand     = 0x01
+	diskSectorNotFound = 0x04
+	diskWriteFault     = 0xcc
+	diskNotReady       = 0x80
+)
+
+func (b *BIOS) int13(m *Machine, _ uint8) error {
+	ah := m.Reg(&registers.AH)
+	d := b.Disks[uint8(m.Reg(&registers.DL))]
+	if d == nil && ah != 0x00 {
+		m.diskStatus(diskNotReady, 0)
+		return nil
+	}
+
+	switch ah {
+	case 0x00:
+		m.diskStatus(diskOK, 0)
+	case 0x02, 0x03:
+		count := int(m.Reg(&registers.AL))
+		cx := m.Reg(&registers.CX)
+		c := int(cx>>8) | int(cx&0xc0)<<2
+		s := int(cx & 0x3f)
+		lba, ok := d.lba(c, int(m.Reg(&registers.DH)), s)
+		if !ok || count == 0 || lba+count > len(d.data)/SectorSize {
+			m.diskStatus(diskSectorNotFound, 0)
+			break
+		}
+		seg, off := m.Reg(&registers.ES), m.Reg(&registers.BX)
+		sectors := d.data[lba*SectorSize : (lba+count)*SectorSize]
+		if ah == 0x02 {
+			for i, v := range sectors {
+				m.writeMem(seg, off+uint16(i), uint16(v), false)
+			}
+		} else {
+			for i := range sectors {
+				sectors[i] = uint8(m.readMem(seg, off+uint16(i), false))
+			}
+			if d.file != nil {
+				if _, err := d.file.WriteAt(sectors, int64(lba*SectorSize)); err != nil {
+					m.diskStatus(diskWriteFault, 0)
+					break
+				}
+			}
+		}
+		m.diskStatus(diskOK, count)
+	case 0x08:
+		maxCyl := d.Cylinders - 1
+		m.SetReg(&registers.BL, uint16(d.Type))
+		m.SetReg(&registers.CH, uint16(maxCyl&0xff))
+		m.SetReg(&registers.CL, uint16(d.Sectors|(maxCyl>>8)<<6))
+		m.SetReg(&registers.DH, uint16(d.Heads-1))
+		m.SetReg(&registers.DL, uint16(len(b.Disks)))
+		// No diskette parameter table to point at.
+		m.SetReg(&registers.ES, 0)
+		m.SetReg(&registers.DI, 0)
+		m.diskStatus(diskOK, 0)
+	default:
+		return fmt.Errorf("unsupported int 13h function %02xh", ah)
+	}
+	return nil
+}
+
+// diskStatus reports an int 13h result: the status in ah, sectors moved
+// in al and CF set on failure.
+func (m *Machine) diskStatus(status uint8, sectors int) {
+	m.SetReg(&registers.AH, uint16(status))
+	m.SetReg(&registers.AL, uint16(sectors))
+	m.SetFlag(registers.FlagCF, status != diskOK)
+}
@@ -0,0 +1,185 @@
+package sim
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sim86/registers"
+)
+
+// diskImage is a 360K floppy whose every sector is filled with the low
+// byte of its index.
+func diskImage() []byte {
+	data := make([]byte, 368640)
+	for i := range data {
+		data[i] = uint8(i / SectorSize)
+	}
+	return data
+}
+
+// diskMachine serves disk as drive 0 through the int 13h at 0000:0000.
+func diskMachine(t *testing.T, disk *Disk) *Machine {
+	t.Helper()
+	m := newTestMachine(t, []byte{0xcd, 0x13}) // int 0x13
+	(&BIOS{Disks: map[uint8]*Disk{0: disk}}).Install(m)
+	return m
+}
+
+// chs is the cx int 13h takes for cylinder c and sector s.
+func chs(c, s int) uint16 {
+	return uint16(c&0xff)<<8 | uint16(c>>8)<<6 | uint16(s)
+}
+
+func TestNewDisk(t *testing.T) {
+	for _, c := range []struct {
+		size                      int
+		cylinders, heads, sectors int
+	}{
+		{368640, 40, 2, 9},
+		{737280, 80, 2, 9},
+		{1228800, 80, 2, 15},
+		{1474560, 80, 2, 18},
+	} {
+		d, err := NewDisk(make([]byte, c.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Cylinders != c.cylinders || d.Heads != c.heads || d.Sectors != c.sectors {
+			t.Errorf("%d bytes: geometry %d/%d/%d, want %d/%d/%d", c.size,
+				d.Cylinders, d.Heads, d.Sectors, c.cylinders, c.heads, c.sectors)
+		}
+	}
+	if _, err := NewDisk(make([]byte, 1000)); err == nil {
+		t.Error("made a disk of 1000 bytes")
+	}
+}
+
+func TestDiskRead(t *testing.T) {
+	const buf = 0x1000
+	for _, c := range []struct {
+		name       string
+		c, h, s    int
+		count      uint16
+		drive      uint16
+		status     uint16
+		firstIndex int // of the sector read
+	}{
+		{name: "first sector", s: 1, count: 1},
+		{name: "last sector of the track", s: 9, count: 1, firstIndex: 8},
+		{name: "second head", h: 1, s: 1, count: 1, firstIndex: 9},
+		{name: "second cylinder", c: 1, s: 2, count: 1, firstIndex: 19},
+		{name: "last sector", c: 39, h: 1, s: 9, count: 1, firstIndex: 719},
+		{name: "across heads", s: 9, count: 3, firstIndex: 8},
+		{name: "sector 0", s: 0, count: 1, status: diskSectorNotFound},
+		{name: "sector past the track", s: 10, count: 1, status: diskSectorNotFound},
+		{name: "head past the disk", h: 2, s: 1, count: 1, status: diskSectorNotFound},
+		{name: "cylinder past the disk", c: 40, s: 1, count: 1, status: diskSectorNotFound},
+		{name: "past the end", c: 39, h: 1, s: 9, count: 2, status: diskSectorNotFound},
+		{name: "no sectors", s: 1, count: 0, status: diskSectorNotFound},
+		{name: "no drive", s: 1, count: 1, drive: 1, status: diskNotReady},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			disk, err := NewDisk(diskImage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := diskMachine(t, disk)
+			callInt(t, m, regValue{&registers.AH, 0x02}, regValue{&registers.AL, c.count},
+				regValue{&registers.CX, chs(c.c, c.s)}, regValue{&registers.DH, uint16(c.h)}, regValue{&registers.DL, c.drive},
+				regValue{&registers.BX, buf})
+			var moved uint16
+			if c.status == diskOK {
+				moved = c.count
+			}
+			if ah, al, cf := m.Reg(&registers.AH), m.Reg(&registers.AL), m.Flag(registers.FlagCF); ah != c.status || al != moved || cf != (c.status != diskOK) {
+				t.Fatalf("status %#02x, %d sectors, cf %t; want %#02x, %d", ah, al, cf, c.status, moved)
+			}
+			for i := 0; i < int(moved); i++ {
+				addr := uint32(buf + i*SectorSize)
+				first, last := m.Memory.Peek(addr), m.Memory.Peek(addr+SectorSize-1)
+				if want := uint8(c.firstIndex + i); first != want || last != want {
+					t.Errorf("sector %d read as %#02x...%#02x, want sector %d", i, first, last, c.firstIndex+i)
+				}
+			}
+			if c.status != diskOK && m.Memory.Peek(buf) != 0 {
+				t.Error("failed read wrote memory")
+			}
+		})
+	}
+}
+
+func TestDiskParameters(t *testing.T) {
+	disk, err := NewDisk(make([]byte, 1474560))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := diskMachine(t, disk)
+	callInt(t, m, regValue{&registers.AH, 0x08}, regValue{&registers.DL, 0}, regValue{&registers.ES, 0x1234})
+	for _, r := range []regValue{
+		{&registers.AH, diskOK}, {&registers.BL, 4}, {&registers.CH, 79}, {&registers.CL, 18},
+		{&registers.DH, 1}, {&registers.DL, 1}, {&registers.ES, 0},
+	} {
+		if got := m.Reg(r.r); got != r.val {
+			t.Errorf("%s is %#04x, want %#04x", r.r, got, r.val)
+		}
+	}
+}
+
+// diskWrite writes a sector of fill at cylinder 1, head 0, sector 3 and
+// reads it back.
+func diskWrite(t *testing.T, disk *Disk, fill uint8) {
+	t.Helper()
+	m := diskMachine(t, disk)
+	for i := uint32(0); i < SectorSize; i++ {
+		m.Memory.Poke(0x1000+i, fill)
+	}
+	callInt(t, m, regValue{&registers.AX, 0x0301}, regValue{&registers.CX, chs(1, 3)},
+		regValue{&registers.DX, 0}, regValue{&registers.BX, 0x1000})
+	if ah, cf := m.Reg(&registers.AH), m.Flag(registers.FlagCF); ah != diskOK || cf {
+		t.Fatalf("write status %#02x cf %t", ah, cf)
+	}
+	callInt(t, m, regValue{&registers.AX, 0x0201}, regValue{&registers.BX, 0x2000})
+	if got := m.Memory.Peek(0x2000 + 100); got != fill {
+		t.Errorf("read back %#02x, want %#02x", got, fill)
+	}
+}
+
+func TestDiskOverlay(t *testing.T) {
+	const sector = (1*2+0)*9 + 3 - 1
+	path := filepath.Join(t.TempDir(), "floppy.img")
+	if err := os.WriteFile(path, diskImage(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	onFile := func() []byte {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data[sector*SectorSize : (sector+1)*SectorSize]
+	}
+
+	// Writes to a disk that isn't writable stay in memory.
+	disk, err := OpenDisk(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskWrite(t, disk, 0xaa)
+	disk.Close()
+	if !bytes.Equal(onFile(), bytes.Repeat([]byte{sector}, SectorSize)) {
+		t.Error("write to a read-only disk reached the file")
+	}
+
+	disk, err = OpenDisk(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskWrite(t, disk, 0xbb)
+	if err := disk.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onFile(), bytes.Repeat([]byte{0xbb}, SectorSize)) {
+		t.Error("write to a writable disk didn't reach the file")
+	}
+}
@@ -0,0 +1,287 @@
+package sim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// DOS emulates the handful of int 21h services small .COM programs lean on.
+// Files are opened relative to Root and can't escape it.
+type DOS struct {
+	Stdin  *bufio.Reader
+	Stdout io.Writer
+	Root   string
+
+	// Exited is set once the program terminates, with its exit code.
+	Exited   bool
+	ExitCode uint8
+
+	files map[uint16]*os.File
+	// line is what is left of the console line the last read of handle
+	// 0 didn't take, for the reads after it.
+	line []byte
+}
+
+// DOS error codes returned in ax with CF set.
+const (
+	dosFileNotFound  = 0x02
+	dosPathNotFound  = 0x03
+	dosTooManyFiles  = 0x04
+	dosAccessDenied  = 0x05
+	dosInvalidHandle = 0x06
+	dosInvalidAccess = 0x0c
+)
+
+const (
+	dosVersionMajor = 5
+	dosVersionMinor = 0
+
+	// Handles 0-4 are stdin, stdout, stderr, aux and prn.
+	dosFirstFreeFile = 5
+	dosMaxOpenFiles  = 20
+
+	// Terminates the strings int 21h/09h prints.
+	dosStringEnd = '$'
+	// What character input returns once stdin runs dry (^Z).
+	dosEndOfInput = 0x1a
+)
+
+func NewDOS(root string, stdin *bufio.Reader, stdout io.Writer) *DOS {
+	return &DOS{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Root:   root,
+		files:  make(map[uint16]*os.File),
+	}
+}
+
+// Install hooks int 20h and int 21h on m.
+func (d *DOS) Install(m *Machine) {
+	m.HandleInterrupt(0x20, func(m *Machine, _ uint8) error {
+		d.exit(m, 0)
+		return nil
+	})
+	m.HandleInterrupt(0x21, d.int21)
+}
+
+// Close closes every file the program left open.
+func (d *DOS) Close() {
+	for h, f := range d.files {
+		f.Close()
+		delete(d.files, h)
+	}
+}
+
+func (d *DOS) int21(m *Machine, _ uint8) error {
+	switch ah := m.Reg(&registers.AH); ah {
+	case 0x00:
+		d.exit(m, 0)
+	case 0x01:
+		c := d.readChar()
+		d.Stdout.Write([]byte{c})
+		m.SetReg(&registers.AL, uint16(c))
+	case 0x02:
+		d.Stdout.Write([]byte{uint8(m.Reg(&registers.DL))})
+	case 0x08:
+		m.SetReg(&registers.AL, uint16(d.readChar()))
+	case 0x09:
+		seg, off := m.Reg(&registers.DS), m.Reg(&registers.DX)
+		var out []byte
+		for i := 0; i < 0x10000; i++ {
+			c := uint8(m.readMem(seg, off+uint16(i), false))
+			if c == dosStringEnd {
+				break
+			}
+			out = append(out, c)
+		}
+		d.Stdout.Write(out)
+		m.SetReg(&registers.AL, dosStringEnd)
+	case 0x30:
+		m.SetReg(&registers.AL, dosVersionMajor)
+		m.SetReg(&registers.AH, dosVersionMinor)
+		m.SetReg(&registers.BX, 0)
+		m.SetReg(&registers.CX, 0)
+	case 0x3c:
+		d.open(m, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	case 0x3d:
+		switch m.Reg(&registers.AL) & 0b111 {
+		case 0:
+			d.open(m, os.O_RDONLY)
+		case 1:
+			d.open(m, os.O_WRONLY)
+		case 2:
+			d.open(m, os.O_RDWR)
+		default:
+			m.fail(dosInvalidAccess)
+		}
+	case 0x3e:
+		h := m.Reg(&registers.BX)
+		f, ok := d.files[h]
+		if !ok {
+			m.fail(dosInvalidHandle)
+			break
+		}
+		f.Close()
+		delete(d.files, h)
+		m.succeed(0)
+	case 0x3f:
+		d.read(m)
+	case 0x40:
+		d.write(m)
+	case 0x4c:
+		d.exit(m, uint8(m.Reg(&registers.AL)))
+	default:
+		return fmt.Errorf("unsupported int 21h function %02xh", ah)
+	}
+	return nil
+}
+
+func (d *DOS) exit(m *Machine, code uint8) {
+	d.Exited = true
+	d.ExitCode = code
+	m.Exited = true
+}
+
+func (d *DOS) readChar() uint8 {
+	if len(d.line) > 0 {
+		c := d.line[0]
+		d.line = d.line[1:]
+		return c
+	}
+	c, err := d.Stdin.ReadByte()
+	if err != nil {
+		return dosEndOfInput
+	}
+	return c
+}
+
+func (d *DOS) open(m *Machine, flags int) {
+	path, ok := d.path(m.Memory, m.Reg(&registers.DS), m.Reg(&registers.DX))
+	if !ok {
+		m.fail(dosPathNotFound)
+		return
+	}
+	h := uint16(dosFirstFreeFile)
+	for ; d.files[h] != nil; h++ {
+	}
+	if h >= dosMaxOpenFiles {
+		m.fail(dosTooManyFiles)
+		return
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		m.fail(dosFileNotFound)
+	case err != nil:
+		m.fail(dosAccessDenied)
+	default:
+		d.files[h] = f
+		m.succeed(h)
+	}
+}
+
+// path turns the ASCIIZ file name at seg:off into a host path inside Root.
+// Drive letters are dropped and backslashes become separators.
+func (d *DOS) path(mem *memory.Memory, seg, off uint16) (string, bool) {
+	var sb strings.Builder
+	for c := mem.Get(memory.Address(seg, off)); c != 0; c = mem.Get(memory.Address(seg, off)) {
+		sb.WriteByte(c)
+		off++
+		if sb.Len() > 128 {
+			return "", false
+		}
+	}
+	name := sb.String()
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+	name = strings.ReplaceAll(name, `\`, "/")
+	if name == "" {
+		return "", false
+	}
+	// Cleaning it as an absolute path drops any .. that would climb out.
+	return filepath.Join(d.Root, filepath.FromSlash(filepath.Clean("/"+name))), true
+}
+
+func (d *DOS) read(m *Machine) {
+	h, n := m.Reg(&registers.BX), m.Reg(&registers.CX)
+	buf := make([]byte, n)
+	var got int
+	var err error
+	switch f, ok := d.files[h]; {
+	case h == 0:
+		// Console input is line buffered like DOS's: a read waits for a
+		// whole line, and what doesn't fit is left for the next one.
+		if len(d.line) == 0 {
+			d.line, err = d.Stdin.ReadBytes('\n')
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		got = copy(buf, d.line)
+		d.line = d.line[got:]
+	case ok:
+		got, err = io.ReadFull(f, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+	default:
+		m.fail(dosInvalidHandle)
+		return
+	}
+	if err != nil {
+		m.fail(dosAccessDenied)
+		return
+	}
+	seg, off := m.Reg(&registers.DS), m.Reg(&registers.DX)
+	for i := 0; i < got; i++ {
+		m.writeMem(seg, off+uint16(i), uint16(buf[i]), false)
+	}
+	m.succeed(uint16(got))
+}
+
+func (d *DOS) write(m *Machine) {
+	h, n := m.Reg(&registers.BX), m.Reg(&registers.CX)
+	seg, off := m.Reg(&registers.DS), m.Reg(&registers.DX)
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = uint8(m.readMem(seg, off+uint16(i), false))
+	}
+
+	var w io.Writer
+	if f, ok := d.files[h]; ok {
+		w = f
+	} else if h == 1 || h == 2 {
+		w = d.Stdout
+	} else {
+		m.fail(dosInvalidHandle)
+		return
+	}
+	wrote, err := w.Write(buf)
+	if err != nil {
+		m.fail(dosAccessDenied)
+		return
+	}
+	m.succeed(uint16(wrote))
+}
+
+// succeed and fail report a service's result the DOS way: ax holds the
+// result or error code and CF says which.
+func (m *Machine) succeed(ax uint16) {
+	m.SetReg(&registers.AX, ax)
+	m.SetFlag(registers.FlagCF, false)
+}
+
+func (m *Machine) fail(code uint16) {
+	m.SetReg(&registers.AX, code)
+	m.SetFlag(registers.FlagCF, true)
+}
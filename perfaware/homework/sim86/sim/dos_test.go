@@ -0,0 +1,313 @@
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// dosMachine runs int 21h calls with d installed. Strings the calls use go
+// at dosName and buffers at dosBuf, both in segment 0.
+func dosMachine(t *testing.T, stdin string) (*Machine, *DOS, *bytes.Buffer) {
+	t.Helper()
+	m := newTestMachine(t, []byte{0xcd, 0x21}) // int 21h
+	var out bytes.Buffer
+	d := NewDOS(t.TempDir(), bufio.NewReader(strings.NewReader(stdin)), &out)
+	d.Install(m)
+	t.Cleanup(d.Close)
+	return m, d, &out
+}
+
+const (
+	dosName = 0x200
+	dosBuf  = 0x400
+)
+
+// callInt runs the int at 0000:0000 with the registers in regs and the rest
+// as the last call left them.
+func callInt(t *testing.T, m *Machine, regs ...regValue) {
+	t.Helper()
+	for _, r := range regs {
+		m.SetReg(r.r, r.val)
+	}
+	m.SetReg(&registers.IP, 0)
+	if _, err := m.Step(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putString(m *Machine, addr uint32, s string) {
+	for i := 0; i < len(s); i++ {
+		m.Memory.Poke(addr+uint32(i), s[i])
+	}
+}
+
+func getString(m *Machine, addr uint32, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = m.Memory.Peek(addr + uint32(i))
+	}
+	return string(b)
+}
+
+// checkResult checks the ax and CF a file service left.
+func checkResult(t *testing.T, m *Machine, what string, ax uint16, cf bool) {
+	t.Helper()
+	if got, gotCF := m.Reg(&registers.AX), m.Flag(registers.FlagCF); got != ax || gotCF != cf {
+		t.Errorf("%s: ax %#04x cf %t, want ax %#04x cf %t", what, got, gotCF, ax, cf)
+	}
+}
+
+func TestDOSConsole(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		stdin string
+		mem   string
+		regs  []regValue
+		want  []regValue
+		out   string
+		// exited is whether the call ends the program, with exit code.
+		exited bool
+		code   uint8
+	}{
+		{
+			name: "print character",
+			regs: []regValue{{&registers.AH, 0x02}, {&registers.DL, 'A'}},
+			out:  "A",
+		},
+		{
+			name: "print string",
+			mem:  "hello$world",
+			regs: []regValue{{&registers.AH, 0x09}, {&registers.DX, dosName}},
+			want: []regValue{{&registers.AL, '$'}},
+			out:  "hello",
+		},
+		{
+			name:  "read character with echo",
+			stdin: "xy",
+			regs:  []regValue{{&registers.AH, 0x01}},
+			want:  []regValue{{&registers.AL, 'x'}},
+			out:   "x",
+		},
+		{
+			name:  "read character without echo",
+			stdin: "xy",
+			regs:  []regValue{{&registers.AH, 0x08}},
+			want:  []regValue{{&registers.AL, 'x'}},
+		},
+		{
+			name: "read character at end of input",
+			regs: []regValue{{&registers.AH, 0x08}},
+			want: []regValue{{&registers.AL, dosEndOfInput}},
+		},
+		{
+			name: "version",
+			regs: []regValue{{&registers.AH, 0x30}, {&registers.BX, 0x1234}},
+			want: []regValue{{&registers.AL, dosVersionMajor}, {&registers.AH, dosVersionMinor}, {&registers.BX, 0}},
+		},
+		{
+			name: "write to stdout",
+			mem:  "abc",
+			regs: []regValue{{&registers.AH, 0x40}, {&registers.BX, 1}, {&registers.CX, 3}, {&registers.DX, dosName}},
+			want: []regValue{{&registers.AX, 3}},
+			out:  "abc",
+		},
+		{
+			name:   "terminate",
+			regs:   []regValue{{&registers.AH, 0x00}},
+			exited: true,
+		},
+		{
+			name:   "terminate with code",
+			regs:   []regValue{{&registers.AX, 0x4c07}},
+			exited: true,
+			code:   7,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m, d, out := dosMachine(t, c.stdin)
+			putString(m, dosName, c.mem)
+			callInt(t, m, c.regs...)
+			for _, w := range c.want {
+				if got := m.Reg(w.r); got != w.val {
+					t.Errorf("%s is %#04x, want %#04x", w.r, got, w.val)
+				}
+			}
+			if out.String() != c.out {
+				t.Errorf("printed %q, want %q", out, c.out)
+			}
+			if d.Exited != c.exited || m.Exited != c.exited || d.ExitCode != c.code {
+				t.Errorf("exited %t with %d, want %t with %d", d.Exited, d.ExitCode, c.exited, c.code)
+			}
+		})
+	}
+}
+
+func TestDOSUnsupported(t *testing.T) {
+	m, _, _ := dosMachine(t, "")
+	m.SetReg(&registers.AH, 0x99)
+	if _, err := m.Step(); err == nil || !strings.Contains(err.Error(), "function 99h") {
+		t.Errorf("got %v, want an unsupported function error", err)
+	}
+}
+
+func TestDOSPath(t *testing.T) {
+	root := filepath.FromSlash("/dos")
+	d := &DOS{Root: root}
+	for _, c := range []struct {
+		name, want string
+		ok         bool
+	}{
+		{"FOO.TXT", "FOO.TXT", true},
+		{`DATA\FOO.TXT`, "DATA/FOO.TXT", true},
+		{`C:\DATA\FOO.TXT`, "DATA/FOO.TXT", true},
+		{`C:FOO.TXT`, "FOO.TXT", true},
+		// Nothing climbs out of the root.
+		{`..\..\ESCAPE.TXT`, "ESCAPE.TXT", true},
+		{`DATA\..\..\..\ESCAPE.TXT`, "ESCAPE.TXT", true},
+		{`C:\..\ESCAPE.TXT`, "ESCAPE.TXT", true},
+		{`\ETC\PASSWD`, "ETC/PASSWD", true},
+		{"/etc/passwd", "etc/passwd", true},
+		{"", "", false},
+		{"C:", "", false},
+		{strings.Repeat("A", 129), "", false},
+	} {
+		mem := memory.New()
+		for i := 0; i < len(c.name); i++ {
+			mem.Poke(dosName+uint32(i), c.name[i])
+		}
+		got, ok := d.path(mem, 0, dosName)
+		want := ""
+		if c.ok {
+			want = filepath.Join(root, filepath.FromSlash(c.want))
+		}
+		if got != want || ok != c.ok {
+			t.Errorf("%q: got %q %t, want %q %t", c.name, got, ok, want, c.ok)
+		}
+	}
+}
+
+func TestDOSFiles(t *testing.T) {
+	m, d, _ := dosMachine(t, "")
+	open := func(ah, al uint8, name string) {
+		t.Helper()
+		putString(m, dosName, name+"\x00")
+		callInt(t, m, regValue{&registers.AH, uint16(ah)}, regValue{&registers.AL, uint16(al)}, regValue{&registers.DX, dosName})
+	}
+
+	open(0x3c, 0, `C:\OUT.TXT`)
+	checkResult(t, m, "create", dosFirstFreeFile, false)
+	putString(m, dosBuf, "hello")
+	callInt(t, m, regValue{&registers.AH, 0x40}, regValue{&registers.BX, dosFirstFreeFile}, regValue{&registers.CX, 5}, regValue{&registers.DX, dosBuf})
+	checkResult(t, m, "write", 5, false)
+	callInt(t, m, regValue{&registers.AH, 0x3e})
+	checkResult(t, m, "close", 0, false)
+	if data, err := os.ReadFile(filepath.Join(d.Root, "OUT.TXT")); err != nil || string(data) != "hello" {
+		t.Errorf("file holds %q (%v), want hello", data, err)
+	}
+
+	open(0x3d, 0, "OUT.TXT")
+	checkResult(t, m, "open", dosFirstFreeFile, false)
+	callInt(t, m, regValue{&registers.AH, 0x3f}, regValue{&registers.BX, dosFirstFreeFile}, regValue{&registers.CX, 100}, regValue{&registers.DX, dosBuf + 0x10})
+	checkResult(t, m, "read", 5, false)
+	if got := getString(m, dosBuf+0x10, 5); got != "hello" {
+		t.Errorf("read %q, want hello", got)
+	}
+	callInt(t, m, regValue{&registers.AH, 0x3f}, regValue{&registers.CX, 100})
+	checkResult(t, m, "read at end", 0, false)
+
+	// A second file gets the next handle.
+	open(0x3d, 2, "OUT.TXT")
+	checkResult(t, m, "open another", dosFirstFreeFile+1, false)
+
+	// A file created through .. lands in the root.
+	open(0x3c, 0, `..\..\ESCAPE.TXT`)
+	checkResult(t, m, "create outside", dosFirstFreeFile+2, false)
+	if _, err := os.Stat(filepath.Join(d.Root, "ESCAPE.TXT")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.Root, "..", "ESCAPE.TXT")); err == nil {
+		t.Error("created a file outside the root")
+	}
+
+	open(0x3d, 0, "MISSING.TXT")
+	checkResult(t, m, "open missing", dosFileNotFound, true)
+	open(0x3d, 0, `NODIR\FILE.TXT`)
+	checkResult(t, m, "open in missing directory", dosFileNotFound, true)
+	open(0x3d, 3, "OUT.TXT")
+	checkResult(t, m, "open with bad access", dosInvalidAccess, true)
+	open(0x3d, 0, "")
+	checkResult(t, m, "open without a name", dosPathNotFound, true)
+	callInt(t, m, regValue{&registers.AH, 0x3e}, regValue{&registers.BX, 9})
+	checkResult(t, m, "close unopened", dosInvalidHandle, true)
+	callInt(t, m, regValue{&registers.AH, 0x3f}, regValue{&registers.BX, 9})
+	checkResult(t, m, "read unopened", dosInvalidHandle, true)
+	callInt(t, m, regValue{&registers.AH, 0x40}, regValue{&registers.BX, 9})
+	checkResult(t, m, "write unopened", dosInvalidHandle, true)
+}
+
+func TestDOSTooManyFiles(t *testing.T) {
+	m, d, _ := dosMachine(t, "")
+	if err := os.WriteFile(filepath.Join(d.Root, "A"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	putString(m, dosName, "A\x00")
+	for h := dosFirstFreeFile; h < dosMaxOpenFiles; h++ {
+		callInt(t, m, regValue{&registers.AX, 0x3d00}, regValue{&registers.DX, dosName})
+		checkResult(t, m, "open", uint16(h), false)
+	}
+	callInt(t, m, regValue{&registers.AX, 0x3d00})
+	checkResult(t, m, "open one too many", dosTooManyFiles, true)
+}
+
+func TestDOSStdin(t *testing.T) {
+	// What doesn't fit in a read is left for the reads after it.
+	m, _, _ := dosMachine(t, "hello world\nsecond\nthird")
+	for _, c := range []struct {
+		ah   uint8
+		cx   uint16
+		want string
+	}{
+		{0x3f, 5, "hello"},
+		{0x3f, 100, " world\n"},
+		{0x08, 0, "s"},
+		{0x3f, 3, "eco"},
+		{0x01, 0, "n"},
+		{0x3f, 100, "d\n"},
+		{0x3f, 100, "third"},
+		{0x3f, 100, ""},
+	} {
+		callInt(t, m, regValue{&registers.AH, uint16(c.ah)}, regValue{&registers.BX, 0}, regValue{&registers.CX, c.cx}, regValue{&registers.DX, dosBuf})
+		var got string
+		if c.ah == 0x3f {
+			checkResult(t, m, "read", uint16(len(c.want)), false)
+			got = getString(m, dosBuf, len(c.want))
+		} else {
+			got = string(rune(m.Reg(&registers.AL)))
+		}
+		if got != c.want {
+			t.Errorf("function %02xh read %q, want %q", c.ah, got, c.want)
+		}
+	}
+}
+
+func TestDOSStdinLongLine(t *testing.T) {
+	// Lines longer than the reader's buffer come through whole.
+	line := strings.Repeat("0123456789", 10) + "\n"
+	m := newTestMachine(t, []byte{0xcd, 0x21})
+	d := NewDOS(t.TempDir(), bufio.NewReaderSize(strings.NewReader(line+"next\n"), 16), &bytes.Buffer{})
+	d.Install(m)
+	callInt(t, m, regValue{&registers.AH, 0x3f}, regValue{&registers.BX, 0}, regValue{&registers.CX, 0x200}, regValue{&registers.DX, dosBuf})
+	checkResult(t, m, "read", uint16(len(line)), false)
+	if got := getString(m, dosBuf, len(line)); got != line {
+		t.Errorf("read %q, want %q", got, line)
+	}
+	callInt(t, m, regValue{&registers.AH, 0x3f}, regValue{&registers.CX, 0x200})
+	checkResult(t, m, "read next", 5, false)
+}
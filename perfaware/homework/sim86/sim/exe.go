@@ -0,0 +1,144 @@
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// mzHeader is the fixed part of a DOS MZ executable's header. Sizes are
+// in 512 byte pages and 16 byte paragraphs, as in the file.
+type mzHeader struct {
+	Signature    [2]byte
+	LastPage     uint16 // bytes used in the last page, 0 meaning all 512
+	Pages        uint16
+	Relocations  uint16
+	HeaderParas  uint16
+	MinExtra     uint16
+	MaxExtra     uint16
+	SS, SP       uint16
+	Checksum     uint16
+	IP, CS       uint16
+	RelocTable   uint16
+	OverlayIndex uint16
+}
+
+const (
+	mzHeaderSize = 28
+	mzPageSize   = 512
+	paragraph    = 16
+	// The load module starts in the paragraph after the PSP.
+	pspParas = 0x10
+)
+
+// EXELoader loads an MZ executable with its PSP at Seg, relocated to run
+// from the paragraph right after it.
+type EXELoader struct {
+	Seg  uint16
+	Args string
+}
+
+// MZError is a malformed MZ executable.
+type MZError struct {
+	Msg string
+}
+
+func (e MZError) Error() string {
+	return "mz: " + e.Msg
+}
+
+func mzErrorf(format string, args ...any) error {
+	return MZError{fmt.Sprintf(format, args...)}
+}
+
+// parseMZ checks the header against the file and returns it with the
+// load module: the bytes after the header that actually get loaded.
+func parseMZ(image []byte) (mzHeader, []byte, error) {
+	var h mzHeader
+	if len(image) < mzHeaderSize {
+		return h, nil, mzErrorf("file is %d bytes, too short for the %d byte header", len(image), mzHeaderSize)
+	}
+	copy(h.Signature[:], image)
+	words := []*uint16{&h.LastPage, &h.Pages, &h.Relocations, &h.HeaderParas, &h.MinExtra,
+		&h.MaxExtra, &h.SS, &h.SP, &h.Checksum, &h.IP, &h.CS, &h.RelocTable, &h.OverlayIndex}
+	for i, w := range words {
+		*w = binary.LittleEndian.Uint16(image[2+2*i:])
+	}
+
+	if sig := string(h.Signature[:]); sig != "MZ" && sig != "ZM" {
+		return h, nil, mzErrorf("signature is %q, want \"MZ\"", sig)
+	}
+	if h.LastPage >= mzPageSize {
+		return h, nil, mzErrorf("last page byte count %d at offset 0x02 is not below %d", h.LastPage, mzPageSize)
+	}
+	if h.Pages == 0 {
+		return h, nil, mzErrorf("page count at offset 0x04 is 0")
+	}
+	size := int(h.Pages) * mzPageSize
+	if h.LastPage != 0 {
+		size -= mzPageSize - int(h.LastPage)
+	}
+	if size > len(image) {
+		return h, nil, mzErrorf("header says the image is %d bytes (%d pages, %d in the last) but the file is %d bytes",
+			size, h.Pages, h.LastPage, len(image))
+	}
+	headerSize := int(h.HeaderParas) * paragraph
+	if headerSize < mzHeaderSize {
+		return h, nil, mzErrorf("header size at offset 0x08 is %d paragraphs, smaller than the header itself", h.HeaderParas)
+	}
+	if headerSize > size {
+		return h, nil, mzErrorf("header size at offset 0x08 is %d bytes, past the %d byte image", headerSize, size)
+	}
+	relocEnd := int(h.RelocTable) + 4*int(h.Relocations)
+	if h.Relocations > 0 && (int(h.RelocTable) < mzHeaderSize || relocEnd > headerSize) {
+		return h, nil, mzErrorf("relocation table at 0x%04x with %d entries lies outside the %d byte header",
+			h.RelocTable, h.Relocations, headerSize)
+	}
+	return h, image[headerSize:size], nil
+}
+
+func (l EXELoader) Load(m *Machine, image []byte) error {
+	h, module, err := parseMZ(image)
+	if err != nil {
+		return err
+	}
+	tail, err := commandTail(l.Args)
+	if err != nil {
+		return err
+	}
+
+	// The program gets its load module plus at least MinExtra and at most
+	// MaxExtra paragraphs of whatever memory is left.
+	loadSeg := l.Seg + pspParas
+	moduleParas := uint32(len(module)+paragraph-1) / paragraph
+	free := int64(memoryTopSegment) - int64(loadSeg) - int64(moduleParas)
+	if free < int64(h.MinExtra) {
+		return mzErrorf("needs %d paragraphs beyond its %d byte load module, only %d are free",
+			h.MinExtra, len(module), max(free, 0))
+	}
+	extra := min(int64(h.MaxExtra), free)
+	top := uint16(uint32(loadSeg) + moduleParas + uint32(extra))
+
+	writePSP(m.Memory, l.Seg, tail, top)
+	m.Load(module, memory.Address(loadSeg, 0))
+
+	for i := 0; i < int(h.Relocations); i++ {
+		entry := image[int(h.RelocTable)+4*i:]
+		off := binary.LittleEndian.Uint16(entry)
+		seg := binary.LittleEndian.Uint16(entry[2:])
+		if uint32(seg)*paragraph+uint32(off)+2 > uint32(len(module)) {
+			return mzErrorf("relocation %d at %04x:%04x is outside the %d byte load module", i, seg, off, len(module))
+		}
+		seg += loadSeg
+		m.Memory.PutWord(seg, off, m.Memory.GetWord(seg, off)+loadSeg)
+	}
+
+	m.SetReg(&registers.DS, l.Seg)
+	m.SetReg(&registers.ES, l.Seg)
+	m.SetReg(&registers.SS, loadSeg+h.SS)
+	m.SetReg(&registers.SP, h.SP)
+	m.SetReg(&registers.CS, loadSeg+h.CS)
+	m.SetReg(&registers.IP, h.IP)
+	return nil
+}
@@ -0,0 +1,129 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// buildMZ makes an executable of module with a relocation at each seg:off
+// in relocs, and a header that fits them, which edit may then change.
+func buildMZ(module []byte, relocs [][2]uint16, edit func(h *mzHeader)) []byte {
+	headerParas := (mzHeaderSize + 4*len(relocs) + paragraph - 1) / paragraph
+	size := headerParas*paragraph + len(module)
+	h := mzHeader{
+		Signature:   [2]byte{'M', 'Z'},
+		LastPage:    uint16(size % mzPageSize),
+		Pages:       uint16((size + mzPageSize - 1) / mzPageSize),
+		Relocations: uint16(len(relocs)),
+		HeaderParas: uint16(headerParas),
+		MaxExtra:    0xffff,
+		SS:          0x20,
+		SP:          0x100,
+		IP:          0x3,
+		CS:          0,
+		RelocTable:  mzHeaderSize,
+	}
+	if edit != nil {
+		edit(&h)
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, h)
+	for _, r := range relocs {
+		binary.Write(&b, binary.LittleEndian, []uint16{r[1], r[0]})
+	}
+	b.Write(make([]byte, headerParas*paragraph-b.Len()))
+	b.Write(module)
+	return b.Bytes()
+}
+
+// mzModule is mov ax, seg 0; nop, with the segment to relocate at 0:1.
+var mzModule = []byte{0xb8, 0x00, 0x00, 0x90}
+
+func TestMZErrors(t *testing.T) {
+	reloc := [][2]uint16{{0, 1}}
+	for _, c := range []struct {
+		name  string
+		image []byte
+		want  string
+	}{
+		{"short", []byte("MZ"), "too short"},
+		{"signature", buildMZ(mzModule, nil, func(h *mzHeader) { h.Signature = [2]byte{'X', 'Y'} }), "signature"},
+		{"last page", buildMZ(mzModule, nil, func(h *mzHeader) { h.LastPage = mzPageSize }), "last page byte count 512"},
+		{"no pages", buildMZ(mzModule, nil, func(h *mzHeader) { h.Pages = 0 }), "page count"},
+		{"truncated", buildMZ(mzModule, nil, nil)[:mzHeaderSize+2], "but the file is 30 bytes"},
+		{"tiny header", buildMZ(mzModule, nil, func(h *mzHeader) { h.HeaderParas = 1 }), "smaller than the header"},
+		{"huge header", buildMZ(mzModule, nil, func(h *mzHeader) { h.HeaderParas = 3 }), "past the"},
+		{"table in fixed header", buildMZ(mzModule, reloc, func(h *mzHeader) { h.RelocTable = 2 }), "relocation table"},
+		{"table past header", buildMZ(mzModule, reloc, func(h *mzHeader) { h.Relocations = 2 }), "relocation table at 0x001c with 2 entries"},
+		{"relocation past module", buildMZ(mzModule, [][2]uint16{{0, 3}}, nil), "relocation 0 at 0000:0003"},
+		{"relocation segment past module", buildMZ(mzModule, [][2]uint16{{1, 0}}, nil), "outside the 4 byte load module"},
+		{"min extra", buildMZ(mzModule, nil, func(h *mzHeader) { h.MinExtra = 0xffff }), "needs 65535 paragraphs"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewMachine(Options{})
+			err := EXELoader{Seg: 0x1000}.Load(m, c.image)
+			var mzErr MZError
+			if !errors.As(err, &mzErr) {
+				t.Fatalf("got %v, want an MZError", err)
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %q, want it to say %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestMZLoad(t *testing.T) {
+	image := buildMZ(mzModule, [][2]uint16{{0, 1}}, nil)
+	h, module, err := parseMZ(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(module, mzModule) {
+		t.Errorf("load module is % x, want % x", module, mzModule)
+	}
+	if h.Relocations != 1 || h.IP != 3 {
+		t.Errorf("header has %d relocations and ip %#x, want 1 and 0x3", h.Relocations, h.IP)
+	}
+
+	const psp = 0x1000
+	loadSeg := uint16(psp + pspParas)
+	m := NewMachine(Options{})
+	if err := (EXELoader{Seg: psp, Args: "x"}).Load(m, image); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Memory.GetWord(loadSeg, 1); got != loadSeg {
+		t.Errorf("relocated word is %#04x, want the load segment %#04x", got, loadSeg)
+	}
+	if got := m.Memory.Peek(memory.Address(loadSeg, 3)); got != 0x90 {
+		t.Errorf("byte after the relocation is %#02x, want 0x90", got)
+	}
+	for _, c := range []struct {
+		r    *registers.Register
+		want uint16
+	}{
+		{&registers.CS, loadSeg},
+		{&registers.IP, 3},
+		{&registers.SS, loadSeg + 0x20},
+		{&registers.SP, 0x100},
+		{&registers.DS, psp},
+		{&registers.ES, psp},
+	} {
+		if got := m.Reg(c.r); got != c.want {
+			t.Errorf("%s is %#04x, want %#04x", c.r, got, c.want)
+		}
+	}
+	// The PSP starts with int 20h and holds the command tail at 80h.
+	if m.Memory.GetWord(psp, 0) != 0x20cd {
+		t.Errorf("PSP starts with %#04x, want int 20h", m.Memory.GetWord(psp, 0))
+	}
+	if n := m.Memory.Peek(memory.Address(psp, 0x80)); n != 2 {
+		t.Errorf("command tail is %d bytes, want 2", n)
+	}
+}
@@ -0,0 +1,620 @@
+package sim
+
+import (
+	"math/bits"
+	"sim86/instructions"
+	"sim86/registers"
+)
+
+func (m *Machine) execute(ex *Exec) error {
+	op := ex.Op
+	wide := op.Wide()
+	dst := m.locate(ex, op.Operands[0])
+	src := m.locate(ex, op.Operands[1])
+
+	switch op.OpType {
+	case instructions.OpMov:
+		m.write(dst, m.read(src))
+
+	case instructions.OpAdd:
+		m.write(dst, m.add(m.read(dst), m.read(src), 0, wide))
+	case instructions.OpAdc:
+		m.write(dst, m.add(m.read(dst), m.read(src), m.carry(), wide))
+	case instructions.OpSub:
+		m.write(dst, m.sub(m.read(dst), m.read(src), 0, wide))
+	case instructions.OpSbb:
+		m.write(dst, m.sub(m.read(dst), m.read(src), m.carry(), wide))
+	case instructions.OpCmp:
+		m.sub(m.read(dst), m.read(src), 0, wide)
+	case instructions.OpAnd:
+		m.write(dst, m.logic(m.read(dst)&m.read(src), wide))
+	case instructions.OpTest:
+		m.logic(m.read(dst)&m.read(src), wide)
+	case instructions.OpOr:
+		m.write(dst, m.logic(m.read(dst)|m.read(src), wide))
+	case instructions.OpXor:
+		m.write(dst, m.logic(m.read(dst)^m.read(src), wide))
+
+	case instructions.OpInc:
+		cf := m.Flag(registers.FlagCF)
+		m.write(dst, m.add(m.read(dst), 1, 0, wide))
+		m.SetFlag(registers.FlagCF, cf)
+	case instructions.OpDec:
+		cf := m.Flag(registers.FlagCF)
+		m.write(dst, m.sub(m.read(dst), 1, 0, wide))
+		m.SetFlag(registers.FlagCF, cf)
+	case instructions.OpNeg:
+		m.write(dst, m.sub(0, m.read(dst), 0, wide))
+	case instructions.OpNot:
+		m.write(dst, ^m.read(dst))
+
+	case instructions.OpShl, instructions.OpShr, instructions.OpSar,
+		instructions.OpRol, instructions.OpRor, instructions.OpRcl, instructions.OpRcr:
+		count := m.read(src) & 0xff
+		ex.ShiftCount = count
+		m.write(dst, m.shift(op.OpType, m.read(dst), count, wide))
+
+	case instructions.OpMul, instructions.OpImul:
+		m.multiply(op.OpType, m.read(dst), wide)
+	case instructions.OpDiv, instructions.OpIdiv:
+		if !m.divide(op.OpType, m.read(dst), wide) {
+			// The 8086 pushes the address after the div, so the
+			// handler returns past it.
+			return m.interrupt(0)
+		}
+
+	case instructions.OpCbw:
+		m.SetReg(&registers.AX, uint16(int16(int8(m.Reg(&registers.AL)))))
+	case instructions.OpCwd:
+		if m.Reg(&registers.AX)&0x8000 != 0 {
+			m.SetReg(&registers.DX, 0xffff)
+		} else {
+			m.SetReg(&registers.DX, 0)
+		}
+
+	case instructions.OpAaa, instructions.OpAas, instructions.OpDaa, instructions.OpDas,
+		instructions.OpAam, instructions.OpAad:
+		m.decimalAdjust(op.OpType)
+
+	case instructions.OpXchg:
+		a, b := m.read(dst), m.read(src)
+		m.write(dst, b)
+		m.write(src, a)
+	case instructions.OpLea:
+		_, off := m.effectiveAddress(op, op.Operands[1])
+		m.write(dst, off)
+	case instructions.OpLds, instructions.OpLes:
+		seg, off := m.effectiveAddress(op, op.Operands[1])
+		m.write(dst, m.readMem(seg, off, true))
+		segReg := &registers.DS
+		if op.OpType == instructions.OpLes {
+			segReg = &registers.ES
+		}
+		m.SetReg(segReg, m.readMem(seg, off+2, true))
+	case instructions.OpXlat:
+		off := m.Reg(&registers.BX) + m.Reg(&registers.AL)
+		m.SetReg(&registers.AL, m.readMem(m.dataSegment(op), off, false))
+	case instructions.OpLahf:
+		m.SetReg(&registers.AH, m.Reg(&registers.FLAGS)&lahfMask)
+	case instructions.OpSahf:
+		m.SetReg(&registers.FLAGS, m.Reg(&registers.FLAGS)&^lahfMask|m.Reg(&registers.AH)&lahfMask)
+
+	case instructions.OpJe, instructions.OpJl, instructions.OpJle, instructions.OpJb,
+		instructions.OpJbe, instructions.OpJp, instructions.OpJo, instructions.OpJs,
+		instructions.OpJne, instructions.OpJnl, instructions.OpJg, instructions.OpJnb,
+		instructions.OpJa, instructions.OpJnp, instructions.OpJno, instructions.OpJns,
+		instructions.OpLoop, instructions.OpLoopz, instructions.OpLoopnz, instructions.OpJcxz:
+		ex.BranchTaken = m.condition(op.OpType)
+		if ex.BranchTaken {
+			m.SetReg(&registers.IP, m.Reg(&registers.IP)+dst.value)
+		}
+	case instructions.OpJmp:
+		m.jump(ex, dst)
+
+	case instructions.OpPush:
+		// push sp pushes the already decremented value, like the 8086.
+		l := only(op, dst, src)
+		val := m.read(l)
+		if l.reg == &registers.SP {
+			val -= 2
+		}
+		m.push(val)
+	case instructions.OpPop:
+		m.write(only(op, dst, src), m.pop())
+	case instructions.OpPushf:
+		m.push(m.Reg(&registers.FLAGS) | registers.FlagReserved)
+	case instructions.OpPopf:
+		m.SetReg(&registers.FLAGS, m.pop()&registers.FlagMask)
+
+	case instructions.OpCall:
+		m.call(ex, dst)
+	case instructions.OpRet:
+		m.SetReg(&registers.IP, m.pop())
+		m.SetReg(&registers.SP, m.Reg(&registers.SP)+dst.value)
+	case instructions.OpRetf:
+		m.SetReg(&registers.IP, m.pop())
+		m.SetReg(&registers.CS, m.pop())
+		m.SetReg(&registers.SP, m.Reg(&registers.SP)+dst.value)
+
+	case instructions.OpInt:
+		return m.interrupt(uint8(dst.value))
+	case instructions.OpInt3:
+		return m.interrupt(3)
+	case instructions.OpInto:
+		ex.BranchTaken = m.Flag(registers.FlagOF)
+		if ex.BranchTaken {
+			return m.interrupt(4)
+		}
+	case instructions.OpIret:
+		m.iret()
+
+	case instructions.OpIn:
+		val, err := m.in(m.read(src), wide)
+		if err != nil {
+			return err
+		}
+		m.write(dst, val)
+	case instructions.OpOut:
+		return m.out(m.read(dst), m.read(src), wide)
+
+	case instructions.OpMovs, instructions.OpCmps, instructions.OpScas,
+		instructions.OpLods, instructions.OpStos:
+		m.stringOp(ex)
+
+	case instructions.OpClc:
+		m.SetFlag(registers.FlagCF, false)
+	case instructions.OpCmc:
+		m.SetFlag(registers.FlagCF, !m.Flag(registers.FlagCF))
+	case instructions.OpStc:
+		m.SetFlag(registers.FlagCF, true)
+	case instructions.OpCld:
+		m.SetFlag(registers.FlagDF, false)
+	case instructions.OpStd:
+		m.SetFlag(registers.FlagDF, true)
+	case instructions.OpCli:
+		m.SetFlag(registers.FlagIF, false)
+	case instructions.OpSti:
+		m.SetFlag(registers.FlagIF, true)
+
+	case instructions.OpHlt:
+		m.Halted = true
+	case instructions.OpWait, instructions.OpEsc:
+		// Nothing to wait for and no coprocessor to talk to.
+
+	default:
+		return UnimplementedError{op.OpType}
+	}
+	return nil
+}
+
+// jump handles every form of jmp: relative, through a register or memory
+// word, and far to an explicit or stored segment:offset.
+func (m *Machine) jump(ex *Exec, target location) {
+	o := ex.Op.Operands[0]
+	switch {
+	case o.Type == instructions.ValImmediate:
+		m.SetReg(&registers.IP, m.Reg(&registers.IP)+target.value)
+	case o.Explicit:
+		m.SetReg(&registers.CS, o.Segment)
+		m.SetReg(&registers.IP, uint16(o.Disp))
+	case ex.Op.Far:
+		m.SetReg(&registers.IP, m.readMem(target.seg, target.off, true))
+		m.SetReg(&registers.CS, m.readMem(target.seg, target.off+2, true))
+	default:
+		m.SetReg(&registers.IP, m.read(target))
+	}
+}
+
+// call is jump with the return address pushed first. The target is read
+// before anything is pushed, since it may live on the stack.
+func (m *Machine) call(ex *Exec, target location) {
+	o := ex.Op.Operands[0]
+	switch {
+	case o.Type == instructions.ValImmediate:
+		m.push(m.Reg(&registers.IP))
+		m.SetReg(&registers.IP, m.Reg(&registers.IP)+target.value)
+	case o.Explicit:
+		m.push(m.Reg(&registers.CS))
+		m.push(m.Reg(&registers.IP))
+		m.SetReg(&registers.CS, o.Segment)
+		m.SetReg(&registers.IP, uint16(o.Disp))
+	case ex.Op.Far:
+		ip := m.readMem(target.seg, target.off, true)
+		cs := m.readMem(target.seg, target.off+2, true)
+		m.push(m.Reg(&registers.CS))
+		m.push(m.Reg(&registers.IP))
+		m.SetReg(&registers.CS, cs)
+		m.SetReg(&registers.IP, ip)
+	default:
+		ip := m.read(target)
+		m.push(m.Reg(&registers.IP))
+		m.SetReg(&registers.IP, ip)
+	}
+}
+
+// only returns the location of a one operand instruction's operand, which
+// the decoder puts in either slot depending on the encoding.
+func only(op instructions.Operation, dst, src location) location {
+	if op.Operands[0].Type == instructions.ValNone {
+		return src
+	}
+	return dst
+}
+
+func (m *Machine) condition(t instructions.OpType) bool {
+	cf := m.Flag(registers.FlagCF)
+	pf := m.Flag(registers.FlagPF)
+	zf := m.Flag(registers.FlagZF)
+	sf := m.Flag(registers.FlagSF)
+	of := m.Flag(registers.FlagOF)
+
+	switch t {
+	case instructions.OpJe:
+		return zf
+	case instructions.OpJl:
+		return sf != of
+	case instructions.OpJle:
+		return zf || sf != of
+	case instructions.OpJb:
+		return cf
+	case instructions.OpJbe:
+		return cf || zf
+	case instructions.OpJp:
+		return pf
+	case instructions.OpJo:
+		return of
+	case instructions.OpJs:
+		return sf
+	case instructions.OpJne:
+		return !zf
+	case instructions.OpJnl:
+		return sf == of
+	case instructions.OpJg:
+		return !zf && sf == of
+	case instructions.OpJnb:
+		return !cf
+	case instructions.OpJa:
+		return !cf && !zf
+	case instructions.OpJnp:
+		return !pf
+	case instructions.OpJno:
+		return !of
+	case instructions.OpJns:
+		return !sf
+	case instructions.OpLoop:
+		m.SetReg(&registers.CX, m.Reg(&registers.CX)-1)
+		return m.Reg(&registers.CX) != 0
+	case instructions.OpLoopz:
+		m.SetReg(&registers.CX, m.Reg(&registers.CX)-1)
+		return m.Reg(&registers.CX) != 0 && zf
+	case instructions.OpLoopnz:
+		m.SetReg(&registers.CX, m.Reg(&registers.CX)-1)
+		return m.Reg(&registers.CX) != 0 && !zf
+	case instructions.OpJcxz:
+		return m.Reg(&registers.CX) == 0
+	}
+	return false
+}
+
+// stringOp runs movs/cmps/scas/lods/stos, repeating while cx allows it
+// when there is a rep prefix.
+func (m *Machine) stringOp(ex *Exec) {
+	op := ex.Op
+	wide := op.Wide()
+	step := uint16(1)
+	if wide {
+		step = 2
+	}
+	if m.Flag(registers.FlagDF) {
+		step = -step
+	}
+	srcSeg := m.dataSegment(op)
+
+	if op.Rep {
+		ex.RepCount = m.Reg(&registers.CX)
+	}
+	for !op.Rep || m.Reg(&registers.CX) != 0 {
+		si, di := m.Reg(&registers.SI), m.Reg(&registers.DI)
+		switch op.OpType {
+		case instructions.OpMovs:
+			m.writeMem(m.Reg(&registers.ES), di, m.readMem(srcSeg, si, wide), wide)
+			m.SetReg(&registers.SI, si+step)
+			m.SetReg(&registers.DI, di+step)
+		case instructions.OpCmps:
+			m.sub(m.readMem(srcSeg, si, wide), m.readMem(m.Reg(&registers.ES), di, wide), 0, wide)
+			m.SetReg(&registers.SI, si+step)
+			m.SetReg(&registers.DI, di+step)
+		case instructions.OpScas:
+			m.sub(m.Reg(accumulator(wide)), m.readMem(m.Reg(&registers.ES), di, wide), 0, wide)
+			m.SetReg(&registers.DI, di+step)
+		case instructions.OpLods:
+			m.SetReg(accumulator(wide), m.readMem(srcSeg, si, wide))
+			m.SetReg(&registers.SI, si+step)
+		case instructions.OpStos:
+			m.writeMem(m.Reg(&registers.ES), di, m.Reg(accumulator(wide)), wide)
+			m.SetReg(&registers.DI, di+step)
+		}
+
+		if !op.Rep {
+			break
+		}
+		m.SetReg(&registers.CX, m.Reg(&registers.CX)-1)
+		compares := op.OpType == instructions.OpCmps || op.OpType == instructions.OpScas
+		if compares && m.Flag(registers.FlagZF) != op.RepZ {
+			break
+		}
+	}
+}
+
+func accumulator(wide bool) *registers.Register {
+	if wide {
+		return &registers.AX
+	}
+	return &registers.AL
+}
+
+// The flags lahf/sahf move, the ones the 8080 had.
+const lahfMask = registers.FlagSF | registers.FlagZF | registers.FlagAF | registers.FlagPF | registers.FlagCF
+
+func widthMask(wide bool) uint32 {
+	if wide {
+		return 0xffff
+	}
+	return 0xff
+}
+
+func signBit(wide bool) uint32 {
+	if wide {
+		return 0x8000
+	}
+	return 0x80
+}
+
+func (m *Machine) carry() uint16 {
+	if m.Flag(registers.FlagCF) {
+		return 1
+	}
+	return 0
+}
+
+// setCommonFlags sets SF, ZF and PF from a result. PF only ever looks at
+// the low byte, even for word operations.
+func (m *Machine) setCommonFlags(r uint32, wide bool) {
+	m.SetFlag(registers.FlagSF, r&signBit(wide) != 0)
+	m.SetFlag(registers.FlagZF, r&widthMask(wide) == 0)
+	m.SetFlag(registers.FlagPF, bits.OnesCount8(uint8(r))%2 == 0)
+}
+
+func (m *Machine) add(a, b, c uint16, wide bool) uint16 {
+	mask := widthMask(wide)
+	x, y := uint32(a)&mask, uint32(b)&mask
+	r := x + y + uint32(c)
+	m.SetFlag(registers.FlagCF, r > mask)
+	m.SetFlag(registers.FlagAF, (x^y^r)&0x10 != 0)
+	m.SetFlag(registers.FlagOF, ^(x^y)&(x^r)&signBit(wide) != 0)
+	m.setCommonFlags(r, wide)
+	return uint16(r & mask)
+}
+
+func (m *Machine) sub(a, b, c uint16, wide bool) uint16 {
+	mask := widthMask(wide)
+	x, y := uint32(a)&mask, uint32(b)&mask
+	r := x - y - uint32(c)
+	m.SetFlag(registers.FlagCF, x < y+uint32(c))
+	m.SetFlag(registers.FlagAF, (x^y^r)&0x10 != 0)
+	m.SetFlag(registers.FlagOF, (x^y)&(x^r)&signBit(wide) != 0)
+	m.setCommonFlags(r, wide)
+	return uint16(r & mask)
+}
+
+func (m *Machine) logic(r uint16, wide bool) uint16 {
+	m.SetFlag(registers.FlagCF, false)
+	m.SetFlag(registers.FlagOF, false)
+	m.SetFlag(registers.FlagAF, false)
+	m.setCommonFlags(uint32(r), wide)
+	return r
+}
+
+// shift runs one of the shift/rotate group count times. A count of zero
+// leaves the operand and flags alone.
+func (m *Machine) shift(t instructions.OpType, v, count uint16, wide bool) uint16 {
+	if count == 0 {
+		return v
+	}
+	mask := widthMask(wide)
+	sign := signBit(wide)
+	x := uint32(v) & mask
+	cf := m.Flag(registers.FlagCF)
+	of := false
+
+	for i := uint16(0); i < count; i++ {
+		msb := x&sign != 0
+		lsb := x&1 != 0
+		switch t {
+		case instructions.OpShl:
+			cf = msb
+			x = (x << 1) & mask
+			of = (x&sign != 0) != cf
+		case instructions.OpShr:
+			cf = lsb
+			of = msb
+			x >>= 1
+		case instructions.OpSar:
+			cf = lsb
+			of = false
+			x = x>>1 | x&sign
+		case instructions.OpRol:
+			cf = msb
+			x = (x << 1) & mask
+			if cf {
+				x |= 1
+			}
+			of = (x&sign != 0) != cf
+		case instructions.OpRor:
+			cf = lsb
+			x >>= 1
+			if cf {
+				x |= sign
+			}
+			of = (x&sign != 0) != (x&(sign>>1) != 0)
+		case instructions.OpRcl:
+			x = (x << 1) & mask
+			if cf {
+				x |= 1
+			}
+			cf = msb
+			of = (x&sign != 0) != cf
+		case instructions.OpRcr:
+			of = msb != cf
+			x >>= 1
+			if cf {
+				x |= sign
+			}
+			cf = lsb
+		}
+	}
+
+	m.SetFlag(registers.FlagCF, cf)
+	m.SetFlag(registers.FlagOF, of)
+	switch t {
+	case instructions.OpShl, instructions.OpShr, instructions.OpSar:
+		m.setCommonFlags(x, wide)
+	}
+	return uint16(x)
+}
+
+// multiply implements mul and imul: al*src into ax, or ax*src into dx:ax.
+// CF and OF say whether the upper half carries any significance.
+func (m *Machine) multiply(t instructions.OpType, v uint16, wide bool) {
+	var upper bool
+	if wide {
+		var r uint32
+		if t == instructions.OpImul {
+			r = uint32(int32(int16(m.Reg(&registers.AX))) * int32(int16(v)))
+			upper = int32(r) != int32(int16(r))
+		} else {
+			r = uint32(m.Reg(&registers.AX)) * uint32(v)
+			upper = r>>16 != 0
+		}
+		m.SetReg(&registers.AX, uint16(r))
+		m.SetReg(&registers.DX, uint16(r>>16))
+	} else {
+		var r uint16
+		if t == instructions.OpImul {
+			r = uint16(int16(int8(m.Reg(&registers.AL))) * int16(int8(v)))
+			upper = int16(r) != int16(int8(r))
+		} else {
+			r = m.Reg(&registers.AL) * (v & 0xff)
+			upper = r>>8 != 0
+		}
+		m.SetReg(&registers.AX, r)
+	}
+	m.SetFlag(registers.FlagCF, upper)
+	m.SetFlag(registers.FlagOF, upper)
+}
+
+// divide implements div and idiv: ax/src into al rem ah, or dx:ax/src into
+// ax rem dx. It reports false, leaving them alone, for a zero divisor or a
+// quotient that doesn't fit: a divide error.
+func (m *Machine) divide(t instructions.OpType, v uint16, wide bool) bool {
+	if wide {
+		dividend := uint32(m.Reg(&registers.DX))<<16 | uint32(m.Reg(&registers.AX))
+		if v == 0 {
+			return false
+		}
+		if t == instructions.OpIdiv {
+			q := int32(dividend) / int32(int16(v))
+			r := int32(dividend) % int32(int16(v))
+			if q > 0x7fff || q < -0x7fff {
+				return false
+			}
+			m.SetReg(&registers.AX, uint16(q))
+			m.SetReg(&registers.DX, uint16(r))
+			return true
+		}
+		q := dividend / uint32(v)
+		if q > 0xffff {
+			return false
+		}
+		m.SetReg(&registers.AX, uint16(q))
+		m.SetReg(&registers.DX, uint16(dividend%uint32(v)))
+		return true
+	}
+
+	dividend := m.Reg(&registers.AX)
+	divisor := v & 0xff
+	if divisor == 0 {
+		return false
+	}
+	if t == instructions.OpIdiv {
+		q := int16(dividend) / int16(int8(divisor))
+		r := int16(dividend) % int16(int8(divisor))
+		if q > 0x7f || q < -0x7f {
+			return false
+		}
+		m.SetReg(&registers.AL, uint16(q))
+		m.SetReg(&registers.AH, uint16(r))
+		return true
+	}
+	q := dividend / divisor
+	if q > 0xff {
+		return false
+	}
+	m.SetReg(&registers.AL, q)
+	m.SetReg(&registers.AH, dividend%divisor)
+	return true
+}
+
+// decimalAdjust implements the BCD adjustments.
+func (m *Machine) decimalAdjust(t instructions.OpType) {
+	al := m.Reg(&registers.AL)
+	af := m.Flag(registers.FlagAF)
+	cf := m.Flag(registers.FlagCF)
+
+	switch t {
+	case instructions.OpAaa, instructions.OpAas:
+		adjust := al&0x0f > 9 || af
+		if adjust {
+			if t == instructions.OpAaa {
+				m.SetReg(&registers.AX, m.Reg(&registers.AX)+0x106)
+			} else {
+				m.SetReg(&registers.AL, al-6)
+				m.SetReg(&registers.AH, m.Reg(&registers.AH)-1)
+			}
+		}
+		m.SetReg(&registers.AL, m.Reg(&registers.AL)&0x0f)
+		m.SetFlag(registers.FlagAF, adjust)
+		m.SetFlag(registers.FlagCF, adjust)
+	case instructions.OpDaa, instructions.OpDas:
+		r := al
+		newCF := false
+		if al&0x0f > 9 || af {
+			if t == instructions.OpDaa {
+				r += 6
+			} else {
+				r -= 6
+			}
+			af = true
+		}
+		if al > 0x99 || cf {
+			if t == instructions.OpDaa {
+				r += 0x60
+			} else {
+				r -= 0x60
+			}
+			newCF = true
+		}
+		m.SetReg(&registers.AL, r)
+		m.SetFlag(registers.FlagAF, af)
+		m.SetFlag(registers.FlagCF, newCF)
+		m.setCommonFlags(uint32(r), false)
+	case instructions.OpAam:
+		m.SetReg(&registers.AH, al/10)
+		m.SetReg(&registers.AL, al%10)
+		m.setCommonFlags(uint32(m.Reg(&registers.AL)), false)
+	case instructions.OpAad:
+		m.SetReg(&registers.AL, m.Reg(&registers.AH)*10+al)
+		m.SetReg(&registers.AH, 0)
+		m.setCommonFlags(uint32(m.Reg(&registers.AL)), false)
+	}
+}
@@ -0,0 +1,165 @@
+package sim
+
+import (
+	"context"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+type regValue struct {
+	r   *registers.Register
+	val uint16
+}
+
+// programTest runs code from seg:0000 to its end with the stack at
+// 2000:0100, after setting regs and calling setup, and checks the
+// registers and the words at physical addresses that follow.
+type programTest struct {
+	name  string
+	seg   uint16
+	code  []byte
+	regs  []regValue
+	setup func(m *Machine)
+	want  []regValue
+	words map[uint32]uint16
+	flags map[uint16]bool
+}
+
+func (c programTest) run(t *testing.T) *Machine {
+	t.Helper()
+	m := NewMachine(Options{})
+	if err := (RawLoader{Seg: c.seg}).Load(m, c.code); err != nil {
+		t.Fatal(err)
+	}
+	m.SetReg(&registers.SS, 0x2000)
+	m.SetReg(&registers.SP, 0x100)
+	for _, r := range c.regs {
+		m.SetReg(r.r, r.val)
+	}
+	if c.setup != nil {
+		c.setup(m)
+	}
+	m.StepLimit = 100
+	if res := m.Run(context.Background()); res.Reason != StopEnd {
+		t.Fatalf("run stopped with %v after %d instructions: %v", res.Reason, res.Executed, res.Err)
+	}
+	for _, w := range c.want {
+		if got := m.Reg(w.r); got != w.val {
+			t.Errorf("%s is %#04x, want %#04x", w.r, got, w.val)
+		}
+	}
+	for addr, want := range c.words {
+		if got := m.Memory.GetWord(uint16(addr>>4), uint16(addr&0xf)); got != want {
+			t.Errorf("word at %05x is %#04x, want %#04x", addr, got, want)
+		}
+	}
+	for bit, want := range c.flags {
+		if got := m.Flag(bit); got != want {
+			t.Errorf("flags %s: %#04x bit is %t, want %t", registers.FlagsString(m.Reg(&registers.FLAGS)), bit, got, want)
+		}
+	}
+	return m
+}
+
+func TestStack(t *testing.T) {
+	const stack = 0x20000
+	for _, c := range []programTest{
+		{
+			name:  "push pop",
+			code:  []byte{0xb8, 0x34, 0x12, 0x50, 0x5b}, // mov ax, 0x1234; push ax; pop bx
+			want:  []regValue{{&registers.BX, 0x1234}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfe: 0x1234},
+		},
+		{
+			name:  "sp wraps",
+			code:  []byte{0xb8, 0x34, 0x12, 0x50, 0x59}, // mov ax, 0x1234; push ax; pop cx
+			regs:  []regValue{{&registers.SP, 0}},
+			want:  []regValue{{&registers.CX, 0x1234}, {&registers.SP, 0}},
+			words: map[uint32]uint16{stack + 0xfffe: 0x1234},
+		},
+		{
+			name: "memory",
+			code: []byte{
+				0xc7, 0x06, 0x00, 0x01, 0x78, 0x56, // mov word [0x100], 0x5678
+				0xff, 0x36, 0x00, 0x01, // push word [0x100]
+				0x8f, 0x06, 0x02, 0x01, // pop word [0x102]
+			},
+			want:  []regValue{{&registers.SP, 0x100}},
+			words: map[uint32]uint16{0x102: 0x5678},
+		},
+		{
+			name: "segment registers",
+			code: []byte{
+				0xb8, 0x00, 0x30, // mov ax, 0x3000
+				0x8e, 0xc0, // mov es, ax
+				0x06, // push es
+				0x1f, // pop ds
+			},
+			want: []regValue{{&registers.DS, 0x3000}, {&registers.SP, 0x100}},
+		},
+		{
+			name:  "flags",
+			code:  []byte{0xf9, 0x9c, 0xf8, 0x9d}, // stc; pushf; clc; popf
+			want:  []regValue{{&registers.SP, 0x100}},
+			flags: map[uint16]bool{registers.FlagCF: true},
+		},
+		{
+			name: "call ret",
+			code: []byte{
+				0xe8, 0x05, 0x00, // call sub
+				0xbb, 0x01, 0x00, // mov bx, 1
+				0xeb, 0x04, // jmp end
+				0xb9, 0x02, 0x00, // sub: mov cx, 2
+				0xc3, // ret
+			},
+			want:  []regValue{{&registers.BX, 1}, {&registers.CX, 2}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfe: 3},
+		},
+		{
+			name: "far call retf",
+			code: []byte{
+				0x9a, 0x0a, 0x00, 0x00, 0x00, // call 0000:sub
+				0xbb, 0x01, 0x00, // mov bx, 1
+				0xeb, 0x04, // jmp end
+				0xb9, 0x02, 0x00, // sub: mov cx, 2
+				0xcb, // retf
+			},
+			want:  []regValue{{&registers.BX, 1}, {&registers.CX, 2}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfc: 5, stack + 0xfe: 0},
+		},
+		{
+			name: "ret imm16",
+			code: []byte{
+				0x50, 0x50, // push ax; push ax
+				0xe8, 0x05, 0x00, // call sub
+				0xbb, 0x01, 0x00, // mov bx, 1
+				0xeb, 0x03, // jmp end
+				0xc2, 0x04, 0x00, // sub: ret 4
+			},
+			want: []regValue{{&registers.BX, 1}, {&registers.SP, 0x100}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) { c.run(t) })
+	}
+}
+
+func TestStackAccessTrace(t *testing.T) {
+	m := newTestMachine(t, []byte{0x50}) // push ax
+	m.TraceMemory = true
+	m.SetReg(&registers.SS, 0x2000)
+	m.SetReg(&registers.SP, 0x100)
+	m.SetReg(&registers.AX, 0xbeef)
+	ex, err := m.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Access{Write: true, Seg: 0x2000, Off: 0xfe, Wide: true, Value: 0xbeef}
+	if len(ex.Accesses) != 1 || ex.Accesses[0] != want {
+		t.Fatalf("push traced %+v, want [%+v]", ex.Accesses, want)
+	}
+	if got := ex.Accesses[0].Address(); got != memory.Address(0x2000, 0xfe) {
+		t.Errorf("push wrote at %05x", got)
+	}
+}
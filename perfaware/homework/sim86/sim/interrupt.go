@@ -0,0 +1,132 @@
+package sim
+
+import (
+	"errors"
+
+	"sim86/instructions"
+	"sim86/registers"
+)
+
+// InterruptHandler is Go code standing in for a real mode interrupt
+// routine. It runs in place of the call through the vector table, so it
+// sees the registers as the int left them and whatever it changes is what
+// the program sees after the int.
+type InterruptHandler func(m *Machine, vector uint8) error
+
+// ErrBreak is what a handler returns to stop Run at the instruction after
+// the int, as a breakpoint there would. Unlike other errors it keeps what
+// the handler did.
+var ErrBreak = errors.New("break")
+
+// HandleInterrupt makes int vector run h instead of going through the
+// interrupt vector table. A nil h removes the handler again.
+func (m *Machine) HandleInterrupt(vector uint8, h InterruptHandler) {
+	if h == nil {
+		delete(m.handlers, vector)
+		return
+	}
+	if m.handlers == nil {
+		m.handlers = make(map[uint8]InterruptHandler)
+	}
+	m.handlers[vector] = h
+}
+
+// interrupt raises vector the way the 8086 does: flags, cs and ip are
+// pushed, IF and TF cleared, and cs:ip loaded from the vector table at
+// 0000:0000.
+func (m *Machine) interrupt(vector uint8) error {
+	if h, ok := m.handlers[vector]; ok {
+		return h(m, vector)
+	}
+
+	m.push(m.Reg(&registers.FLAGS) | registers.FlagReserved)
+	m.push(m.Reg(&registers.CS))
+	m.push(m.Reg(&registers.IP))
+	m.SetFlag(registers.FlagIF, false)
+	m.SetFlag(registers.FlagTF, false)
+
+	entry := uint16(vector) * 4
+	m.SetReg(&registers.IP, m.readMem(0, entry, true))
+	m.SetReg(&registers.CS, m.readMem(0, entry+2, true))
+	return nil
+}
+
+// iret returns from an interrupt routine.
+func (m *Machine) iret() {
+	m.SetReg(&registers.IP, m.pop())
+	m.SetReg(&registers.CS, m.pop())
+	m.SetReg(&registers.FLAGS, m.pop()&registers.FlagMask)
+}
+
+// SetVector points an entry of the interrupt vector table at seg:off.
+func (m *Machine) SetVector(vector uint8, seg, off uint16) {
+	entry := uint16(vector) * 4
+	m.Memory.PutWord(0, entry, off)
+	m.Memory.PutWord(0, entry+2, seg)
+}
+
+// Vector returns the seg:off an entry of the interrupt vector table holds.
+func (m *Machine) Vector(vector uint8) (uint16, uint16) {
+	entry := uint16(vector) * 4
+	return m.Memory.GetWord(0, entry+2), m.Memory.GetWord(0, entry)
+}
+
+const (
+	// Clocks from INTR to the first instruction of the handler.
+	intrClocks = 61
+	// How long hlt waits for an interrupt before giving up: two of the
+	// timer's longest periods.
+	maxHaltClocks = 2 * 0x10000 * clocksPerTick
+)
+
+// hardwareInterrupts advances the clocked devices past ex and takes an
+// interrupt from the PIC if one is pending and IF allows it. A halted CPU
+// sits out time until one arrives; a program that has exited takes none.
+func (m *Machine) hardwareInterrupts(ex *Exec) error {
+	m.advance(ex.Clocks.Min)
+	if m.PIC == nil || m.Exited || !m.Flag(registers.FlagIF) || interruptShadow(ex.Op) {
+		return nil
+	}
+
+	for waited := uint32(0); m.Halted && waited < maxHaltClocks; waited += clocksPerTick {
+		if _, ok := m.PIC.Pending(); ok {
+			break
+		}
+		m.advance(clocksPerTick)
+		ex.Clocks.Min += clocksPerTick
+		ex.Clocks.Max += clocksPerTick
+	}
+
+	vector, ok := m.PIC.Acknowledge()
+	if !ok {
+		return nil
+	}
+	m.Halted = false
+	ex.Interrupted = true
+	ex.Vector = vector
+	// The timer runs on through the interrupt's entry too.
+	m.advance(intrClocks)
+	ex.Clocks.Min += intrClocks
+	ex.Clocks.Max += intrClocks
+	return m.interrupt(vector)
+}
+
+func (m *Machine) advance(clocks uint32) {
+	for _, d := range m.clocked {
+		d.Advance(clocks)
+	}
+}
+
+// interruptShadow reports whether op holds off interrupts for one more
+// instruction: sti, so sti; hlt can't miss one, and loads of ss, so the
+// sp load after it happens first.
+func interruptShadow(op instructions.Operation) bool {
+	switch op.OpType {
+	case instructions.OpSti:
+		return true
+	case instructions.OpMov, instructions.OpPop:
+		o := op.Operands[0]
+		return o.Type == instructions.ValRegister && o.Seg && o.Reg == 0b10
+	}
+	return false
+}
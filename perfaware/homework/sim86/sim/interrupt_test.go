@@ -0,0 +1,117 @@
+package sim
+
+import (
+	"testing"
+
+	"sim86/registers"
+)
+
+func TestSoftwareInterrupts(t *testing.T) {
+	const (
+		seg   = 0x1000
+		stack = 0x20000
+	)
+	ifOnly := []regValue{{&registers.FLAGS, registers.FlagIF}}
+	for _, c := range []programTest{
+		{
+			// The handler saves the flags it runs with in dx, which have
+			// IF clear and the bits the 8086 always sets in FLAGS set.
+			name: "int",
+			code: []byte{
+				0xcd, 0x40, // int 0x40
+				0xbb, 0x01, 0x00, // mov bx, 1
+				0xeb, 0x06, // jmp end
+				0xb9, 0x02, 0x00, // handler: mov cx, 2
+				0x9c, // pushf
+				0x5a, // pop dx
+				0xcf, // iret
+			},
+			regs:  ifOnly,
+			setup: func(m *Machine) { m.SetVector(0x40, seg, 7) },
+			want: []regValue{
+				{&registers.BX, 1}, {&registers.CX, 2}, {&registers.DX, 0xf002},
+				{&registers.SP, 0x100}, {&registers.FLAGS, registers.FlagIF},
+			},
+			// FLAGS, then CS, then IP of the instruction after int.
+			words: map[uint32]uint16{stack + 0xfe: 0xf002 | registers.FlagIF, stack + 0xfc: seg, stack + 0xfa: 2},
+		},
+		{
+			name: "int3",
+			code: []byte{
+				0xcc,       // int3
+				0xeb, 0x04, // jmp end
+				0xb9, 0x03, 0x00, // handler: mov cx, 3
+				0xcf, // iret
+			},
+			setup: func(m *Machine) { m.SetVector(3, seg, 3) },
+			want:  []regValue{{&registers.CX, 3}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfa: 1},
+		},
+		{
+			name: "into without overflow",
+			code: []byte{
+				0xce,       // into
+				0xeb, 0x04, // jmp end
+				0xb9, 0x04, 0x00, // handler: mov cx, 4
+				0xcf, // iret
+			},
+			setup: func(m *Machine) { m.SetVector(4, seg, 3) },
+			want:  []regValue{{&registers.CX, 0}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfa: 0},
+		},
+		{
+			name: "into with overflow",
+			code: []byte{
+				0xce,       // into
+				0xeb, 0x04, // jmp end
+				0xb9, 0x04, 0x00, // handler: mov cx, 4
+				0xcf, // iret
+			},
+			regs:  []regValue{{&registers.FLAGS, registers.FlagOF}},
+			setup: func(m *Machine) { m.SetVector(4, seg, 3) },
+			want:  []regValue{{&registers.CX, 4}, {&registers.SP, 0x100}, {&registers.FLAGS, registers.FlagOF}},
+		},
+		{
+			// The 8086 pushes the address after the div, not the div.
+			name: "divide by zero",
+			code: []byte{
+				0xf6, 0xf3, // div bl
+				0xeb, 0x04, // jmp end
+				0xb9, 0x05, 0x00, // handler: mov cx, 5
+				0xcf, // iret
+			},
+			regs:  []regValue{{&registers.AX, 0x1234}},
+			setup: func(m *Machine) { m.SetVector(0, seg, 4) },
+			want:  []regValue{{&registers.AX, 0x1234}, {&registers.CX, 5}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfa: 2},
+		},
+		{
+			name: "quotient too big",
+			code: []byte{
+				0xf7, 0xfb, // idiv bx
+				0xeb, 0x04, // jmp end
+				0xb9, 0x05, 0x00, // handler: mov cx, 5
+				0xcf, // iret
+			},
+			regs:  []regValue{{&registers.DX, 1}, {&registers.BX, 1}},
+			setup: func(m *Machine) { m.SetVector(0, seg, 4) },
+			want:  []regValue{{&registers.AX, 0}, {&registers.DX, 1}, {&registers.CX, 5}},
+		},
+		{
+			name: "host handler",
+			code: []byte{0xcd, 0x21}, // int 0x21
+			setup: func(m *Machine) {
+				m.HandleInterrupt(0x21, func(m *Machine, vector uint8) error {
+					m.SetReg(&registers.AX, 0x9900|uint16(vector))
+					return nil
+				})
+			},
+			// Host handlers return straight away, with nothing pushed.
+			want:  []regValue{{&registers.AX, 0x9921}, {&registers.SP, 0x100}},
+			words: map[uint32]uint16{stack + 0xfe: 0},
+		},
+	} {
+		c.seg = seg
+		t.Run(c.name, func(t *testing.T) { c.run(t) })
+	}
+}
@@ -0,0 +1,164 @@
+package sim
+
+import (
+	"slices"
+	"unsafe"
+
+	"sim86/registers"
+)
+
+// Journal is an undo log of executed instructions: the registers before
+// each one, the bytes it overwrote and the state of the devices that run
+// beside the CPU. Undoing entries in reverse order puts the machine back
+// exactly, so running forward again gives the same results.
+//
+// What happens outside the machine isn't undone: console output stays
+// printed, files stay written and input that was read stays consumed.
+type Journal struct {
+	// Budget is how many bytes the journal may use, counting what each
+	// entry holds: registers, overwritten bytes and device states. The
+	// oldest entries are dropped to stay under it.
+	Budget int
+
+	entries []journalEntry
+	size    int
+	devices []Journaled
+}
+
+// Journaled is a device whose state the journal saves with every
+// instruction. SaveState should be cheap, since it runs that often. It
+// also returns how many bytes the state holds, for the budget: memory the
+// state shares with earlier ones needn't be counted again.
+type Journaled interface {
+	SaveState() (state any, size int)
+	RestoreState(state any)
+}
+
+type journalEntry struct {
+	regs    registers.State
+	clocks  ClockInterval
+	halted  bool
+	exited  bool
+	watched bool
+	writes  []overwrite
+	devices []any
+	// size is what the entry counts against the budget.
+	size int
+}
+
+// overwrite is a byte written over and what it held before.
+type overwrite struct {
+	addr uint32
+	old  uint8
+}
+
+// Sizes of an entry, of each write in it and of each device state's slot,
+// for the budget.
+const (
+	journalEntrySize       = int(unsafe.Sizeof(journalEntry{}))
+	journalWriteSize       = int(unsafe.Sizeof(overwrite{}))
+	journalDeviceStateSize = int(unsafe.Sizeof(any(nil)))
+)
+
+// EnableJournal starts journaling instructions within budget bytes. It
+// picks up the devices installed so far, so it belongs after setup.
+func (m *Machine) EnableJournal(budget int) {
+	j := &Journal{Budget: budget}
+	seen := map[Journaled]bool{}
+	add := func(d any) {
+		if jd, ok := d.(Journaled); ok && !seen[jd] {
+			seen[jd] = true
+			j.devices = append(j.devices, jd)
+		}
+	}
+	for _, d := range m.clocked {
+		add(d)
+	}
+	for _, r := range m.Ports.ranges {
+		add(r.device)
+	}
+	m.journal = j
+}
+
+// Journal is nil unless EnableJournal was called.
+func (m *Machine) Journal() *Journal {
+	return m.journal
+}
+
+// Oldest is the index of the earliest instruction that can be undone to.
+func (m *Machine) Oldest() uint64 {
+	if m.journal == nil {
+		return m.Executed
+	}
+	return m.Executed - uint64(len(m.journal.entries))
+}
+
+// begin opens the entry for the instruction about to run.
+func (j *Journal) begin(m *Machine) {
+	e := journalEntry{regs: m.regs, clocks: m.Clocks, halted: m.Halted, exited: m.Exited}
+	if len(j.devices) > 0 {
+		e.devices = make([]any, len(j.devices))
+		for i, d := range j.devices {
+			var size int
+			e.devices[i], size = d.SaveState()
+			e.size += journalDeviceStateSize + size
+		}
+	}
+	j.entries = append(j.entries, e)
+}
+
+// commit closes the current entry with the bytes its instruction wrote
+// over and drops old ones to fit the budget.
+func (j *Journal) commit(writes []overwrite, watched bool) {
+	e := &j.entries[len(j.entries)-1]
+	e.writes = slices.Clone(writes)
+	e.watched = watched
+	e.size += journalEntrySize + cap(e.writes)*journalWriteSize
+	j.size += e.size
+	for j.size > j.Budget && len(j.entries) > 1 {
+		j.size -= j.entries[0].size
+		j.entries[0] = journalEntry{}
+		j.entries = j.entries[1:]
+	}
+}
+
+// abandon undoes and drops the current entry, for an instruction that
+// failed partway. Its writes the machine has already taken back.
+func (j *Journal) abandon(m *Machine) {
+	j.undo(m, j.entries[len(j.entries)-1])
+	j.entries = j.entries[:len(j.entries)-1]
+}
+
+func (j *Journal) undo(m *Machine, e journalEntry) {
+	for i := len(e.writes) - 1; i >= 0; i-- {
+		m.Memory.Poke(e.writes[i].addr, e.writes[i].old)
+	}
+	m.regs = e.regs
+	m.Clocks = e.clocks
+	m.Halted, m.Exited = e.halted, e.exited
+	for i, d := range j.devices {
+		d.RestoreState(e.devices[i])
+	}
+}
+
+// Reset forgets everything, for when the machine is changed behind the
+// journal's back.
+func (j *Journal) Reset() {
+	j.entries = nil
+	j.size = 0
+}
+
+// Undo takes back the last instruction. It reports false when there is
+// nothing left to undo, and whether the instruction set off a watchpoint.
+func (m *Machine) Undo() (ok, watched bool) {
+	j := m.journal
+	if j == nil || len(j.entries) == 0 {
+		return false, false
+	}
+	e := j.entries[len(j.entries)-1]
+	j.entries = j.entries[:len(j.entries)-1]
+	j.size -= e.size
+	j.undo(m, e)
+	m.Executed--
+	return true, e.watched
+}
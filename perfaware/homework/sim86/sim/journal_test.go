@@ -0,0 +1,147 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"unsafe"
+
+	"sim86/registers"
+)
+
+// newTestMachine loads image at 0000:0000.
+func newTestMachine(t *testing.T, image []byte) *Machine {
+	t.Helper()
+	m := NewMachine(Options{})
+	if err := (RawLoader{}).Load(m, image); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// fillLoop stores words forever:
+//
+//	mov bx, 0x1000
+//	again:
+//	mov [bx], ax
+//	inc bx
+//	inc bx
+//	jmp again
+var fillLoop = []byte{0xbb, 0x00, 0x10, 0x89, 0x07, 0x43, 0x43, 0xeb, 0xfa}
+
+func TestJournalBudget(t *testing.T) {
+	const budget = 4096
+	perEntry := map[bool]int{}
+	for _, timer := range []bool{false, true} {
+		m := newTestMachine(t, fillLoop)
+		if timer {
+			if err := InstallTimer(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m.EnableJournal(budget)
+		m.StepLimit = 10000
+		if res := m.Run(context.Background()); res.Reason != StopLimit {
+			t.Fatalf("run stopped with %v: %v", res.Reason, res.Err)
+		}
+
+		j := m.Journal()
+		sum := 0
+		for _, e := range j.entries {
+			sum += e.size
+		}
+		if j.size != sum {
+			t.Errorf("timer %t: journal counts %d bytes, its entries %d", timer, j.size, sum)
+		}
+		if j.size > budget {
+			t.Errorf("timer %t: journal holds %d bytes, over its %d byte budget", timer, j.size, budget)
+		}
+		if j.size < budget/2 {
+			t.Errorf("timer %t: journal keeps %d entries in %d bytes, too few for its budget", timer, len(j.entries), j.size)
+		}
+		perEntry[timer] = sum / len(j.entries)
+	}
+	// The PIT's and PIC's states are counted with each entry.
+	devices := int(unsafe.Sizeof(PIT{}) + unsafe.Sizeof(PIC{}))
+	if perEntry[true]-perEntry[false] < devices {
+		t.Errorf("entries are %d bytes with a timer and %d without; want the %d bytes of device state counted",
+			perEntry[true], perEntry[false], devices)
+	}
+}
+
+// machineState is what undoing has to put back, in a comparable form.
+type machineState struct {
+	regs     registers.State
+	clocks   ClockInterval
+	executed uint64
+	halted   bool
+	memory   string
+	pit, pic string
+}
+
+func captureState(t *testing.T, m *Machine) machineState {
+	t.Helper()
+	var mem bytes.Buffer
+	if _, err := m.Memory.WriteTo(&mem); err != nil {
+		t.Fatal(err)
+	}
+	pit, err := m.clocked[0].(*PIT).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pic, err := m.PIC.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return machineState{m.Registers(), m.Clocks, m.Executed, m.Halted, mem.String(), string(pit), string(pic)}
+}
+
+func TestJournalUndoRedo(t *testing.T) {
+	const steps = 1500
+	m := newTimerMachine(t)
+	m.EnableJournal(1 << 20)
+	start := captureState(t, m)
+
+	run := func(n uint64) {
+		t.Helper()
+		m.StepLimit = n
+		if res := m.Run(context.Background()); res.Reason != StopLimit {
+			t.Fatalf("run stopped with %v: %v", res.Reason, res.Err)
+		}
+	}
+	run(steps)
+	if m.Reg(&registers.BX) == 0 {
+		t.Fatal("no timer interrupt in the run; the devices aren't tested")
+	}
+	end := captureState(t, m)
+
+	// Going back part of the way and forward again ends the same.
+	for i := 0; i < steps/3; i++ {
+		if ok, _ := m.Undo(); !ok {
+			t.Fatalf("undo %d failed", i)
+		}
+	}
+	run(steps / 3)
+	if captureState(t, m) != end {
+		t.Error("rerunning the last third ended differently")
+	}
+
+	for i := 0; i < steps; i++ {
+		if ok, _ := m.Undo(); !ok {
+			t.Fatalf("undo %d failed", i)
+		}
+	}
+	if ok, _ := m.Undo(); ok {
+		t.Error("undid past the start")
+	}
+	if got := captureState(t, m); got != start {
+		t.Errorf("undoing everything left regs %v clocks %v, want regs %v clocks %v (memory equal %t, devices equal %t)",
+			got.regs, got.clocks, start.regs, start.clocks, got.memory == start.memory,
+			got.pit == start.pit && got.pic == start.pic)
+	}
+	run(steps)
+	if got := captureState(t, m); got != end {
+		t.Errorf("rerunning ended with regs %v clocks %v, want regs %v clocks %v",
+			got.regs, got.clocks, end.regs, end.clocks)
+	}
+}
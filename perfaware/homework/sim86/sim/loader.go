@@ -0,0 +1,105 @@
+package sim
+
+import (
+	"fmt"
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// A Loader puts a program image into a fresh machine and sets up the
+// registers it starts with.
+type Loader interface {
+	Load(m *Machine, image []byte) error
+}
+
+// RawLoader copies the image to Seg:Off as is and starts executing at its
+// first byte. Every other register is left at zero, which is what the
+// course listings expect.
+type RawLoader struct {
+	Seg, Off uint16
+}
+
+func (l RawLoader) Load(m *Machine, image []byte) error {
+	if len(image) > 0x10000-int(l.Off) {
+		return fmt.Errorf("image is %d bytes, more than fit in a segment at offset %#x", len(image), l.Off)
+	}
+	m.Load(image, memory.Address(l.Seg, l.Off))
+	m.SetReg(&registers.CS, l.Seg)
+	m.SetReg(&registers.IP, l.Off)
+	return nil
+}
+
+// COMLoader loads a DOS .COM program the way DOS does: a Program Segment
+// Prefix at Seg:0000, the image at Seg:0100, every segment register set to
+// Seg and the stack at the top of the segment.
+type COMLoader struct {
+	Seg uint16
+	// Args is the command tail, everything after the program name.
+	Args string
+}
+
+const (
+	COMDefaultSegment = 0x1000
+	comImageOffset    = 0x100
+	comMaxImage       = 0x10000 - comImageOffset
+	comStackTop       = 0xfffe
+
+	// The paragraph past the end of conventional memory, which PSP:0002
+	// reports as the top of the program's allocation.
+	memoryTopSegment = 0xa000
+
+	pspMemoryTop   = 0x02
+	pspCommandTail = 0x80
+	maxCommandTail = 126
+)
+
+func (l COMLoader) Load(m *Machine, image []byte) error {
+	if len(image) > comMaxImage {
+		return fmt.Errorf("com image is %d bytes, more than the %d that fit in a segment", len(image), comMaxImage)
+	}
+	tail, err := commandTail(l.Args)
+	if err != nil {
+		return err
+	}
+
+	writePSP(m.Memory, l.Seg, tail, memoryTopSegment)
+	m.Load(image, memory.Address(l.Seg, comImageOffset))
+
+	for _, r := range []*registers.Register{&registers.CS, &registers.DS, &registers.ES, &registers.SS} {
+		m.SetReg(r, l.Seg)
+	}
+	m.SetReg(&registers.IP, comImageOffset)
+	// DOS pushes a zero so a plain ret lands on the int 20h at PSP:0000.
+	m.SetReg(&registers.SP, comStackTop)
+	m.Memory.PutWord(l.Seg, comStackTop, 0)
+	return nil
+}
+
+func commandTail(args string) (string, error) {
+	if args == "" {
+		return "", nil
+	}
+	// DOS keeps the space that separated it from the program name.
+	tail := " " + args
+	if len(tail) > maxCommandTail {
+		return "", fmt.Errorf("command tail is %d bytes, DOS allows %d", len(tail), maxCommandTail)
+	}
+	return tail, nil
+}
+
+// writePSP builds the parts of a Program Segment Prefix small programs
+// actually look at. top is the segment just past the program's memory.
+func writePSP(mem *memory.Memory, seg uint16, tail string, top uint16) {
+	// int 20h, where programs that ret or jmp 0 end up.
+	mem.Put(memory.Address(seg, 0), 0xcd)
+	mem.Put(memory.Address(seg, 1), 0x20)
+	mem.PutWord(seg, pspMemoryTop, top)
+
+	// The command tail is a length byte, the text, and a carriage return
+	// that the length doesn't count.
+	mem.Put(memory.Address(seg, pspCommandTail), uint8(len(tail)))
+	for i := 0; i < len(tail); i++ {
+		mem.Put(memory.Address(seg, pspCommandTail+1+uint16(i)), tail[i])
+	}
+	mem.Put(memory.Address(seg, pspCommandTail+1+uint16(len(tail))), '\r')
+}
@@ -0,0 +1,107 @@
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+func TestCOMLoader(t *testing.T) {
+	const seg = 0x1234
+	image := []byte{0xb8, 0x01, 0x00, 0xc3} // mov ax, 1; ret
+	m := NewMachine(Options{})
+	if err := (COMLoader{Seg: seg, Args: "foo bar"}).Load(m, image); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []regValue{
+		{&registers.CS, seg}, {&registers.DS, seg}, {&registers.ES, seg}, {&registers.SS, seg},
+		{&registers.IP, 0x100}, {&registers.SP, 0xfffe},
+	} {
+		if got := m.Reg(r.r); got != r.val {
+			t.Errorf("%s is %#04x, want %#04x", r.r, got, r.val)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		off  uint16
+		want []byte
+	}{
+		{"int 20h", 0x00, []byte{0xcd, 0x20}},
+		{"memory top", 0x02, []byte{0x00, 0xa0}},
+		{"command tail", 0x80, []byte("\x08 foo bar\r")},
+		{"image", 0x100, image},
+		{"return address", 0xfffe, []byte{0, 0}},
+	} {
+		got := make([]byte, len(c.want))
+		for i := range got {
+			got[i] = m.Memory.Peek(memory.Address(seg, c.off+uint16(i)))
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s at %04x:%04x is % x, want % x", c.name, seg, c.off, got, c.want)
+		}
+	}
+
+	// The ret goes to the int 20h at the start of the PSP, which exits.
+	d := NewDOS(t.TempDir(), bufio.NewReader(strings.NewReader("")), &bytes.Buffer{})
+	d.Install(m)
+	m.StepLimit = 10
+	if res := m.Run(context.Background()); res.Reason != StopEnd || res.Executed != 3 || !d.Exited {
+		t.Errorf("stopped with %v after %d instructions, exited %t: %v", res.Reason, res.Executed, d.Exited, res.Err)
+	}
+	if ax := m.Reg(&registers.AX); ax != 1 {
+		t.Errorf("ax is %#04x, want 0x0001", ax)
+	}
+}
+
+func TestCOMLoaderNoArgs(t *testing.T) {
+	m := NewMachine(Options{})
+	if err := (COMLoader{Seg: COMDefaultSegment}).Load(m, []byte{0x90}); err != nil {
+		t.Fatal(err)
+	}
+	tail := memory.Address(COMDefaultSegment, 0x80)
+	if n, cr := m.Memory.Peek(tail), m.Memory.Peek(tail+1); n != 0 || cr != '\r' {
+		t.Errorf("empty command tail is %#02x %#02x, want 0x00 0x0d", n, cr)
+	}
+}
+
+func TestRawLoader(t *testing.T) {
+	m := NewMachine(Options{})
+	if err := (RawLoader{Seg: 0x2000, Off: 0x10}).Load(m, []byte{0x90, 0xf4}); err != nil {
+		t.Fatal(err)
+	}
+	if cs, ip := m.Reg(&registers.CS), m.Reg(&registers.IP); cs != 0x2000 || ip != 0x10 {
+		t.Errorf("starts at %04x:%04x, want 2000:0010", cs, ip)
+	}
+	if got := m.Memory.Peek(0x20011); got != 0xf4 {
+		t.Errorf("image byte 1 is %#02x", got)
+	}
+	for _, r := range []*registers.Register{&registers.DS, &registers.SS, &registers.SP, &registers.AX} {
+		if got := m.Reg(r); got != 0 {
+			t.Errorf("%s is %#04x, want 0", r, got)
+		}
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		loader Loader
+		image  []byte
+		want   string
+	}{
+		{"com too big", COMLoader{Seg: COMDefaultSegment}, make([]byte, 0xff01), "more than the 65280"},
+		{"tail too long", COMLoader{Seg: COMDefaultSegment, Args: strings.Repeat("x", 126)}, nil, "DOS allows 126"},
+		{"raw past the segment", RawLoader{Off: 0xff00}, make([]byte, 0x101), "more than fit in a segment"},
+	} {
+		err := c.loader.Load(NewMachine(Options{}), c.image)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error saying %s", c.name, err, c.want)
+		}
+	}
+}
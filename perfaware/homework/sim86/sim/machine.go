@@ -0,0 +1,484 @@
+// Package sim simulates an 8086 or 8088: it loads programs, executes them
+// an instruction at a time or until something stops them, and estimates
+// the clocks they take. The sim86 command is built on it.
+//
+// Each Machine owns its registers and memory, so any number of them can
+// run side by side, one goroutine per machine.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"sim86/instructions"
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// Machine is a simulated 8086: its registers and main memory plus the
+// bookkeeping the simulator needs around them.
+type Machine struct {
+	regs   registers.State
+	Memory *memory.Memory
+	Ports  Ports
+
+	// End is one past the last loaded byte. Execution stops when CS:IP
+	// reaches it, the same way the reference simulator stops.
+	End uint32
+	// loadedAt and loadedEnd are where the last Load put the image, for
+	// the disassembler and source listings.
+	loadedAt, loadedEnd uint32
+
+	// Is8088 makes clock estimates pay the 8088's 8-bit bus penalty.
+	Is8088 bool
+	// Clocks is the running total of estimated clocks.
+	Clocks ClockInterval
+
+	// Halted is set by hlt, until an interrupt wakes the CPU.
+	Halted bool
+	// Exited is set when the program terminates, by asking DOS to. Unlike
+	// Halted, no interrupt undoes it.
+	Exited bool
+	// Executed counts the instructions run, which makes it the index of
+	// the next one.
+	Executed uint64
+	journal  *Journal
+	// overwritten is the bytes the instruction running has written, with
+	// what they held, so that one failing partway can be taken back.
+	overwritten []overwrite
+
+	// TraceMemory records every memory access an instruction makes in its
+	// Exec.
+	TraceMemory bool
+	accesses    []Access
+
+	// watches is nil unless a watchpoint is set, which is all the memory
+	// access path checks before looking for hits.
+	watches []Watch
+	hits    []WatchHit
+
+	handlers map[uint8]InterruptHandler
+
+	// StepLimit, BreakOn, StopOnWatch and Trace control Run; see
+	// Options.
+	StepLimit   uint64
+	BreakOn     func(instructions.Operation) bool
+	StopOnWatch bool
+	Trace       func(Exec)
+
+	breakpoints map[uint32]bool
+
+	// PIC, when set, delivers hardware interrupts between instructions.
+	PIC *PIC
+	// clocked are the devices that run off the CPU clock.
+	clocked []Clocked
+}
+
+// Clocked is a device that runs off the CPU clock, like the timer. It is
+// advanced by each instruction's estimated clocks.
+type Clocked interface {
+	Advance(clocks uint32)
+}
+
+// AddClocked makes d advance with every instruction executed.
+func (m *Machine) AddClocked(d Clocked) {
+	m.clocked = append(m.clocked, d)
+}
+
+// Access is one memory read or write made by an instruction.
+type Access struct {
+	Write    bool
+	Seg, Off uint16
+	Wide     bool
+	// Old is what a write overwrote. Value is what was read or written.
+	Old, Value uint16
+}
+
+// Address is the physical address of the access.
+func (a Access) Address() uint32 {
+	return memory.Address(a.Seg, a.Off)
+}
+
+// Exec describes one executed instruction.
+type Exec struct {
+	Op instructions.Operation
+	// Address is the physical address the instruction was fetched from.
+	Address uint32
+	// Before holds the registers as they were before the instruction ran.
+	Before registers.State
+
+	BranchTaken bool
+	ShiftCount  uint16
+	RepCount    uint16
+	Unaligned   bool
+
+	// Accesses is only filled in when the machine's TraceMemory is set.
+	Accesses []Access
+	// Watched are the accesses that set off watchpoints.
+	Watched []WatchHit
+
+	Timing instructionTiming
+	Clocks ClockInterval
+
+	// Interrupted is set when a hardware interrupt was taken after the
+	// instruction, through Vector.
+	Interrupted bool
+	Vector      uint8
+}
+
+type UnimplementedError struct {
+	Op instructions.OpType
+}
+
+func (e UnimplementedError) Error() string {
+	return fmt.Sprintf("unimplemented instruction (%s)", e.Op)
+}
+
+// Options set up a new machine. Each is also a field of Machine that can
+// be changed between runs.
+type Options struct {
+	// Is8088 estimates clocks for an 8088 instead of an 8086.
+	Is8088 bool
+	// TraceMemory fills in the Accesses of each Exec.
+	TraceMemory bool
+	// StepLimit, when nonzero, stops each Run after that many
+	// instructions.
+	StepLimit uint64
+	// BreakOn, when set, is a breakpoint on every instruction it returns
+	// true for, such as every ret.
+	BreakOn func(instructions.Operation) bool
+	// StopOnWatch stops Run after an instruction sets off a watchpoint.
+	// Without it hits are only reported in each Exec.
+	StopOnWatch bool
+	// Trace, when set, is called with each instruction Run executes.
+	Trace func(Exec)
+}
+
+// NewMachine makes a machine with empty memory and every register zero.
+func NewMachine(opts Options) *Machine {
+	return &Machine{
+		Memory:      memory.New(),
+		Is8088:      opts.Is8088,
+		TraceMemory: opts.TraceMemory,
+		StepLimit:   opts.StepLimit,
+		BreakOn:     opts.BreakOn,
+		StopOnWatch: opts.StopOnWatch,
+		Trace:       opts.Trace,
+	}
+}
+
+// Load copies image into memory at addr and moves End past it.
+func (m *Machine) Load(image []byte, addr uint32) {
+	for i, b := range image {
+		m.Memory.Put(addr+uint32(i), b)
+	}
+	end := addr + uint32(len(image))
+	if end > memory.Size {
+		end = memory.Size
+	}
+	m.End = end
+	m.loadedAt, m.loadedEnd = addr, end
+}
+
+// Loaded is where the last Load put the image: its first byte and one
+// past its last.
+func (m *Machine) Loaded() (first, end uint32) {
+	return m.loadedAt, m.loadedEnd
+}
+
+// Registers returns the 16-bit registers, indexed like registers.Words.
+func (m *Machine) Registers() registers.State {
+	return m.regs
+}
+
+// SetRegisters sets every 16-bit register.
+func (m *Machine) SetRegisters(s registers.State) {
+	m.regs = s
+}
+
+// Register reads a register by name, e.g. "ax" or "dl".
+func (m *Machine) Register(name string) (uint16, error) {
+	r := registers.ByName(name)
+	if r == nil {
+		return 0, fmt.Errorf("no register %q", name)
+	}
+	return m.Reg(r), nil
+}
+
+// SetRegister sets a register by name.
+func (m *Machine) SetRegister(name string, val uint16) error {
+	r := registers.ByName(name)
+	if r == nil {
+		return fmt.Errorf("no register %q", name)
+	}
+	m.SetReg(r, val)
+	return nil
+}
+
+// Flags returns the flags register.
+func (m *Machine) Flags() uint16 {
+	return m.Reg(&registers.FLAGS)
+}
+
+// Reg reads a register, e.g. &registers.AX or &registers.DL.
+func (m *Machine) Reg(r *registers.Register) uint16 {
+	return m.regs.Get(r)
+}
+
+// SetReg sets a register.
+func (m *Machine) SetReg(r *registers.Register, val uint16) {
+	m.regs.Put(r, val)
+}
+
+// Flag reports whether a flag is set: bit is one of the registers
+// package's flag bits, such as registers.FlagZF.
+func (m *Machine) Flag(bit uint16) bool {
+	return m.regs.Flag(bit)
+}
+
+// SetFlag sets or clears a flag.
+func (m *Machine) SetFlag(bit uint16, on bool) {
+	m.regs.SetFlag(bit, on)
+}
+
+// ReadMemory copies n bytes from the physical address addr. Like Peek it
+// reads the RAM under mapped regions without setting them off.
+func (m *Machine) ReadMemory(addr uint32, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = m.Memory.Peek(addr + uint32(i))
+	}
+	return b
+}
+
+// WriteMemory copies b to the physical address addr, into the RAM under
+// any mapped regions.
+func (m *Machine) WriteMemory(addr uint32, b []byte) {
+	for i, v := range b {
+		m.Memory.Poke(addr+uint32(i), v)
+	}
+}
+
+// PC is the physical address of CS:IP.
+func (m *Machine) PC() uint32 {
+	return memory.Address(m.Reg(&registers.CS), m.Reg(&registers.IP))
+}
+
+// Running reports whether there is anything left to execute.
+func (m *Machine) Running() bool {
+	return !m.Halted && !m.Exited && m.PC() < m.End
+}
+
+// Fetch decodes the instruction at CS:IP without executing it.
+func (m *Machine) Fetch() (instructions.Operation, error) {
+	m.Memory.ClearErr()
+	return instructions.Parse(m.Memory.Reader(m.Reg(&registers.CS), m.Reg(&registers.IP)))
+}
+
+// Step fetches and executes one instruction.
+func (m *Machine) Step() (Exec, error) {
+	op, err := m.Fetch()
+	if err != nil {
+		return Exec{Op: op, Address: m.PC(), Before: m.regs}, err
+	}
+	return m.Execute(op)
+}
+
+// Execute runs an instruction that was fetched from CS:IP. An instruction
+// that fails leaves the registers and memory as they were, though not
+// what a device or interrupt handler did outside them; one whose handler
+// returns ErrBreak completes and returns it.
+func (m *Machine) Execute(op instructions.Operation) (Exec, error) {
+	ex := Exec{Op: op, Address: m.PC(), Before: m.regs}
+	if m.journal != nil {
+		m.journal.begin(m)
+	}
+	m.SetReg(&registers.IP, m.Reg(&registers.IP)+uint16(op.Size))
+
+	m.accesses, m.hits = nil, nil
+	m.overwritten = m.overwritten[:0]
+	m.Memory.ClearErr()
+	err := m.execute(&ex)
+	brk := errors.Is(err, ErrBreak)
+	if brk {
+		err = nil
+	}
+	if err == nil {
+		err = m.Memory.Err()
+	}
+	if err != nil {
+		ex.Accesses = m.accesses
+		for i := len(m.overwritten) - 1; i >= 0; i-- {
+			m.Memory.Poke(m.overwritten[i].addr, m.overwritten[i].old)
+		}
+		m.regs = ex.Before
+		if m.journal != nil {
+			m.journal.abandon(m)
+		}
+		return ex, err
+	}
+
+	ex.Timing, ex.Clocks = estimateClocks(ex, m.Is8088)
+	if brk {
+		// Taking an interrupt would move cs:ip off the instruction the
+		// break stops at; a pending one waits for the next instruction.
+		m.advance(ex.Clocks.Min)
+		err = ErrBreak
+	} else {
+		err = m.hardwareInterrupts(&ex)
+	}
+	ex.Accesses = m.accesses
+	ex.Watched = m.hits
+	for i := range ex.Watched {
+		ex.Watched[i].At = ex.Address
+	}
+	m.Clocks.Min += ex.Clocks.Min
+	m.Clocks.Max += ex.Clocks.Max
+	m.Executed++
+	if m.journal != nil {
+		m.journal.commit(m.overwritten, len(ex.Watched) > 0)
+	}
+	return ex, err
+}
+
+// location is somewhere an operand can be read from or written to.
+type location struct {
+	reg *registers.Register
+
+	mem      bool
+	seg, off uint16
+
+	imm   bool
+	value uint16
+
+	wide bool
+}
+
+func (m *Machine) locate(ex *Exec, o instructions.Operand) location {
+	wide := ex.Op.Wide()
+	switch o.Type {
+	case instructions.ValRegister:
+		r := o.Register()
+		return location{reg: r, wide: r.Wide()}
+	case instructions.ValMemory:
+		seg, off := m.effectiveAddress(ex.Op, o)
+		ex.Unaligned = ex.Unaligned || off&1 == 1
+		return location{mem: true, seg: seg, off: off, wide: wide}
+	case instructions.ValImmediate:
+		return location{imm: true, value: uint16(o.Imm), wide: wide}
+	}
+	return location{imm: true}
+}
+
+// effectiveAddress resolves a memory operand to segment:offset. bp based
+// addresses default to ss, everything else to ds, unless a segment prefix
+// says otherwise.
+func (m *Machine) effectiveAddress(op instructions.Operation, o instructions.Operand) (uint16, uint16) {
+	if o.Explicit {
+		return o.Segment, uint16(o.Disp)
+	}
+	off := uint16(o.Disp)
+	terms := o.Terms()
+	for _, r := range terms {
+		off += m.Reg(r)
+	}
+	seg := m.Reg(&registers.DS)
+	if len(terms) > 0 && terms[0] == &registers.BP {
+		seg = m.Reg(&registers.SS)
+	}
+	if op.SegOverride != nil {
+		seg = m.Reg(registers.GetSeg(op.SegOverride.Value))
+	}
+	return seg, off
+}
+
+// dataSegment is ds, or the segment prefix when there is one.
+func (m *Machine) dataSegment(op instructions.Operation) uint16 {
+	if op.SegOverride != nil {
+		return m.Reg(registers.GetSeg(op.SegOverride.Value))
+	}
+	return m.Reg(&registers.DS)
+}
+
+func (m *Machine) read(l location) uint16 {
+	switch {
+	case l.reg != nil:
+		return m.Reg(l.reg)
+	case l.mem:
+		return m.readMem(l.seg, l.off, l.wide)
+	}
+	return l.value
+}
+
+func (m *Machine) write(l location, val uint16) {
+	switch {
+	case l.reg != nil:
+		m.SetReg(l.reg, val)
+	case l.mem:
+		m.writeMem(l.seg, l.off, val, l.wide)
+	}
+}
+
+func (m *Machine) readMem(seg, off uint16, wide bool) uint16 {
+	var val uint16
+	if wide {
+		val = m.Memory.GetWord(seg, off)
+	} else {
+		val = uint16(m.Memory.Get(memory.Address(seg, off)))
+	}
+	if m.TraceMemory || m.watches != nil {
+		m.record(Access{Seg: seg, Off: off, Wide: wide, Value: val})
+	}
+	return val
+}
+
+func (m *Machine) writeMem(seg, off, val uint16, wide bool) {
+	if m.TraceMemory || m.watches != nil {
+		old := m.Peek(seg, off, wide)
+		m.record(Access{Write: true, Seg: seg, Off: off, Wide: wide, Old: old, Value: val})
+	}
+	addr := memory.Address(seg, off)
+	m.overwritten = append(m.overwritten, overwrite{addr, m.Memory.Peek(addr)})
+	if wide {
+		addr = memory.Address(seg, off+1)
+		m.overwritten = append(m.overwritten, overwrite{addr, m.Memory.Peek(addr)})
+	}
+	if wide {
+		m.Memory.PutWord(seg, off, val)
+		return
+	}
+	m.Memory.Put(memory.Address(seg, off), uint8(val))
+}
+
+func (m *Machine) record(a Access) {
+	if m.TraceMemory {
+		m.accesses = append(m.accesses, a)
+	}
+	if m.watches != nil {
+		m.watch(a)
+	}
+}
+
+// Peek reads memory without it counting as an access. It sees the RAM
+// under any mapped regions.
+func (m *Machine) Peek(seg, off uint16, wide bool) uint16 {
+	val := uint16(m.Memory.Peek(memory.Address(seg, off)))
+	if wide {
+		val |= uint16(m.Memory.Peek(memory.Address(seg, off+1))) << 8
+	}
+	return val
+}
+
+// push and pop move words through ss:sp. sp wraps within the stack
+// segment, so pushing with sp at 0 writes to ss:fffe.
+func (m *Machine) push(val uint16) {
+	sp := m.Reg(&registers.SP) - 2
+	m.SetReg(&registers.SP, sp)
+	m.writeMem(m.Reg(&registers.SS), sp, val, true)
+}
+
+func (m *Machine) pop() uint16 {
+	sp := m.Reg(&registers.SP)
+	val := m.readMem(m.Reg(&registers.SS), sp, true)
+	m.SetReg(&registers.SP, sp+2)
+	return val
+}
@@ -0,0 +1,163 @@
+package sim
+
+import "unsafe"
+
+// PIC is an 8259 programmable interrupt controller, wired up the way the
+// PC has it: a single controller at ports 20h-21h with IRQ0 at vector 8.
+// Only what DOS era programs touch is emulated: the ICW1-4 init sequence,
+// the mask, specific and non-specific EOI, and reading IRR or ISR. There
+// is no cascading and priority never rotates.
+type PIC struct {
+	irr, isr, imr uint8
+	vectorBase    uint8
+
+	// initStep is the ICW the next write to the data port is, or 0 when
+	// the controller isn't being initialized.
+	initStep int
+	needICW4 bool
+	single   bool
+	autoEOI  bool
+	readISR  bool
+}
+
+const (
+	picCommandPort = 0x20
+	picDataPort    = 0x21
+	picPCVector    = 0x08
+)
+
+func NewPIC() *PIC {
+	return &PIC{vectorBase: picPCVector}
+}
+
+// Raise signals an edge on irq. Edges that arrive before the first one is
+// serviced are lost, as on the real chip.
+func (p *PIC) Raise(irq uint8) {
+	p.irr |= 1 << irq
+}
+
+// Pending reports the highest priority unmasked request that isn't held
+// off by an interrupt already in service.
+func (p *PIC) Pending() (uint8, bool) {
+	for irq := uint8(0); irq < 8; irq++ {
+		bit := uint8(1) << irq
+		if p.isr&bit != 0 {
+			return 0, false
+		}
+		if p.irr&bit != 0 && p.imr&bit == 0 {
+			return irq, true
+		}
+	}
+	return 0, false
+}
+
+// Acknowledge is the CPU's interrupt acknowledge cycle: the pending
+// request moves to in service and its vector is returned.
+func (p *PIC) Acknowledge() (uint8, bool) {
+	irq, ok := p.Pending()
+	if !ok {
+		return 0, false
+	}
+	bit := uint8(1) << irq
+	p.irr &^= bit
+	if !p.autoEOI {
+		p.isr |= bit
+	}
+	return p.vectorBase + irq, true
+}
+
+func (p *PIC) SaveState() (any, int) {
+	return *p, int(unsafe.Sizeof(*p))
+}
+
+func (p *PIC) RestoreState(state any) {
+	*p = state.(PIC)
+}
+
+// picSnapshot is a PIC as snapshot files have it.
+type picSnapshot struct {
+	IRR, ISR, IMR, VectorBase          uint8
+	InitStep                           uint8
+	NeedICW4, Single, AutoEOI, ReadISR bool
+}
+
+func (p *PIC) SnapshotName() string {
+	return "pic"
+}
+
+func (p *PIC) MarshalBinary() ([]byte, error) {
+	return marshalState(picSnapshot{p.irr, p.isr, p.imr, p.vectorBase, uint8(p.initStep),
+		p.needICW4, p.single, p.autoEOI, p.readISR})
+}
+
+func (p *PIC) UnmarshalBinary(data []byte) error {
+	var s picSnapshot
+	if err := unmarshalState(data, &s); err != nil {
+		return err
+	}
+	p.irr, p.isr, p.imr, p.vectorBase, p.initStep = s.IRR, s.ISR, s.IMR, s.VectorBase, int(s.InitStep)
+	p.needICW4, p.single, p.autoEOI, p.readISR = s.NeedICW4, s.Single, s.AutoEOI, s.ReadISR
+	return nil
+}
+
+func (p *PIC) In(port uint16, wide bool) uint16 {
+	if port == picDataPort {
+		return uint16(p.imr)
+	}
+	if p.readISR {
+		return uint16(p.isr)
+	}
+	return uint16(p.irr)
+}
+
+func (p *PIC) Out(port uint16, val uint16, wide bool) {
+	v := uint8(val)
+	if port == picCommandPort {
+		switch {
+		case v&0x10 != 0:
+			// ICW1 starts initialization over.
+			p.initStep = 2
+			p.needICW4 = v&0x01 != 0
+			p.single = v&0x02 != 0
+			p.imr, p.isr, p.irr = 0, 0, 0
+			p.readISR, p.autoEOI = false, false
+		case v&0x18 == 0x08:
+			// OCW3
+			if v&0x02 != 0 {
+				p.readISR = v&0x01 != 0
+			}
+		case v&0x20 != 0:
+			// OCW2 end of interrupt, specific when bit 6 is set.
+			if v&0x40 != 0 {
+				p.isr &^= 1 << (v & 0x07)
+			} else {
+				p.isr &= p.isr - 1 // clears the highest priority bit
+			}
+		}
+		return
+	}
+
+	switch p.initStep {
+	case 2:
+		p.vectorBase = v &^ 0x07
+		p.initStep = 3
+		if p.single {
+			p.initStep = 4
+		}
+		if p.initStep == 4 && !p.needICW4 {
+			p.initStep = 0
+		}
+	case 3:
+		// ICW3 wires up cascading, which there is none of.
+		p.initStep = 0
+		if p.needICW4 {
+			p.initStep = 4
+		}
+	case 4:
+		p.autoEOI = v&0x02 != 0
+		p.initStep = 0
+	default:
+		// OCW1
+		p.imr = v
+	}
+}
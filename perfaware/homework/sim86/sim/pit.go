@@ -0,0 +1,245 @@
+package sim
+
+import "unsafe"
+
+// PIT is an 8253 programmable interval timer at ports 40h-43h. It runs off
+// the simulated clock: the PC feeds it 14.31818 MHz / 12 = 1.193182 MHz,
+// exactly one tick for every 4 clocks of the 4.77 MHz CPU, so timing only
+// depends on the instructions executed.
+//
+// Modes 0 and 4 count down once, modes 2 and 3 repeat. Modes 1 and 5 wait
+// for a gate edge that never comes on channel 0. Mode 3's count is read
+// back as if it counted down by one like mode 2 rather than by two.
+type PIT struct {
+	Channels [3]pitChannel
+	// Out0 is called on each rising edge of channel 0's output. On a PC
+	// it is IRQ0.
+	Out0 func()
+
+	clocks uint32 // CPU clocks not yet worth a whole tick
+}
+
+type pitChannel struct {
+	mode   uint8
+	access uint8 // 1 low byte, 2 high byte, 3 low then high
+
+	reload  uint32 // 1-65536
+	elapsed uint32 // ticks into the current count
+	running bool
+	fired   bool // a one shot mode has reached terminal count
+
+	writeHigh, readHigh bool
+	pendingLow          uint8
+	latched             bool
+	latch               uint16
+}
+
+const (
+	pitFirstPort   = 0x40
+	pitControlPort = 0x43
+	clocksPerTick  = 4
+)
+
+// InstallTimer puts a PIC and a PIT on m's ports with the PIT's channel 0
+// driving IRQ0, the way a PC wires them.
+func InstallTimer(m *Machine) error {
+	pic := NewPIC()
+	pit := &PIT{Out0: func() { pic.Raise(0) }}
+	if err := m.Ports.Register(picCommandPort, picDataPort, pic); err != nil {
+		return err
+	}
+	if err := m.Ports.Register(pitFirstPort, pitControlPort, pit); err != nil {
+		return err
+	}
+	m.PIC = pic
+	m.AddClocked(pit)
+	return nil
+}
+
+// Advance moves the timer on by clocks CPU clocks.
+func (p *PIT) Advance(clocks uint32) {
+	p.clocks += clocks
+	ticks := p.clocks / clocksPerTick
+	p.clocks %= clocksPerTick
+	if ticks == 0 {
+		return
+	}
+	for i := range p.Channels {
+		if p.Channels[i].advance(ticks) && i == 0 && p.Out0 != nil {
+			p.Out0()
+		}
+	}
+}
+
+// advance reports whether the output rose at least once.
+func (c *pitChannel) advance(ticks uint32) bool {
+	if !c.running {
+		return false
+	}
+	switch c.mode {
+	case 0, 4:
+		edge := !c.fired && c.elapsed+ticks >= c.reload
+		c.elapsed += ticks
+		if edge {
+			c.fired = true
+		}
+		if c.fired {
+			// It keeps counting and only the low 16 bits are visible.
+			c.elapsed %= 0x10000
+		}
+		return edge
+	case 2, 3:
+		c.elapsed += ticks
+		edge := c.elapsed >= c.reload
+		c.elapsed %= c.reload
+		return edge
+	}
+	return false
+}
+
+// count is what reading the channel returns.
+func (c *pitChannel) count() uint16 {
+	if !c.running {
+		return uint16(c.reload)
+	}
+	// 65536 reads back as 0, and one shot counts keep wrapping.
+	return uint16(c.reload - c.elapsed)
+}
+
+func (p *PIT) SaveState() (any, int) {
+	return *p, int(unsafe.Sizeof(*p))
+}
+
+func (p *PIT) RestoreState(state any) {
+	out0 := p.Out0
+	*p = state.(PIT)
+	p.Out0 = out0
+}
+
+// pitSnapshot is a PIT as snapshot files have it.
+type pitSnapshot struct {
+	Clocks   uint32
+	Channels [3]struct {
+		Mode, Access                        uint8
+		Reload, Elapsed                     uint32
+		Running, Fired, WriteHigh, ReadHigh bool
+		PendingLow                          uint8
+		Latched                             bool
+		Latch                               uint16
+	}
+}
+
+func (p *PIT) SnapshotName() string {
+	return "pit"
+}
+
+func (p *PIT) MarshalBinary() ([]byte, error) {
+	s := pitSnapshot{Clocks: p.clocks}
+	for i, c := range p.Channels {
+		sc := &s.Channels[i]
+		sc.Mode, sc.Access, sc.Reload, sc.Elapsed = c.mode, c.access, c.reload, c.elapsed
+		sc.Running, sc.Fired, sc.WriteHigh, sc.ReadHigh = c.running, c.fired, c.writeHigh, c.readHigh
+		sc.PendingLow, sc.Latched, sc.Latch = c.pendingLow, c.latched, c.latch
+	}
+	return marshalState(s)
+}
+
+func (p *PIT) UnmarshalBinary(data []byte) error {
+	var s pitSnapshot
+	if err := unmarshalState(data, &s); err != nil {
+		return err
+	}
+	p.clocks = s.Clocks
+	for i, sc := range s.Channels {
+		c := &p.Channels[i]
+		c.mode, c.access, c.reload, c.elapsed = sc.Mode, sc.Access, sc.Reload, sc.Elapsed
+		c.running, c.fired, c.writeHigh, c.readHigh = sc.Running, sc.Fired, sc.WriteHigh, sc.ReadHigh
+		c.pendingLow, c.latched, c.latch = sc.PendingLow, sc.Latched, sc.Latch
+	}
+	return nil
+}
+
+func (p *PIT) In(port uint16, wide bool) uint16 {
+	if port == pitControlPort {
+		// The 8253's control register can't be read.
+		return 0xff
+	}
+	c := &p.Channels[port-pitFirstPort]
+	val := c.count()
+	if c.latched {
+		val = c.latch
+	}
+
+	var b uint8
+	switch c.access {
+	case 1:
+		b = uint8(val)
+		c.latched = false
+	case 2:
+		b = uint8(val >> 8)
+		c.latched = false
+	case 3:
+		if c.readHigh {
+			b = uint8(val >> 8)
+			c.latched = false
+		} else {
+			b = uint8(val)
+		}
+		c.readHigh = !c.readHigh
+	}
+	return uint16(b)
+}
+
+func (p *PIT) Out(port uint16, val uint16, wide bool) {
+	v := uint8(val)
+	if port == pitControlPort {
+		sel := v >> 6
+		if sel == 3 {
+			// Read back is an 8254 command.
+			return
+		}
+		c := &p.Channels[sel]
+		access := (v >> 4) & 0x03
+		if access == 0 {
+			if !c.latched {
+				c.latched = true
+				c.latch = c.count()
+			}
+			return
+		}
+		c.access = access
+		c.mode = (v >> 1) & 0x07
+		if c.mode > 5 {
+			c.mode -= 4
+		}
+		c.running = false
+		c.writeHigh, c.readHigh, c.latched = false, false, false
+		return
+	}
+
+	c := &p.Channels[port-pitFirstPort]
+	var reload uint16
+	switch c.access {
+	case 1:
+		reload = uint16(v)
+	case 2:
+		reload = uint16(v) << 8
+	case 3:
+		if !c.writeHigh {
+			c.pendingLow = v
+			c.writeHigh = true
+			return
+		}
+		reload = uint16(v)<<8 | uint16(c.pendingLow)
+		c.writeHigh = false
+	default:
+		return
+	}
+	c.reload = uint32(reload)
+	if c.reload == 0 {
+		c.reload = 0x10000
+	}
+	c.elapsed = 0
+	c.fired = false
+	c.running = true
+}
@@ -0,0 +1,258 @@
+package sim
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"sim86/registers"
+)
+
+// readCount latches channel 0 and reads its count back low byte first.
+func readCount(p *PIT) uint16 {
+	p.Out(pitControlPort, 0x00, false)
+	lo := p.In(pitFirstPort, false)
+	hi := p.In(pitFirstPort, false)
+	return hi<<8 | lo
+}
+
+func TestPITChannel0(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		control uint8
+		reload  uint16
+		advance []uint32 // clocks, in separate calls
+		count   uint16
+		edges   int
+	}{
+		{"mode 2 before terminal count", 0x34, 100, []uint32{99 * clocksPerTick}, 1, 0},
+		{"mode 2 at terminal count", 0x34, 100, []uint32{100 * clocksPerTick}, 100, 1},
+		{"mode 2 repeats", 0x34, 100, []uint32{100 * clocksPerTick, 100 * clocksPerTick, 50 * clocksPerTick}, 50, 2},
+		{"partial ticks carry", 0x34, 2, []uint32{3, 3, 3}, 2, 1},
+		{"mode 3 65536", 0x36, 0, []uint32{0x8000 * clocksPerTick, 0x8000 * clocksPerTick}, 0, 1},
+		{"mode 0 fires once", 0x30, 100, []uint32{100 * clocksPerTick, 100 * clocksPerTick}, 0xff9c, 1},
+		{"mode 4 fires once", 0x38, 10, []uint32{5 * clocksPerTick, 5 * clocksPerTick, 10 * clocksPerTick}, 0xfff6, 1},
+		{"mode 1 waits for its gate", 0x32, 10, []uint32{20 * clocksPerTick}, 10, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			edges := 0
+			p := &PIT{Out0: func() { edges++ }}
+			p.Out(pitControlPort, uint16(c.control), false)
+			p.Out(pitFirstPort, c.reload&0xff, false)
+			p.Out(pitFirstPort, c.reload>>8, false)
+			for _, clocks := range c.advance {
+				p.Advance(clocks)
+			}
+			if got := readCount(p); got != c.count {
+				t.Errorf("count is %#04x, want %#04x", got, c.count)
+			}
+			if edges != c.edges {
+				t.Errorf("output rose %d times, want %d", edges, c.edges)
+			}
+		})
+	}
+}
+
+func TestPITLatch(t *testing.T) {
+	p := &PIT{}
+	p.Out(pitControlPort, 0x34, false)
+	p.Out(pitFirstPort, 0x00, false)
+	p.Out(pitFirstPort, 0x10, false)
+	p.Advance(0x10 * clocksPerTick)
+
+	// The latched count holds while the counter runs on, until both of
+	// its bytes are read.
+	p.Out(pitControlPort, 0x00, false)
+	p.Advance(0x20 * clocksPerTick)
+	lo := p.In(pitFirstPort, false)
+	p.Advance(0x20 * clocksPerTick)
+	hi := p.In(pitFirstPort, false)
+	if got := hi<<8 | lo; got != 0x0ff0 {
+		t.Errorf("latched count is %#04x, want 0x0ff0", got)
+	}
+	if got := readCount(p); got != 0x0fb0 {
+		t.Errorf("count after the latch is read is %#04x, want 0x0fb0", got)
+	}
+	if got := p.In(pitControlPort, false); got != 0xff {
+		t.Errorf("control port reads %#02x, want 0xff", got)
+	}
+}
+
+func TestPIC(t *testing.T) {
+	p := NewPIC()
+	p.Raise(1)
+	p.Raise(0)
+	if vector, ok := p.Acknowledge(); !ok || vector != 8 {
+		t.Fatalf("first acknowledge gave %d %t, want IRQ0's vector 8", vector, ok)
+	}
+	// IRQ0 in service holds off IRQ1 until its EOI.
+	if irq, ok := p.Pending(); ok {
+		t.Errorf("IRQ%d pending with IRQ0 in service", irq)
+	}
+	p.Out(picCommandPort, 0x0b, false) // OCW3: read ISR
+	if got := p.In(picCommandPort, false); got != 0x01 {
+		t.Errorf("ISR is %#02x, want 0x01", got)
+	}
+	p.Out(picCommandPort, 0x0a, false) // OCW3: read IRR
+	if got := p.In(picCommandPort, false); got != 0x02 {
+		t.Errorf("IRR is %#02x, want 0x02", got)
+	}
+	p.Out(picCommandPort, 0x20, false) // non-specific EOI
+	if vector, ok := p.Acknowledge(); !ok || vector != 9 {
+		t.Fatalf("acknowledge after EOI gave %d %t, want IRQ1's vector 9", vector, ok)
+	}
+	p.Out(picCommandPort, 0x61, false) // specific EOI for IRQ1
+
+	// A masked request waits until it is unmasked.
+	p.Out(picDataPort, 0x01, false)
+	if got := p.In(picDataPort, false); got != 0x01 {
+		t.Errorf("mask reads %#02x, want 0x01", got)
+	}
+	p.Raise(0)
+	if _, ok := p.Pending(); ok {
+		t.Error("masked IRQ0 is pending")
+	}
+	p.Out(picDataPort, 0x00, false)
+	if irq, ok := p.Pending(); !ok || irq != 0 {
+		t.Errorf("unmasked IRQ0: pending gave %d %t", irq, ok)
+	}
+}
+
+// timerProgram programs channel 0 as a rate generator counting 100 ticks,
+// enables interrupts and spins. Its IRQ0 handler, at 0000:0500, counts in
+// bx and sends an EOI.
+//
+//	mov al, 0x34
+//	out 0x43, al
+//	mov al, 100
+//	out 0x40, al
+//	mov al, 0
+//	out 0x40, al
+//	sti
+//	jmp $
+var (
+	timerProgram = []byte{0xb0, 0x34, 0xe6, 0x43, 0xb0, 0x64, 0xe6, 0x40, 0xb0, 0x00, 0xe6, 0x40, 0xfb, 0xeb, 0xfe}
+	// inc bx; mov al, 0x20; out 0x20, al; iret
+	timerHandler = []byte{0x43, 0xb0, 0x20, 0xe6, 0x20, 0xcf}
+)
+
+// newTimerMachine loads timerProgram at 1000:0000 with the timer installed
+// and its handler in place.
+func newTimerMachine(t *testing.T) *Machine {
+	t.Helper()
+	m := NewMachine(Options{})
+	if err := (RawLoader{Seg: 0x1000}).Load(m, timerProgram); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallTimer(m); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range timerHandler {
+		m.Memory.Poke(0x500+uint32(i), b)
+	}
+	m.SetVector(8, 0, 0x500)
+	m.SetReg(&registers.SS, 0x2000)
+	m.SetReg(&registers.SP, 0x100)
+	return m
+}
+
+// timerInterrupts runs timerProgram for n instructions and returns the
+// clock count at each interrupt taken.
+func timerInterrupts(t *testing.T, n uint64) (*Machine, []uint32) {
+	t.Helper()
+	m := newTimerMachine(t)
+	var at []uint32
+	m.Trace = func(ex Exec) {
+		if ex.Interrupted {
+			at = append(at, m.Clocks.Min)
+		}
+	}
+	m.StepLimit = n
+	if res := m.Run(context.Background()); res.Reason != StopLimit {
+		t.Fatalf("run stopped with %v: %v", res.Reason, res.Err)
+	}
+	return m, at
+}
+
+func TestTimerInterrupts(t *testing.T) {
+	const period = 100 * clocksPerTick
+	m, at := timerInterrupts(t, 2000)
+	if len(at) < 10 {
+		t.Fatalf("took %d timer interrupts in %d clocks", len(at), m.Clocks.Min)
+	}
+	if got := m.Reg(&registers.BX); int(got) != len(at) {
+		t.Errorf("handler ran %d times for %d interrupts", got, len(at))
+	}
+	// Each interrupt comes within one instruction and the entry of its
+	// period, and the periods don't drift.
+	for i := 1; i < len(at); i++ {
+		if gap := at[i] - at[i-1]; gap < period-50 || gap > period+50+intrClocks {
+			t.Errorf("interrupt %d came %d clocks after the last, want about %d", i, gap, period)
+		}
+	}
+	if span, want := at[len(at)-1]-at[0], uint32(len(at)-1)*period; span < want-50 || span > want+50 {
+		t.Errorf("%d interrupts took %d clocks, want about %d", len(at), span, want)
+	}
+
+	// The timing only depends on the instructions run.
+	_, again := timerInterrupts(t, 2000)
+	if len(again) != len(at) {
+		t.Fatalf("second run took %d interrupts, first %d", len(again), len(at))
+	}
+	for i := range at {
+		if again[i] != at[i] {
+			t.Errorf("interrupt %d at clock %d, first run at %d", i, again[i], at[i])
+		}
+	}
+}
+
+func TestExitIgnoresTimer(t *testing.T) {
+	// A program that leaves the timer running and exits through DOS stays
+	// exited: the pending IRQ0 doesn't run its handler.
+	//
+	//	mov al, 0x34
+	//	out 0x43, al
+	//	mov al, 1
+	//	out 0x40, al
+	//	mov al, 0
+	//	out 0x40, al
+	//	mov ah, 0x4c
+	//	sti
+	//	int 0x21
+	//	hlt
+	code := []byte{0xb0, 0x34, 0xe6, 0x43, 0xb0, 0x01, 0xe6, 0x40, 0xb0, 0x00, 0xe6, 0x40, 0xb4, 0x4c, 0xfb, 0xcd, 0x21, 0xf4}
+	m := NewMachine(Options{})
+	if err := (RawLoader{Seg: 0x1000}).Load(m, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallTimer(m); err != nil {
+		t.Fatal(err)
+	}
+	dos := NewDOS(t.TempDir(), bufio.NewReader(strings.NewReader("")), io.Discard)
+	dos.Install(m)
+	for i, b := range timerHandler {
+		m.Memory.Poke(0x500+uint32(i), b)
+	}
+	m.SetVector(8, 0, 0x500)
+	m.SetReg(&registers.SS, 0x2000)
+	m.SetReg(&registers.SP, 0x100)
+
+	m.StepLimit = 100
+	if res := m.Run(context.Background()); res.Reason != StopEnd {
+		t.Fatalf("run stopped with %v after %d instructions: %v", res.Reason, res.Executed, res.Err)
+	}
+	if !m.Exited || !dos.Exited {
+		t.Errorf("machine exited %t, DOS exited %t", m.Exited, dos.Exited)
+	}
+	if _, ok := m.PIC.Pending(); !ok {
+		t.Error("no IRQ0 pending at the exit; the test doesn't test anything")
+	}
+	if bx, sp := m.Reg(&registers.BX), m.Reg(&registers.SP); bx != 0 || sp != 0x100 {
+		t.Errorf("timer handler ran after the exit: bx %d sp %#04x", bx, sp)
+	}
+	if ip := m.Reg(&registers.IP); ip != 0x11 {
+		t.Errorf("stopped at ip %#04x, want the hlt at 0x0011", ip)
+	}
+}
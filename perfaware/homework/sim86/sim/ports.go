@@ -0,0 +1,99 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// PortDevice is something on the other end of in and out. Wide accesses
+// are word reads and writes of port and port+1, which the device owning
+// port handles as one access.
+type PortDevice interface {
+	In(port uint16, wide bool) uint16
+	Out(port uint16, val uint16, wide bool)
+}
+
+type portRange struct {
+	first, last uint16
+	device      PortDevice
+}
+
+// Ports is the 64K I/O port space.
+type Ports struct {
+	ranges []portRange
+}
+
+// Register maps first through last, inclusive, to d.
+func (p *Ports) Register(first, last uint16, d PortDevice) error {
+	if last < first {
+		return fmt.Errorf("port range 0x%x-0x%x is backwards", first, last)
+	}
+	for _, r := range p.ranges {
+		if first <= r.last && r.first <= last {
+			return fmt.Errorf("ports 0x%x-0x%x overlap 0x%x-0x%x, which are already mapped", first, last, r.first, r.last)
+		}
+	}
+	p.ranges = append(p.ranges, portRange{first, last, d})
+	sort.Slice(p.ranges, func(i, j int) bool { return p.ranges[i].first < p.ranges[j].first })
+	return nil
+}
+
+// Device returns whatever is mapped at port.
+func (p *Ports) Device(port uint16) PortDevice {
+	i := sort.Search(len(p.ranges), func(i int) bool { return p.ranges[i].last >= port })
+	if i < len(p.ranges) && p.ranges[i].first <= port {
+		return p.ranges[i].device
+	}
+	return nil
+}
+
+// UnmappedPortError is an in or out to a port no device is registered for.
+type UnmappedPortError struct {
+	Port  uint16
+	Write bool
+}
+
+func (e UnmappedPortError) Error() string {
+	if e.Write {
+		return fmt.Sprintf("out to unmapped port 0x%x", e.Port)
+	}
+	return fmt.Sprintf("in from unmapped port 0x%x", e.Port)
+}
+
+func (m *Machine) in(port uint16, wide bool) (uint16, error) {
+	d := m.Ports.Device(port)
+	if d == nil {
+		return 0, UnmappedPortError{Port: port}
+	}
+	return d.In(port, wide), nil
+}
+
+func (m *Machine) out(port, val uint16, wide bool) error {
+	d := m.Ports.Device(port)
+	if d == nil {
+		return UnmappedPortError{Port: port, Write: true}
+	}
+	d.Out(port, val, wide)
+	return nil
+}
+
+// DebugPort prints every byte written to it, the way Bochs' port 0xE9
+// hack does. Reading it returns 0xE9 so programs can check it's there.
+type DebugPort struct {
+	W io.Writer
+}
+
+const debugPortNumber = 0xe9
+
+func (d DebugPort) In(port uint16, wide bool) uint16 {
+	return debugPortNumber
+}
+
+func (d DebugPort) Out(port uint16, val uint16, wide bool) {
+	if wide {
+		d.W.Write([]byte{uint8(val), uint8(val >> 8)})
+		return
+	}
+	d.W.Write([]byte{uint8(val)})
+}
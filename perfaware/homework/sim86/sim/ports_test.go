@@ -0,0 +1,138 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"sim86/registers"
+)
+
+// portLog records the accesses it gets and answers ins with the port
+// number plus 0x100.
+type portLog struct {
+	log []string
+}
+
+func (p *portLog) In(port uint16, wide bool) uint16 {
+	p.log = append(p.log, fmt.Sprintf("in %#x %t", port, wide))
+	return port + 0x100
+}
+
+func (p *portLog) Out(port uint16, val uint16, wide bool) {
+	p.log = append(p.log, fmt.Sprintf("out %#x %#x %t", port, val, wide))
+}
+
+func TestPortDispatch(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		code []byte
+		ax   uint16
+		log  string
+	}{
+		{"in al, imm8", []byte{0xe4, 0x40}, 0x1240, "in 0x40 false"},
+		{"in ax, imm8", []byte{0xe5, 0x41}, 0x0141, "in 0x41 true"},
+		{"in al, dx", []byte{0xec}, 0x1210, "in 0x3210 false"},
+		{"in ax, dx", []byte{0xed}, 0x3310, "in 0x3210 true"},
+		{"out imm8, al", []byte{0xe6, 0x40}, 0x1234, "out 0x40 0x34 false"},
+		{"out imm8, ax", []byte{0xe7, 0x41}, 0x1234, "out 0x41 0x1234 true"},
+		{"out dx, al", []byte{0xee}, 0x1234, "out 0x3210 0x34 false"},
+		{"out dx, ax", []byte{0xef}, 0x1234, "out 0x3210 0x1234 true"},
+		// The device owning the first port takes a word access whole.
+		{"word across devices", []byte{0xe5, 0x4f}, 0x014f, "in 0x4f true"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMachine(t, c.code)
+			low, high := &portLog{}, &portLog{}
+			if err := m.Ports.Register(0x40, 0x4f, low); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Ports.Register(0x50, 0x5f, high); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Ports.Register(0x3210, 0x3210, low); err != nil {
+				t.Fatal(err)
+			}
+			m.SetReg(&registers.AX, 0x1234)
+			m.SetReg(&registers.DX, 0x3210)
+			if res := m.Run(context.Background()); res.Reason != StopEnd {
+				t.Fatalf("stopped with %v: %v", res.Reason, res.Err)
+			}
+			if ax := m.Reg(&registers.AX); ax != c.ax {
+				t.Errorf("ax is %#04x, want %#04x", ax, c.ax)
+			}
+			if got := strings.Join(low.log, "; "); got != c.log {
+				t.Errorf("device got %q, want %q", got, c.log)
+			}
+			if len(high.log) != 0 {
+				t.Errorf("the next device got %q", high.log)
+			}
+		})
+	}
+}
+
+func TestUnmappedPort(t *testing.T) {
+	for _, c := range []struct {
+		code  []byte
+		port  uint16
+		write bool
+	}{
+		{[]byte{0xe4, 0x60}, 0x60, false},
+		{[]byte{0xef}, 0x3210, true},
+	} {
+		m := newTestMachine(t, c.code)
+		m.Ports.Register(0x61, 0x3200, &portLog{})
+		m.SetReg(&registers.DX, 0x3210)
+		_, err := m.Step()
+		var pe UnmappedPortError
+		if !errors.As(err, &pe) || pe.Port != c.port || pe.Write != c.write {
+			t.Errorf("% x: got %v, want an unmapped port error for %#x", c.code, err, c.port)
+		}
+	}
+}
+
+func TestPortRegister(t *testing.T) {
+	var p Ports
+	d := &portLog{}
+	if err := p.Register(0x20, 0x21, d); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		first, last uint16
+		want        string
+	}{
+		{0x30, 0x2f, "backwards"},
+		{0x10, 0x20, "overlap"},
+		{0x21, 0x21, "overlap"},
+	} {
+		if err := p.Register(c.first, c.last, d); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%#x-%#x: got %v, want an error saying %s", c.first, c.last, err, c.want)
+		}
+	}
+	for port, want := range map[uint16]PortDevice{0x1f: nil, 0x20: d, 0x21: d, 0x22: nil} {
+		if got := p.Device(port); got != want {
+			t.Errorf("port %#x has %v, want %v", port, got, want)
+		}
+	}
+}
+
+func TestDebugPort(t *testing.T) {
+	code := []byte{
+		0xe4, 0xe9, // in al, 0xe9
+		0xe6, 0xe9, // out 0xe9, al
+		0xb8, 'o', 'k', // mov ax, "ok"
+		0xe7, 0xe9, // out 0xe9, ax
+	}
+	m := newTestMachine(t, code)
+	var out bytes.Buffer
+	m.Ports.Register(debugPortNumber, debugPortNumber, DebugPort{W: &out})
+	if res := m.Run(context.Background()); res.Reason != StopEnd {
+		t.Fatalf("stopped with %v: %v", res.Reason, res.Err)
+	}
+	if out.String() != "\xe9ok" {
+		t.Errorf("printed %q, want \"\\xe9ok\"", &out)
+	}
+}
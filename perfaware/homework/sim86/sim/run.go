@@ -0,0 +1,132 @@
+package sim
+
+import (
+	"context"
+	"sort"
+)
+
+// StopReason is why Run returned.
+type StopReason int
+
+const (
+	// StopHalt is a hlt with no interrupt controller to wake the CPU.
+	StopHalt StopReason = iota + 1
+	// StopEnd is the program exiting, or CS:IP reaching End, past it.
+	StopEnd
+	// StopBreakpoint is reaching a breakpoint, before executing the
+	// instruction there, or with StopOnWatch an instruction setting off a
+	// watchpoint, after executing it.
+	StopBreakpoint
+	// StopError is an instruction failing, or the context being canceled
+	// or passing its deadline.
+	StopError
+	// StopLimit is the step limit running out.
+	StopLimit
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopHalt:
+		return "halted"
+	case StopEnd:
+		return "end of program"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopError:
+		return "error"
+	case StopLimit:
+		return "step limit"
+	}
+	return "running"
+}
+
+// RunResult says how a Run went.
+type RunResult struct {
+	Reason StopReason
+	// Executed counts the instructions this run executed.
+	Executed uint64
+	// Err is what stopped a run with StopError: the instruction's error
+	// or the context's. A StopBreakpoint has ErrBreak when an interrupt
+	// handler asked for it.
+	Err error
+	// Watched are the hits of the watchpoints that stopped the run.
+	Watched []WatchHit
+}
+
+// ctxCheckInterval is how many instructions Run executes between looks at
+// its context, which costs more than an instruction does.
+const ctxCheckInterval = 4096
+
+// Run executes instructions until the machine halts, reaches the end of
+// the program or a breakpoint, an instruction fails, the step limit runs
+// out or ctx is done. Breakpoints stop it only after the first
+// instruction, so Run carries on from where it stopped, breakpoint or not.
+func (m *Machine) Run(ctx context.Context) RunResult {
+	var res RunResult
+	stop := func(reason StopReason, err error) RunResult {
+		res.Reason, res.Err = reason, err
+		return res
+	}
+	for {
+		if res.Executed%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return stop(StopError, err)
+			}
+		}
+		switch {
+		case m.Halted:
+			return stop(StopHalt, nil)
+		case m.Exited || m.PC() >= m.End:
+			return stop(StopEnd, nil)
+		case m.StepLimit != 0 && res.Executed >= m.StepLimit:
+			return stop(StopLimit, nil)
+		}
+		op, err := m.Fetch()
+		if err != nil {
+			return stop(StopError, err)
+		}
+		if res.Executed > 0 && (m.breakpoints[m.PC()] || (m.BreakOn != nil && m.BreakOn(op))) {
+			return stop(StopBreakpoint, nil)
+		}
+		ex, err := m.Execute(op)
+		if err != nil && err != ErrBreak {
+			return stop(StopError, err)
+		}
+		res.Executed++
+		if m.Trace != nil {
+			m.Trace(ex)
+		}
+		if err == ErrBreak {
+			res.Watched = ex.Watched
+			return stop(StopBreakpoint, err)
+		}
+		if m.StopOnWatch && len(ex.Watched) > 0 {
+			res.Watched = ex.Watched
+			return stop(StopBreakpoint, nil)
+		}
+	}
+}
+
+// AddBreakpoint makes Run stop before executing the instruction at the
+// physical address addr.
+func (m *Machine) AddBreakpoint(addr uint32) {
+	if m.breakpoints == nil {
+		m.breakpoints = map[uint32]bool{}
+	}
+	m.breakpoints[addr] = true
+}
+
+// RemoveBreakpoint clears the breakpoint at addr, if there is one.
+func (m *Machine) RemoveBreakpoint(addr uint32) {
+	delete(m.breakpoints, addr)
+}
+
+// Breakpoints returns the breakpoints' addresses in order.
+func (m *Machine) Breakpoints() []uint32 {
+	addrs := make([]uint32, 0, len(m.breakpoints))
+	for addr := range m.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
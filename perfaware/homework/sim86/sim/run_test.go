@@ -0,0 +1,328 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"sim86/instructions"
+	"sim86/memory"
+	"sim86/registers"
+)
+
+func TestRunStops(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		code     []byte
+		setup    func(m *Machine)
+		reason   StopReason
+		executed uint64
+		ip       uint16
+		err      string
+	}{
+		{
+			name:     "halt",
+			code:     []byte{0xb8, 0x01, 0x00, 0xf4, 0x90}, // mov ax, 1; hlt; nop
+			reason:   StopHalt,
+			executed: 2,
+			ip:       4,
+		},
+		{
+			name:     "end",
+			code:     []byte{0x90, 0x90}, // nop; nop
+			reason:   StopEnd,
+			executed: 2,
+			ip:       2,
+		},
+		{
+			name:   "exited",
+			code:   []byte{0x90},
+			setup:  func(m *Machine) { m.Exited = true },
+			reason: StopEnd,
+		},
+		{
+			name:     "breakpoint",
+			code:     fillLoop,
+			setup:    func(m *Machine) { m.AddBreakpoint(7) },
+			reason:   StopBreakpoint,
+			executed: 4,
+			ip:       7,
+		},
+		{
+			// Run always executes the instruction it starts at, so it
+			// goes once around the loop back to the breakpoint.
+			name: "breakpoint where it starts",
+			code: fillLoop,
+			setup: func(m *Machine) {
+				m.AddBreakpoint(3)
+				m.SetReg(&registers.IP, 3)
+			},
+			reason:   StopBreakpoint,
+			executed: 4,
+			ip:       3,
+		},
+		{
+			name: "removed breakpoint",
+			code: fillLoop,
+			setup: func(m *Machine) {
+				m.AddBreakpoint(7)
+				m.RemoveBreakpoint(7)
+			},
+			reason:   StopLimit,
+			executed: 1000,
+			ip:       7,
+		},
+		{
+			name: "break on",
+			code: fillLoop,
+			setup: func(m *Machine) {
+				m.BreakOn = func(op instructions.Operation) bool { return op.OpType == instructions.OpInc }
+			},
+			reason:   StopBreakpoint,
+			executed: 2,
+			ip:       5,
+		},
+		{
+			// The watch stops the run after the write, in the second
+			// time around the loop.
+			name: "watch",
+			code: fillLoop,
+			setup: func(m *Machine) {
+				m.StopOnWatch = true
+				m.AddWatch(Watch{First: 0x1002, Last: 0x1003, Write: true})
+			},
+			reason:   StopBreakpoint,
+			executed: 6,
+			ip:       5,
+		},
+		{
+			name: "watch without StopOnWatch",
+			code: fillLoop,
+			setup: func(m *Machine) {
+				m.AddWatch(Watch{First: 0x1002, Last: 0x1003, Write: true})
+			},
+			reason:   StopLimit,
+			executed: 1000,
+			ip:       7,
+		},
+		{
+			name:     "limit",
+			code:     fillLoop,
+			setup:    func(m *Machine) { m.StepLimit = 10 },
+			reason:   StopLimit,
+			executed: 10,
+			ip:       5,
+		},
+		{
+			name: "handler break",
+			code: []byte{0x90, 0xcd, 0x21, 0x90}, // nop; int 0x21; nop
+			setup: func(m *Machine) {
+				m.HandleInterrupt(0x21, func(*Machine, uint8) error { return ErrBreak })
+			},
+			reason:   StopBreakpoint,
+			executed: 2,
+			ip:       3,
+			err:      "break",
+		},
+		{
+			name:     "undecodable",
+			code:     []byte{0x90, 0x60}, // nop; an 80186 pusha
+			reason:   StopError,
+			executed: 1,
+			ip:       1,
+			err:      "unknown opcode",
+		},
+		{
+			name:     "failing instruction",
+			code:     []byte{0x90, 0xe6, 0x10}, // nop; out 0x10, al
+			reason:   StopError,
+			executed: 1,
+			ip:       1,
+			err:      "unmapped port",
+		},
+		{
+			name:     "write to read-only memory",
+			code:     []byte{0x90, 0xa3, 0x00, 0x02}, // nop; mov [0x200], ax
+			setup:    func(m *Machine) { m.Memory.MapReadOnly(0x200, 0x2ff) },
+			reason:   StopError,
+			executed: 1,
+			ip:       1,
+			err:      "write to read-only memory at 0x00200",
+		},
+		{
+			name: "read of unmapped memory",
+			code: []byte{0x90, 0xa1, 0x00, 0x03}, // nop; mov ax, [0x300]
+			setup: func(m *Machine) {
+				m.Memory.MapUnmapped(0x300, 0x3ff)
+				m.Memory.Policy = memory.Fault
+			},
+			reason:   StopError,
+			executed: 1,
+			ip:       1,
+			err:      "read from unmapped memory at 0x00300",
+		},
+		{
+			name: "fetch from unmapped memory",
+			code: []byte{0x90, 0x90},
+			setup: func(m *Machine) {
+				m.Memory.MapUnmapped(0x001, 0x0ff)
+				m.Memory.Policy = memory.Fault
+			},
+			reason:   StopError,
+			executed: 1,
+			ip:       1,
+			err:      "read from unmapped memory at 0x00001",
+		},
+		{
+			name:     "write to rom",
+			code:     []byte{0xa3, 0x00, 0x02}, // mov [0x200], ax
+			setup:    func(m *Machine) { m.Memory.MapROM(0x200, 0x2ff) },
+			reason:   StopEnd,
+			executed: 1,
+			ip:       3,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMachine(t, c.code)
+			m.StepLimit = 1000
+			if c.setup != nil {
+				c.setup(m)
+			}
+			res := m.Run(context.Background())
+			if res.Reason != c.reason || res.Executed != c.executed {
+				t.Errorf("stopped with %v after %d instructions, want %v after %d (%v)",
+					res.Reason, res.Executed, c.reason, c.executed, res.Err)
+			}
+			if ip := m.Reg(&registers.IP); ip != c.ip {
+				t.Errorf("stopped at ip %#04x, want %#04x", ip, c.ip)
+			}
+			if c.err == "" && res.Err != nil {
+				t.Errorf("got error %v", res.Err)
+			}
+			if c.err != "" && (res.Err == nil || !strings.Contains(res.Err.Error(), c.err)) {
+				t.Errorf("got error %v, want one saying %s", res.Err, c.err)
+			}
+			if m.Executed != res.Executed {
+				t.Errorf("machine counts %d instructions, run %d", m.Executed, res.Executed)
+			}
+		})
+	}
+}
+
+func TestRunErrorUndoesWrites(t *testing.T) {
+	// The word write's low byte lands before its high byte faults.
+	for _, journal := range []bool{false, true} {
+		m := newTestMachine(t, []byte{0xa3, 0xff, 0x01}) // mov [0x1ff], ax
+		m.Memory.MapReadOnly(0x200, 0x2ff)
+		m.SetReg(&registers.AX, 0x4242)
+		m.Memory.Poke(0x1ff, 0x11)
+		if journal {
+			m.EnableJournal(1 << 20)
+		}
+		res := m.Run(context.Background())
+		if res.Reason != StopError {
+			t.Fatalf("journal %t: stopped with %v", journal, res.Reason)
+		}
+		if got := m.Memory.Peek(0x1ff); got != 0x11 {
+			t.Errorf("journal %t: failed write left %#02x, want 0x11", journal, got)
+		}
+		if ip := m.Reg(&registers.IP); ip != 0 {
+			t.Errorf("journal %t: failed write left ip %#04x", journal, ip)
+		}
+	}
+}
+
+func TestRunHandlerBreak(t *testing.T) {
+	// What the handler did stays, and the interrupt it raised waits for
+	// the next instruction.
+	m := newTestMachine(t, []byte{0xcd, 0x21, 0x90}) // int 0x21; nop
+	m.PIC = NewPIC()
+	m.HandleInterrupt(0x21, func(m *Machine, _ uint8) error {
+		m.SetReg(&registers.AX, 0x4321)
+		m.PIC.Raise(0)
+		return ErrBreak
+	})
+	m.SetFlag(registers.FlagIF, true)
+	res := m.Run(context.Background())
+	if res.Reason != StopBreakpoint || !errors.Is(res.Err, ErrBreak) || res.Executed != 1 {
+		t.Fatalf("stopped with %v after %d instructions: %v", res.Reason, res.Executed, res.Err)
+	}
+	if ip, ax := m.Reg(&registers.IP), m.Reg(&registers.AX); ip != 2 || ax != 0x4321 {
+		t.Errorf("stopped at ip %#04x with ax %#04x, want 0x0002 and 0x4321", ip, ax)
+	}
+	if _, ok := m.PIC.Pending(); !ok {
+		t.Error("the break took the interrupt")
+	}
+}
+
+func TestRunWatched(t *testing.T) {
+	m := newTestMachine(t, fillLoop)
+	m.StopOnWatch = true
+	m.SetReg(&registers.AX, 0xbeef)
+	w := m.AddWatch(Watch{First: 0x1002, Last: 0x1003, Write: true})
+	res := m.Run(context.Background())
+	if len(res.Watched) != 1 {
+		t.Fatalf("run stopped with %v and watch hits %v, want one", res.Reason, res.Watched)
+	}
+	hit := res.Watched[0]
+	if hit.Watch != w || hit.At != 3 || !hit.Write || hit.Address() != 0x1002 || hit.Value != 0xbeef {
+		t.Errorf("watch hit %+v, want watch %d writing 0xbeef at 01002 from 00003", hit, w)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	m := newTestMachine(t, fillLoop)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := m.Run(ctx)
+	if res.Reason != StopError || res.Executed != 0 || !errors.Is(res.Err, context.Canceled) {
+		t.Errorf("canceled run: %v after %d instructions: %v", res.Reason, res.Executed, res.Err)
+	}
+
+	// Canceled while running, it stops at its next look at the context.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	m.Trace = func(Exec) {
+		if m.Executed == ctxCheckInterval+1 {
+			cancel()
+		}
+	}
+	res = m.Run(ctx)
+	if res.Reason != StopError || res.Executed != 2*ctxCheckInterval || !errors.Is(res.Err, context.Canceled) {
+		t.Errorf("run canceled after %d: %v after %d instructions: %v",
+			ctxCheckInterval+1, res.Reason, res.Executed, res.Err)
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	// Machines share nothing, so each runs on its own goroutine.
+	machines := make([]*Machine, 4)
+	for i := range machines {
+		machines[i] = newTestMachine(t, fillLoop)
+		machines[i].SetReg(&registers.AX, uint16(i+1))
+		machines[i].StepLimit = 10000
+	}
+	var wg sync.WaitGroup
+	results := make([]RunResult, len(machines))
+	for i, m := range machines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	for i, m := range machines {
+		if results[i].Reason != StopLimit || results[i].Executed != 10000 {
+			t.Errorf("machine %d stopped with %v after %d instructions", i, results[i].Reason, results[i].Executed)
+		}
+		if got := m.Memory.GetWord(0, 0x1000); got != uint16(i+1) {
+			t.Errorf("machine %d wrote %#04x, want %#04x", i, got, i+1)
+		}
+		if m.Clocks != machines[0].Clocks {
+			t.Errorf("machine %d took %v clocks, machine 0 %v", i, m.Clocks, machines[0].Clocks)
+		}
+	}
+}
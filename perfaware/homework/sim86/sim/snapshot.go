@@ -0,0 +1,292 @@
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+// Snapshot files hold a whole machine: registers, memory, clocks and the
+// state of its devices. They start with an 8 byte magic, "SIM86SNP", and
+// a little-endian uint16 version, then a series of sections, each a 4 byte
+// tag, a little-endian uint32 length and that many bytes:
+//
+//	"CPU " the 16-bit registers as little-endian uint16s in the order
+//	       ax bx cx dx sp bp si di es cs ss ds ip flags
+//	"MACH" uint32 end, uint32 loaded at, uint32 loaded end,
+//	       uint32 clocks min, uint32 clocks max, uint64 executed,
+//	       uint8 halted (1) or not (0)
+//	"MEM " the 1 MB of memory
+//	"DEV " a device: a uint8 name length, the name, then the device's
+//	       own encoding
+//	"END " the end, with no data
+//
+// All numbers are little-endian and addresses physical. Readers skip
+// sections they don't know and bytes past what they expect at the end
+// of one, so later versions of this format only add sections, or add to
+// the end of them, and older readers still read their files. The version
+// goes up only when existing data changes meaning, and readers refuse
+// versions newer than theirs.
+//
+// What lives outside the machine isn't saved: files DOS has open, disk
+// images and output already written.
+const (
+	snapshotMagic   = "SIM86SNP"
+	snapshotVersion = 1
+)
+
+// Snapshotted is a device whose state goes in snapshot files. The name
+// tags its section, so it must stay the same from version to version.
+type Snapshotted interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	SnapshotName() string
+}
+
+type machineSnapshot struct {
+	End, LoadedAt, LoadedEnd uint32
+	ClocksMin, ClocksMax     uint32
+	Executed                 uint64
+	// CPUState is haltedState or exitedState, or 0 for running; it was a
+	// bool for halted before there was exitedState.
+	CPUState uint8
+}
+
+const (
+	haltedState = 1
+	exitedState = 2
+)
+
+func cpuState(halted, exited bool) uint8 {
+	switch {
+	case exited:
+		return exitedState
+	case halted:
+		return haltedState
+	}
+	return 0
+}
+
+// snapshotted are the installed devices with state to save.
+func (m *Machine) snapshotted() []Snapshotted {
+	var devices []Snapshotted
+	seen := map[Snapshotted]bool{}
+	add := func(d any) {
+		if sd, ok := d.(Snapshotted); ok && !seen[sd] {
+			seen[sd] = true
+			devices = append(devices, sd)
+		}
+	}
+	for _, d := range m.clocked {
+		add(d)
+	}
+	for _, r := range m.Ports.ranges {
+		add(r.device)
+	}
+	return devices
+}
+
+// WriteSnapshot saves the machine to w.
+func (m *Machine) WriteSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	binary.Write(bw, binary.LittleEndian, uint16(snapshotVersion))
+
+	section := func(tag string, data []byte) {
+		bw.WriteString(tag)
+		binary.Write(bw, binary.LittleEndian, uint32(len(data)))
+		bw.Write(data)
+	}
+	encode := func(v any) []byte {
+		b, _ := marshalState(v)
+		return b
+	}
+
+	section("CPU ", encode(m.regs))
+	section("MACH", encode(machineSnapshot{
+		End: m.End, LoadedAt: m.loadedAt, LoadedEnd: m.loadedEnd,
+		ClocksMin: m.Clocks.Min, ClocksMax: m.Clocks.Max,
+		Executed: m.Executed, CPUState: cpuState(m.Halted, m.Exited),
+	}))
+	var mem bytes.Buffer
+	m.Memory.WriteTo(&mem)
+	section("MEM ", mem.Bytes())
+	for _, d := range m.snapshotted() {
+		state, err := d.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("saving %s: %w", d.SnapshotName(), err)
+		}
+		name := d.SnapshotName()
+		section("DEV ", append(append([]byte{uint8(len(name))}, name...), state...))
+	}
+	section("END ", nil)
+	return bw.Flush()
+}
+
+// ReadSnapshot restores the machine from r. The machine needs the devices
+// the snapshot was taken with; devices it has that the snapshot doesn't
+// keep their state. The undo journal starts over.
+func (m *Machine) ReadSnapshot(r io.Reader) error {
+	devices := map[string]Snapshotted{}
+	for _, d := range m.snapshotted() {
+		devices[d.SnapshotName()] = d
+	}
+	err := readSections(r, func(tag string, data []byte) error {
+		switch tag {
+		case "CPU ":
+			var regs registers.State
+			if err := unmarshalState(data, &regs); err != nil {
+				return err
+			}
+			m.regs = regs
+		case "MACH":
+			var ms machineSnapshot
+			if err := unmarshalState(data, &ms); err != nil {
+				return err
+			}
+			m.End, m.loadedAt, m.loadedEnd = ms.End, ms.LoadedAt, ms.LoadedEnd
+			m.Clocks = ClockInterval{ms.ClocksMin, ms.ClocksMax}
+			m.Executed = ms.Executed
+			m.Halted, m.Exited = ms.CPUState == haltedState, ms.CPUState == exitedState
+		case "MEM ":
+			if len(data) < memory.Size {
+				return errors.New("too little memory")
+			}
+			_, err := m.Memory.Load(bytes.NewReader(data[:memory.Size]), 0)
+			return err
+		case "DEV ":
+			name, state, err := deviceSection(data)
+			if err != nil {
+				return err
+			}
+			d, ok := devices[name]
+			if !ok {
+				return fmt.Errorf("no %s on this machine; set it up with the flags it was saved with", name)
+			}
+			return d.UnmarshalBinary(state)
+		}
+		return nil
+	})
+	if err == nil && m.journal != nil {
+		m.journal.Reset()
+	}
+	return err
+}
+
+// SnapshotState is what a snapshot holds, read without restoring it into
+// a machine, for comparing snapshots.
+type SnapshotState struct {
+	Registers                registers.State
+	End, LoadedAt, LoadedEnd uint32
+	Clocks                   ClockInterval
+	Executed                 uint64
+	Halted, Exited           bool
+	Memory                   []byte
+	// Devices holds each device's own encoding, by name.
+	Devices map[string][]byte
+}
+
+// IsSnapshot reports whether data starts like a snapshot file.
+func IsSnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(snapshotMagic))
+}
+
+// ParseSnapshot reads a snapshot from r.
+func ParseSnapshot(r io.Reader) (*SnapshotState, error) {
+	s := &SnapshotState{Devices: map[string][]byte{}}
+	err := readSections(r, func(tag string, data []byte) error {
+		switch tag {
+		case "CPU ":
+			return unmarshalState(data, &s.Registers)
+		case "MACH":
+			var ms machineSnapshot
+			if err := unmarshalState(data, &ms); err != nil {
+				return err
+			}
+			s.End, s.LoadedAt, s.LoadedEnd = ms.End, ms.LoadedAt, ms.LoadedEnd
+			s.Clocks = ClockInterval{ms.ClocksMin, ms.ClocksMax}
+			s.Executed = ms.Executed
+			s.Halted, s.Exited = ms.CPUState == haltedState, ms.CPUState == exitedState
+		case "MEM ":
+			if len(data) < memory.Size {
+				return errors.New("too little memory")
+			}
+			s.Memory = data[:memory.Size]
+		case "DEV ":
+			name, state, err := deviceSection(data)
+			s.Devices[name] = state
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.Memory == nil {
+		return nil, errors.New("snapshot has no memory")
+	}
+	return s, nil
+}
+
+// readSections checks a snapshot's header and calls f with each section
+// up to the end.
+func readSections(r io.Reader, f func(tag string, data []byte) error) error {
+	br := bufio.NewReader(r)
+	var header struct {
+		Magic   [8]byte
+		Version uint16
+	}
+	if err := binary.Read(br, binary.LittleEndian, &header); err != nil || string(header.Magic[:]) != snapshotMagic {
+		return errors.New("not a sim86 snapshot")
+	}
+	if header.Version > snapshotVersion {
+		return fmt.Errorf("snapshot is version %d, newer than this sim86 reads (%d)", header.Version, snapshotVersion)
+	}
+	for {
+		var s struct {
+			Tag    [4]byte
+			Length uint32
+		}
+		if err := binary.Read(br, binary.LittleEndian, &s); err != nil {
+			return fmt.Errorf("snapshot is cut short: %w", err)
+		}
+		tag := string(s.Tag[:])
+		if tag == "END " {
+			return nil
+		}
+		data := make([]byte, s.Length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("snapshot is cut short in %q: %w", tag, err)
+		}
+		if err := f(tag, data); err != nil {
+			return fmt.Errorf("section %q: %w", tag, err)
+		}
+	}
+}
+
+// deviceSection splits a DEV section into the device's name and state.
+func deviceSection(data []byte) (string, []byte, error) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil, errors.New("device without a name")
+	}
+	return string(data[1 : 1+data[0]]), data[1+data[0]:], nil
+}
+
+// marshalState and unmarshalState encode the fixed size structs devices
+// describe their state with, for their MarshalBinary and UnmarshalBinary.
+func marshalState(v any) ([]byte, error) {
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.LittleEndian, v)
+	return b.Bytes(), err
+}
+
+func unmarshalState(data []byte, v any) error {
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, v)
+}
@@ -0,0 +1,154 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// snapshotRun runs m for n more instructions.
+func snapshotRun(t *testing.T, m *Machine, n uint64) {
+	t.Helper()
+	m.StepLimit = n
+	if res := m.Run(context.Background()); res.Reason != StopLimit {
+		t.Fatalf("run stopped with %v: %v", res.Reason, res.Err)
+	}
+}
+
+func writeSnapshot(t *testing.T, m *Machine) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := m.WriteSnapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	m := newTimerMachine(t)
+	snapshotRun(t, m, 777)
+	data := writeSnapshot(t, m)
+
+	restored := newTimerMachine(t)
+	if err := restored.ReadSnapshot(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if captureState(t, restored) != captureState(t, m) {
+		t.Fatal("restored machine differs from the one saved")
+	}
+	// Both go on the same way, timer and all.
+	snapshotRun(t, m, 1000)
+	snapshotRun(t, restored, 1000)
+	if captureState(t, restored) != captureState(t, m) {
+		t.Error("restored machine ran differently from the one saved")
+	}
+}
+
+func TestSnapshotCPUState(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		halted, exited bool
+		state          uint8
+	}{
+		{"running", false, false, 0},
+		{"halted", true, false, haltedState},
+		{"exited", false, true, exitedState},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMachine(t, fillLoop)
+			m.Halted, m.Exited = c.halted, c.exited
+			data := writeSnapshot(t, m)
+			s, err := ParseSnapshot(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Halted != c.halted || s.Exited != c.exited {
+				t.Errorf("parsed halted %t exited %t", s.Halted, s.Exited)
+			}
+			restored := newTestMachine(t, nil)
+			if err := restored.ReadSnapshot(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if restored.Halted != c.halted || restored.Exited != c.exited {
+				t.Errorf("restored halted %t exited %t", restored.Halted, restored.Exited)
+			}
+			// The state byte is where version 1 had its halted bool.
+			if got := data[bytes.Index(data, []byte("MACH"))+8+28]; got != c.state {
+				t.Errorf("state byte is %d, want %d", got, c.state)
+			}
+		})
+	}
+}
+
+// withSection puts a section before the one tagged before in data.
+func withSection(data []byte, before, tag string, body []byte) []byte {
+	i := bytes.LastIndex(data, []byte(before))
+	var b bytes.Buffer
+	b.Write(data[:i])
+	b.WriteString(tag)
+	binary.Write(&b, binary.LittleEndian, uint32(len(body)))
+	b.Write(body)
+	b.Write(data[i:])
+	return b.Bytes()
+}
+
+func TestSnapshotLaterVersions(t *testing.T) {
+	m := newTimerMachine(t)
+	snapshotRun(t, m, 300)
+	data := writeSnapshot(t, m)
+
+	// A section this version doesn't know is skipped.
+	unknown := withSection(data, "END ", "XTRA", []byte("from the future"))
+
+	// So are bytes added to the end of a known section.
+	longer := slices.Clone(data)
+	mach := bytes.Index(longer, []byte("MACH"))
+	n := binary.LittleEndian.Uint32(longer[mach+4:])
+	binary.LittleEndian.PutUint32(longer[mach+4:], n+3)
+	longer = slices.Insert(longer, mach+8+int(n), 1, 2, 3)
+
+	for name, data := range map[string][]byte{"unknown section": unknown, "longer section": longer} {
+		t.Run(name, func(t *testing.T) {
+			restored := newTimerMachine(t)
+			if err := restored.ReadSnapshot(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if captureState(t, restored) != captureState(t, m) {
+				t.Error("restored machine differs from the one saved")
+			}
+			if _, err := ParseSnapshot(bytes.NewReader(data)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	m := newTimerMachine(t)
+	data := writeSnapshot(t, m)
+	newer := slices.Clone(data)
+	binary.LittleEndian.PutUint16(newer[len(snapshotMagic):], snapshotVersion+1)
+
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		machine *Machine
+		want    string
+	}{
+		{"not a snapshot", []byte("MZ hello"), newTimerMachine(t), "not a sim86 snapshot"},
+		{"newer version", newer, newTimerMachine(t), "newer than this sim86 reads"},
+		{"cut short", data[:len(data)-20], newTimerMachine(t), "cut short"},
+		{"missing device", data, newTestMachine(t, nil), "no pit on this machine"},
+		{"nameless device", withSection(data, "END ", "DEV ", nil), newTimerMachine(t), "device without a name"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.machine.ReadSnapshot(bytes.NewReader(c.data))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %v, want an error saying %s", err, c.want)
+			}
+		})
+	}
+}
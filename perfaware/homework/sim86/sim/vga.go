@@ -0,0 +1,276 @@
+package sim
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"unsafe"
+
+	"sim86/memory"
+)
+
+// VGA is mode 13h: 320x200 with a byte per pixel at A000:0000, each byte
+// an index into a 256 color palette of 6-bit DAC values. The screen is
+// plain memory, so this only keeps the palette and takes pictures of it.
+type VGA struct {
+	Mem *memory.Memory
+	// Prefix names the PNG files snapshots are saved to, as
+	// Prefix-0001.png, Prefix-0002.png and so on.
+	Prefix string
+	// Every, when nonzero, saves a snapshot every Every frames.
+	Every uint32
+	// OnHalt saves a snapshot each time the CPU halts.
+	OnHalt bool
+
+	// Palette is copied on write once SaveState has handed it out.
+	Palette       *[256][3]uint8
+	paletteShared bool
+	// paletteCounted is set once a saved state has counted the palette
+	// against the journal's budget.
+	paletteCounted bool
+
+	writeIndex, readIndex uint8
+	writeRGB, readRGB     int // which component of the entry is next
+
+	clocks uint32
+	frames uint32
+	shots  int
+	err    error
+}
+
+const (
+	vgaBase   = 0xa0000
+	vgaWidth  = 320
+	vgaHeight = 200
+
+	vgaReadIndex  = 0x3c7
+	vgaWriteIndex = 0x3c8
+	vgaData       = 0x3c9
+
+	// Mode 13h refreshes at 70 Hz.
+	vgaFrameClocks = 4772727 / 70
+)
+
+// NewVGA returns mode 13h with the palette the BIOS sets up for it.
+func NewVGA(mem *memory.Memory) *VGA {
+	p := defaultPalette()
+	return &VGA{Mem: mem, Palette: &p}
+}
+
+// InstallVGA puts v's DAC ports on m and has it follow m's clock.
+func InstallVGA(m *Machine, v *VGA) error {
+	if err := m.Ports.Register(vgaReadIndex, vgaData, v); err != nil {
+		return err
+	}
+	m.AddClocked(v)
+	return nil
+}
+
+func (v *VGA) Advance(clocks uint32) {
+	v.clocks += clocks
+	for v.clocks >= vgaFrameClocks {
+		v.clocks -= vgaFrameClocks
+		v.frames++
+		if v.Every != 0 && v.frames%v.Every == 0 {
+			v.Snapshot()
+		}
+	}
+}
+
+type vgaState struct {
+	palette               *[256][3]uint8
+	writeIndex, readIndex uint8
+	writeRGB, readRGB     int
+	clocks, frames        uint32
+}
+
+// SaveState keeps everything but the snapshots already saved. The
+// palette is counted by the first state to hold it; once the journal has
+// dropped that one, the states after it share the palette uncounted, but
+// that can only happen to the oldest palette still held.
+func (v *VGA) SaveState() (any, int) {
+	size := int(unsafe.Sizeof(vgaState{}))
+	if !v.paletteCounted {
+		size += int(unsafe.Sizeof(*v.Palette))
+		v.paletteCounted = true
+	}
+	v.paletteShared = true
+	return vgaState{v.Palette, v.writeIndex, v.readIndex, v.writeRGB, v.readRGB, v.clocks, v.frames}, size
+}
+
+func (v *VGA) RestoreState(state any) {
+	s := state.(vgaState)
+	v.Palette, v.paletteShared, v.paletteCounted = s.palette, true, true
+	v.writeIndex, v.readIndex, v.writeRGB, v.readRGB = s.writeIndex, s.readIndex, s.writeRGB, s.readRGB
+	v.clocks, v.frames = s.clocks, s.frames
+}
+
+// vgaSnapshot is a VGA as snapshot files have it.
+type vgaSnapshot struct {
+	Palette               [256][3]uint8
+	WriteIndex, ReadIndex uint8
+	WriteRGB, ReadRGB     uint8
+	Clocks, Frames        uint32
+}
+
+func (v *VGA) SnapshotName() string {
+	return "vga"
+}
+
+// MarshalBinary keeps the same as SaveState does.
+func (v *VGA) MarshalBinary() ([]byte, error) {
+	return marshalState(vgaSnapshot{*v.Palette, v.writeIndex, v.readIndex,
+		uint8(v.writeRGB), uint8(v.readRGB), v.clocks, v.frames})
+}
+
+func (v *VGA) UnmarshalBinary(data []byte) error {
+	var s vgaSnapshot
+	if err := unmarshalState(data, &s); err != nil {
+		return err
+	}
+	v.Palette, v.paletteShared, v.paletteCounted = &s.Palette, false, false
+	v.writeIndex, v.readIndex, v.writeRGB, v.readRGB = s.WriteIndex, s.ReadIndex, int(s.WriteRGB), int(s.ReadRGB)
+	v.clocks, v.frames = s.Clocks, s.Frames
+	return nil
+}
+
+// Halted is told when the CPU executes hlt.
+func (v *VGA) Halted() {
+	if v.OnHalt {
+		v.Snapshot()
+	}
+}
+
+// Snapshot saves the screen to the next numbered file. Devices can't
+// fail an instruction, so the first error is kept for Err.
+func (v *VGA) Snapshot() {
+	v.shots++
+	name := fmt.Sprintf("%s-%04d.png", v.Prefix, v.shots)
+	f, err := os.Create(name)
+	if err == nil {
+		err = png.Encode(f, v.Image())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil && v.err == nil {
+		v.err = err
+	}
+}
+
+// Err is the first error saving a snapshot hit.
+func (v *VGA) Err() error {
+	return v.err
+}
+
+// Image is the screen as it is now.
+func (v *VGA) Image() *image.Paletted {
+	pal := make(color.Palette, len(v.Palette))
+	for i, c := range v.Palette {
+		pal[i] = color.RGBA{dac8(c[0]), dac8(c[1]), dac8(c[2]), 0xff}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, vgaWidth, vgaHeight), pal)
+	for i := range img.Pix {
+		img.Pix[i] = v.Mem.Peek(vgaBase + uint32(i))
+	}
+	return img
+}
+
+// dac8 widens a 6-bit DAC value so that 63 is full brightness.
+func dac8(c uint8) uint8 {
+	c &= 0x3f
+	return c<<2 | c>>4
+}
+
+func (v *VGA) In(port uint16, wide bool) uint16 {
+	switch port {
+	case vgaWriteIndex:
+		return uint16(v.writeIndex)
+	case vgaData:
+		c := v.Palette[v.readIndex][v.readRGB]
+		if v.readRGB++; v.readRGB == 3 {
+			v.readRGB = 0
+			v.readIndex++
+		}
+		return uint16(c)
+	}
+	return 0xff
+}
+
+func (v *VGA) Out(port uint16, val uint16, wide bool) {
+	switch port {
+	case vgaReadIndex:
+		v.readIndex, v.readRGB = uint8(val), 0
+	case vgaWriteIndex:
+		v.writeIndex, v.writeRGB = uint8(val), 0
+	case vgaData:
+		if v.paletteShared {
+			p := *v.Palette
+			v.Palette, v.paletteShared, v.paletteCounted = &p, false, false
+		}
+		v.Palette[v.writeIndex][v.writeRGB] = uint8(val) & 0x3f
+		if v.writeRGB++; v.writeRGB == 3 {
+			v.writeRGB = 0
+			v.writeIndex++
+		}
+	}
+	if wide && port != vgaData {
+		// A word out also hits the next port up, which is how programs
+		// set the index and write red in one go.
+		v.Out(port+1, val>>8, false)
+	}
+}
+
+// defaultPalette is the BIOS's mode 13h palette: the 16 CGA colors, 16
+// grays, then a 24 hue color wheel at three saturations for each of three
+// intensities. The last 8 entries are black.
+func defaultPalette() [256][3]uint8 {
+	var p [256][3]uint8
+	for i := 0; i < 16; i++ {
+		var r, g, b uint8
+		if i&8 != 0 {
+			r, g, b = 21, 21, 21
+		}
+		if i&4 != 0 {
+			r += 42
+		}
+		if i&2 != 0 {
+			g += 42
+		}
+		if i&1 != 0 {
+			b += 42
+		}
+		p[i] = [3]uint8{r, g, b}
+	}
+	// Brown, not dark yellow.
+	p[6] = [3]uint8{42, 21, 0}
+
+	grays := [16]uint8{0, 5, 8, 11, 14, 17, 20, 24, 28, 32, 36, 40, 45, 50, 56, 63}
+	for i, v := range grays {
+		p[16+i] = [3]uint8{v, v, v}
+	}
+
+	levels := [9][5]uint8{
+		{0, 16, 31, 47, 63}, {31, 39, 47, 55, 63}, {45, 49, 54, 58, 63},
+		{0, 7, 14, 21, 28}, {14, 17, 21, 24, 28}, {20, 22, 24, 26, 28},
+		{0, 4, 8, 12, 16}, {8, 10, 12, 14, 16}, {11, 12, 13, 15, 16},
+	}
+	// Which level each of red, green and blue is at around the wheel,
+	// starting at blue and going through magenta, red, yellow, green and
+	// cyan.
+	wheel := [24][3]int{
+		{0, 0, 4}, {1, 0, 4}, {2, 0, 4}, {3, 0, 4}, {4, 0, 4}, {4, 0, 3}, {4, 0, 2}, {4, 0, 1},
+		{4, 0, 0}, {4, 1, 0}, {4, 2, 0}, {4, 3, 0}, {4, 4, 0}, {3, 4, 0}, {2, 4, 0}, {1, 4, 0},
+		{0, 4, 0}, {0, 4, 1}, {0, 4, 2}, {0, 4, 3}, {0, 4, 4}, {0, 3, 4}, {0, 2, 4}, {0, 1, 4},
+	}
+	i := 32
+	for _, l := range levels {
+		for _, h := range wheel {
+			p[i] = [3]uint8{l[h[0]], l[h[1]], l[h[2]]}
+			i++
+		}
+	}
+	return p
+}
@@ -0,0 +1,151 @@
+package sim
+
+import (
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+)
+
+func TestVGAPalette(t *testing.T) {
+	var v *VGA
+	c := programTest{
+		name: "palette",
+		code: []byte{
+			0xba, 0xc8, 0x03, // mov dx, 0x3c8
+			0xb0, 0x05, // mov al, 5
+			0xee,       // out dx, al
+			0x42,       // inc dx
+			0xb0, 0x3f, // mov al, 63
+			0xee,       // out dx, al
+			0xb0, 0x4a, // mov al, 0x40 | 10
+			0xee,       // out dx, al
+			0xb0, 0x00, // mov al, 0
+			0xee,       // out dx, al
+			0xb0, 0x01, // mov al, 1
+			0xee,             // out dx, al: the red of entry 6
+			0x4a,             // dec dx
+			0xb8, 0x07, 0x20, // mov ax, 0x2007
+			0xef,             // out dx, ax: index 7 and its red in one go
+			0xba, 0xc7, 0x03, // mov dx, 0x3c7
+			0xb0, 0x05, // mov al, 5
+			0xee,             // out dx, al
+			0x83, 0xc2, 0x02, // add dx, 2
+			0xec,       // in al, dx
+			0x88, 0xc3, // mov bl, al
+			0xec,       // in al, dx
+			0x88, 0xc7, // mov bh, al
+			0xec,       // in al, dx
+			0x88, 0xc1, // mov cl, al
+			0xec,       // in al, dx: the red of entry 6
+			0x88, 0xc5, // mov ch, al
+			0x4a, // dec dx
+			0xec, // in al, dx: the write index, still 7 until its blue
+		},
+		setup: func(m *Machine) {
+			v = NewVGA(m.Memory)
+			if err := InstallVGA(m, v); err != nil {
+				t.Fatal(err)
+			}
+		},
+		// The DAC keeps 6 bits of each component.
+		want: []regValue{{&registers.BX, 0x0a3f}, {&registers.CX, 0x0100}, {&registers.AL, 7}},
+	}
+	c.run(t)
+	for i, want := range map[int][3]uint8{5: {63, 10, 0}, 6: {1, 21, 0}, 7: {32, 42, 42}} {
+		if got := v.Palette[i]; got != want {
+			t.Errorf("palette entry %d is %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestVGAPaletteCopyOnWrite(t *testing.T) {
+	v := NewVGA(memory.New())
+	state, _ := v.SaveState()
+	v.Out(vgaWriteIndex, 1, false)
+	v.Out(vgaData, 63, false)
+	if v.Palette[1][0] != 63 {
+		t.Fatalf("write didn't land: %v", v.Palette[1])
+	}
+	v.RestoreState(state)
+	if got := v.Palette[1]; got != [3]uint8{0, 0, 42} {
+		t.Errorf("restored palette entry 1 is %v, want the default blue", got)
+	}
+}
+
+func TestVGADefaultPalette(t *testing.T) {
+	p := defaultPalette()
+	for i, want := range map[int][3]uint8{
+		0: {0, 0, 0}, 1: {0, 0, 42}, 6: {42, 21, 0}, 14: {63, 63, 21}, 15: {63, 63, 63},
+		16: {0, 0, 0}, 31: {63, 63, 63}, 32: {0, 0, 63}, 40: {63, 0, 0}, 48: {0, 63, 0},
+		248: {0, 0, 0}, 255: {0, 0, 0},
+	} {
+		if p[i] != want {
+			t.Errorf("entry %d is %v, want %v", i, p[i], want)
+		}
+	}
+}
+
+func TestVGASnapshot(t *testing.T) {
+	mem := memory.New()
+	v := NewVGA(mem)
+	v.Prefix = filepath.Join(t.TempDir(), "screen")
+	v.Every = 2
+	mem.Poke(vgaBase, 4)                       // red, top left
+	mem.Poke(vgaBase+vgaWidth*vgaHeight-1, 15) // white, bottom right
+	v.Out(vgaWriteIndex, 0x20, false)
+	for _, c := range []uint8{63, 32, 1} {
+		v.Out(vgaData, uint16(c), false)
+	}
+	mem.Poke(vgaBase+vgaWidth+1, 0x20)
+
+	v.Advance(vgaFrameClocks)
+	if _, err := os.Stat(v.Prefix + "-0001.png"); err == nil {
+		t.Fatal("saved a snapshot after one frame")
+	}
+	v.Advance(vgaFrameClocks)
+	f, err := os.Open(v.Prefix + "-0001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != vgaWidth || b.Dy() != vgaHeight {
+		t.Fatalf("image is %v", b)
+	}
+	for _, c := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{170, 0, 0, 255}},
+		{319, 199, color.RGBA{255, 255, 255, 255}},
+		{1, 1, color.RGBA{255, 130, 4, 255}},
+		{2, 1, color.RGBA{0, 0, 0, 255}},
+	} {
+		if got := color.RGBAModel.Convert(img.At(c.x, c.y)); got != c.want {
+			t.Errorf("pixel %d,%d is %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+
+	v.OnHalt = true
+	v.Halted()
+	if _, err := os.Stat(v.Prefix + "-0002.png"); err != nil {
+		t.Error(err)
+	}
+	if v.Err() != nil {
+		t.Error(v.Err())
+	}
+
+	v.Prefix = filepath.Join(t.TempDir(), "missing", "screen")
+	v.Snapshot()
+	if v.Err() == nil {
+		t.Error("saving to a missing directory didn't fail")
+	}
+}
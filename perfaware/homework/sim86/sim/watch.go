@@ -0,0 +1,114 @@
+package sim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sim86/memory"
+)
+
+// Watch is a watchpoint on the physical addresses First through Last,
+// inclusive. It triggers on reads, writes or both.
+type Watch struct {
+	First, Last uint32
+	Read, Write bool
+}
+
+func (w Watch) String() string {
+	kind := "access"
+	switch {
+	case !w.Read:
+		kind = "write"
+	case !w.Write:
+		kind = "read"
+	}
+	if w.First == w.Last {
+		return fmt.Sprintf("%s 0x%05x", kind, w.First)
+	}
+	return fmt.Sprintf("%s 0x%05x-0x%05x", kind, w.First, w.Last)
+}
+
+// WatchHit is an access that set off a watchpoint.
+type WatchHit struct {
+	// Watch is the index of the watchpoint in Watches.
+	Watch int
+	Access
+	// At is the physical address of the instruction that made the access.
+	At uint32
+}
+
+func (h WatchHit) String() string {
+	if h.Write {
+		return fmt.Sprintf("write 0x%05x at 0x%05x: 0x%x->0x%x", h.Address(), h.At, h.Old, h.Value)
+	}
+	return fmt.Sprintf("read 0x%05x at 0x%05x: 0x%x", h.Address(), h.At, h.Value)
+}
+
+// AddWatch sets a watchpoint and returns its index.
+func (m *Machine) AddWatch(w Watch) int {
+	m.watches = append(m.watches, w)
+	return len(m.watches) - 1
+}
+
+// RemoveWatch clears the watchpoint at index i. Later ones move down.
+func (m *Machine) RemoveWatch(i int) {
+	m.watches = append(m.watches[:i], m.watches[i+1:]...)
+	if len(m.watches) == 0 {
+		// readMem and writeMem only look for hits while this is non-nil.
+		m.watches = nil
+	}
+}
+
+func (m *Machine) Watches() []Watch {
+	return m.watches
+}
+
+// watch records a if it touches a watchpoint.
+func (m *Machine) watch(a Access) {
+	first := a.Address()
+	last := first
+	if a.Wide {
+		last = memory.Address(a.Seg, a.Off+1)
+	}
+	for i, w := range m.watches {
+		if (a.Write && !w.Write) || (!a.Write && !w.Read) {
+			continue
+		}
+		if (first >= w.First && first <= w.Last) || (last >= w.First && last <= w.Last) {
+			m.hits = append(m.hits, WatchHit{Watch: i, Access: a})
+		}
+	}
+}
+
+// ParseWatch parses a -watch style spec, addr[+len]. addr is a physical
+// address or seg:off in hex, len a count of bytes in decimal.
+func ParseWatch(spec string, read, write bool) (Watch, error) {
+	addrText, lenText, hasLen := strings.Cut(spec, "+")
+	n := uint64(1)
+	if hasLen {
+		var err error
+		if n, err = strconv.ParseUint(lenText, 10, 32); err != nil || n == 0 {
+			return Watch{}, fmt.Errorf("bad watch length in %q", spec)
+		}
+	}
+	var first uint32
+	if seg, off, ok := strings.Cut(addrText, ":"); ok {
+		s, err1 := strconv.ParseUint(seg, 16, 16)
+		o, err2 := strconv.ParseUint(off, 16, 16)
+		if err1 != nil || err2 != nil {
+			return Watch{}, fmt.Errorf("bad watch address in %q", spec)
+		}
+		first = memory.Address(uint16(s), uint16(o))
+	} else {
+		a, err := strconv.ParseUint(strings.TrimPrefix(addrText, "0x"), 16, 20)
+		if err != nil {
+			return Watch{}, fmt.Errorf("bad watch address in %q", spec)
+		}
+		first = uint32(a)
+	}
+	if uint64(first)+n > memory.Size {
+		return Watch{}, fmt.Errorf("watch %q runs past the end of memory", spec)
+	}
+	return Watch{First: first, Last: first + uint32(n) - 1, Read: read, Write: write}, nil
+}
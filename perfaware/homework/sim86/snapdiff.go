@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// machineState is one side of a diff.
+type machineState struct {
+	name string
+	*sim.SnapshotState
+}
+
+// snapdiff is `sim86 diff a b`: it compares two machine states, writing
+// the differences to w, and exits 1 if they differ. Each is a snapshot
+// file, or a program that is run to its end to get its final state, which
+// is how two versions of a routine are checked for leaving memory the
+// same.
+func snapdiff(w io.Writer, args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sim86 diff [flags] a b\n\na and b are snapshots, or programs to run to the end.\n\n")
+		fs.PrintDefaults()
+	}
+	stopOnRet := fs.Bool("stoponret", false, "stop programs at their first ret")
+	stopAfter := fs.Uint64("stopafter", 0, "stop programs after `n` instructions")
+	ignore := fs.String("ignore", "", "comma separated `registers` to leave out, e.g. ip,flags")
+	code := fs.Bool("code", false, "compare the memory programs were loaded into too")
+	gap := fs.Int("gap", 4, "join memory differences fewer than `n` equal bytes apart into one range")
+	maxBytes := fs.Int("bytes", 64, "show at most `n` bytes of each range")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	skip := map[string]bool{}
+	for _, r := range strings.Split(*ignore, ",") {
+		if r = strings.TrimSpace(strings.ToLower(r)); r != "" {
+			if registers.ByName(r) == nil {
+				fmt.Fprintf(os.Stderr, "no register %q\n", r)
+				return 2
+			}
+			skip[r] = true
+		}
+	}
+
+	var states [2]*machineState
+	for i, name := range fs.Args() {
+		s, err := readState(name, options{StopOnRet: *stopOnRet, StopAfter: *stopAfter})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		states[i] = s
+	}
+
+	a, b := states[0], states[1]
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", a.name, b.name)
+	same := diffRegisters(w, a, b, skip)
+	if a.Clocks != b.Clocks || a.Executed != b.Executed {
+		// Not a difference in state, but what an optimization is for.
+		fmt.Fprintf(w, "clocks: %s -> %s, instructions: %d -> %d\n",
+			a.Clocks, b.Clocks, a.Executed, b.Executed)
+	}
+	ranges := diffMemory(a, b, *code, *gap)
+	if len(ranges) > 0 {
+		same = false
+		n := 0
+		for _, r := range ranges {
+			n += r.count
+		}
+		fmt.Fprintf(w, "memory: %d bytes differ in %d ranges\n", n, len(ranges))
+		for _, r := range ranges {
+			writeRange(w, r, a.Memory, b.Memory, *maxBytes)
+		}
+	}
+	for name, sa := range a.Devices {
+		if sb, ok := b.Devices[name]; !ok || !bytes.Equal(sa, sb) {
+			fmt.Fprintf(w, "device %s differs\n", name)
+			same = false
+		}
+	}
+	for name := range b.Devices {
+		if _, ok := a.Devices[name]; !ok {
+			fmt.Fprintf(w, "device %s differs\n", name)
+			same = false
+		}
+	}
+	if same {
+		fmt.Fprintln(w, "same")
+		return 0
+	}
+	return 1
+}
+
+// readState reads a snapshot, or runs a program and takes one at the end.
+func readState(name string, opt options) (*machineState, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if !sim.IsSnapshot(data) {
+		if data, err = runToSnapshot(name, data, opt); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	state, err := sim.ParseSnapshot(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &machineState{name, state}, nil
+}
+
+// runToSnapshot runs image the way sim86 would by default, with DOS for
+// the programs that need it and nothing read from the keyboard.
+func runToSnapshot(name string, image []byte, opt options) ([]byte, error) {
+	format := formatFor(name)
+	loader, needsDOS, err := newLoader(format, "0:0", 0, "", io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	noInput := bufio.NewReader(bytes.NewReader(nil))
+	opt.Loader = loader
+	if needsDOS {
+		opt.DOS = sim.NewDOS(filepath.Dir(name), noInput, io.Discard)
+		defer opt.DOS.Close()
+	}
+	if format == "boot" {
+		opt.BIOS = &sim.BIOS{Stdin: noInput, Stdout: io.Discard, Disks: map[uint8]*sim.Disk{}}
+	}
+	s, err := newSession(io.Discard, image, opt)
+	if err != nil {
+		return nil, err
+	}
+	res := s.m.Run(context.Background())
+	if err := s.finish(res.Err); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = s.m.WriteSnapshot(&b)
+	return b.Bytes(), err
+}
+
+// diffRegisters prints the registers that differ and reports whether none
+// did.
+func diffRegisters(w io.Writer, a, b *machineState, skip map[string]bool) bool {
+	same := true
+	for i, r := range registers.Words {
+		va, vb := a.Registers[i], b.Registers[i]
+		if va == vb || skip[r.Name] {
+			continue
+		}
+		if same {
+			fmt.Fprintln(w, "registers:")
+			same = false
+		}
+		if r == &registers.FLAGS {
+			fmt.Fprintf(w, "  %5s: %s -> %s\n", r.Name, registers.FlagsString(va), registers.FlagsString(vb))
+			continue
+		}
+		fmt.Fprintf(w, "  %5s: 0x%04x -> 0x%04x\n", r.Name, va, vb)
+	}
+	if a.Halted != b.Halted {
+		fmt.Fprintf(w, "halted: %t -> %t\n", a.Halted, b.Halted)
+		same = false
+	}
+	if a.Exited != b.Exited {
+		fmt.Fprintf(w, "exited: %t -> %t\n", a.Exited, b.Exited)
+		same = false
+	}
+	return same
+}
+
+// diffRange is a run of memory with differences in it.
+type diffRange struct {
+	first, last uint32
+	count       int // bytes that differ
+}
+
+// diffMemory finds where the memory differs, leaving out the programs
+// unless code is set.
+func diffMemory(a, b *machineState, code bool, gap int) []diffRange {
+	loaded := func(s *machineState, addr uint32) bool {
+		return addr >= s.LoadedAt && addr < s.LoadedEnd
+	}
+	var ranges []diffRange
+	for addr := uint32(0); addr < memory.Size; addr++ {
+		if a.Memory[addr] == b.Memory[addr] || (!code && (loaded(a, addr) || loaded(b, addr))) {
+			continue
+		}
+		if n := len(ranges); n > 0 && int(addr-ranges[n-1].last) <= gap {
+			ranges[n-1].last = addr
+			ranges[n-1].count++
+			continue
+		}
+		ranges = append(ranges, diffRange{addr, addr, 1})
+	}
+	return ranges
+}
+
+// writeRange prints a range's bytes before and after, 16 to a line, up to
+// max bytes of it.
+func writeRange(w io.Writer, r diffRange, before, after []byte, max int) {
+	size := int(r.last-r.first) + 1
+	fmt.Fprintf(w, "  0x%05x-0x%05x: %d of %d bytes differ\n", r.first, r.last, r.count, size)
+	shown := min(size, max)
+	for off := 0; off < shown; off += 16 {
+		addr := r.first + uint32(off)
+		n := min(16, shown-off)
+		fmt.Fprintf(w, "    - 0x%05x: % x\n", addr, before[addr:addr+uint32(n)])
+		fmt.Fprintf(w, "    + 0x%05x: % x\n", addr, after[addr:addr+uint32(n)])
+	}
+	if shown < size {
+		fmt.Fprintf(w, "    ... %d more bytes\n", size-shown)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+func TestSnapdiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, code []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, code, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// Both store ax at 0x100; the second stores 2 rather than 1 and a 5
+	// at 0x108 too.
+	a := write("a.bin", []byte{
+		0xb8, 0x01, 0x00, // mov ax, 1
+		0xa3, 0x00, 0x01, // mov [0x100], ax
+	})
+	b := write("b.bin", []byte{
+		0xb8, 0x02, 0x00, // mov ax, 2
+		0xa3, 0x00, 0x01, // mov [0x100], ax
+		0xc6, 0x06, 0x08, 0x01, 0x05, // mov byte [0x108], 5
+	})
+
+	for _, c := range []struct {
+		name string
+		args []string
+		code int
+		want string
+	}{
+		{"same", []string{a, a}, 0, "--- A\n+++ A\nsame\n"},
+		{"different", []string{a, b}, 1, `--- A
++++ B
+registers:
+     ax: 0x0001 -> 0x0002
+     ip: 0x0006 -> 0x000b
+clocks: 19 -> 35, instructions: 2 -> 3
+memory: 2 bytes differ in 2 ranges
+  0x00100-0x00100: 1 of 1 bytes differ
+    - 0x00100: 01
+    + 0x00100: 02
+  0x00108-0x00108: 1 of 1 bytes differ
+    - 0x00108: 00
+    + 0x00108: 05
+`},
+		{"ignored registers and a wider gap", []string{"-ignore", "AX, ip", "-gap", "8", a, b}, 1, `--- A
++++ B
+clocks: 19 -> 35, instructions: 2 -> 3
+memory: 2 bytes differ in 1 ranges
+  0x00100-0x00108: 2 of 9 bytes differ
+    - 0x00100: 01 00 00 00 00 00 00 00 00
+    + 0x00100: 02 00 00 00 00 00 00 00 05
+`},
+		{"code", []string{"-code", "-ignore", "ax,ip", "-bytes", "4", a, b}, 1, `--- A
++++ B
+clocks: 19 -> 35, instructions: 2 -> 3
+memory: 8 bytes differ in 4 ranges
+  0x00001-0x00001: 1 of 1 bytes differ
+    - 0x00001: 01
+    + 0x00001: 02
+  0x00006-0x0000a: 5 of 5 bytes differ
+    - 0x00006: 00 00 00 00
+    + 0x00006: c6 06 08 01
+    ... 1 more bytes
+  0x00100-0x00100: 1 of 1 bytes differ
+    - 0x00100: 01
+    + 0x00100: 02
+  0x00108-0x00108: 1 of 1 bytes differ
+    - 0x00108: 00
+    + 0x00108: 05
+`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := snapdiff(&out, c.args); code != c.code {
+				t.Errorf("exited with %d, want %d", code, c.code)
+			}
+			got := strings.NewReplacer(a, "A", b, "B").Replace(out.String())
+			if got != c.want {
+				t.Errorf("printed\n%s\nwant\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDiffRegisters(t *testing.T) {
+	state := func() *machineState {
+		return &machineState{"", &sim.SnapshotState{Memory: make([]byte, memory.Size)}}
+	}
+	a, b := state(), state()
+	if !diffRegisters(&bytes.Buffer{}, a, b, nil) {
+		t.Error("equal states differ")
+	}
+
+	a.Registers.Put(&registers.FLAGS, registers.FlagZF)
+	b.Registers.Put(&registers.FLAGS, registers.FlagCF|registers.FlagZF)
+	b.Registers.Put(&registers.SP, 0xfffe)
+	b.Halted = true
+	var out bytes.Buffer
+	if diffRegisters(&out, a, b, map[string]bool{"sp": true}) {
+		t.Error("different states are the same")
+	}
+	want := "registers:\n  flags: Z -> CZ\nhalted: false -> true\n"
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", &out, want)
+	}
+}
+
+func TestWriteRange(t *testing.T) {
+	before, after := make([]byte, 0x40), make([]byte, 0x40)
+	after[0x10], after[0x23] = 0xaa, 0xbb
+	var out bytes.Buffer
+	writeRange(&out, diffRange{0x10, 0x23, 2}, before, after, 64)
+	want := `  0x00010-0x00023: 2 of 20 bytes differ
+    - 0x00010: 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00
+    + 0x00010: aa 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00
+    - 0x00020: 00 00 00 00
+    + 0x00020: 00 00 00 bb
+`
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", &out, want)
+	}
+}
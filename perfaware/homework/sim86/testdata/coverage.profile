@@ -0,0 +1,28 @@
+Profile: 12 instructions executed, 77 clocks
+
+Instructions:
+      clocks             count  address    instruction
+          36  46.8%          3  0000:0006  jne $-3                  ; 9: jnz again
+          15  19.5%          1  0000:0008  jmp $+3                  ; 10: jmp done
+          12  15.6%          3  0000:0004  js $+6                   ; 8: js never
+           6   7.8%          3  0000:0003  dec cx                   ; 7: dec cx
+           4   5.2%          1  0000:0000  mov cx, 3                ; 5: mov cx, 3
+           4   5.2%          1  0000:000b  xchg ax, ax              ; 14: nop
+
+Basic blocks:
+      clocks             count  first      last       instructions
+          36  46.8%          3  0000:0006  0000:0006  1 again+0x3
+                                            jne $-3
+          18  23.4%          3  0000:0003  0000:0004  2 again
+                                            dec cx
+                                            js $+6
+          15  19.5%          1  0000:0008  0000:0008  1 again+0x5
+                                            jmp $+3
+           4   5.2%          1  0000:0000  0000:0000  1
+                                            mov cx, 3
+           4   5.2%          1  0000:000b  0000:000b  1 done
+                                            xchg ax, ax
+
+Loops:
+      clocks        iterations  header     latch      entries
+          54  70.1%          2  0000:0003  0000:0006  1 again
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sim86/instructions"
+	"sim86/memory"
+	"sim86/registers"
+	"sim86/sim"
+)
+
+// options are the switches that change what a run prints. They mirror the
+// reference simulator's command line so its listings can be reproduced.
+type options struct {
+	Is8088        bool
+	ShowBanner    bool
+	ShowClocks    bool
+	ExplainClocks bool
+	ShowIP        bool
+	ShowMemory    bool
+	StopOnRet     bool
+	// Quiet prints nothing, for programs with output of their own.
+	Quiet bool
+
+	// Loader places the image; nil loads it raw at 0000:0000.
+	Loader sim.Loader
+	// DOS, when set, serves int 20h and int 21h.
+	DOS *sim.DOS
+	// BIOS, when set, serves int 10h, int 13h and int 16h.
+	BIOS *sim.BIOS
+	// DebugPort, when nonzero, is a port whose writes go to the console.
+	DebugPort uint16
+	// Timer adds an 8253 timer and 8259 interrupt controller.
+	Timer bool
+	// Screen, when set, shows the CGA text screen live, redrawn every
+	// ScreenFrames+1 frames.
+	Screen       io.Writer
+	ScreenFrames uint32
+	// ScreenText, when set, gets the final CGA text screen as plain text.
+	ScreenText io.Writer
+	// Journal is the budget in bytes for the debugger's undo history.
+	Journal int
+
+	// Watches are watchpoints whose hits are logged.
+	Watches []sim.Watch
+	// Regions are mapped over memory once the program is loaded, and
+	// MemFault makes accessing their Unmapped ones an error.
+	Regions  []memory.Region
+	MemFault bool
+
+	// Listing, when set, puts labels and source lines beside
+	// instructions. Its Base is set to where the image is loaded.
+	Listing *Listing
+	// Program is the name of the file being run, for reports.
+	Program string
+
+	// Profile, when set, gets a report of where the clocks went at the
+	// end of the run, and PProf the same profile for go tool pprof.
+	Profile io.Writer
+	PProf   io.Writer
+	// Coverage, when set, gets the listing or a disassembly annotated
+	// with what ran, and LCOV the same coverage as an lcov tracefile.
+	Coverage io.Writer
+	LCOV     io.Writer
+	// LCOVSource is where a disassembly for LCOV's lines to refer to is
+	// written when there is no listing.
+	LCOVSource string
+
+	// Restore, when set, is a snapshot file the machine starts from once
+	// it is set up, and Save one written when the run stops.
+	Restore string
+	Save    string
+	// StopAfter, when nonzero, stops a run after that many instructions.
+	StopAfter uint64
+
+	// VGA, when set, adds mode 13h graphics with snapshots saved as PNGs
+	// named after it. Without VGAEvery or VGAOnHalt, one is taken at the
+	// end of the run.
+	VGA       string
+	VGAEvery  uint32
+	VGAOnHalt bool
+}
+
+func (opt options) load(m *sim.Machine, image []byte) error {
+	l := opt.Loader
+	if l == nil {
+		l = sim.RawLoader{}
+	}
+	return l.Load(m, image)
+}
+
+const clocksWarning = `WARNING: Clocks reported by this utility are strictly from the 8086 manual.
+They will be inaccurate, both because the manual clocks are estimates, and because
+some of the entries in the manual look highly suspicious and are probably typos.
+`
+
+// disassemble prints image as a nasm source file.
+func disassemble(w io.Writer, name string, image []byte, opt options) error {
+	m := sim.NewMachine(sim.Options{})
+	if err := opt.load(m, image); err != nil {
+		return err
+	}
+	base, end := m.Loaded()
+	if opt.Listing != nil {
+		opt.Listing.Base = base
+	}
+	fmt.Fprintf(w, "; %s disassembly:\nbits 16\n", name)
+	for m.PC() < end {
+		op, err := m.Fetch()
+		if err != nil {
+			return err
+		}
+		if opt.Listing == nil {
+			fmt.Fprintln(w, op)
+		} else {
+			printLabel(w, opt.Listing, m.PC())
+			fmt.Fprintln(w, withSource(op.String(), " ; ", opt.Listing, m.PC()))
+		}
+		m.SetReg(&registers.IP, m.Reg(&registers.IP)+uint16(op.Size))
+	}
+	return nil
+}
+
+// session is a machine set up with the devices and services opt asks
+// for, ready to run.
+type session struct {
+	m        *sim.Machine
+	opt      options
+	cga      *sim.CGA
+	vga      *sim.VGA
+	profile  *Profile
+	coverage *Coverage
+	// trace, when set, sees each instruction Run executes before the
+	// reports do.
+	trace func(sim.Exec)
+}
+
+func newSession(w io.Writer, image []byte, opt options) (*session, error) {
+	s := &session{opt: opt}
+	mopt := sim.Options{
+		Is8088:      opt.Is8088,
+		TraceMemory: opt.ShowMemory,
+		StepLimit:   opt.StopAfter,
+		Trace: func(ex sim.Exec) {
+			if s.trace != nil {
+				s.trace(ex)
+			}
+			s.executed(ex)
+		},
+	}
+	if opt.StopOnRet {
+		mopt.BreakOn = func(op instructions.Operation) bool {
+			return op.OpType == instructions.OpRet || op.OpType == instructions.OpRetf
+		}
+	}
+	m := sim.NewMachine(mopt)
+	s.m = m
+	if err := opt.load(m, image); err != nil {
+		return nil, err
+	}
+	base, _ := m.Loaded()
+	if opt.Listing != nil {
+		opt.Listing.Base = base
+	}
+	if opt.Profile != nil || opt.PProf != nil {
+		s.profile = NewProfile()
+	}
+	if opt.Coverage != nil || opt.LCOV != nil {
+		s.coverage = NewCoverage(image, base)
+	}
+	for _, wp := range opt.Watches {
+		m.AddWatch(wp)
+	}
+	for _, r := range opt.Regions {
+		if err := m.Memory.Map(r); err != nil {
+			return nil, err
+		}
+	}
+	if opt.MemFault {
+		m.Memory.Policy = memory.Fault
+	}
+	if opt.DOS != nil {
+		opt.DOS.Install(m)
+	}
+	if opt.BIOS != nil {
+		opt.BIOS.Install(m)
+	}
+	if opt.Timer {
+		if err := sim.InstallTimer(m); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Screen != nil || opt.ScreenText != nil {
+		s.cga = &sim.CGA{Mem: m.Memory, Live: opt.Screen, Frames: opt.ScreenFrames}
+		if err := sim.InstallCGA(m, s.cga); err != nil {
+			return nil, err
+		}
+	}
+	if opt.VGA != "" {
+		s.vga = sim.NewVGA(m.Memory)
+		s.vga.Prefix, s.vga.Every, s.vga.OnHalt = opt.VGA, opt.VGAEvery, opt.VGAOnHalt
+		if err := sim.InstallVGA(m, s.vga); err != nil {
+			return nil, err
+		}
+	}
+	if opt.DebugPort != 0 {
+		if err := m.Ports.Register(opt.DebugPort, opt.DebugPort+1, sim.DebugPort{W: w}); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Restore != "" {
+		if err := readSnapshot(m, opt.Restore); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func readSnapshot(m *sim.Machine, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := m.ReadSnapshot(f); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func writeSnapshot(m *sim.Machine, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = m.WriteSnapshot(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// interruptible is a context that is canceled when something arrives on
+// ch, for interrupting a Run from the keyboard or a debugger client.
+func interruptible[T any](ch <-chan T) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// executed lets devices and reports that care see each instruction run.
+func (s *session) executed(ex sim.Exec) {
+	if s.profile != nil {
+		s.profile.Record(ex, s.m.PC())
+	}
+	if s.coverage != nil {
+		s.coverage.Record(ex)
+	}
+	if s.vga != nil && ex.Op.OpType == instructions.OpHlt {
+		s.vga.Halted()
+	}
+}
+
+// finish writes out the screens and returns err, or the first error
+// writing them.
+func (s *session) finish(err error) error {
+	if s.cga != nil {
+		s.cga.Close()
+		if s.opt.ScreenText != nil {
+			io.WriteString(s.opt.ScreenText, s.cga.Text())
+		}
+	}
+	if s.vga != nil {
+		if s.opt.VGAEvery == 0 && !s.opt.VGAOnHalt {
+			s.vga.Snapshot()
+		}
+		if err == nil {
+			err = s.vga.Err()
+		}
+	}
+	if s.profile != nil {
+		if s.opt.Profile != nil {
+			s.profile.WriteReport(s.opt.Profile, s.opt.Listing)
+		}
+		if s.opt.PProf != nil {
+			if perr := s.profile.WritePProf(s.opt.PProf, s.opt.Program, s.opt.Listing); err == nil {
+				err = perr
+			}
+		}
+	}
+	if s.opt.Save != "" {
+		if serr := writeSnapshot(s.m, s.opt.Save); err == nil {
+			err = serr
+		}
+	}
+	if s.coverage != nil {
+		if s.opt.Coverage != nil {
+			s.coverage.WriteAnnotated(s.opt.Coverage, s.opt.Listing, s.opt.Program)
+		}
+		if s.opt.LCOV != nil {
+			if l := s.opt.Listing; l == nil || l.Text == nil {
+				f, ferr := os.Create(s.opt.LCOVSource)
+				if ferr == nil {
+					s.coverage.WriteDisassembly(f, l, s.opt.Program)
+					ferr = f.Close()
+				}
+				if err == nil {
+					err = ferr
+				}
+			}
+			s.coverage.WriteLCOV(s.opt.LCOV, s.opt.Listing, s.opt.Program, s.opt.LCOVSource)
+		}
+	}
+	return err
+}
+
+// simulate executes image and prints a trace in the reference simulator's
+// format, followed by the final registers.
+func simulate(w io.Writer, name string, image []byte, opt options) error {
+	s, err := newSession(w, image, opt)
+	if err != nil {
+		return err
+	}
+	m := s.m
+
+	if !opt.Quiet {
+		header(w, name, opt)
+	}
+
+	s.trace = func(ex sim.Exec) {
+		if !opt.Quiet {
+			traceLine(w, m, ex, opt)
+		}
+		for _, h := range ex.Watched {
+			fmt.Fprintf(w, "WATCH: %s (%s)\n", h, ex.Op)
+		}
+	}
+	res := m.Run(context.Background())
+	if res.Reason == sim.StopBreakpoint && res.Err == nil {
+		fmt.Fprintf(w, "STOPONRET: Return encountered at address %d.\n", m.PC())
+	}
+	if res.Err == sim.ErrBreak {
+		res.Err = nil
+	}
+	err = s.finish(res.Err)
+
+	var unimplemented sim.UnimplementedError
+	if errors.As(err, &unimplemented) {
+		fmt.Fprintf(w, "ERROR: Unimplemented instruction (%s).\n", unimplemented.Op)
+		err = nil
+	}
+	if opt.Quiet {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nFinal registers:")
+	printRegisters(w, m, opt.ShowIP)
+	fmt.Fprintln(w)
+	return err
+}
+
+// printRegisters prints the nonzero registers the way the reference
+// simulator ends its runs.
+func printRegisters(w io.Writer, m *sim.Machine, showIP bool) {
+	for _, r := range registers.Words {
+		v := m.Reg(r)
+		if v == 0 || (r == &registers.IP && !showIP) {
+			continue
+		}
+		if r == &registers.FLAGS {
+			fmt.Fprintf(w, "%8s: %s\n", r.Name, registers.FlagsString(v))
+			continue
+		}
+		fmt.Fprintf(w, "%8s: 0x%04x (%d)\n", r.Name, v, v)
+	}
+}
+
+func header(w io.Writer, name string, opt options) {
+	if opt.ShowBanner {
+		cpu := "8086"
+		if opt.Is8088 {
+			cpu = "8088"
+		}
+		fmt.Fprintf(w, "**************\n**** %s ****\n**************\n", cpu)
+	}
+	if opt.ShowClocks {
+		fmt.Fprintf(w, "\n%s\n", clocksWarning)
+	}
+	fmt.Fprintf(w, "--- %s execution ---\n", name)
+}
+
+// printLabel prints the label at addr on a line of its own, as the source
+// would have it.
+func printLabel(w io.Writer, l *Listing, addr uint32) {
+	if label := l.Label(addr); label != "" {
+		fmt.Fprintf(w, "%s:\n", label)
+	}
+}
+
+// withSource is text followed by sep and the source line for addr, when
+// the listing has one.
+func withSource(text, sep string, l *Listing, addr uint32) string {
+	if l == nil {
+		return text
+	}
+	if src := l.Describe(addr); src != "" {
+		return text + sep + src
+	}
+	return text
+}
+
+func traceLine(w io.Writer, m *sim.Machine, ex sim.Exec, opt options) {
+	if opt.Listing != nil {
+		printLabel(w, opt.Listing, ex.Address)
+	}
+	fmt.Fprintf(w, "%s ; ", ex.Op)
+	if opt.ShowClocks {
+		fmt.Fprintf(w, "Clocks: +%s = %s", ex.Clocks, m.Clocks)
+		if opt.ExplainClocks {
+			fmt.Fprint(w, ex.ExplainClocks())
+		}
+		fmt.Fprint(w, " | ")
+	}
+	for i, r := range registers.Words {
+		before, after := ex.Before[i], m.Reg(r)
+		if before == after || (r == &registers.IP && !opt.ShowIP) {
+			continue
+		}
+		if r == &registers.FLAGS {
+			fmt.Fprintf(w, "flags:%s->%s ", registers.FlagsString(before), registers.FlagsString(after))
+			continue
+		}
+		fmt.Fprintf(w, "%s:0x%x->0x%x ", r.Name, before, after)
+	}
+	if ex.Interrupted {
+		fmt.Fprintf(w, "interrupt:0x%x ", ex.Vector)
+	}
+	if opt.ShowMemory {
+		for _, a := range ex.Accesses {
+			if a.Write {
+				fmt.Fprintf(w, "w[0x%05x]:0x%x->0x%x ", a.Address(), a.Old, a.Value)
+			} else {
+				fmt.Fprintf(w, "r[0x%05x]:0x%x ", a.Address(), a.Value)
+			}
+		}
+	}
+	fmt.Fprintln(w, withSource("", "| ", opt.Listing, ex.Address))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A run is one "--- name execution ---" block of a reference listing,
+// split into the sections verify compares separately.
+type run struct {
+	name string
+	opt  options
+
+	decode    []string
+	trace     []string
+	clocks    []string
+	registers []string
+}
+
+var cpuBanner = regexp.MustCompile(`^\*\*\*\* (808[68]) \*\*\*\*$`)
+
+// parseRuns splits simulator output into runs and works out the options
+// each one must have been produced with.
+func parseRuns(text string) []run {
+	var runs []run
+	var pending options
+	var cur *run
+	inRegisters := false
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		switch {
+		case cpuBanner.MatchString(line):
+			pending.ShowBanner = true
+			pending.Is8088 = cpuBanner.FindStringSubmatch(line)[1] == "8088"
+		case strings.HasPrefix(line, "WARNING: Clocks"):
+			pending.ShowClocks = true
+		case strings.HasPrefix(line, "--- ") && strings.HasSuffix(line, " execution ---"):
+			runs = append(runs, run{
+				name: strings.TrimSuffix(strings.TrimPrefix(line, "--- "), " execution ---"),
+				opt:  pending,
+			})
+			cur = &runs[len(runs)-1]
+			cur.opt.StopOnRet = true
+			pending = options{}
+			inRegisters = false
+		case cur == nil:
+		case line == "Final registers:":
+			inRegisters = true
+		case inRegisters:
+			if line == "" {
+				inRegisters = false
+				cur = nil
+				continue
+			}
+			cur.registers = append(cur.registers, line)
+			if strings.HasPrefix(strings.TrimSpace(line), "ip:") {
+				cur.opt.ShowIP = true
+			}
+		case strings.HasPrefix(line, "STOPONRET:"), strings.HasPrefix(line, "ERROR:"):
+			cur.trace = append(cur.trace, line)
+		case strings.Contains(line, " ; "):
+			asm, effects, _ := strings.Cut(line, " ; ")
+			cur.decode = append(cur.decode, asm)
+			if strings.HasPrefix(effects, "Clocks: ") {
+				var clocks string
+				clocks, effects, _ = strings.Cut(effects, " | ")
+				cur.clocks = append(cur.clocks, clocks)
+				if strings.Contains(clocks, "(") {
+					cur.opt.ExplainClocks = true
+				}
+			}
+			cur.trace = append(cur.trace, strings.TrimRight(effects, " "))
+			if strings.Contains(effects, "ip:") {
+				cur.opt.ShowIP = true
+			}
+		}
+	}
+	return runs
+}
+
+func (r run) sections() []struct {
+	name  string
+	lines []string
+} {
+	return []struct {
+		name  string
+		lines []string
+	}{
+		{"decode", r.decode},
+		{"trace", r.trace},
+		{"clocks", r.clocks},
+		{"registers", r.registers},
+	}
+}
+
+func (r run) label() string {
+	if r.opt.ShowBanner {
+		if r.opt.Is8088 {
+			return "8088"
+		}
+		return "8086"
+	}
+	return "run"
+}
+
+// verify runs every part1 listing that has a reference .txt and compares
+// the output with it. Local golden copies, when present, take precedence
+// over the reference so known differences can be pinned with -update.
+func verify(w io.Writer, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", filepath.Join("..", "..", "part1"), "directory holding the listings")
+	golden := fs.String("golden", "testdata", "directory holding local golden copies")
+	update := fs.Bool("update", false, "rewrite the local golden copies from the current output")
+	pattern := fs.String("run", "", "only verify listings matching this regexp")
+	fs.Parse(args)
+
+	match, err := regexp.Compile(*pattern)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	refs, err := filepath.Glob(filepath.Join(*dir, "listing_*.txt"))
+	if err != nil || len(refs) == 0 {
+		fmt.Fprintf(os.Stderr, "no listings found in %s\n", *dir)
+		return 2
+	}
+
+	failed := 0
+	for _, ref := range refs {
+		name := strings.TrimSuffix(filepath.Base(ref), ".txt")
+		if !match.MatchString(name) {
+			continue
+		}
+		image, err := os.ReadFile(filepath.Join(*dir, name))
+		if err != nil {
+			// Listings like 0058 are C++ sources with no binary.
+			continue
+		}
+
+		goldenPath := filepath.Join(*golden, name+".txt")
+		wantPath := goldenPath
+		want, err := os.ReadFile(goldenPath)
+		if err != nil {
+			wantPath = ref
+			want, err = os.ReadFile(ref)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		var out bytes.Buffer
+		for i, r := range parseRuns(string(want)) {
+			if i > 0 {
+				out.WriteString("\n\n")
+			}
+			if err := simulate(&out, r.name, image, r.opt); err != nil {
+				fmt.Fprintf(&out, "ERROR: %v\n", err)
+			}
+		}
+
+		if *update {
+			if err := os.MkdirAll(*golden, 0755); err == nil {
+				err = os.WriteFile(goldenPath, out.Bytes(), 0644)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			fmt.Fprintf(w, "updated %s\n", goldenPath)
+			continue
+		}
+
+		if report := compareRuns(wantPath, parseRuns(string(want)), parseRuns(out.String())); report != "" {
+			fmt.Fprintf(w, "FAIL %s\n%s", name, report)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s\n", name)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "%d listing(s) failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+func compareRuns(wantPath string, want, got []run) string {
+	var sb strings.Builder
+	if len(want) != len(got) {
+		fmt.Fprintf(&sb, "%s has %d runs, simulator produced %d\n", wantPath, len(want), len(got))
+	}
+	for i := 0; i < len(want) && i < len(got); i++ {
+		for j, ws := range want[i].sections() {
+			gs := got[i].sections()[j]
+			label := fmt.Sprintf("%s %s", want[i].label(), ws.name)
+			diff := unifiedDiff(wantPath+" ("+label+")", "sim86 ("+label+")", ws.lines, gs.lines)
+			sb.WriteString(diff)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestVerify runs sim86 verify on each part 1 listing, so the trace,
+// clock and register output keeps matching the reference listings or
+// their golden copies.
+func TestVerify(t *testing.T) {
+	refs, err := filepath.Glob(filepath.Join("..", "..", "part1", "listing_*.txt"))
+	if err != nil || len(refs) == 0 {
+		t.Skip("no part 1 listings")
+	}
+	for _, ref := range refs {
+		name := strings.TrimSuffix(filepath.Base(ref), ".txt")
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := verify(&out, []string{"-run", "^" + regexp.QuoteMeta(name) + "$"}); code != 0 {
+				t.Errorf("verify exited with %d:\n%s", code, &out)
+			}
+		})
+	}
+}